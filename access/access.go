@@ -1,23 +1,117 @@
 package access
 
+import (
+	"errors"
+	"fmt"
+)
+
 type PermFlags = int
 
 const (
 	ListRoomsPerm = 1 << iota
 	CreateRoomPerm
-	AllGlobalPerms = ListRoomsPerm | CreateRoomPerm
+	AdminPerm // назначение глобальных ролей
+	AllGlobalPerms = ListRoomsPerm | CreateRoomPerm | AdminPerm
 )
 
 const (
 	ReadPerm = 1 << iota
 	WritePerm
-	AllRoomPerms = ReadPerm | WritePerm
+	ModeratePerm // изменение чужих сообщений и просмотр их истории правок
+	HistoryPerm // просмотр истории правок своих сообщений
+	KickPerm
+	BanPerm
+	MutePerm
+	InvitePerm
+	RenamePerm // изменение названия и видимости комнаты
+	TopicPerm
+	RolesPerm // назначение ролей в комнате
+	DeletePerm // архивирование и удаление комнаты
+	AllRoomPerms = ReadPerm | WritePerm | ModeratePerm | HistoryPerm | KickPerm | BanPerm | MutePerm |
+		InvitePerm | RenamePerm | TopicPerm | RolesPerm | DeletePerm
+)
+
+// разрешения, которые снимаются в архивной комнате
+const ArchivedDenied = WritePerm | ModeratePerm
+
+// роли, которые назначаются запросами модерации
+const (
+	MutedRole = "muted"
+	BannedRole = "banned"
 )
 
+// Admit не допускает забаненного пользователя
+var Banned = errors.New("user is banned from the room")
+
+// имена разрешений в файле настроек
+var GlobalPermNames = map[string]PermFlags {
+	"list-rooms": ListRoomsPerm,
+	"create-room": CreateRoomPerm,
+	"admin": AdminPerm,
+}
+
+var RoomPermNames = map[string]PermFlags {
+	"read": ReadPerm,
+	"write": WritePerm,
+	"moderate": ModeratePerm,
+	"history": HistoryPerm,
+	"kick": KickPerm,
+	"ban": BanPerm,
+	"mute": MutePerm,
+	"invite": InvitePerm,
+	"rename": RenamePerm,
+	"topic": TopicPerm,
+	"roles": RolesPerm,
+	"delete": DeletePerm,
+}
+
 type Controller interface {
 	GlobalPerms (userId int) PermFlags
 	RoomPerms (userId, roomId int) PermFlags
 	HasGlobalPerm (userId, perm int) bool
 	HasRoomPerm (userId, roomId, perm int) bool
 	NewRoom (userId, roomId int)
+	Admit (userId, roomId int) error // допуск в комнату по приглашению; забаненному - Banned
+	DeleteRoom (roomId int) // забывает допуски и роли удаленной комнаты
+}
+
+// управление ролями; реализуется не всеми контроллерами
+type RoleManager interface {
+	RoomRole (userId, roomId int) string
+	GlobalRole (userId int) string
+	RoomRoles (roomId int) map[int]string // только явно назначенные роли, {userId: role}
+	// true, если actorId стоит в комнате выше userId
+	Outranks (actorId, userId, roomId int) bool
+	// actorId - пользователь, выполняющий назначение; пустая роль снимает назначенную,
+	// в комнате по приглашениям пользователь при этом остается допущенным
+	SetRoomRole (actorId, userId, roomId int, role string) error
+	SetGlobalRole (actorId, userId int, role string) error
+}
+
+// ограничение разрешений подключения (например, API-токеном): действуют только разрешения,
+// которые есть и у пользователя, и в области
+type Scope struct {
+	Global PermFlags `json:"global"`
+	Room PermFlags `json:"room"`
+}
+
+var FullScope = Scope {AllGlobalPerms, AllRoomPerms}
+
+// имена из GlobalPermNames и RoomPermNames вперемешку; "*" - все разрешения
+func ParseScope (names []string) (Scope, error) {
+	result := Scope {}
+	for _, name := range names {
+		if name == "*" {
+			return FullScope, nil
+		}
+
+		if perm, found := GlobalPermNames[name]; found {
+			result.Global |= perm
+		} else if perm, found = RoomPermNames[name]; found {
+			result.Room |= perm
+		} else {
+			return Scope {}, fmt.Errorf("unknown permission %q", name)
+		}
+	}
+	return result, nil
 }
@@ -0,0 +1,77 @@
+package ram
+
+import (
+	"sync"
+
+	"github.com/ava12/go-chat/access/role"
+)
+
+type memStorageRec struct {
+	lock sync.Mutex
+	roomRoles map[int]map[int]string
+	globalRoles map[int]string
+}
+
+func NewStorage () role.Storage {
+	return &memStorageRec {roomRoles: make(map[int]map[int]string), globalRoles: make(map[int]string)}
+}
+
+func copyRoles (roles map[int]string) map[int]string {
+	result := make(map[int]string, len(roles))
+	for uid, r := range roles {
+		result[uid] = r
+	}
+	return result
+}
+
+func (msr *memStorageRec) RoomRoles (roomId int) (map[int]string, error) {
+	msr.lock.Lock()
+	defer msr.lock.Unlock()
+
+	return copyRoles(msr.roomRoles[roomId]), nil
+}
+
+func (msr *memStorageRec) SetRoomRole (roomId, userId int, r string) error {
+	msr.lock.Lock()
+	defer msr.lock.Unlock()
+
+	roles := msr.roomRoles[roomId]
+	if roles == nil {
+		roles = make(map[int]string)
+		msr.roomRoles[roomId] = roles
+	}
+
+	if r == "" {
+		delete(roles, userId)
+	} else {
+		roles[userId] = r
+	}
+	return nil
+}
+
+func (msr *memStorageRec) GlobalRoles () (map[int]string, error) {
+	msr.lock.Lock()
+	defer msr.lock.Unlock()
+
+	return copyRoles(msr.globalRoles), nil
+}
+
+func (msr *memStorageRec) SetGlobalRole (userId int, r string) error {
+	msr.lock.Lock()
+	defer msr.lock.Unlock()
+
+	if r == "" {
+		delete(msr.globalRoles, userId)
+	} else {
+		msr.globalRoles[userId] = r
+	}
+	return nil
+}
+
+func (msr *memStorageRec) DeleteRoomRoles (roomId int) error {
+	msr.lock.Lock()
+	defer msr.lock.Unlock()
+
+	delete(msr.roomRoles, roomId)
+	return nil
+}
@@ -0,0 +1,394 @@
+package role
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/ava12/go-chat/access"
+	"github.com/ava12/go-chat/config"
+	"github.com/ava12/go-chat/room"
+)
+
+// Контроллер доступа на ролях.
+// Роль в комнате: owner (создатель комнаты), moderator, member, muted, banned; без назначенной роли действует member,
+// а в комнату по приглашению пользователь без роли не допускается (приглашение назначает member).
+// Глобальная роль: admin или user; администратору разрешено все.
+// Разрешения ролей задаются в секции Access файла настроек, назначенные роли хранятся в Storage.
+// Назначать роли в комнате могут владельцы и модераторы, и только пользователям ниже себя;
+// владелец может назначить другого владельца.
+
+const (
+	configSection = "Access"
+
+	Owner = "owner"
+	Moderator = "moderator"
+	Member = "member"
+	Muted = access.MutedRole
+	Banned = access.BannedRole
+
+	Admin = "admin"
+	User = "user"
+)
+
+type Conf struct {
+	RoomRoles map[string][]string // {role: [perm]}, имена из access.RoomPermNames
+	GlobalRoles map[string][]string // имена из access.GlobalPermNames
+	Admins []int // администраторы независимо от хранилища
+}
+
+// хранилище назначенных ролей; пустая роль удаляет назначение
+type Storage interface {
+	RoomRoles (roomId int) (map[int]string, error)
+	SetRoomRole (roomId, userId int, role string) error
+	DeleteRoomRoles (roomId int) error
+	GlobalRoles () (map[int]string, error)
+	SetGlobalRole (userId int, role string) error
+}
+
+var (
+	UnknownRole = errors.New("unknown role")
+	Denied = errors.New("permission denied")
+)
+
+var roomRanks = map[string]int {
+	Banned: 0,
+	Muted: 1,
+	Member: 2,
+	Moderator: 3,
+	Owner: 4,
+}
+
+const adminRank = 5
+
+func DefaultConf () Conf {
+	return Conf {
+		RoomRoles: map[string][]string {
+			Owner: {"read", "write", "moderate", "history", "kick", "ban", "mute", "invite", "rename", "topic", "roles", "delete"},
+			Moderator: {"read", "write", "moderate", "history", "kick", "ban", "mute", "invite", "topic"},
+			Member: {"read", "write", "history"},
+			Muted: {"read", "history"},
+			Banned: {},
+		},
+		GlobalRoles: map[string][]string {
+			Admin: {"list-rooms", "create-room", "admin"},
+			User: {"list-rooms", "create-room"},
+		},
+	}
+}
+
+type Controller struct {
+	lock sync.RWMutex
+	storage Storage
+	rooms room.Registry // nil - личные комнаты не проверяются
+	roomPerms map[string]access.PermFlags
+	globalPerms map[string]access.PermFlags
+	admins map[int]bool
+	globalRoles map[int]string
+	roomRoles map[int]map[int]string // загружаются из хранилища при первом обращении
+}
+
+func New (c *config.Config, storage Storage, rooms room.Registry) (*Controller, error) {
+	sect := DefaultConf()
+	e := c.Section(configSection, &sect)
+	if e != nil {
+		return nil, e
+	}
+
+	return NewController(sect, storage, rooms)
+}
+
+func NewController (c Conf, storage Storage, rooms room.Registry) (*Controller, error) {
+	result := &Controller {
+		storage: storage,
+		rooms: rooms,
+		roomPerms: make(map[string]access.PermFlags),
+		globalPerms: make(map[string]access.PermFlags),
+		admins: make(map[int]bool),
+		roomRoles: make(map[int]map[int]string),
+	}
+
+	for role := range roomRanks {
+		perm, e := parsePerms(c.RoomRoles[role], access.RoomPermNames)
+		if e != nil {
+			return nil, fmt.Errorf("role %q: %s", role, e.Error())
+		}
+		result.roomPerms[role] = perm
+	}
+
+	for _, role := range []string {Admin, User} {
+		perm, e := parsePerms(c.GlobalRoles[role], access.GlobalPermNames)
+		if e != nil {
+			return nil, fmt.Errorf("role %q: %s", role, e.Error())
+		}
+		result.globalPerms[role] = perm
+	}
+	result.globalPerms[Admin] |= access.AllGlobalPerms
+
+	for _, uid := range c.Admins {
+		result.admins[uid] = true
+	}
+
+	var e error
+	result.globalRoles, e = storage.GlobalRoles()
+	if e != nil {
+		return nil, e
+	}
+
+	return result, nil
+}
+
+func parsePerms (names []string, known map[string]access.PermFlags) (access.PermFlags, error) {
+	var result access.PermFlags
+	for _, name := range names {
+		perm, found := known[name]
+		if !found {
+			return 0, fmt.Errorf("unknown permission %q", name)
+		}
+		result |= perm
+	}
+	return result, nil
+}
+
+func (c *Controller) GlobalRole (userId int) string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.globalRole(userId)
+}
+
+// вызывающий должен удерживать lock
+func (c *Controller) globalRole (userId int) string {
+	if c.admins[userId] {
+		return Admin
+	}
+
+	role := c.globalRoles[userId]
+	if role == "" {
+		role = User
+	}
+	return role
+}
+
+// назначенные роли комнаты; вызывающий должен удерживать lock на запись
+func (c *Controller) loadRoom (roomId int) map[int]string {
+	roles := c.roomRoles[roomId]
+	if roles != nil {
+		return roles
+	}
+
+	roles, e := c.storage.RoomRoles(roomId)
+	if e != nil {
+		log.Println(e)
+		return make(map[int]string)
+	}
+
+	c.roomRoles[roomId] = roles
+	return roles
+}
+
+// назначенная роль, "" - не назначена
+func (c *Controller) assignedRole (userId, roomId int) string {
+	c.lock.RLock()
+	roles, found := c.roomRoles[roomId]
+	role := roles[userId]
+	c.lock.RUnlock()
+
+	if !found {
+		c.lock.Lock()
+		role = c.loadRoom(roomId)[userId]
+		c.lock.Unlock()
+	}
+
+	return role
+}
+
+func (c *Controller) roomRole (userId, roomId int) string {
+	role := c.assignedRole(userId, roomId)
+	if role == "" {
+		role = Member
+	}
+	return role
+}
+
+func (c *Controller) RoomRole (userId, roomId int) string {
+	return c.roomRole(userId, roomId)
+}
+
+func (c *Controller) RoomRoles (roomId int) map[int]string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	result := make(map[int]string)
+	for uid, role := range c.loadRoom(roomId) {
+		result[uid] = role
+	}
+	return result
+}
+
+func (c *Controller) GlobalPerms (userId int) access.PermFlags {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.globalPerms[c.globalRole(userId)]
+}
+
+func (c *Controller) RoomPerms (userId, roomId int) access.PermFlags {
+	entry, found := room.Entry {}, false
+	if c.rooms != nil {
+		entry, found = c.rooms.Room(roomId)
+	}
+
+	mask := access.AllRoomPerms
+	if found && entry.Archived {
+		mask &^= access.ArchivedDenied
+	}
+
+	if c.GlobalRole(userId) == Admin {
+		return mask
+	}
+
+	role := c.assignedRole(userId, roomId)
+	if found && entry.IsDirect() && !entry.HasUser(userId) {
+		return 0
+	}
+	if found && !entry.IsDirect() && entry.Visibility == room.InviteOnly && role == "" {
+		return 0
+	}
+
+	if role == "" {
+		role = Member
+	}
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.roomPerms[role] & mask
+}
+
+func (c *Controller) HasGlobalPerm (userId int, perm access.PermFlags) bool {
+	return (perm & c.GlobalPerms(userId) != 0)
+}
+
+func (c *Controller) HasRoomPerm (userId, roomId int, perm access.PermFlags) bool {
+	return (perm & c.RoomPerms(userId, roomId) != 0)
+}
+
+func (c *Controller) NewRoom (userId, roomId int) {
+	e := c.setRoomRole(userId, roomId, Owner)
+	if e != nil {
+		log.Println(e)
+	}
+}
+
+func (c *Controller) DeleteRoom (roomId int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	e := c.storage.DeleteRoomRoles(roomId)
+	if e != nil {
+		log.Println(e)
+	}
+	delete(c.roomRoles, roomId)
+}
+
+// пользователь с назначенной ролью уже допущен, кроме забаненного
+func (c *Controller) Admit (userId, roomId int) error {
+	switch c.assignedRole(userId, roomId) {
+	case "":
+		return c.setRoomRole(userId, roomId, Member)
+	case Banned:
+		return access.Banned
+	default:
+		return nil
+	}
+}
+
+func (c *Controller) setRoomRole (userId, roomId int, role string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	e := c.storage.SetRoomRole(roomId, userId, role)
+	if e != nil {
+		return e
+	}
+
+	roles := c.loadRoom(roomId)
+	if role == "" {
+		delete(roles, userId)
+	} else {
+		roles[userId] = role
+	}
+	return nil
+}
+
+func (c *Controller) rank (userId, roomId int) int {
+	if c.GlobalRole(userId) == Admin {
+		return adminRank
+	}
+	return roomRanks[c.roomRole(userId, roomId)]
+}
+
+func (c *Controller) Outranks (actorId, userId, roomId int) bool {
+	return (c.rank(actorId, roomId) > c.rank(userId, roomId))
+}
+
+func (c *Controller) SetRoomRole (actorId, userId, roomId int, role string) error {
+	newRank := roomRanks[Member]
+	if role != "" {
+		var found bool
+		newRank, found = roomRanks[role]
+		if !found {
+			return UnknownRole
+		}
+	}
+
+	actorRank := c.rank(actorId, roomId)
+	if actorRank < roomRanks[Moderator] || c.rank(userId, roomId) >= actorRank ||
+		(newRank >= actorRank && actorRank != roomRanks[Owner] && actorRank != adminRank) {
+		return Denied
+	}
+
+	// иначе снятие бана или другой роли закрыло бы доступ к комнате
+	if role == "" && c.isInviteOnly(roomId) {
+		role = Member
+	}
+	return c.setRoomRole(userId, roomId, role)
+}
+
+func (c *Controller) isInviteOnly (roomId int) bool {
+	if c.rooms == nil {
+		return false
+	}
+
+	entry, found := c.rooms.Room(roomId)
+	return (found && !entry.IsDirect() && entry.Visibility == room.InviteOnly)
+}
+
+func (c *Controller) SetGlobalRole (actorId, userId int, role string) error {
+	if role != "" && role != Admin && role != User {
+		return UnknownRole
+	}
+	if role == User {
+		role = ""
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.globalRole(actorId) != Admin || c.admins[userId] {
+		return Denied
+	}
+
+	e := c.storage.SetGlobalRole(userId, role)
+	if e != nil {
+		return e
+	}
+
+	if role == "" {
+		delete(c.globalRoles, userId)
+	} else {
+		c.globalRoles[userId] = role
+	}
+	return nil
+}
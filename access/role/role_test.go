@@ -0,0 +1,144 @@
+package role_test
+
+import (
+	"testing"
+
+	"github.com/ava12/go-chat/access"
+	"github.com/ava12/go-chat/access/role"
+	"github.com/ava12/go-chat/access/role/ram"
+	"github.com/ava12/go-chat/room"
+	roomram "github.com/ava12/go-chat/room/ram"
+)
+
+const (
+	admin = iota + 1
+	owner
+	moderator
+	member
+	other
+)
+
+func TestRoomRoles (t *testing.T) {
+	rooms := roomram.NewRegistry()
+	rid, _ := rooms.CreateRoom("room", owner)
+	conf := role.DefaultConf()
+	conf.Admins = []int {admin}
+	c, e := role.NewController(conf, ram.NewStorage(), rooms)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	c.NewRoom(owner, rid)
+	for _, step := range []struct {
+		actor, user int
+		role string
+		e error
+	} {
+		{member, other, role.Muted, role.Denied},
+		{owner, moderator, role.Moderator, nil},
+		{moderator, other, role.Moderator, role.Denied},
+		{moderator, other, role.Muted, nil},
+		{moderator, owner, role.Banned, role.Denied},
+		{moderator, moderator, "", role.Denied},
+		{owner, member, "king", role.UnknownRole},
+		{owner, member, role.Owner, nil},
+		{member, owner, role.Member, role.Denied},
+		{admin, member, "", nil},
+	} {
+		e := c.SetRoomRole(step.actor, step.user, rid, step.role)
+		if e != step.e {
+			t.Fatalf("%d sets %q for %d: got %v, expecting %v", step.actor, step.role, step.user, e, step.e)
+		}
+	}
+
+	if !c.HasRoomPerm(moderator, rid, access.ModeratePerm) {
+		t.Fatal("moderator cannot moderate")
+	}
+	if c.HasRoomPerm(other, rid, access.WritePerm) || !c.HasRoomPerm(other, rid, access.ReadPerm) {
+		t.Fatalf("unexpected muted user perms: %d", c.RoomPerms(other, rid))
+	}
+	if r := c.RoomRole(member, rid); r != role.Member {
+		t.Fatalf("revoked role is %q", r)
+	}
+	if !c.Outranks(moderator, member, rid) || c.Outranks(moderator, owner, rid) || c.Outranks(member, member, rid) {
+		t.Fatal("unexpected ranks")
+	}
+	if c.HasRoomPerm(moderator, rid, access.RolesPerm) || !c.HasRoomPerm(owner, rid, access.RolesPerm) {
+		t.Fatal("unexpected role management perms")
+	}
+
+	dm, _, _ := rooms.DirectRoom([]int {member, other})
+	if c.RoomPerms(owner, dm.Id) != 0 || !c.HasRoomPerm(other, dm.Id, access.WritePerm) {
+		t.Fatal("unexpected direct room perms")
+	}
+	rooms.SetArchived(rid, true)
+	if c.HasRoomPerm(owner, rid, access.WritePerm) || c.HasRoomPerm(admin, rid, access.ModeratePerm) || !c.HasRoomPerm(member, rid, access.ReadPerm) {
+		t.Fatal("unexpected archived room perms")
+	}
+
+	c.DeleteRoom(rid)
+	if r := c.RoomRole(owner, rid); r != role.Member {
+		t.Fatalf("role kept after room deletion: %q", r)
+	}
+}
+
+func TestInviteOnlyRoom (t *testing.T) {
+	rooms := roomram.NewRegistry()
+	rid, _ := rooms.CreateRoom("room", owner)
+	rooms.SetVisibility(rid, room.InviteOnly)
+	c, e := role.NewController(role.DefaultConf(), ram.NewStorage(), rooms)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	c.NewRoom(owner, rid)
+	if c.HasRoomPerm(member, rid, access.ReadPerm) {
+		t.Fatal("uninvited user can read")
+	}
+	if e = c.Admit(member, rid); e != nil || !c.HasRoomPerm(member, rid, access.ReadPerm) {
+		t.Fatalf("admitted user cannot read: %v", e)
+	}
+
+	if e = c.SetRoomRole(owner, member, rid, role.Banned); e != nil {
+		t.Fatal(e)
+	}
+	if e = c.Admit(member, rid); e != access.Banned || c.HasRoomPerm(member, rid, access.ReadPerm) {
+		t.Fatalf("banned user admitted: %v", e)
+	}
+
+	// снятый бан возвращает доступ
+	if e = c.SetRoomRole(owner, member, rid, ""); e != nil {
+		t.Fatal(e)
+	}
+	if r := c.RoomRole(member, rid); r != role.Member || !c.HasRoomPerm(member, rid, access.ReadPerm) {
+		t.Fatalf("unbanned user has role %q and perms %d", r, c.RoomPerms(member, rid))
+	}
+}
+
+func TestGlobalRoles (t *testing.T) {
+	conf := role.DefaultConf()
+	conf.Admins = []int {admin}
+	conf.GlobalRoles[role.User] = []string {"list-rooms"}
+	c, e := role.NewController(conf, ram.NewStorage(), nil)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	if c.HasGlobalPerm(member, access.CreateRoomPerm) {
+		t.Fatal("user can create rooms")
+	}
+	if c.SetGlobalRole(member, other, role.Admin) != role.Denied || c.SetGlobalRole(admin, admin, "") != role.Denied {
+		t.Fatal("global role change not denied")
+	}
+	if e = c.SetGlobalRole(admin, member, role.Admin); e != nil {
+		t.Fatal(e)
+	}
+	if !c.HasGlobalPerm(member, access.CreateRoomPerm) || c.RoomPerms(member, 100) != access.AllRoomPerms {
+		t.Fatal("new admin has no perms")
+	}
+
+	conf.RoomRoles[role.Muted] = []string {"shout"}
+	if _, e = role.NewController(conf, ram.NewStorage(), nil); e == nil {
+		t.Fatal("unknown permission accepted")
+	}
+}
@@ -0,0 +1,94 @@
+package sqldb
+
+import (
+	"database/sql"
+	"sync"
+
+	"github.com/ava12/go-chat/access/role"
+	"github.com/ava12/go-chat/db"
+)
+
+const component = "roles"
+
+var migrations = []string {
+	`CREATE TABLE room_roles (
+		room_id INTEGER NOT NULL,
+		user_id INTEGER NOT NULL,
+		role VARCHAR(32) NOT NULL,
+		PRIMARY KEY (room_id, user_id)
+	);
+	CREATE TABLE global_roles (
+		user_id INTEGER NOT NULL PRIMARY KEY,
+		role VARCHAR(32) NOT NULL
+	)`,
+}
+
+type storageRec struct {
+	lock sync.Mutex
+	db *db.DB
+}
+
+func NewStorage (d *db.DB) (role.Storage, error) {
+	e := d.Migrate(component, migrations)
+	if e != nil {
+		return nil, e
+	}
+
+	return &storageRec {db: d}, nil
+}
+
+func scanRoles (rows *sql.Rows, e error) (map[int]string, error) {
+	result := make(map[int]string)
+	if e != nil {
+		return result, e
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var uid int
+		var r string
+		e = rows.Scan(&uid, &r)
+		if e != nil {
+			return result, e
+		}
+
+		result[uid] = r
+	}
+
+	return result, rows.Err()
+}
+
+func (s *storageRec) RoomRoles (roomId int) (map[int]string, error) {
+	return scanRoles(s.db.Query("SELECT user_id, role FROM room_roles WHERE room_id = ?", roomId))
+}
+
+func (s *storageRec) SetRoomRole (roomId, userId int, r string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	_, e := s.db.Exec("DELETE FROM room_roles WHERE room_id = ? AND user_id = ?", roomId, userId)
+	if e == nil && r != "" {
+		_, e = s.db.Exec("INSERT INTO room_roles (room_id, user_id, role) VALUES (?, ?, ?)", roomId, userId, r)
+	}
+	return e
+}
+
+func (s *storageRec) GlobalRoles () (map[int]string, error) {
+	return scanRoles(s.db.Query("SELECT user_id, role FROM global_roles"))
+}
+
+func (s *storageRec) SetGlobalRole (userId int, r string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	_, e := s.db.Exec("DELETE FROM global_roles WHERE user_id = ?", userId)
+	if e == nil && r != "" {
+		_, e = s.db.Exec("INSERT INTO global_roles (user_id, role) VALUES (?, ?)", userId, r)
+	}
+	return e
+}
+
+func (s *storageRec) DeleteRoomRoles (roomId int) error {
+	_, e := s.db.Exec("DELETE FROM room_roles WHERE room_id = ?", roomId)
+	return e
+}
@@ -0,0 +1,32 @@
+package sqldb_test
+
+import (
+	"testing"
+
+	"github.com/ava12/go-chat/db/dbtest"
+	rolesql "github.com/ava12/go-chat/access/role/sqldb"
+)
+
+func TestRoleStorage (t *testing.T) {
+	s, e := rolesql.NewStorage(dbtest.Open(t))
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	s.SetRoomRole(1, 2, "owner")
+	s.SetRoomRole(1, 3, "muted")
+	s.SetRoomRole(1, 3, "banned")
+	s.SetRoomRole(1, 4, "moderator")
+	s.SetRoomRole(1, 4, "")
+	s.SetRoomRole(5, 2, "member")
+	roles, e := s.RoomRoles(1)
+	if e != nil || len(roles) != 2 || roles[2] != "owner" || roles[3] != "banned" {
+		t.Fatalf("unexpected room roles: %v %v", roles, e)
+	}
+
+	s.SetGlobalRole(7, "admin")
+	roles, e = s.GlobalRoles()
+	if e != nil || len(roles) != 1 || roles[7] != "admin" {
+		t.Fatalf("unexpected global roles: %v %v", roles, e)
+	}
+}
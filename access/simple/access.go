@@ -1,21 +1,77 @@
 package simple
 
 import (
+	"sync"
+
 	"github.com/ava12/go-chat/access"
+	"github.com/ava12/go-chat/room"
 )
 
-type accessRec struct {}
+// Все разрешено всем, кроме личных комнат и комнат по приглашению:
+// в личные допускаются только участники, в комнаты по приглашению - создатель и приглашенные.
+// Модерация, переименование и удаление комнаты доступны только ее создателю.
+// В архивных комнатах писать нельзя.
+// Допуск хранится только в памяти.
+
+const (
+	directRoomPerms = access.ReadPerm | access.WritePerm | access.HistoryPerm
+	creatorPerms = access.ModeratePerm | access.KickPerm | access.BanPerm | access.MutePerm |
+		access.RenamePerm | access.RolesPerm | access.DeletePerm
+	memberPerms = access.AllRoomPerms &^ creatorPerms
+)
+
+type admitKey struct {
+	userId, roomId int
+}
+
+type accessRec struct {
+	rooms room.Registry // nil - личные комнаты и приглашения не проверяются
+	lock sync.RWMutex
+	admitted map[admitKey]bool
+}
 
-func NewAccessController () access.Controller {
-	return &accessRec {}
+func NewAccessController (rooms room.Registry) access.Controller {
+	return &accessRec {rooms: rooms, admitted: make(map[admitKey]bool)}
 }
 
 func (ar *accessRec) GlobalPerms (userId int) access.PermFlags {
 	return access.AllGlobalPerms
 }
 
+// без реестра комнат создатель неизвестен, и модерировать не может никто
 func (ar *accessRec) RoomPerms (userId, roomId int) access.PermFlags {
-	return access.AllRoomPerms
+	if ar.rooms == nil {
+		return memberPerms
+	}
+
+	entry, found := ar.rooms.Room(roomId)
+	perms := memberPerms
+	if found && entry.CreatorId == userId {
+		perms = access.AllRoomPerms
+	}
+
+	switch {
+	case !found:
+		return memberPerms
+	case entry.IsDirect():
+		if entry.HasUser(userId) {
+			return directRoomPerms
+		}
+		return 0
+	case entry.Visibility == room.InviteOnly && !ar.isAdmitted(userId, roomId):
+		return 0
+	case entry.Archived:
+		return perms &^ access.ArchivedDenied
+	default:
+		return perms
+	}
+}
+
+func (ar *accessRec) isAdmitted (userId, roomId int) bool {
+	ar.lock.RLock()
+	defer ar.lock.RUnlock()
+
+	return ar.admitted[admitKey {userId, roomId}]
 }
 
 func (ar *accessRec) HasGlobalPerm (userId int, perm access.PermFlags) bool {
@@ -23,7 +79,28 @@ func (ar *accessRec) HasGlobalPerm (userId int, perm access.PermFlags) bool {
 }
 
 func (ar *accessRec) HasRoomPerm (userId, roomId int, perm access.PermFlags) bool {
-	return (perm & access.AllRoomPerms != 0)
+	return (perm & ar.RoomPerms(userId, roomId) != 0)
 }
 
-func (ar *accessRec) NewRoom (userId, roomId int) {}
+func (ar *accessRec) NewRoom (userId, roomId int) {
+	ar.Admit(userId, roomId)
+}
+
+func (ar *accessRec) DeleteRoom (roomId int) {
+	ar.lock.Lock()
+	defer ar.lock.Unlock()
+
+	for key := range ar.admitted {
+		if key.roomId == roomId {
+			delete(ar.admitted, key)
+		}
+	}
+}
+
+func (ar *accessRec) Admit (userId, roomId int) error {
+	ar.lock.Lock()
+	defer ar.lock.Unlock()
+
+	ar.admitted[admitKey {userId, roomId}] = true
+	return nil
+}
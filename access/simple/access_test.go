@@ -0,0 +1,50 @@
+package simple_test
+
+import (
+	"testing"
+
+	"github.com/ava12/go-chat/access"
+	"github.com/ava12/go-chat/access/simple"
+	"github.com/ava12/go-chat/room"
+	roomram "github.com/ava12/go-chat/room/ram"
+)
+
+const (
+	creator = iota + 1
+	member
+	other
+)
+
+func TestRoomPerms (t *testing.T) {
+	rooms := roomram.NewRegistry()
+	rid, _ := rooms.CreateRoom("room", creator)
+	ac := simple.NewAccessController(rooms)
+	ac.NewRoom(creator, rid)
+
+	if ac.RoomPerms(creator, rid) != access.AllRoomPerms {
+		t.Fatalf("unexpected creator perms: %d", ac.RoomPerms(creator, rid))
+	}
+	moderation := access.ModeratePerm | access.KickPerm | access.BanPerm | access.RenamePerm | access.DeletePerm
+	if !ac.HasRoomPerm(member, rid, access.WritePerm) || ac.RoomPerms(member, rid) & moderation != 0 {
+		t.Fatalf("unexpected member perms: %d", ac.RoomPerms(member, rid))
+	}
+
+	rooms.SetVisibility(rid, room.InviteOnly)
+	if ac.RoomPerms(member, rid) != 0 || !ac.HasRoomPerm(creator, rid, access.DeletePerm) {
+		t.Fatal("unexpected invite-only room perms")
+	}
+	ac.Admit(member, rid)
+	if !ac.HasRoomPerm(member, rid, access.ReadPerm) || ac.HasRoomPerm(member, rid, access.KickPerm) {
+		t.Fatalf("unexpected admitted user perms: %d", ac.RoomPerms(member, rid))
+	}
+
+	rooms.SetArchived(rid, true)
+	if ac.HasRoomPerm(creator, rid, access.WritePerm) || !ac.HasRoomPerm(creator, rid, access.DeletePerm) {
+		t.Fatal("unexpected archived room perms")
+	}
+
+	dm, _, _ := rooms.DirectRoom([]int {member, other})
+	if ac.RoomPerms(creator, dm.Id) != 0 || ac.HasRoomPerm(other, dm.Id, access.DeletePerm) {
+		t.Fatal("unexpected direct room perms")
+	}
+}
@@ -0,0 +1,61 @@
+package apitoken
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/ava12/go-chat/access"
+)
+
+// Личные API-токены для ботов и скриптов. Секрет токена сообщается владельцу только при создании,
+// в реестре хранится его хеш. Область токена сужает разрешения владельца.
+
+type Entry struct {
+	Id int `json:"id"`
+	UserId int `json:"userId"`
+	Name string `json:"name"`
+	Scope access.Scope `json:"scope"`
+	Created int64 `json:"created"` // unix-время
+}
+
+type Registry interface {
+	// секрет нигде не сохраняется, повторно получить его нельзя
+	NewToken (userId int, name string, scope access.Scope) (secret string, entry Entry, e error)
+	Token (secret string) (Entry, bool)
+	UserTokens (userId int) []Entry
+	// отзывает только токен, принадлежащий пользователю
+	RevokeToken (userId, id int) error
+}
+
+const (
+	MaxNameLen = 50
+	secretBytes = 32
+)
+
+var (
+	NotFound = errors.New("API token not found")
+	BadName = errors.New("bad API token name")
+)
+
+func NewSecret () (string, error) {
+	buf := make([]byte, secretBytes)
+	_, e := rand.Read(buf)
+	return hex.EncodeToString(buf), e
+}
+
+func Hash (secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func NormalizeName (name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || utf8.RuneCountInString(name) > MaxNameLen {
+		return "", BadName
+	}
+	return name, nil
+}
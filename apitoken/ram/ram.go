@@ -0,0 +1,84 @@
+package ram
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ava12/go-chat/access"
+	"github.com/ava12/go-chat/apitoken"
+)
+
+type memRegistryRec struct {
+	lock sync.RWMutex
+	tokens map[string]*apitoken.Entry // {hash: entry}
+	lastId int
+}
+
+func NewRegistry () apitoken.Registry {
+	return &memRegistryRec {tokens: make(map[string]*apitoken.Entry)}
+}
+
+func (mrr *memRegistryRec) NewToken (userId int, name string, scope access.Scope) (string, apitoken.Entry, error) {
+	name, e := apitoken.NormalizeName(name)
+	if e != nil {
+		return "", apitoken.Entry {}, e
+	}
+
+	mrr.lock.Lock()
+	defer mrr.lock.Unlock()
+
+	var secret, hash string
+	for {
+		secret, e = apitoken.NewSecret()
+		if e != nil {
+			return "", apitoken.Entry {}, e
+		}
+
+		hash = apitoken.Hash(secret)
+		if mrr.tokens[hash] == nil {
+			break
+		}
+	}
+
+	mrr.lastId++
+	entry := &apitoken.Entry {Id: mrr.lastId, UserId: userId, Name: name, Scope: scope, Created: time.Now().Unix()}
+	mrr.tokens[hash] = entry
+	return secret, *entry, nil
+}
+
+func (mrr *memRegistryRec) Token (secret string) (apitoken.Entry, bool) {
+	mrr.lock.RLock()
+	defer mrr.lock.RUnlock()
+
+	entry := mrr.tokens[apitoken.Hash(secret)]
+	if entry == nil {
+		return apitoken.Entry {}, false
+	}
+	return *entry, true
+}
+
+func (mrr *memRegistryRec) UserTokens (userId int) []apitoken.Entry {
+	mrr.lock.RLock()
+	defer mrr.lock.RUnlock()
+
+	result := make([]apitoken.Entry, 0)
+	for _, entry := range mrr.tokens {
+		if entry.UserId == userId {
+			result = append(result, *entry)
+		}
+	}
+	return result
+}
+
+func (mrr *memRegistryRec) RevokeToken (userId, id int) error {
+	mrr.lock.Lock()
+	defer mrr.lock.Unlock()
+
+	for hash, entry := range mrr.tokens {
+		if entry.Id == id && entry.UserId == userId {
+			delete(mrr.tokens, hash)
+			return nil
+		}
+	}
+	return apitoken.NotFound
+}
@@ -0,0 +1,126 @@
+package sqldb
+
+import (
+	"database/sql"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/ava12/go-chat/access"
+	"github.com/ava12/go-chat/apitoken"
+	"github.com/ava12/go-chat/db"
+)
+
+const component = "api_tokens"
+
+var migrations = []string {
+	`CREATE TABLE api_tokens (
+		id INTEGER NOT NULL PRIMARY KEY,
+		user_id INTEGER NOT NULL,
+		name VARCHAR(255) NOT NULL,
+		hash VARCHAR(64) NOT NULL UNIQUE,
+		global_perms INTEGER NOT NULL,
+		room_perms INTEGER NOT NULL,
+		created BIGINT NOT NULL
+	)`,
+}
+
+const tokenFields = "id, user_id, name, global_perms, room_perms, created"
+
+type registryRec struct {
+	lock sync.Mutex
+	db *db.DB
+}
+
+func NewRegistry (d *db.DB) (apitoken.Registry, error) {
+	e := d.Migrate(component, migrations)
+	if e != nil {
+		return nil, e
+	}
+
+	return &registryRec {db: d}, nil
+}
+
+type scanner interface {
+	Scan (dest ... interface {}) error
+}
+
+func scanToken (s scanner) (apitoken.Entry, error) {
+	entry := apitoken.Entry {}
+	e := s.Scan(&entry.Id, &entry.UserId, &entry.Name, &entry.Scope.Global, &entry.Scope.Room, &entry.Created)
+	return entry, e
+}
+
+func (r *registryRec) NewToken (userId int, name string, scope access.Scope) (string, apitoken.Entry, error) {
+	name, e := apitoken.NormalizeName(name)
+	if e != nil {
+		return "", apitoken.Entry {}, e
+	}
+
+	secret, e := apitoken.NewSecret()
+	if e != nil {
+		return "", apitoken.Entry {}, e
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	id, e := r.db.NextId("api_tokens")
+	if e != nil {
+		return "", apitoken.Entry {}, e
+	}
+
+	entry := apitoken.Entry {Id: id, UserId: userId, Name: name, Scope: scope, Created: time.Now().Unix()}
+	_, e = r.db.Exec("INSERT INTO api_tokens (" + tokenFields + ", hash) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		id, userId, name, scope.Global, scope.Room, entry.Created, apitoken.Hash(secret))
+	if e != nil {
+		return "", apitoken.Entry {}, e
+	}
+
+	return secret, entry, nil
+}
+
+func (r *registryRec) Token (secret string) (apitoken.Entry, bool) {
+	entry, e := scanToken(r.db.QueryRow("SELECT " + tokenFields + " FROM api_tokens WHERE hash = ?", apitoken.Hash(secret)))
+	if e != nil {
+		if e != sql.ErrNoRows {
+			log.Println(e)
+		}
+		return apitoken.Entry {}, false
+	}
+	return entry, true
+}
+
+func (r *registryRec) UserTokens (userId int) []apitoken.Entry {
+	result := make([]apitoken.Entry, 0)
+	rows, e := r.db.Query("SELECT " + tokenFields + " FROM api_tokens WHERE user_id = ? ORDER BY id", userId)
+	if e != nil {
+		log.Println(e)
+		return result
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		entry, e := scanToken(rows)
+		if e != nil {
+			log.Println(e)
+			break
+		}
+
+		result = append(result, entry)
+	}
+	return result
+}
+
+func (r *registryRec) RevokeToken (userId, id int) error {
+	res, e := r.db.Exec("DELETE FROM api_tokens WHERE id = ? AND user_id = ?", id, userId)
+	if e != nil {
+		return e
+	}
+
+	n, e := res.RowsAffected()
+	if e == nil && n == 0 {
+		e = apitoken.NotFound
+	}
+	return e
+}
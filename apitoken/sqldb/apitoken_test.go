@@ -0,0 +1,44 @@
+package sqldb_test
+
+import (
+	"testing"
+
+	"github.com/ava12/go-chat/access"
+	"github.com/ava12/go-chat/apitoken"
+	"github.com/ava12/go-chat/db/dbtest"
+	tokensql "github.com/ava12/go-chat/apitoken/sqldb"
+)
+
+func TestApiTokenRegistry (t *testing.T) {
+	r, e := tokensql.NewRegistry(dbtest.Open(t))
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	scope, e := access.ParseScope([]string {"list-rooms", "read"})
+	if e != nil {
+		t.Fatal(e)
+	}
+	secret, entry, e := r.NewToken(1, " bot ", scope)
+	if e != nil || secret == "" || entry.Name != "bot" {
+		t.Fatalf("token not created: %v %v", entry, e)
+	}
+
+	found, ok := r.Token(secret)
+	if !ok || found.UserId != 1 || found.Scope != (access.Scope {Global: access.ListRoomsPerm, Room: access.ReadPerm}) {
+		t.Fatalf("unexpected token: %v %v", found, ok)
+	}
+	if _, ok = r.Token(apitoken.Hash(secret)); ok {
+		t.Fatal("token found by hash")
+	}
+
+	if e = r.RevokeToken(2, entry.Id); e != apitoken.NotFound {
+		t.Fatalf("token revoked by another user: %v", e)
+	}
+	if e = r.RevokeToken(1, entry.Id); e != nil {
+		t.Fatal(e)
+	}
+	if list := r.UserTokens(1); len(list) != 0 {
+		t.Fatalf("revoked token listed: %v", list)
+	}
+}
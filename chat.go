@@ -6,14 +6,40 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"time"
 	"github.com/ava12/go-chat/server"
+	"github.com/ava12/go-chat/access"
+	"github.com/ava12/go-chat/apitoken"
+	"github.com/ava12/go-chat/access/role"
 	"github.com/ava12/go-chat/hub"
 	"github.com/ava12/go-chat/config"
-	access "github.com/ava12/go-chat/access/simple"
+	"github.com/ava12/go-chat/db"
+	"github.com/ava12/go-chat/cursor"
+	"github.com/ava12/go-chat/hub/file"
+	"github.com/ava12/go-chat/invite"
+	"github.com/ava12/go-chat/room"
+	"github.com/ava12/go-chat/session"
+	"github.com/ava12/go-chat/user"
+	accesssimple "github.com/ava12/go-chat/access/simple"
 	proto "github.com/ava12/go-chat/proto/simple"
-	room "github.com/ava12/go-chat/room/ram"
-	session "github.com/ava12/go-chat/session/ram"
-	user "github.com/ava12/go-chat/user/ram"
+	"github.com/ava12/go-chat/proto/irc"
+	roleram "github.com/ava12/go-chat/access/role/ram"
+	rolesql "github.com/ava12/go-chat/access/role/sqldb"
+	cursorram "github.com/ava12/go-chat/cursor/ram"
+	cursorsql "github.com/ava12/go-chat/cursor/sqldb"
+	hubsql "github.com/ava12/go-chat/hub/sqldb"
+	tokenram "github.com/ava12/go-chat/apitoken/ram"
+	tokensql "github.com/ava12/go-chat/apitoken/sqldb"
+	inviteram "github.com/ava12/go-chat/invite/ram"
+	invitesql "github.com/ava12/go-chat/invite/sqldb"
+	roomram "github.com/ava12/go-chat/room/ram"
+	roomsql "github.com/ava12/go-chat/room/sqldb"
+	sessionfile "github.com/ava12/go-chat/session/file"
+	sessionram "github.com/ava12/go-chat/session/ram"
+	sessionsigned "github.com/ava12/go-chat/session/signed"
+	sessionsql "github.com/ava12/go-chat/session/sqldb"
+	userram "github.com/ava12/go-chat/user/ram"
+	usersql "github.com/ava12/go-chat/user/sqldb"
 )
 
 const (
@@ -23,6 +49,52 @@ const (
 	errOther
 )
 
+const (
+	storageSection = "Storage"
+	protoSection = "Proto"
+	accessSection = "Access"
+)
+
+// контроллер доступа: "simple" - все разрешено всем, "role" - роли (настройки в той же секции)
+type accessConf struct {
+	Controller string
+}
+
+type protoConf struct {
+	GracePeriod int // миллисекунды
+	PersistentMembership bool // требует хранилища комнат "sql"
+	IdleTimeout int // миллисекунды, 0 - статус "away" выставляется только вручную
+	ReadReceipts bool
+	DeletedRoomHistory string // "keep" или "purge"
+}
+
+// реализации хранилищ: "ram", "sql" (соединение из секции Database),
+// для сообщений также "file" (настройки в секции FileStorage), для сессий - "file" и "signed" (настройки в секции Sessions)
+type storageConf struct {
+	Messages string
+	Rooms    string
+	Users    string
+	Sessions string
+	Cursors  string
+	Roles    string // назначенные роли для контроллера "role"
+	Invites  string
+	Tokens   string // API-токены; пустая строка - токены не принимаются
+}
+
+type storagesRec struct {
+	db       *db.DB
+	file     *file.Storage
+	messages hub.MessageStorage
+	rooms    room.Registry
+	users    user.Registry
+	sessions session.Registry
+	sessionConf session.Conf
+	cursors  cursor.Registry
+	roles    role.Storage
+	invites  invite.Registry
+	tokens   apitoken.Registry
+}
+
 func main () {
 	var e error
 
@@ -39,14 +111,50 @@ func main () {
 	stop(errConfig, e)
 
 	stop(errConfig, os.Chdir(baseDir))
+	storages, e := newStorages(conf)
+	if e != nil {
+		os.Chdir(cwd)
+		stop(errConfig, e)
+	}
 	s, e := newServer(conf)
 	os.Chdir(cwd)
 	stop(errServer, e)
 
-	s.Hub = hub.New(hub.NewMemStorage())
-	s.Sessions = session.NewRegistry()
-	s.Users = user.NewRegistry()
-	s.Proto = proto.New(s.Hub, s.Users, room.NewRegistry(), access.NewAccessController())
+	s.Hub = hub.New(storages.messages)
+	s.Sessions = storages.sessions
+	s.SweepPeriod = time.Duration(storages.sessionConf.SweepPeriod) * time.Second
+	s.Users = storages.users
+	s.Tokens = storages.tokens
+	ac, e := newAccess(conf, storages)
+	stop(errConfig, e)
+	s.Access = ac
+	p := proto.New(s.Hub, s.Users, storages.rooms, ac)
+	pc := protoConf {}
+	stop(errConfig, conf.Section(protoSection, &pc))
+	p.SetGracePeriod(time.Duration(pc.GracePeriod) * time.Millisecond)
+	p.SetIdleTimeout(time.Duration(pc.IdleTimeout) * time.Millisecond)
+	p.SetCursors(storages.cursors)
+	p.SetInvites(storages.invites)
+	p.SetReadReceipts(pc.ReadReceipts)
+	stop(errConfig, p.SetHistoryPolicy(pc.DeletedRoomHistory))
+	if _, ok := storages.messages.(hub.RoomPurger); pc.DeletedRoomHistory == proto.PurgeHistory && !ok {
+		stop(errConfig, hub.CannotPurge)
+	}
+	if pc.PersistentMembership {
+		members, ok := storages.rooms.(room.Members)
+		if !ok {
+			stop(errConfig, fmt.Errorf("room registry does not keep membership"))
+		}
+		p.SetMembers(members)
+	}
+	stop(errConfig, p.RestoreRooms())
+	s.Proto = p
+	if s.IrcAddr != "" || s.IrcTlsAddr != "" {
+		if _, ok := s.Users.(user.Authenticator); !ok {
+			stop(errConfig, irc.NoPasswords)
+		}
+		s.Irc = irc.New(s.IrcName, p, s.Hub, s.Users, storages.rooms, ac)
+	}
 
 	log.Println("starting")
 
@@ -55,6 +163,8 @@ func main () {
 	log.Println(s.Run())
 	log.Println("stopping")
 
+	stop(errOther, storages.close())
+
 	os.Exit(0)
 }
 
@@ -105,6 +215,180 @@ func readConfig (name string) (*config.Config, string, error) {
 	return result, baseDir, e
 }
 
+func newStorages (c *config.Config) (result *storagesRec, e error) {
+	sect := storageConf {}
+	e = c.Section(storageSection, &sect)
+	if e != nil {
+		return
+	}
+
+	result = &storagesRec {}
+	defer func () {
+		if e != nil {
+			result.close()
+			result = nil
+		}
+	}()
+
+	for _, name := range []string {sect.Messages, sect.Rooms, sect.Users, sect.Sessions, sect.Cursors, sect.Roles, sect.Invites, sect.Tokens} {
+		if name == "sql" {
+			result.db, e = db.New(c)
+			if e != nil {
+				return
+			}
+			break
+		}
+	}
+
+	switch sect.Messages {
+	case "", "ram":
+		result.messages = hub.NewMemStorage()
+	case "file":
+		result.file, e = file.New(c)
+		result.messages = result.file
+	case "sql":
+		result.messages, e = hubsql.NewStorage(result.db)
+	default:
+		e = fmt.Errorf("unknown message storage: %q", sect.Messages)
+	}
+	if e != nil {
+		return
+	}
+
+	switch sect.Rooms {
+	case "", "ram":
+		result.rooms = roomram.NewRegistry()
+	case "sql":
+		result.rooms, e = roomsql.NewRegistry(result.db)
+	default:
+		e = fmt.Errorf("unknown room registry: %q", sect.Rooms)
+	}
+	if e != nil {
+		return
+	}
+
+	switch sect.Users {
+	case "", "ram":
+		result.users = userram.NewRegistry()
+	case "sql":
+		result.users, e = usersql.NewRegistry(result.db)
+	default:
+		e = fmt.Errorf("unknown user registry: %q", sect.Users)
+	}
+	if e != nil {
+		return
+	}
+
+	result.sessionConf, e = session.ReadConf(c)
+	if e != nil {
+		return
+	}
+
+	timeouts := result.sessionConf.Timeouts()
+	switch sect.Sessions {
+	case "", "ram":
+		result.sessions = sessionram.NewRegistry(timeouts)
+	case "sql":
+		result.sessions, e = sessionsql.NewRegistry(result.db, timeouts)
+	case "file":
+		result.sessions, e = sessionfile.NewRegistry(result.sessionConf.File, timeouts)
+	case "signed":
+		var signed *sessionsigned.Registry
+		signed, e = sessionsigned.NewRegistry(result.sessionConf.Keys, result.sessionConf.Encrypt, timeouts)
+		if e == nil {
+			e = signed.SetEpochFile(result.sessionConf.EpochFile)
+		}
+		result.sessions = signed
+	default:
+		e = fmt.Errorf("unknown session registry: %q", sect.Sessions)
+	}
+	if e != nil {
+		return
+	}
+
+	switch sect.Cursors {
+	case "", "ram":
+		result.cursors = cursorram.NewRegistry()
+	case "sql":
+		result.cursors, e = cursorsql.NewRegistry(result.db)
+	default:
+		e = fmt.Errorf("unknown read cursor registry: %q", sect.Cursors)
+	}
+	if e != nil {
+		return
+	}
+
+	switch sect.Roles {
+	case "", "ram":
+		result.roles = roleram.NewStorage()
+	case "sql":
+		result.roles, e = rolesql.NewStorage(result.db)
+	default:
+		e = fmt.Errorf("unknown role storage: %q", sect.Roles)
+	}
+	if e != nil {
+		return
+	}
+
+	switch sect.Invites {
+	case "", "ram":
+		result.invites = inviteram.NewRegistry()
+	case "sql":
+		result.invites, e = invitesql.NewRegistry(result.db)
+	default:
+		e = fmt.Errorf("unknown invite registry: %q", sect.Invites)
+	}
+	if e != nil {
+		return
+	}
+
+	switch sect.Tokens {
+	case "":
+	case "ram":
+		result.tokens = tokenram.NewRegistry()
+	case "sql":
+		result.tokens, e = tokensql.NewRegistry(result.db)
+	default:
+		e = fmt.Errorf("unknown API token registry: %q", sect.Tokens)
+	}
+	return
+}
+
+func newAccess (c *config.Config, storages *storagesRec) (access.Controller, error) {
+	sect := accessConf {}
+	e := c.Section(accessSection, &sect)
+	if e != nil {
+		return nil, e
+	}
+
+	switch sect.Controller {
+	case "", "simple":
+		return accesssimple.NewAccessController(storages.rooms), nil
+	case "role":
+		rc, e := role.New(c, storages.roles, storages.rooms)
+		if e != nil {
+			return nil, e
+		}
+		return rc, nil
+	default:
+		return nil, fmt.Errorf("unknown access controller: %q", sect.Controller)
+	}
+}
+
+func (s *storagesRec) close () error {
+	var e error
+	if s.file != nil {
+		e = s.file.Close()
+	}
+	if s.db != nil {
+		de := s.db.Close()
+		if e == nil {
+			e = de
+		}
+	}
+	return e
+}
+
 func newServer (c *config.Config) (*server.Server, error) {
 
 	result, e := server.New(c)
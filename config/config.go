@@ -49,7 +49,7 @@ func (c *Config) Section (name string, dst interface{}) error {
 
 func (c *Config) LoadJson (data []byte) error {
 	layer := newJsonLayer()
-	e := json.Unmarshal(data, &layer)
+	e := json.Unmarshal(data, &layer.sections)
 	if e != nil {
 		return e
 	}
@@ -61,7 +61,7 @@ func (c *Config) LoadJson (data []byte) error {
 func (c *Config) ReadJson (r io.Reader) error {
 	layer := newJsonLayer()
 	decoder := json.NewDecoder(r)
-	e := decoder.Decode(&layer)
+	e := decoder.Decode(&layer.sections)
 	if e != nil {
 		return e
 	}
@@ -1,5 +1,7 @@
 package conn
 
+import "github.com/ava12/go-chat/access"
+
 type Conn interface {
 	Id () int
 	UserId () int
@@ -7,3 +9,16 @@ type Conn interface {
 	Close ()
 	IsAlive () bool
 }
+
+// подключение с ограниченными разрешениями; реализуется не всеми подключениями
+type Scoped interface {
+	Scope () access.Scope
+}
+
+// область подключения; у подключений без ограничений - access.FullScope
+func ScopeOf (c Conn) access.Scope {
+	if sc, ok := c.(Scoped); ok {
+		return sc.Scope()
+	}
+	return access.FullScope
+}
@@ -0,0 +1,281 @@
+package poll
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ava12/go-chat/access"
+	"github.com/ava12/go-chat/proto"
+)
+
+// Подключение длинными запросами (long polling) для клиентов, у которых работает только HTTP.
+// Открытое подключение получает номер и ключ; опрос (параметры conn и key) ждет сообщений не дольше PollWait
+// и забирает все накопленные, запрос протоколу передается параметром request.
+// Сообщения нумеруются с 1; в параметре опроса ack клиент передает номер последнего полученного сообщения.
+// Сообщение удаляется из очереди только после подтверждения, так что ответ, не дошедший до клиента,
+// повторяется при следующем опросе.
+// Клиент, который не опрашивал сервер дольше Timeout, считается отключившимся.
+
+const (
+	PollWait = 25 * time.Second
+	Timeout = time.Minute
+	MaxQueue = 1000 // включая неподтвержденные сообщения
+
+	keyBytes = 16
+)
+
+var NotFound = errors.New("polling connection not found")
+
+type connRec struct {
+	id, userId int
+	key string
+	remoteAddr string
+	scope access.Scope
+	registry *Registry
+	p proto.Proto
+
+	lock sync.Mutex
+	queue []json.RawMessage
+	first int // номер queue[0]
+	notify chan struct {} // сигнал опросу о новых сообщениях
+	done chan struct {} // закрывается под lock
+	closeOnce sync.Once
+	timer *time.Timer // срабатывает, если клиент перестал опрашивать сервер; взводится и закрывается под lock
+
+	pollLock sync.Mutex // опросы и запросы подключения обрабатываются по одному
+	requestLock sync.Mutex
+}
+
+// ответ на опрос
+type pollRec struct {
+	Seq int `json:"seq"` // номер первого сообщения
+	Messages []json.RawMessage `json:"messages"`
+}
+
+type Registry struct {
+	lock sync.Mutex
+	conns map[int]*connRec
+}
+
+func NewRegistry () *Registry {
+	return &Registry {conns: make(map[int]*connRec)}
+}
+
+func (r *Registry) New (req *http.Request, p proto.Proto, id, userId int, scope access.Scope) (*connRec, error) {
+	buf := make([]byte, keyBytes)
+	_, e := rand.Read(buf)
+	if e != nil {
+		return nil, e
+	}
+
+	c := &connRec {
+		id: id,
+		userId: userId,
+		key: hex.EncodeToString(buf),
+		remoteAddr: req.RemoteAddr,
+		scope: scope,
+		registry: r,
+		p: p,
+		queue: make([]json.RawMessage, 0),
+		first: 1,
+		notify: make(chan struct {}, 1),
+		done: make(chan struct {}),
+	}
+	c.timer = time.AfterFunc(Timeout, func () {
+		log.Printf("u%dc%d (%s) poll timeout\n", c.userId, c.id, c.remoteAddr)
+		c.Close()
+	})
+
+	r.lock.Lock()
+	r.conns[id] = c
+	r.lock.Unlock()
+	return c, nil
+}
+
+func (r *Registry) find (req *http.Request, userId int) *connRec {
+	id, _ := strconv.Atoi(req.FormValue("conn"))
+	r.lock.Lock()
+	c := r.conns[id]
+	r.lock.Unlock()
+
+	if c == nil || c.userId != userId || c.key != req.FormValue("key") || !c.IsAlive() {
+		return nil
+	}
+	return c
+}
+
+// подтверждает сообщения до ack включительно и отвечает неподтвержденными, пустым списком - если за PollWait их не появилось
+func (r *Registry) Poll (w http.ResponseWriter, req *http.Request, userId int) error {
+	c := r.find(req, userId)
+	if c == nil {
+		return NotFound
+	}
+
+	c.pollLock.Lock()
+	defer c.pollLock.Unlock()
+
+	c.lock.Lock()
+	c.timer.Stop()
+	c.lock.Unlock()
+	defer c.rearm()
+
+	// сигнал о сообщениях, которые будут забраны сейчас, не должен прервать следующее ожидание
+	select {
+	case <-c.notify:
+	default:
+	}
+
+	ack, _ := strconv.Atoi(req.FormValue("ack"))
+	resp := c.unacked(ack)
+	if len(resp.Messages) == 0 {
+		wait := time.NewTimer(PollWait)
+		select {
+		case <-c.notify:
+		case <-wait.C:
+		case <-req.Context().Done():
+		case <-c.done:
+			wait.Stop()
+			return NotFound
+		}
+		wait.Stop()
+		resp = c.unacked(ack)
+	}
+
+	data, e := json.Marshal(resp)
+	if e != nil {
+		return e
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", "text/json")
+	h.Set("Cache-Control", "no-store")
+	_, e = w.Write(data)
+	return e
+}
+
+func (r *Registry) TakeRequest (req *http.Request, userId int) error {
+	c := r.find(req, userId)
+	if c == nil {
+		return NotFound
+	}
+
+	c.requestLock.Lock()
+	defer c.requestLock.Unlock()
+	c.p.TakeRequest(c, []byte(req.FormValue("request")))
+	return nil
+}
+
+func (r *Registry) CloseAll () {
+	r.lock.Lock()
+	conns := make([]*connRec, 0, len(r.conns))
+	for _, c := range r.conns {
+		conns = append(conns, c)
+	}
+	r.lock.Unlock()
+
+	for _, c := range conns {
+		c.Close()
+	}
+}
+
+// удаляет из очереди сообщения до ack включительно, возвращает остальные
+func (c *connRec) unacked (ack int) pollRec {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	n := ack - c.first + 1
+	if n > len(c.queue) {
+		n = len(c.queue)
+	}
+	if n > 0 {
+		c.queue = append(make([]json.RawMessage, 0, len(c.queue) - n), c.queue[n:]...)
+		c.first += n
+	}
+
+	return pollRec {c.first, append([]json.RawMessage {}, c.queue...)}
+}
+
+// закрытое подключение не взводит таймер
+func (c *connRec) rearm () {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.IsAlive() {
+		c.timer.Reset(Timeout)
+	}
+}
+
+func (c *connRec) Id () int {
+	return c.id
+}
+
+func (c *connRec) UserId () int {
+	return c.userId
+}
+
+func (c *connRec) Key () string {
+	return c.key
+}
+
+func (c *connRec) Scope () access.Scope {
+	return c.scope
+}
+
+// подключение, клиент которого не забирает сообщения, закрывается
+func (c *connRec) Send (m []byte) {
+	if !c.IsAlive() {
+		return
+	}
+
+	c.lock.Lock()
+	overflow := (len(c.queue) >= MaxQueue)
+	if !overflow {
+		c.queue = append(c.queue, json.RawMessage(m))
+	}
+	c.lock.Unlock()
+
+	if overflow {
+		log.Printf("u%dc%d (%s) send queue overflow\n", c.userId, c.id, c.remoteAddr)
+		c.Close()
+		return
+	}
+
+	select {
+	case c.notify <- struct {} {}:
+	default:
+	}
+}
+
+// отключает от протокола в отдельной горутине: Close может быть вызван из протокола
+func (c *connRec) Close () {
+	c.closeOnce.Do(func () {
+		c.lock.Lock()
+		close(c.done)
+		c.timer.Stop()
+		c.lock.Unlock()
+
+		go func () {
+			c.registry.lock.Lock()
+			delete(c.registry.conns, c.id)
+			c.registry.lock.Unlock()
+
+			c.p.Disconnect(c.id)
+		}()
+	})
+}
+
+func (c *connRec) IsAlive () bool {
+	select {
+	case <-c.done:
+		return false
+	default:
+		return true
+	}
+}
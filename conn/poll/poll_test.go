@@ -0,0 +1,199 @@
+package poll
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ava12/go-chat/access"
+	"github.com/ava12/go-chat/conn"
+)
+
+type testProto struct {
+	requests chan string
+	disconnects chan int
+}
+
+func newTestProto () *testProto {
+	return &testProto {make(chan string, 10), make(chan int, 10)}
+}
+
+func (p *testProto) Connect (c conn.Conn) {}
+
+func (p *testProto) Disconnect (connId int) {
+	p.disconnects <- connId
+}
+
+func (p *testProto) Stop () {}
+
+func (p *testProto) TakeRequest (c conn.Conn, r []byte) {
+	p.requests <- string(r)
+}
+
+func openConn (t *testing.T, r *Registry, p *testProto) *connRec {
+	c, e := r.New(httptest.NewRequest("POST", "/poll/open", nil), p, 1, 7, access.FullScope)
+	if e != nil {
+		t.Fatal(e)
+	}
+	return c
+}
+
+func pollQuery (c *connRec, key string, ack int) string {
+	return "/poll?" + url.Values {"conn": {strconv.Itoa(c.id)}, "key": {key}, "ack": {strconv.Itoa(ack)}}.Encode()
+}
+
+// опрос, который без сообщений ждет не дольше wait
+func poll (t *testing.T, r *Registry, c *connRec, ack int, wait time.Duration) (pollRec, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), wait)
+	defer cancel()
+
+	req := httptest.NewRequest("GET", pollQuery(c, c.key, ack), nil).WithContext(ctx)
+	w := httptest.NewRecorder()
+	result := pollRec {}
+	e := r.Poll(w, req, c.userId)
+	if e == nil {
+		e = json.Unmarshal(w.Body.Bytes(), &result)
+	}
+	return result, e
+}
+
+func checkPoll (t *testing.T, resp pollRec, e error, seq int, messages ...string) {
+	t.Helper()
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	got := make([]string, 0, len(resp.Messages))
+	for _, m := range resp.Messages {
+		got = append(got, string(m))
+	}
+	if resp.Seq != seq || strings.Join(got, " ") != strings.Join(messages, " ") {
+		t.Fatalf("expecting seq %d %v, got %d %v", seq, messages, resp.Seq, got)
+	}
+}
+
+func TestPollAck (t *testing.T) {
+	r := NewRegistry()
+	c := openConn(t, r, newTestProto())
+	defer c.Close()
+
+	c.Send([]byte("1"))
+	c.Send([]byte("2"))
+	c.Send([]byte("3"))
+
+	resp, e := poll(t, r, c, 0, time.Second)
+	checkPoll(t, resp, e, 1, "1", "2", "3")
+
+	// ответ не дошел, клиент повторяет опрос с прежним ack
+	resp, e = poll(t, r, c, 0, time.Second)
+	checkPoll(t, resp, e, 1, "1", "2", "3")
+
+	resp, e = poll(t, r, c, 2, time.Second)
+	checkPoll(t, resp, e, 3, "3")
+
+	resp, e = poll(t, r, c, 3, 50 * time.Millisecond)
+	checkPoll(t, resp, e, 4)
+
+	// подтверждение уже удаленных и еще не отправленных сообщений ничего не меняет
+	c.Send([]byte("4"))
+	resp, e = poll(t, r, c, 1, time.Second)
+	checkPoll(t, resp, e, 4, "4")
+	resp, e = poll(t, r, c, 100, 50 * time.Millisecond)
+	checkPoll(t, resp, e, 5)
+}
+
+func TestPollWakeup (t *testing.T) {
+	r := NewRegistry()
+	c := openConn(t, r, newTestProto())
+	defer c.Close()
+
+	go func () {
+		time.Sleep(50 * time.Millisecond)
+		c.Send([]byte("1"))
+	}()
+
+	started := time.Now()
+	resp, e := poll(t, r, c, 0, 5 * time.Second)
+	checkPoll(t, resp, e, 1, "1")
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Fatalf("poll was not woken up: %s", elapsed)
+	}
+}
+
+func TestPollCredentials (t *testing.T) {
+	r := NewRegistry()
+	p := newTestProto()
+	c := openConn(t, r, p)
+	defer c.Close()
+
+	w := httptest.NewRecorder()
+	if e := r.Poll(w, httptest.NewRequest("GET", pollQuery(c, "wrong", 0), nil), c.userId); e != NotFound {
+		t.Fatalf("wrong key accepted: %v", e)
+	}
+	if e := r.Poll(w, httptest.NewRequest("GET", pollQuery(c, c.key, 0), nil), c.userId + 1); e != NotFound {
+		t.Fatalf("wrong user accepted: %v", e)
+	}
+
+	body := url.Values {"conn": {strconv.Itoa(c.id)}, "key": {c.key}, "request": {"hello"}}
+	req := httptest.NewRequest("POST", "/poll", strings.NewReader(body.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if e := r.TakeRequest(req, c.userId); e != nil {
+		t.Fatal(e)
+	}
+	if m := <-p.requests; m != "hello" {
+		t.Fatalf("unexpected request %q", m)
+	}
+}
+
+func TestPollClose (t *testing.T) {
+	r := NewRegistry()
+	p := newTestProto()
+	c := openConn(t, r, p)
+
+	go func () {
+		time.Sleep(50 * time.Millisecond)
+		c.Close()
+	}()
+
+	if _, e := poll(t, r, c, 0, 5 * time.Second); e != NotFound {
+		t.Fatalf("expecting NotFound from closed connection, got %v", e)
+	}
+	if c.timer.Stop() {
+		t.Fatal("poll timer rearmed after Close")
+	}
+
+	select {
+	case id := <-p.disconnects:
+		if id != c.id {
+			t.Fatalf("unexpected disconnect of c%d", id)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("closed connection was not disconnected")
+	}
+	if _, e := poll(t, r, c, 0, time.Second); e != NotFound {
+		t.Fatalf("closed connection found: %v", e)
+	}
+}
+
+func TestPollOverflow (t *testing.T) {
+	r := NewRegistry()
+	p := newTestProto()
+	c := openConn(t, r, p)
+
+	for i := 0; i <= MaxQueue; i++ {
+		c.Send([]byte("1"))
+	}
+	if c.IsAlive() {
+		t.Fatal("connection is alive after queue overflow")
+	}
+	select {
+	case <-p.disconnects:
+	case <-time.After(time.Second):
+		t.Fatal("overflowed connection was not disconnected")
+	}
+}
@@ -0,0 +1,137 @@
+// тот же интерфейс, что у WsConn, поверх Xhr (static/xhr.js): сообщения забираются длинными GET-запросами,
+// запросы отправляются POST-запросами по одному, в порядке вызова send;
+// каждый опрос подтверждает (ack) номер последнего полученного сообщения, неподтвержденные сервер присылает повторно
+PollConn = function (path) {
+	if (!path) {
+		path = '/poll'
+	}
+
+	this.path = path
+	this.params = null
+	this.active = false
+	this.running = false
+	this.sending = false
+	this.generation = 0 // ответы на запросы прежнего подключения не обрабатываются
+	this.ack = 0 // номер последнего полученного сообщения
+	this.queue = []
+	this.messageCallback = null
+	this.errorCallback = null
+}
+
+PollConn.prototype.cleanup = function () {
+	this.generation++
+	this.params = null
+	this.ack = 0
+	this.active = false
+	this.running = false
+	this.sending = false
+	this.queue = []
+}
+
+PollConn.prototype.connect = function (messageCallback, errorCallback) {
+	this.messageCallback = messageCallback
+	this.errorCallback = errorCallback
+	if (this.active) {
+		return
+	}
+
+	this.active = true
+	var t = this
+	var generation = this.generation
+	;(new Xhr()).post(this.path + '/open', null, function (xhr) {
+		if (t.generation != generation) {
+			return
+		}
+
+		var data = xhr.getJsonResponse()
+		t.params = {conn: data.id, key: data.key}
+		t.running = true
+		t.poll()
+		t.sendNext()
+	}, this.failHandler('cannot open polling connection'))
+}
+
+PollConn.prototype.disconnect = function () {
+	if (this.active) {
+		this.cleanup()
+	}
+}
+
+PollConn.prototype.send = function (data) {
+	if (!this.active) {
+		this.giveError('no polling connection')
+		return
+	}
+
+	if (typeof data != 'string') {
+		data = JSON.stringify(data)
+	}
+
+	this.queue.push(data)
+	this.sendNext()
+}
+
+PollConn.prototype.poll = function () {
+	var t = this
+	var generation = this.generation
+	var params = {conn: this.params.conn, key: this.params.key, ack: this.ack}
+	;(new Xhr()).get(this.path, params, function (xhr) {
+		if (t.generation != generation) {
+			return
+		}
+
+		var data = xhr.getJsonResponse()
+		for (var i = 0; i < data.messages.length && t.generation == generation; i++) {
+			var seq = data.seq + i
+			if (seq > t.ack) {
+				t.ack = seq
+				t.giveMessage(data.messages[i])
+			}
+		}
+		if (t.generation == generation) {
+			t.poll()
+		}
+	}, this.failHandler('polling connection is closed'))
+}
+
+PollConn.prototype.sendNext = function () {
+	if (!this.running || this.sending || !this.queue.length) {
+		return
+	}
+
+	var t = this
+	var generation = this.generation
+	var data = {conn: this.params.conn, key: this.params.key, request: this.queue.shift()}
+	this.sending = true
+	;(new Xhr()).post(this.path, data, function () {
+		if (t.generation == generation) {
+			t.sending = false
+			t.sendNext()
+		}
+	}, this.failHandler('polling request failed'))
+}
+
+PollConn.prototype.failHandler = function (message) {
+	var t = this
+	var generation = this.generation
+	return function (xhr) {
+		if (t.generation != generation) {
+			return
+		}
+
+		t.cleanup()
+		t.giveError(message + ': ' + xhr.xhr.status + ' ' + xhr.xhr.statusText)
+	}
+}
+
+PollConn.prototype.giveMessage = function (data) {
+	if (this.messageCallback) {
+		this.messageCallback(data)
+	}
+}
+
+PollConn.prototype.giveError = function (message) {
+	if (this.errorCallback) {
+		this.errorCallback(message)
+	}
+}
@@ -0,0 +1,238 @@
+package sse
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ava12/go-chat/access"
+	"github.com/ava12/go-chat/proto"
+)
+
+// Подключение через Server-Sent Events. GET-запрос открывает поток text/event-stream;
+// первое событие "connect" сообщает номер подключения и ключ, остальные события - сообщения Send с номерами событий.
+// Запросы клиента приходят POST-запросами с параметрами conn (номер) и key (ключ) и передаются протоколу по порядку.
+
+const (
+	QueueSize = 256
+	KeepAlivePeriod = 30 * time.Second
+	MaxRequestSize = 1 << 20
+
+	keyBytes = 16
+)
+
+var (
+	NoStreaming = errors.New("streaming is not supported")
+	NotFound = errors.New("SSE connection not found")
+)
+
+type connRec struct {
+	id, userId int
+	key string
+	remoteAddr string
+	scope access.Scope
+
+	w http.ResponseWriter
+	flusher http.Flusher
+	queue chan []byte
+	done chan struct {}
+	closeOnce sync.Once
+	lastEventId int
+
+	requestLock sync.Mutex // запросы подключения обрабатываются по одному
+}
+
+// открытые подключения; запросы POST находят подключение по номеру
+type Registry struct {
+	lock sync.Mutex
+	conns map[int]*connRec
+}
+
+func NewRegistry () *Registry {
+	return &Registry {conns: make(map[int]*connRec)}
+}
+
+type connectEventRec struct {
+	Id int `json:"id"`
+	Key string `json:"key"`
+}
+
+// отправляет заголовки ответа и событие connect; поток передается вызовом Serve
+func (r *Registry) New (w http.ResponseWriter, req *http.Request, id, userId int, scope access.Scope) (*connRec, error) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return nil, NoStreaming
+	}
+
+	buf := make([]byte, keyBytes)
+	_, e := rand.Read(buf)
+	if e != nil {
+		return nil, e
+	}
+
+	c := &connRec {
+		id: id,
+		userId: userId,
+		key: hex.EncodeToString(buf),
+		remoteAddr: req.RemoteAddr,
+		scope: scope,
+		w: w,
+		flusher: flusher,
+		queue: make(chan []byte, QueueSize),
+		done: make(chan struct {}),
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	data, _ := json.Marshal(connectEventRec {id, c.key})
+	e = c.writeEvent("connect", data)
+	if e != nil {
+		return nil, e
+	}
+
+	r.lock.Lock()
+	r.conns[id] = c
+	r.lock.Unlock()
+	return c, nil
+}
+
+// передает сообщения до закрытия подключения или разрыва связи, после чего отключает его от протокола
+func (r *Registry) Serve (c *connRec, req *http.Request, p proto.Proto) {
+	timer := time.NewTicker(KeepAlivePeriod)
+	var e error
+
+Loop:
+	for e == nil {
+		select {
+		case m := <-c.queue:
+			e = c.writeEvent("", m)
+		case <-timer.C:
+			_, e = io.WriteString(c.w, ": ping\n\n")
+			c.flusher.Flush()
+		case <-req.Context().Done():
+			e = req.Context().Err()
+		case <-c.done:
+			break Loop
+		}
+	}
+
+	timer.Stop()
+	if e != nil {
+		log.Printf("u%dc%d (%s) %s\n", c.userId, c.id, c.remoteAddr, e.Error())
+	}
+	c.Close()
+
+	r.lock.Lock()
+	delete(r.conns, c.id)
+	r.lock.Unlock()
+
+	p.Disconnect(c.id)
+}
+
+// запрос клиента: параметры URL conn и key, тело - запрос протокола
+func (r *Registry) TakeRequest (w http.ResponseWriter, req *http.Request, p proto.Proto, userId int) error {
+	query := req.URL.Query()
+	id, _ := strconv.Atoi(query.Get("conn"))
+	r.lock.Lock()
+	c := r.conns[id]
+	r.lock.Unlock()
+
+	if c == nil || c.userId != userId || c.key != query.Get("key") || !c.IsAlive() {
+		return NotFound
+	}
+
+	body, e := io.ReadAll(http.MaxBytesReader(w, req.Body, MaxRequestSize))
+	if e != nil {
+		return e
+	}
+
+	c.requestLock.Lock()
+	defer c.requestLock.Unlock()
+	p.TakeRequest(c, body)
+	return nil
+}
+
+func (r *Registry) CloseAll () {
+	r.lock.Lock()
+	conns := make([]*connRec, 0, len(r.conns))
+	for _, c := range r.conns {
+		conns = append(conns, c)
+	}
+	r.lock.Unlock()
+
+	for _, c := range conns {
+		c.Close()
+	}
+}
+
+// пустое имя - событие message с очередным номером
+func (c *connRec) writeEvent (name string, data []byte) error {
+	var b strings.Builder
+	if name == "" {
+		c.lastEventId++
+		fmt.Fprintf(&b, "id: %d\n", c.lastEventId)
+	} else {
+		fmt.Fprintf(&b, "event: %s\n", name)
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		b.WriteString("data: ")
+		b.WriteString(line)
+		b.WriteString("\n")
+	}
+	b.WriteString("\n")
+
+	_, e := io.WriteString(c.w, b.String())
+	c.flusher.Flush()
+	return e
+}
+
+func (c *connRec) Id () int {
+	return c.id
+}
+
+func (c *connRec) UserId () int {
+	return c.userId
+}
+
+func (c *connRec) Scope () access.Scope {
+	return c.scope
+}
+
+// не блокирует; подключение, не успевающее принимать сообщения, закрывается
+func (c *connRec) Send (m []byte) {
+	select {
+	case <-c.done:
+	case c.queue <- m:
+	default:
+		log.Printf("u%dc%d (%s) send queue overflow\n", c.userId, c.id, c.remoteAddr)
+		c.Close()
+	}
+}
+
+func (c *connRec) Close () {
+	c.closeOnce.Do(func () {
+		close(c.done)
+	})
+}
+
+func (c *connRec) IsAlive () bool {
+	select {
+	case <-c.done:
+		return false
+	default:
+		return true
+	}
+}
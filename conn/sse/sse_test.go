@@ -0,0 +1,207 @@
+package sse
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ava12/go-chat/access"
+	"github.com/ava12/go-chat/conn"
+)
+
+type testProto struct {
+	requests chan string
+	disconnects chan int
+}
+
+func newTestProto () *testProto {
+	return &testProto {make(chan string, 10), make(chan int, 10)}
+}
+
+func (p *testProto) Connect (c conn.Conn) {}
+
+func (p *testProto) Disconnect (connId int) {
+	p.disconnects <- connId
+}
+
+func (p *testProto) Stop () {}
+
+func (p *testProto) TakeRequest (c conn.Conn, r []byte) {
+	p.requests <- string(r)
+}
+
+type streamRec struct {
+	r *Registry
+	p *testProto
+	srv *httptest.Server
+	resp *http.Response
+	reader *bufio.Reader
+}
+
+// открывает поток подключения 1 пользователя 7
+func openStream (t *testing.T) *streamRec {
+	s := &streamRec {r: NewRegistry(), p: newTestProto()}
+	s.srv = httptest.NewServer(http.HandlerFunc(func (w http.ResponseWriter, req *http.Request) {
+		c, e := s.r.New(w, req, 1, 7, access.FullScope)
+		if e == nil {
+			s.r.Serve(c, req, s.p)
+		}
+	}))
+
+	resp, e := http.Get(s.srv.URL)
+	if e != nil {
+		s.srv.Close()
+		t.Fatal(e)
+	}
+
+	s.resp = resp
+	s.reader = bufio.NewReader(resp.Body)
+	t.Cleanup(func () {
+		s.r.CloseAll()
+		s.resp.Body.Close()
+		s.srv.Close()
+	})
+	return s
+}
+
+// строки события без завершающей пустой строки
+func (s *streamRec) event (t *testing.T) []string {
+	t.Helper()
+	result := make([]string, 0, 2)
+	for {
+		line, e := s.reader.ReadString('\n')
+		if e != nil {
+			t.Fatal(e)
+		}
+
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return result
+		}
+		result = append(result, line)
+	}
+}
+
+func (s *streamRec) conn (t *testing.T) *connRec {
+	s.r.lock.Lock()
+	defer s.r.lock.Unlock()
+
+	c := s.r.conns[1]
+	if c == nil {
+		t.Fatal("connection not registered")
+	}
+	return c
+}
+
+func TestConnectEvent (t *testing.T) {
+	s := openStream(t)
+	if ct := s.resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("unexpected content type %q", ct)
+	}
+
+	ev := s.event(t)
+	if len(ev) != 2 || ev[0] != "event: connect" || !strings.HasPrefix(ev[1], "data: ") {
+		t.Fatalf("unexpected connect event: %q", ev)
+	}
+
+	data := connectEventRec {}
+	e := json.Unmarshal([]byte(strings.TrimPrefix(ev[1], "data: ")), &data)
+	if e != nil || data.Id != 1 || data.Key != s.conn(t).key {
+		t.Fatalf("unexpected connect data: %+v, %v", data, e)
+	}
+}
+
+func TestMessageEvents (t *testing.T) {
+	s := openStream(t)
+	s.event(t)
+	c := s.conn(t)
+
+	c.Send([]byte("one"))
+	c.Send([]byte("two\nlines\n"))
+
+	expected := [][]string {
+		{"id: 1", "data: one"},
+		{"id: 2", "data: two", "data: lines", "data: "},
+	}
+	for _, exp := range expected {
+		if ev := s.event(t); strings.Join(ev, "|") != strings.Join(exp, "|") {
+			t.Fatalf("expecting %q, got %q", exp, ev)
+		}
+	}
+}
+
+func TestTakeRequest (t *testing.T) {
+	s := openStream(t)
+	s.event(t)
+	c := s.conn(t)
+
+	post := func (id int, key string, userId int) error {
+		query := url.Values {"conn": {strconv.Itoa(id)}, "key": {key}}.Encode()
+		req := httptest.NewRequest("POST", "/sse?" + query, strings.NewReader("hello"))
+		return s.r.TakeRequest(httptest.NewRecorder(), req, s.p, userId)
+	}
+
+	if e := post(c.id, "wrong", c.userId); e != NotFound {
+		t.Fatalf("wrong key accepted: %v", e)
+	}
+	if e := post(c.id, c.key, c.userId + 1); e != NotFound {
+		t.Fatalf("wrong user accepted: %v", e)
+	}
+	if e := post(c.id + 1, c.key, c.userId); e != NotFound {
+		t.Fatalf("wrong connection accepted: %v", e)
+	}
+	select {
+	case m := <-s.p.requests:
+		t.Fatalf("rejected request passed to proto: %q", m)
+	default:
+	}
+
+	if e := post(c.id, c.key, c.userId); e != nil {
+		t.Fatal(e)
+	}
+	if m := <-s.p.requests; m != "hello" {
+		t.Fatalf("unexpected request %q", m)
+	}
+}
+
+func TestQueueOverflow (t *testing.T) {
+	r := NewRegistry()
+	c, e := r.New(httptest.NewRecorder(), httptest.NewRequest("GET", "/sse", nil), 1, 7, access.FullScope)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	// Serve не запущен, очередь никто не разбирает
+	for i := 0; i < QueueSize; i++ {
+		c.Send([]byte("m"))
+	}
+	if !c.IsAlive() {
+		t.Fatal("connection closed before queue overflow")
+	}
+
+	c.Send([]byte("m"))
+	if c.IsAlive() {
+		t.Fatal("connection is alive after queue overflow")
+	}
+}
+
+func TestCloseAll (t *testing.T) {
+	s := openStream(t)
+	s.event(t)
+
+	s.r.CloseAll()
+	select {
+	case id := <-s.p.disconnects:
+		if id != 1 {
+			t.Fatalf("unexpected disconnect of c%d", id)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("connection was not disconnected")
+	}
+}
@@ -0,0 +1,133 @@
+// тот же интерфейс, что у WsConn: сообщения приходят потоком Server-Sent Events,
+// запросы отправляются POST-запросами по одному, в порядке вызова send
+SseConn = function (url) {
+	if (!url) {
+		url = '/sse'
+	}
+
+	this.url = url
+	this.es = null
+	this.running = false
+	this.sending = false
+	this.postUrl = ''
+	this.queue = []
+	this.messageCallback = null
+	this.errorCallback = null
+}
+
+SseConn.prototype.cleanup = function () {
+	this.es = null
+	this.running = false
+	this.sending = false
+	this.queue = []
+}
+
+SseConn.prototype.connect = function (messageCallback, errorCallback) {
+	this.messageCallback = messageCallback
+	this.errorCallback = errorCallback
+	if (this.es) {
+		return
+	}
+
+	this.es = new EventSource(this.url)
+	if (!this.es) {
+		this.giveError('cannot connect to ' + this.url)
+	}
+
+	var t = this
+
+	this.es.addEventListener('connect', function (e) {
+		var data = JSON.parse(e.data)
+		t.postUrl = t.url + (t.url.indexOf('?') < 0 ? '?' : '&') +
+			'conn=' + encodeURIComponent(data.id) + '&key=' + encodeURIComponent(data.key)
+		t.running = true
+		t.sendNext()
+	})
+
+	// EventSource переподключается сам, но новый поток - это новое подключение; восстановлением занимается приложение
+	this.es.onerror = function () {
+		t.disconnect()
+		t.giveError('SSE connection is closed')
+	}
+
+	this.es.onmessage = function (e) {
+		var data = JSON.parse(e.data)
+		if (data == undefined) {
+			t.giveError('incorrect SSE message')
+			t.disconnect()
+			return
+		}
+
+		t.giveMessage(data)
+	}
+}
+
+SseConn.prototype.disconnect = function () {
+	if (!this.es) {
+		return
+	}
+
+	this.es.close()
+	this.cleanup()
+}
+
+SseConn.prototype.send = function (data) {
+	if (!this.es) {
+		this.giveError('no SSE connection')
+		return
+	}
+
+	if (typeof data != 'string') {
+		data = JSON.stringify(data)
+	}
+
+	this.queue.push(data)
+	this.sendNext()
+}
+
+SseConn.prototype.sendNext = function () {
+	if (!this.running || this.sending || !this.queue.length) {
+		return
+	}
+
+	var t = this
+	var es = this.es
+	var xhr = new XMLHttpRequest()
+	xhr.open('POST', this.postUrl)
+	xhr.setRequestHeader('Content-Type', 'text/plain')
+	xhr.onload = function () {
+		if (t.es !== es) {
+			return
+		}
+
+		t.sending = false
+		if (xhr.status >= 300) {
+			t.disconnect()
+			t.giveError('SSE request failed: ' + xhr.status + ' ' + xhr.statusText)
+			return
+		}
+
+		t.sendNext()
+	}
+	xhr.onerror = function () {
+		if (t.es === es) {
+			t.disconnect()
+			t.giveError('SSE request failed')
+		}
+	}
+
+	this.sending = true
+	xhr.send(this.queue.shift())
+}
+
+SseConn.prototype.giveMessage = function (data) {
+	if (this.messageCallback) {
+		this.messageCallback(data)
+	}
+}
+
+SseConn.prototype.giveError = function (message) {
+	if (this.errorCallback) {
+		this.errorCallback(message)
+	}
+}
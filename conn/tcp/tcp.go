@@ -0,0 +1,148 @@
+package tcp
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ava12/go-chat/access"
+	"github.com/ava12/go-chat/proto"
+)
+
+// Подключение по TCP (в том числе TLS) строками JSON, подходит для netcat и скриптов.
+// Первая строка клиента - учетные данные: {"session": "<номер сессии>"} или {"token": "<секрет API-токена>"};
+// сервер отвечает строкой {"success": true, "user": {...}}, при ошибке - {"success": false, "error": "..."}
+// и закрывает подключение. Дальше каждая строка клиента - запрос протокола, каждая строка сервера - сообщение.
+
+const (
+	AuthTimeout = 10 * time.Second
+	WriteTimeout = 10 * time.Second
+	MaxLineSize = 1 << 20
+)
+
+type Credentials struct {
+	Session string `json:"session"`
+	Token string `json:"token"`
+}
+
+type authResponseRec struct {
+	Success bool `json:"success"`
+	User interface {} `json:"user,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+type connRec struct {
+	nc net.Conn
+	scanner *bufio.Scanner
+	id, userId int
+	scope access.Scope
+
+	writeLock sync.Mutex // записи в соединение по одной
+	alive int32
+}
+
+// подключение до проверки учетных данных
+func New (nc net.Conn) *connRec {
+	scanner := bufio.NewScanner(nc)
+	scanner.Buffer(make([]byte, 0, 4096), MaxLineSize)
+	return &connRec {nc: nc, scanner: scanner, alive: 1}
+}
+
+// читает первую строку не дольше AuthTimeout
+func (c *connRec) ReadCredentials () (Credentials, error) {
+	result := Credentials {}
+	c.nc.SetReadDeadline(time.Now().Add(AuthTimeout))
+	defer c.nc.SetReadDeadline(time.Time {})
+
+	if !c.scanner.Scan() {
+		e := c.scanner.Err()
+		if e == nil {
+			e = net.ErrClosed
+		}
+		return result, e
+	}
+
+	e := json.Unmarshal(c.scanner.Bytes(), &result)
+	return result, e
+}
+
+// сообщает об ошибке входа и закрывает подключение
+func (c *connRec) Reject (e error) {
+	c.writeJson(authResponseRec {false, nil, e.Error()})
+	c.Close()
+}
+
+func (c *connRec) Accept (id, userId int, scope access.Scope, user interface {}) {
+	c.id = id
+	c.userId = userId
+	c.scope = scope
+	c.writeJson(authResponseRec {true, user, ""})
+}
+
+// передает строки протоколу до разрыва связи, после чего отключает подключение от протокола
+func (c *connRec) Serve (p proto.Proto) {
+	for c.scanner.Scan() {
+		line := c.scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+
+		p.TakeRequest(c, append([]byte(nil), line...))
+	}
+
+	if e := c.scanner.Err(); e != nil && c.IsAlive() {
+		log.Printf("u%dc%d (%s) %s\n", c.userId, c.id, c.nc.RemoteAddr(), e.Error())
+	}
+	c.Close()
+	p.Disconnect(c.id)
+}
+
+func (c *connRec) writeJson (v interface {}) {
+	data, e := json.Marshal(v)
+	if e == nil {
+		c.Send(data)
+	}
+}
+
+func (c *connRec) Id () int {
+	return c.id
+}
+
+func (c *connRec) UserId () int {
+	return c.userId
+}
+
+func (c *connRec) Scope () access.Scope {
+	return c.scope
+}
+
+func (c *connRec) Send (m []byte) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	if !c.IsAlive() {
+		return
+	}
+
+	c.nc.SetWriteDeadline(time.Now().Add(WriteTimeout))
+	_, e := c.nc.Write(append(append(make([]byte, 0, len(m) + 1), m...), '\n'))
+	if e != nil {
+		log.Printf("u%dc%d (%s) %s\n", c.userId, c.id, c.nc.RemoteAddr(), e.Error())
+		c.Close()
+	}
+}
+
+// не ждет завершения текущей записи: закрытое соединение прерывает ее
+func (c *connRec) Close () {
+	if atomic.CompareAndSwapInt32(&c.alive, 1, 0) {
+		c.nc.Close()
+	}
+}
+
+func (c *connRec) IsAlive () bool {
+	return (atomic.LoadInt32(&c.alive) != 0)
+}
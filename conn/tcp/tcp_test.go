@@ -0,0 +1,151 @@
+package tcp
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ava12/go-chat/access"
+	"github.com/ava12/go-chat/conn"
+)
+
+type testProto struct {
+	requests chan string
+	disconnects chan int
+}
+
+func newTestProto () *testProto {
+	return &testProto {make(chan string, 10), make(chan int, 10)}
+}
+
+func (p *testProto) Connect (c conn.Conn) {}
+
+func (p *testProto) Disconnect (connId int) {
+	p.disconnects <- connId
+}
+
+func (p *testProto) Stop () {}
+
+func (p *testProto) TakeRequest (c conn.Conn, r []byte) {
+	p.requests <- string(r)
+}
+
+// серверная сторона и клиентское соединение; net.Pipe синхронный, запись ждет чтения
+func newPipe (t *testing.T) (*connRec, net.Conn, *bufio.Reader) {
+	server, client := net.Pipe()
+	t.Cleanup(func () {
+		server.Close()
+		client.Close()
+	})
+	return New(server), client, bufio.NewReader(client)
+}
+
+func readLine (t *testing.T, r *bufio.Reader) string {
+	t.Helper()
+	line, e := r.ReadString('\n')
+	if e != nil {
+		t.Fatal(e)
+	}
+	return line
+}
+
+func TestReadCredentials (t *testing.T) {
+	c, client, _ := newPipe(t)
+	go io.WriteString(client, "{\"token\": \"secret\"}\n")
+
+	cred, e := c.ReadCredentials()
+	if e != nil || cred.Token != "secret" || cred.Session != "" {
+		t.Fatalf("unexpected credentials: %+v, %v", cred, e)
+	}
+
+	c, client, _ = newPipe(t)
+	go io.WriteString(client, "not json\n")
+	if _, e = c.ReadCredentials(); e == nil {
+		t.Fatal("bad credentials accepted")
+	}
+}
+
+func TestReject (t *testing.T) {
+	c, _, reader := newPipe(t)
+	go c.Reject(errors.New("nope"))
+
+	if line := readLine(t, reader); line != "{\"success\":false,\"error\":\"nope\"}\n" {
+		t.Fatalf("unexpected reject line %q", line)
+	}
+	if _, e := reader.ReadString('\n'); e != io.EOF {
+		t.Fatalf("connection is not closed after reject: %v", e)
+	}
+	if c.IsAlive() {
+		t.Fatal("rejected connection is alive")
+	}
+}
+
+func TestServe (t *testing.T) {
+	c, client, reader := newPipe(t)
+	p := newTestProto()
+	go c.Accept(3, 7, access.FullScope, map[string]int {"id": 7})
+
+	if line := readLine(t, reader); line != "{\"success\":true,\"user\":{\"id\":7}}\n" {
+		t.Fatalf("unexpected accept line %q", line)
+	}
+	if c.Id() != 3 || c.UserId() != 7 {
+		t.Fatalf("unexpected connection ids: %d %d", c.Id(), c.UserId())
+	}
+
+	served := make(chan bool)
+	go func () {
+		c.Serve(p)
+		close(served)
+	}()
+
+	io.WriteString(client, "{\"a\":1}\n\n{\"b\":2}\n")
+	for _, expected := range []string {"{\"a\":1}", "{\"b\":2}"} {
+		if m := <-p.requests; m != expected {
+			t.Fatalf("expecting request %q, got %q", expected, m)
+		}
+	}
+
+	go c.Send([]byte("{\"c\":3}"))
+	if line := readLine(t, reader); line != "{\"c\":3}\n" {
+		t.Fatalf("unexpected message line %q", line)
+	}
+
+	client.Close()
+	select {
+	case <-served:
+	case <-time.After(time.Second):
+		t.Fatal("Serve did not return after disconnect")
+	}
+	if id := <-p.disconnects; id != 3 || c.IsAlive() {
+		t.Fatalf("unexpected disconnect: c%d, alive %v", id, c.IsAlive())
+	}
+}
+
+func TestCloseDuringWrite (t *testing.T) {
+	c, _, _ := newPipe(t)
+
+	// клиент не читает, запись висит до закрытия соединения
+	sent := make(chan bool)
+	go func () {
+		c.Send([]byte("{}"))
+		close(sent)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	closed := make(chan bool)
+	go func () {
+		c.Close()
+		close(closed)
+	}()
+
+	for _, ch := range []chan bool {closed, sent} {
+		select {
+		case <-ch:
+		case <-time.After(time.Second):
+			t.Fatal("Close blocked by pending write")
+		}
+	}
+}
@@ -2,13 +2,79 @@ package ws
 
 import (
 	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 	"github.com/gorilla/websocket"
+	"github.com/ava12/go-chat/access"
+	"github.com/ava12/go-chat/config"
 	"github.com/ava12/go-chat/proto"
 )
 
+// Все записи в соединение, кроме кадра закрытия, делает одна горутина-писатель: сообщения берутся из очереди,
+// между ними каждые PingPeriod отправляется ping. Клиент, не ответивший на ping за PongWait и не приславший
+// за это время ни одного сообщения, считается отключившимся. Переполнение очереди (клиент не успевает читать)
+// тоже закрывает подключение.
+
+const configSection = "Websocket"
+
+type Options struct {
+	PingPeriod time.Duration
+	PongWait time.Duration // больше PingPeriod
+	WriteWait time.Duration // предельное время записи одного сообщения
+	MaxMessageSize int64 // для сообщений клиента
+	QueueLen int
+}
+
+var DefaultOptions = Options {
+	PingPeriod: 30 * time.Second,
+	PongWait: 60 * time.Second,
+	WriteWait: 10 * time.Second,
+	MaxMessageSize: 1 << 20,
+	QueueLen: 256,
+}
+
+// секция Websocket файла настроек, времена в секундах
+type Conf struct {
+	PingPeriod int
+	PongTimeout int
+	WriteTimeout int
+	MaxMessageSize int64
+	QueueLen int
+}
+
+func ReadConf (c *config.Config) (Conf, error) {
+	d := DefaultOptions
+	result := Conf {
+		PingPeriod: int(d.PingPeriod / time.Second),
+		PongTimeout: int(d.PongWait / time.Second),
+		WriteTimeout: int(d.WriteWait / time.Second),
+		MaxMessageSize: d.MaxMessageSize,
+		QueueLen: d.QueueLen,
+	}
+	e := c.Section(configSection, &result)
+	if e == nil && (result.PingPeriod <= 0 || result.PongTimeout <= result.PingPeriod || result.WriteTimeout <= 0 ||
+		result.MaxMessageSize <= 0 || result.QueueLen <= 0) {
+		e = fmt.Errorf("bad websocket settings: %+v", result)
+	}
+	return result, e
+}
+
+func (c Conf) Options () Options {
+	return Options {
+		PingPeriod: time.Duration(c.PingPeriod) * time.Second,
+		PongWait: time.Duration(c.PongTimeout) * time.Second,
+		WriteWait: time.Duration(c.WriteTimeout) * time.Second,
+		MaxMessageSize: c.MaxMessageSize,
+		QueueLen: c.QueueLen,
+	}
+}
+
+var QueueOverflow = errors.New("websocket send queue overflow")
+
 var upgrader = websocket.Upgrader {
 	HandshakeTimeout: 5 * time.Second,
 	ReadBufferSize: 1024,
@@ -19,37 +85,107 @@ type connRec struct {
 	c *websocket.Conn
 	remoteAddr string
 	id, userId int
-	alive bool
+	scope access.Scope
+	opts Options
+
+	queue chan []byte
+	done chan bool // закрывается при закрытии подключения
+	closeOnce sync.Once
+	alive int32
 }
 
-func New (w http.ResponseWriter, r *http.Request, p proto.Proto, id, userId int) (*connRec, error) {
+// подключение до запуска Serve
+func New (w http.ResponseWriter, r *http.Request, id, userId int, scope access.Scope, opts Options) (*connRec, error) {
 	c, e := upgrader.Upgrade(w, r, nil)
 	if e != nil {
 		return nil, e
 	}
 
-	conn := &connRec {c, r.RemoteAddr, id, userId, true}
-	p.Connect(conn)
+	conn := &connRec {
+		c: c,
+		remoteAddr: r.RemoteAddr,
+		id: id,
+		userId: userId,
+		scope: scope,
+		opts: opts,
+		queue: make(chan []byte, opts.QueueLen),
+		done: make(chan bool),
+		alive: 1,
+	}
+	return conn, nil
+}
 
-	go func () {
-		for conn.alive {
-			t, m, e := c.ReadMessage()
-			if e == nil && t != websocket.TextMessage {
-				e = errors.New("wrong WS message type")
+// передает сообщения протоколу до разрыва связи, после чего отключает подключение от протокола
+func (c *connRec) Serve (p proto.Proto) {
+	c.c.SetReadLimit(c.opts.MaxMessageSize)
+	c.extendDeadline()
+	c.c.SetPongHandler(func (string) error {
+		c.extendDeadline()
+		return nil
+	})
+	go c.goWrite()
+
+	for {
+		t, m, e := c.c.ReadMessage()
+		if e == nil && t != websocket.TextMessage {
+			e = errors.New("wrong WS message type")
+		}
+		if e != nil {
+			if c.IsAlive() && !websocket.IsCloseError(e, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				c.log(e)
 			}
+			break
+		}
+
+		c.extendDeadline()
+		p.TakeRequest(c, m)
+	}
+
+	c.Close()
+	p.Disconnect(c.id)
+}
+
+func (c *connRec) extendDeadline () {
+	c.c.SetReadDeadline(time.Now().Add(c.opts.PongWait))
+}
+
+func (c *connRec) goWrite () {
+	ticker := time.NewTicker(c.opts.PingPeriod)
+	defer func () {
+		ticker.Stop()
+		c.c.Close()
+	}()
+
+	for {
+		select {
+		case m := <-c.queue:
+			c.c.SetWriteDeadline(time.Now().Add(c.opts.WriteWait))
+			e := c.c.WriteMessage(websocket.TextMessage, m)
 			if e != nil {
-				conn.alive = false
-				log.Printf("u%dc%d (%s) %s\n", conn.userId, conn.id, conn.remoteAddr, e.Error())
-				break
+				c.log(e)
+				c.Close()
+				return
 			}
 
-			p.TakeRequest(conn, m)
-		}
+		case <-ticker.C:
+			c.c.SetWriteDeadline(time.Now().Add(c.opts.WriteWait))
+			e := c.c.WriteMessage(websocket.PingMessage, nil)
+			if e != nil {
+				c.log(e)
+				c.Close()
+				return
+			}
 
-		p.Disconnect(conn.id)
-	}()
+		case <-c.done:
+			m := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+			c.c.WriteControl(websocket.CloseMessage, m, time.Now().Add(c.opts.WriteWait))
+			return
+		}
+	}
+}
 
-	return conn, nil
+func (c *connRec) log (e error) {
+	log.Printf("u%dc%d (%s) %s\n", c.userId, c.id, c.remoteAddr, e.Error())
 }
 
 func (c *connRec) Id () int {
@@ -60,24 +196,32 @@ func (c *connRec) UserId () int {
 	return c.userId
 }
 
+func (c *connRec) Scope () access.Scope {
+	return c.scope
+}
+
+// ставит сообщение в очередь писателя; при переполненной очереди закрывает подключение
 func (c *connRec) Send (m []byte) {
-	if !c.alive {
+	if !c.IsAlive() {
 		return
 	}
 
-	e := c.c.WriteMessage(websocket.TextMessage, m)
-	if e != nil {
-		log.Println(e)
+	select {
+	case c.queue <- m:
+	default:
+		c.log(QueueOverflow)
 		c.Close()
 	}
 }
 
+// писатель отправляет кадр закрытия и закрывает соединение, читатель после этого завершает Serve
 func (c *connRec) Close () {
-	c.alive = false
-	c.c.Close()
-	c.c = nil
+	c.closeOnce.Do(func () {
+		atomic.StoreInt32(&c.alive, 0)
+		close(c.done)
+	})
 }
 
 func (c *connRec) IsAlive () bool {
-	return c.alive
+	return (atomic.LoadInt32(&c.alive) != 0)
 }
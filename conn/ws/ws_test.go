@@ -0,0 +1,199 @@
+package ws
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/ava12/go-chat/access"
+	"github.com/ava12/go-chat/conn"
+)
+
+var testOptions = Options {
+	PingPeriod: 20 * time.Millisecond,
+	PongWait: 100 * time.Millisecond,
+	WriteWait: time.Second,
+	MaxMessageSize: 64,
+	QueueLen: 4,
+}
+
+// отвечает на каждый запрос тем же сообщением
+type protoRec struct {
+	requests chan string
+	disconnected chan int
+}
+
+func newProto () *protoRec {
+	return &protoRec {make(chan string, 16), make(chan int, 1)}
+}
+
+func (p *protoRec) Connect (c conn.Conn) {}
+
+func (p *protoRec) Disconnect (connId int) {
+	p.disconnected <- connId
+}
+
+func (p *protoRec) Stop () {}
+
+func (p *protoRec) TakeRequest (c conn.Conn, r []byte) {
+	p.requests <- string(r)
+	c.Send(r)
+}
+
+// сервер с одним подключением; serve - запускать ли Serve
+func startServer (t *testing.T, p *protoRec, opts Options, serve bool) (*websocket.Conn, <-chan *connRec) {
+	conns := make(chan *connRec, 1)
+	server := httptest.NewServer(http.HandlerFunc(func (w http.ResponseWriter, r *http.Request) {
+		c, e := New(w, r, 1, 2, access.FullScope, opts)
+		if e != nil {
+			t.Error(e)
+			return
+		}
+
+		conns <- c
+		if serve {
+			c.Serve(p)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	client, _, e := websocket.DefaultDialer.Dial("ws" + strings.TrimPrefix(server.URL, "http"), nil)
+	if e != nil {
+		t.Fatal(e)
+	}
+	t.Cleanup(func () {
+		client.Close()
+	})
+	return client, conns
+}
+
+func waitDisconnect (t *testing.T, p *protoRec) {
+	select {
+	case <-p.disconnected:
+	case <-time.After(2 * time.Second):
+		t.Fatal("connection is not disconnected")
+	}
+}
+
+func TestEchoAndPing (t *testing.T) {
+	p := newProto()
+	client, _ := startServer(t, p, testOptions, true)
+
+	pings := make(chan bool, 16)
+	client.SetPingHandler(func (data string) error {
+		pings <- true
+		return client.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+	})
+
+	client.WriteMessage(websocket.TextMessage, []byte("hello"))
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, m, e := client.ReadMessage()
+	if e != nil || string(m) != "hello" {
+		t.Fatalf("got %q, %v", m, e)
+	}
+
+	// клиент отвечает на ping и потому остается подключенным дольше PongWait
+	deadline := time.Now().Add(3 * testOptions.PongWait)
+	go func () {
+		for {
+			if _, _, e := client.ReadMessage(); e != nil {
+				return
+			}
+		}
+	}()
+	for time.Now().Before(deadline) {
+		select {
+		case <-p.disconnected:
+			t.Fatal("live client is disconnected")
+		case <-pings:
+		case <-time.After(testOptions.PongWait):
+			t.Fatal("no pings")
+		}
+	}
+}
+
+func TestDeadPeer (t *testing.T) {
+	p := newProto()
+	startServer(t, p, testOptions, true)
+
+	// клиент не читает и потому не отвечает на ping
+	waitDisconnect(t, p)
+}
+
+func TestMessageSizeLimit (t *testing.T) {
+	p := newProto()
+	client, conns := startServer(t, p, testOptions, true)
+	c := <-conns
+
+	client.WriteMessage(websocket.TextMessage, make([]byte, testOptions.MaxMessageSize + 1))
+	waitDisconnect(t, p)
+	if c.IsAlive() {
+		t.Fatal("connection is alive")
+	}
+	if len(p.requests) != 0 {
+		t.Fatal("oversized message is accepted")
+	}
+}
+
+func TestQueueOverflow (t *testing.T) {
+	p := newProto()
+	_, conns := startServer(t, p, testOptions, false)
+	c := <-conns
+
+	// писатель не запущен, очередь не разбирается
+	for i := 0; i < testOptions.QueueLen; i++ {
+		c.Send([]byte("m"))
+	}
+	if !c.IsAlive() {
+		t.Fatal("connection is closed before overflow")
+	}
+
+	c.Send([]byte("m"))
+	if c.IsAlive() {
+		t.Fatal("connection is alive after overflow")
+	}
+	c.c.Close()
+}
+
+func TestConcurrentSendAndClose (t *testing.T) {
+	p := newProto()
+	opts := testOptions
+	opts.QueueLen = 1024
+	client, conns := startServer(t, p, opts, true)
+	c := <-conns
+
+	go func () {
+		for {
+			if _, _, e := client.ReadMessage(); e != nil {
+				return
+			}
+		}
+	}()
+
+	wg := sync.WaitGroup {}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func (i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				c.Send([]byte("message"))
+				if i == 0 && j == 25 {
+					c.Close()
+				}
+				c.IsAlive()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	c.Close()
+	c.Send([]byte("after close"))
+	waitDisconnect(t, p)
+	if c.IsAlive() {
+		t.Fatal("connection is alive after Close")
+	}
+}
@@ -0,0 +1,12 @@
+package cursor
+
+// Позиции прочтения: номер последнего прочитанного пользователем сообщения в комнате.
+// Позиция только растет; 0 - пользователь ничего в комнате не читал.
+
+type Registry interface {
+	Cursor (userId, roomId int) (int, error)
+	// false, если позиция не сдвинулась (новая не больше текущей)
+	SetCursor (userId, roomId, messageId int) (bool, error)
+	RoomCursors (roomId int) (map[int]int, error) // {userId: messageId}
+	DeleteRoom (roomId int) error
+}
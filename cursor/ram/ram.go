@@ -0,0 +1,65 @@
+package ram
+
+import (
+	"sync"
+
+	"github.com/ava12/go-chat/cursor"
+)
+
+type keyRec struct {
+	userId, roomId int
+}
+
+type memRegistryRec struct {
+	lock sync.RWMutex
+	cursors map[keyRec]int
+}
+
+func NewRegistry () cursor.Registry {
+	return &memRegistryRec {cursors: make(map[keyRec]int)}
+}
+
+func (mrr *memRegistryRec) Cursor (userId, roomId int) (int, error) {
+	mrr.lock.RLock()
+	defer mrr.lock.RUnlock()
+
+	return mrr.cursors[keyRec {userId, roomId}], nil
+}
+
+func (mrr *memRegistryRec) SetCursor (userId, roomId, messageId int) (bool, error) {
+	mrr.lock.Lock()
+	defer mrr.lock.Unlock()
+
+	key := keyRec {userId, roomId}
+	if messageId <= mrr.cursors[key] {
+		return false, nil
+	}
+
+	mrr.cursors[key] = messageId
+	return true, nil
+}
+
+func (mrr *memRegistryRec) RoomCursors (roomId int) (map[int]int, error) {
+	mrr.lock.RLock()
+	defer mrr.lock.RUnlock()
+
+	result := make(map[int]int)
+	for key, messageId := range mrr.cursors {
+		if key.roomId == roomId {
+			result[key.userId] = messageId
+		}
+	}
+	return result, nil
+}
+
+func (mrr *memRegistryRec) DeleteRoom (roomId int) error {
+	mrr.lock.Lock()
+	defer mrr.lock.Unlock()
+
+	for key := range mrr.cursors {
+		if key.roomId == roomId {
+			delete(mrr.cursors, key)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package sqldb
+
+import (
+	"database/sql"
+	"sync"
+
+	"github.com/ava12/go-chat/cursor"
+	"github.com/ava12/go-chat/db"
+)
+
+const component = "cursors"
+
+var migrations = []string {
+	`CREATE TABLE read_cursors (
+		user_id INTEGER NOT NULL,
+		room_id INTEGER NOT NULL,
+		message_id INTEGER NOT NULL,
+		PRIMARY KEY (user_id, room_id)
+	)`,
+}
+
+type registryRec struct {
+	lock sync.Mutex
+	db *db.DB
+}
+
+func NewRegistry (d *db.DB) (cursor.Registry, error) {
+	e := d.Migrate(component, migrations)
+	if e != nil {
+		return nil, e
+	}
+
+	return &registryRec {db: d}, nil
+}
+
+func (r *registryRec) Cursor (userId, roomId int) (int, error) {
+	var result int
+	e := r.db.QueryRow("SELECT message_id FROM read_cursors WHERE user_id = ? AND room_id = ?", userId, roomId).Scan(&result)
+	if e == sql.ErrNoRows {
+		e = nil
+	}
+	return result, e
+}
+
+func (r *registryRec) SetCursor (userId, roomId, messageId int) (bool, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	current, e := r.Cursor(userId, roomId)
+	if e != nil || messageId <= current {
+		return false, e
+	}
+
+	if current == 0 {
+		_, e = r.db.Exec("INSERT INTO read_cursors (user_id, room_id, message_id) VALUES (?, ?, ?)", userId, roomId, messageId)
+	} else {
+		_, e = r.db.Exec("UPDATE read_cursors SET message_id = ? WHERE user_id = ? AND room_id = ?", messageId, userId, roomId)
+	}
+	return (e == nil), e
+}
+
+func (r *registryRec) RoomCursors (roomId int) (map[int]int, error) {
+	result := make(map[int]int)
+	rows, e := r.db.Query("SELECT user_id, message_id FROM read_cursors WHERE room_id = ?", roomId)
+	if e != nil {
+		return result, e
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var uid, mid int
+		e = rows.Scan(&uid, &mid)
+		if e != nil {
+			return result, e
+		}
+
+		result[uid] = mid
+	}
+
+	return result, rows.Err()
+}
+
+func (r *registryRec) DeleteRoom (roomId int) error {
+	_, e := r.db.Exec("DELETE FROM read_cursors WHERE room_id = ?", roomId)
+	return e
+}
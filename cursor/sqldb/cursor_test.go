@@ -0,0 +1,39 @@
+package sqldb_test
+
+import (
+	"testing"
+
+	"github.com/ava12/go-chat/db/dbtest"
+	cursorsql "github.com/ava12/go-chat/cursor/sqldb"
+)
+
+func TestCursorRegistry (t *testing.T) {
+	r, e := cursorsql.NewRegistry(dbtest.Open(t))
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	for _, step := range []struct {
+		messageId int
+		moved bool
+	} {{5, true}, {3, false}, {5, false}, {8, true}} {
+		moved, e := r.SetCursor(1, 2, step.messageId)
+		if e != nil || moved != step.moved {
+			t.Fatalf("set cursor to %d: got %v %v", step.messageId, moved, e)
+		}
+	}
+	r.SetCursor(3, 2, 4)
+	r.SetCursor(1, 7, 1)
+
+	if c, e := r.Cursor(1, 2); c != 8 || e != nil {
+		t.Fatalf("unexpected cursor: %d %v", c, e)
+	}
+	if c, e := r.Cursor(3, 7); c != 0 || e != nil {
+		t.Fatalf("unexpected missing cursor: %d %v", c, e)
+	}
+
+	cursors, e := r.RoomCursors(2)
+	if e != nil || len(cursors) != 2 || cursors[1] != 8 || cursors[3] != 4 {
+		t.Fatalf("unexpected room cursors: %v %v", cursors, e)
+	}
+}
@@ -0,0 +1,206 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/ava12/go-chat/config"
+)
+
+// Общее подключение к реляционной БД для sqldb-реализаций хранилищ.
+// Запросы пишутся с плейсхолдерами вида "?", для драйверов PostgreSQL они заменяются на "$N".
+
+const (
+	configSection = "Database"
+
+	versionTable = "schema_versions"
+	sequenceTable = "id_sequences"
+
+	nextIdAttempts = 3
+)
+
+// счетчики номеров для NextId
+var sequenceMigrations = []string {
+	`CREATE TABLE ` + sequenceTable + ` (
+		name VARCHAR(64) NOT NULL PRIMARY KEY,
+		last_id INTEGER NOT NULL
+	)`,
+}
+
+type conf struct {
+	Driver string
+	Dsn    string
+}
+
+type DB struct {
+	*sql.DB
+	Driver string
+}
+
+func New (c *config.Config) (*DB, error) {
+	sect := conf {}
+	e := c.Section(configSection, &sect)
+	if e != nil {
+		return nil, e
+	}
+
+	if sect.Driver == "" {
+		return nil, errors.New("no database driver configured")
+	}
+
+	return Open(sect.Driver, sect.Dsn)
+}
+
+func Open (driver, dsn string) (*DB, error) {
+	d, e := sql.Open(driver, dsn)
+	if e != nil {
+		return nil, e
+	}
+
+	e = d.Ping()
+	if e != nil {
+		d.Close()
+		return nil, e
+	}
+
+	result := &DB {d, driver}
+	e = result.Migrate("db", sequenceMigrations)
+	if e != nil {
+		d.Close()
+		return nil, e
+	}
+
+	return result, nil
+}
+
+// заменяет плейсхолдеры "?" на принятые у драйвера
+func (d *DB) Rebind (query string) string {
+	if d.Driver != "postgres" && d.Driver != "pgx" {
+		return query
+	}
+
+	parts := strings.Split(query, "?")
+	var b strings.Builder
+	b.WriteString(parts[0])
+	for i, part := range parts[1:] {
+		b.WriteString("$" + strconv.Itoa(i + 1))
+		b.WriteString(part)
+	}
+	return b.String()
+}
+
+func (d *DB) Exec (query string, args ... interface {}) (sql.Result, error) {
+	return d.DB.Exec(d.Rebind(query), args...)
+}
+
+func (d *DB) Query (query string, args ... interface {}) (*sql.Rows, error) {
+	return d.DB.Query(d.Rebind(query), args...)
+}
+
+func (d *DB) QueryRow (query string, args ... interface {}) *sql.Row {
+	return d.DB.QueryRow(d.Rebind(query), args...)
+}
+
+// выполняет еще не примененные шаги миграции схемы для компонента;
+// шаг i (начиная с 1) применяется один раз, номер последнего примененного хранится в schema_versions
+func (d *DB) Migrate (component string, steps []string) error {
+	_, e := d.Exec("CREATE TABLE IF NOT EXISTS " + versionTable +
+		" (component VARCHAR(64) NOT NULL PRIMARY KEY, version INTEGER NOT NULL)")
+	if e != nil {
+		return e
+	}
+
+	version := 0
+	e = d.QueryRow("SELECT version FROM " + versionTable + " WHERE component = ?", component).Scan(&version)
+	if e == sql.ErrNoRows {
+		_, e = d.Exec("INSERT INTO " + versionTable + " (component, version) VALUES (?, 0)", component)
+	}
+	if e != nil {
+		return e
+	}
+
+	for version < len(steps) {
+		e = d.migrateStep(component, version + 1, steps[version])
+		if e != nil {
+			return fmt.Errorf("%s schema, step %d: %s", component, version + 1, e.Error())
+		}
+
+		version++
+	}
+
+	return nil
+}
+
+func (d *DB) migrateStep (component string, version int, step string) error {
+	tx, e := d.Begin()
+	if e != nil {
+		return e
+	}
+
+	for _, query := range strings.Split(step, ";") {
+		if strings.TrimSpace(query) == "" {
+			continue
+		}
+
+		_, e = tx.Exec(query)
+		if e != nil {
+			tx.Rollback()
+			return e
+		}
+	}
+
+	_, e = tx.Exec(d.Rebind("UPDATE " + versionTable + " SET version = ? WHERE component = ?"), version, component)
+	if e != nil {
+		tx.Rollback()
+		return e
+	}
+
+	return tx.Commit()
+}
+
+// выдает следующий номер для таблицы; номера не повторяются, даже если строки удалены,
+// и не совпадают у разных процессов и подключений: счетчик увеличивается в транзакции.
+// Счетчик заводится при первом обращении, начиная с наибольшего id в таблице
+func (d *DB) NextId (table string) (int, error) {
+	var id int
+	var e error
+	// первое обращение из нескольких подключений сразу может столкнуться на вставке счетчика
+	for i := 0; i < nextIdAttempts; i++ {
+		id, e = d.nextId(table)
+		if e == nil {
+			break
+		}
+	}
+	return id, e
+}
+
+func (d *DB) nextId (table string) (int, error) {
+	tx, e := d.Begin()
+	if e != nil {
+		return 0, e
+	}
+	defer tx.Rollback()
+
+	res, e := tx.Exec(d.Rebind("UPDATE " + sequenceTable + " SET last_id = last_id + 1 WHERE name = ?"), table)
+	if e != nil {
+		return 0, e
+	}
+
+	n, e := res.RowsAffected()
+	if e == nil && n == 0 {
+		_, e = tx.Exec(d.Rebind("INSERT INTO " + sequenceTable + " (name, last_id) SELECT ?, COALESCE(MAX(id), 0) + 1 FROM " + table), table)
+	}
+	if e != nil {
+		return 0, e
+	}
+
+	var id int
+	e = tx.QueryRow(d.Rebind("SELECT last_id FROM " + sequenceTable + " WHERE name = ?"), table).Scan(&id)
+	if e == nil {
+		e = tx.Commit()
+	}
+	return id, e
+}
@@ -0,0 +1,103 @@
+package db_test
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/ava12/go-chat/db"
+	"github.com/ava12/go-chat/db/dbtest"
+)
+
+func TestMigrate (t *testing.T) {
+	d := dbtest.Open(t)
+	steps := []string {
+		"CREATE TABLE t1 (id INTEGER NOT NULL PRIMARY KEY)",
+		"CREATE TABLE t2 (id INTEGER NOT NULL PRIMARY KEY); INSERT INTO t2 (id) VALUES (1)",
+	}
+
+	for i := 0; i < 2; i++ {
+		e := d.Migrate("test", steps)
+		if e != nil {
+			t.Fatal(e)
+		}
+	}
+
+	var cnt int
+	e := d.QueryRow("SELECT COUNT(*) FROM t2").Scan(&cnt)
+	if e != nil || cnt != 1 {
+		t.Fatalf("migration applied incorrectly: %d rows, %v", cnt, e)
+	}
+
+	e = d.Migrate("test", append(steps, "bogus statement"))
+	if e == nil {
+		t.Fatal("broken migration step accepted")
+	}
+}
+
+func TestRebind (t *testing.T) {
+	d := &db.DB {Driver: "pgx"}
+	if q := d.Rebind("a = ? AND b = ?"); q != "a = $1 AND b = $2" {
+		t.Fatalf("unexpected rebind: %s", q)
+	}
+
+	d.Driver = dbtest.Driver
+	if q := d.Rebind("a = ?"); q != "a = ?" {
+		t.Fatalf("unexpected rebind: %s", q)
+	}
+}
+
+func TestNextId (t *testing.T) {
+	d := dbtest.Open(t)
+	e := d.Migrate("test", []string {
+		"CREATE TABLE items (id INTEGER NOT NULL PRIMARY KEY); INSERT INTO items (id) VALUES (5)",
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	id, e := d.NextId("items")
+	if e != nil || id != 6 {
+		t.Fatalf("expecting id 6, got %d, %v", id, e)
+	}
+
+	// удаленные номера не выдаются повторно
+	_, e = d.Exec("DELETE FROM items")
+	if e != nil {
+		t.Fatal(e)
+	}
+	id, e = d.NextId("items")
+	if e != nil || id != 7 {
+		t.Fatalf("expecting id 7, got %d, %v", id, e)
+	}
+
+	const cnt = 20
+	ids := make(chan int, cnt)
+	errs := make(chan error, cnt)
+	var wg sync.WaitGroup
+	for i := 0; i < cnt; i++ {
+		wg.Add(1)
+		go func () {
+			defer wg.Done()
+			id, e := d.NextId("items")
+			if e != nil {
+				errs <- e
+			} else {
+				ids <- id
+			}
+		}()
+	}
+	wg.Wait()
+	close(ids)
+	close(errs)
+
+	for e := range errs {
+		t.Fatal(e)
+	}
+	seen := make(map[int]bool)
+	for id := range ids {
+		if seen[id] || id <= 7 || id > 7 + cnt {
+			t.Fatalf("bad or duplicate id %d", id)
+		}
+		seen[id] = true
+	}
+}
@@ -0,0 +1,26 @@
+// временная база SQLite для тестов sqldb-хранилищ
+package dbtest
+
+import (
+	"path/filepath"
+	"testing"
+
+	_ "github.com/glebarez/go-sqlite"
+
+	"github.com/ava12/go-chat/db"
+)
+
+const Driver = "sqlite"
+
+// открывает пустую базу во временном каталоге теста, закрывается по завершении теста
+func Open (t *testing.T) *db.DB {
+	d, e := db.Open(Driver, filepath.Join(t.TempDir(), "chat.db") + "?_pragma=busy_timeout(5000)")
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	t.Cleanup(func () {
+		d.Close()
+	})
+	return d
+}
@@ -0,0 +1,755 @@
+package file
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ava12/go-chat/config"
+	"github.com/ava12/go-chat/hub"
+)
+
+// Хранилище сообщений на диске.
+// Для каждой комнаты ведется отдельный каталог с журналом, разбитым на сегменты.
+// Журнал только дописывается: сохранение и изменение сообщения добавляют полную запись,
+// актуальной считается последняя запись с данным номером сообщения, предыдущие образуют историю правок.
+// У удаленного сообщения истории нет: прежние записи остаются в сегментах до удаления комнаты, но не читаются.
+// Формат записи: длина данных (4 байта), CRC32 данных (4 байта), данные (JSON).
+// При открытии недописанная или поврежденная запись в конце последнего сегмента отбрасывается.
+
+const (
+	configSection = "FileStorage"
+
+	SyncAlways   = "always"   // fsync после каждой операции
+	SyncPeriodic = "periodic" // fsync не реже раза в SyncPeriod
+	SyncNever    = "never"    // на усмотрение ОС
+
+	DefaultDir         = "messages"
+	DefaultSegmentSize = 4 << 20
+	DefaultSync        = SyncPeriodic
+	DefaultSyncPeriod  = time.Second
+
+	segmentExt    = ".seg"
+	headerSize    = 8
+	maxRecordSize = 16 << 20
+)
+
+type conf struct {
+	Dir         string
+	SegmentSize int64
+	Sync        string
+	SyncPeriod  int // миллисекунды
+}
+
+type recordRec struct {
+	MessageId     int             `json:"messageId"`
+	UserId        int             `json:"userId"`
+	Timestamp     int             `json:"timestamp"`
+	EditTimestamp int             `json:"editTimestamp,omitempty"`
+	EditorId      int             `json:"editorId,omitempty"`
+	Deleted       bool            `json:"deleted,omitempty"`
+	Data          json.RawMessage `json:"data"`
+}
+
+type posRec struct {
+	segment int
+	offset  int64
+	size    int
+}
+
+type segmentRec struct {
+	num  int
+	f    *os.File
+	size int64
+}
+
+type roomRec struct {
+	dir      string
+	segments []*segmentRec
+	index    []posRec // index[MessageId - 1]
+	history  map[int][]posRec // прежние версии измененных сообщений
+	dirty    bool
+}
+
+type Storage struct {
+	lock        sync.RWMutex
+	dir         string
+	segmentSize int64
+	sync        string
+	rooms       map[int]*roomRec
+
+	stopSignal chan bool
+	syncGroup  sync.WaitGroup
+}
+
+var Closed error = errors.New("message storage is closed")
+
+func New (c *config.Config) (*Storage, error) {
+	sect := conf {
+		Dir:         DefaultDir,
+		SegmentSize: DefaultSegmentSize,
+		Sync:        DefaultSync,
+		SyncPeriod:  int(DefaultSyncPeriod / time.Millisecond),
+	}
+	e := c.Section(configSection, &sect)
+	if e != nil {
+		return nil, e
+	}
+
+	return Open(sect.Dir, sect.SegmentSize, sect.Sync, time.Duration(sect.SyncPeriod) * time.Millisecond)
+}
+
+func Open (dir string, segmentSize int64, syncPolicy string, syncPeriod time.Duration) (*Storage, error) {
+	switch syncPolicy {
+	case SyncAlways, SyncNever:
+	case SyncPeriodic:
+		if syncPeriod <= 0 {
+			return nil, fmt.Errorf("bad sync period: %s", syncPeriod)
+		}
+	default:
+		return nil, fmt.Errorf("unknown sync policy: %q", syncPolicy)
+	}
+
+	if segmentSize <= 0 {
+		segmentSize = DefaultSegmentSize
+	}
+
+	dir, e := filepath.Abs(dir)
+	if e != nil {
+		return nil, e
+	}
+
+	e = os.MkdirAll(dir, 0755)
+	if e != nil {
+		return nil, e
+	}
+
+	s := &Storage {
+		dir:         dir,
+		segmentSize: segmentSize,
+		sync:        syncPolicy,
+		rooms:       make(map[int]*roomRec),
+	}
+
+	e = s.load()
+	if e != nil {
+		s.closeFiles()
+		return nil, e
+	}
+
+	if syncPolicy == SyncPeriodic {
+		s.stopSignal = make(chan bool)
+		s.syncGroup.Add(1)
+		go s.goSync(syncPeriod, s.stopSignal)
+	}
+
+	return s, nil
+}
+
+func (s *Storage) load () error {
+	entries, e := os.ReadDir(s.dir)
+	if e != nil {
+		return e
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		roomId, e := strconv.Atoi(entry.Name())
+		if e != nil || roomId <= 0 {
+			continue
+		}
+
+		r, e := loadRoom(filepath.Join(s.dir, entry.Name()))
+		if r != nil {
+			s.rooms[roomId] = r
+		}
+		if e != nil {
+			return fmt.Errorf("room #%d: %s", roomId, e.Error())
+		}
+	}
+
+	return nil
+}
+
+func loadRoom (dir string) (*roomRec, error) {
+	names, e := filepath.Glob(filepath.Join(dir, "*" + segmentExt))
+	if e != nil {
+		return nil, e
+	}
+
+	nums := make([]int, 0, len(names))
+	for _, name := range names {
+		num, e := strconv.Atoi(strings.TrimSuffix(filepath.Base(name), segmentExt))
+		if e == nil && num > 0 {
+			nums = append(nums, num)
+		}
+	}
+	sort.Ints(nums)
+
+	r := &roomRec {dir: dir, segments: make([]*segmentRec, 0, len(nums)), history: make(map[int][]posRec)}
+	for i, num := range nums {
+		f, e := os.OpenFile(segmentName(dir, num), os.O_RDWR, 0)
+		if e != nil {
+			return r, e
+		}
+
+		seg := &segmentRec {num: num, f: f}
+		r.segments = append(r.segments, seg)
+		e = r.scan(i, i == len(nums) - 1)
+		if e != nil {
+			return r, fmt.Errorf("segment %d: %s", num, e.Error())
+		}
+	}
+
+	return r, nil
+}
+
+func segmentName (dir string, num int) string {
+	return filepath.Join(dir, fmt.Sprintf("%08d%s", num, segmentExt))
+}
+
+// читает записи сегмента и дополняет индекс;
+// недописанный хвост последнего сегмента (оборванная запись или последняя запись с неверной контрольной суммой)
+// обрезается, любая другая порча - ошибка: обрезка уничтожила бы целые записи после испорченной
+func (r *roomRec) scan (segIndex int, isLast bool) error {
+	seg := r.segments[segIndex]
+	reader := bufio.NewReader(seg.f)
+	header := make([]byte, headerSize)
+	var offset int64
+
+	for {
+		_, e := io.ReadFull(reader, header)
+		if e == io.EOF {
+			break
+		}
+
+		torn := (e == io.ErrUnexpectedEOF)
+		if e == nil {
+			size := binary.LittleEndian.Uint32(header)
+			sum := binary.LittleEndian.Uint32(header[4:])
+			if size > maxRecordSize {
+				e = fmt.Errorf("record too long at offset %d", offset)
+			} else {
+				payload := make([]byte, size)
+				_, e = io.ReadFull(reader, payload)
+				torn = (e == io.ErrUnexpectedEOF)
+				if e == nil && crc32.ChecksumIEEE(payload) != sum {
+					e = fmt.Errorf("checksum mismatch at offset %d", offset)
+					_, pe := reader.Peek(1)
+					torn = (pe == io.EOF)
+				}
+				if e == nil {
+					e = r.apply(payload, posRec {segIndex, offset + headerSize, int(size)})
+				}
+			}
+		}
+
+		if e == io.ErrUnexpectedEOF {
+			e = fmt.Errorf("incomplete record at offset %d", offset)
+		}
+
+		if e != nil {
+			if !isLast || !torn {
+				return e
+			}
+
+			log.Printf("%s: %s, truncating\n", seg.f.Name(), e.Error())
+			e = seg.f.Truncate(offset)
+			if e == nil {
+				e = seg.f.Sync()
+			}
+			if e != nil {
+				return e
+			}
+			break
+		}
+
+		offset += headerSize + int64(binary.LittleEndian.Uint32(header))
+	}
+
+	seg.size = offset
+	return nil
+}
+
+func (r *roomRec) apply (payload []byte, pos posRec) error {
+	rec := &recordRec {}
+	e := json.Unmarshal(payload, rec)
+	if e != nil {
+		return e
+	}
+
+	if rec.MessageId < 1 || rec.MessageId > len(r.index) + 1 {
+		return fmt.Errorf("unexpected message #%d", rec.MessageId)
+	}
+
+	r.setPos(rec.MessageId, pos, rec.Deleted)
+	return nil
+}
+
+// запоминает положение актуальной записи сообщения, прежняя уходит в историю;
+// "надгробие" удаляет историю
+func (r *roomRec) setPos (messageId int, pos posRec, deleted bool) {
+	if messageId > len(r.index) {
+		r.index = append(r.index, pos)
+		return
+	}
+
+	if deleted {
+		delete(r.history, messageId)
+	} else {
+		r.history[messageId] = append(r.history[messageId], r.index[messageId - 1])
+	}
+	r.index[messageId - 1] = pos
+}
+
+func encodeRecord (m *hub.MessageEntry) ([]byte, error) {
+	data, e := json.Marshal(m.Data)
+	if e != nil {
+		return nil, e
+	}
+
+	payload, e := json.Marshal(&recordRec {m.MessageId, m.UserId, m.Timestamp, m.EditTimestamp, m.EditorId, m.Deleted, data})
+	if e != nil {
+		return nil, e
+	}
+
+	if len(payload) > maxRecordSize {
+		return nil, fmt.Errorf("message #%d is too long", m.MessageId)
+	}
+
+	result := make([]byte, headerSize + len(payload))
+	binary.LittleEndian.PutUint32(result, uint32(len(payload)))
+	binary.LittleEndian.PutUint32(result[4:], crc32.ChecksumIEEE(payload))
+	copy(result[headerSize:], payload)
+	return result, nil
+}
+
+func (s *Storage) room (roomId int) (*roomRec, error) {
+	r := s.rooms[roomId]
+	if r != nil {
+		return r, nil
+	}
+
+	dir := filepath.Join(s.dir, strconv.Itoa(roomId))
+	e := os.MkdirAll(dir, 0755)
+	if e != nil {
+		return nil, e
+	}
+
+	if s.sync == SyncAlways {
+		e = syncDir(s.dir)
+		if e != nil {
+			return nil, e
+		}
+	}
+
+	r = &roomRec {dir: dir, segments: make([]*segmentRec, 0, 1), history: make(map[int][]posRec)}
+	s.rooms[roomId] = r
+	return r, nil
+}
+
+func syncDir (dir string) error {
+	d, e := os.Open(dir)
+	if e != nil {
+		return e
+	}
+
+	e = d.Sync()
+	d.Close()
+	return e
+}
+
+// возвращает сегмент, в который поместится запись размером size;
+// при необходимости заполненный сегмент сбрасывается на диск и открывается новый
+func (s *Storage) activeSegment (r *roomRec, size int) (*segmentRec, error) {
+	num := 1
+	if len(r.segments) > 0 {
+		seg := r.segments[len(r.segments) - 1]
+		if seg.size == 0 || seg.size + int64(size) <= s.segmentSize {
+			return seg, nil
+		}
+
+		if s.sync != SyncNever {
+			e := seg.f.Sync()
+			if e != nil {
+				return nil, e
+			}
+		}
+		num = seg.num + 1
+	}
+
+	f, e := os.OpenFile(segmentName(r.dir, num), os.O_RDWR | os.O_CREATE | os.O_EXCL, 0644)
+	if e != nil {
+		return nil, e
+	}
+
+	if s.sync == SyncAlways {
+		e = syncDir(r.dir)
+		if e != nil {
+			f.Close()
+			return nil, e
+		}
+	}
+
+	seg := &segmentRec {num: num, f: f}
+	r.segments = append(r.segments, seg)
+	return seg, nil
+}
+
+func (s *Storage) write (r *roomRec, m *hub.MessageEntry) error {
+	data, e := encodeRecord(m)
+	if e != nil {
+		return e
+	}
+
+	seg, e := s.activeSegment(r, len(data))
+	if e != nil {
+		return e
+	}
+
+	_, e = seg.f.WriteAt(data, seg.size)
+	if e != nil {
+		seg.f.Truncate(seg.size)
+		return e
+	}
+
+	pos := posRec {len(r.segments) - 1, seg.size + headerSize, len(data) - headerSize}
+	seg.size += int64(len(data))
+	r.dirty = true
+	r.setPos(m.MessageId, pos, m.Deleted)
+	return nil
+}
+
+// nil, если актуальная запись сообщения совпадает с m
+func (s *Storage) checkSaved (r *roomRec, m *hub.MessageEntry) error {
+	data, e := encodeRecord(m)
+	if e != nil {
+		return e
+	}
+
+	pos := r.index[m.MessageId - 1]
+	payload := make([]byte, pos.size)
+	_, e = r.segments[pos.segment].f.ReadAt(payload, pos.offset)
+	if e != nil {
+		return e
+	}
+
+	if !bytes.Equal(payload, data[headerSize:]) {
+		return fmt.Errorf("room #%d: message #%d is already saved", m.RoomId, m.MessageId)
+	}
+	return nil
+}
+
+func (s *Storage) read (r *roomRec, roomId, messageId int) (*hub.MessageEntry, error) {
+	return s.readAt(r, roomId, r.index[messageId - 1])
+}
+
+func (s *Storage) readAt (r *roomRec, roomId int, pos posRec) (*hub.MessageEntry, error) {
+	payload := make([]byte, pos.size)
+	_, e := r.segments[pos.segment].f.ReadAt(payload, pos.offset)
+	if e != nil {
+		return nil, e
+	}
+
+	rec := &recordRec {}
+	e = json.Unmarshal(payload, rec)
+	if e != nil {
+		return nil, e
+	}
+
+	result := &hub.MessageEntry {
+		RoomId:        roomId,
+		MessageId:     rec.MessageId,
+		UserId:        rec.UserId,
+		Timestamp:     rec.Timestamp,
+		EditTimestamp: rec.EditTimestamp,
+		EditorId:      rec.EditorId,
+		Deleted:       rec.Deleted,
+	}
+	if !rec.Deleted {
+		result.Data = rec.Data
+	}
+	return result, nil
+}
+
+func (r *roomRec) flush () error {
+	if !r.dirty || len(r.segments) == 0 {
+		return nil
+	}
+
+	e := r.segments[len(r.segments) - 1].f.Sync()
+	if e == nil {
+		r.dirty = false
+	}
+	return e
+}
+
+func (s *Storage) Save (messages hub.MessageList) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.rooms == nil {
+		return Closed
+	}
+
+	touched := make(map[int]*roomRec)
+	var e error
+	for _, m := range messages {
+		var r *roomRec
+		r, e = s.room(m.RoomId)
+		if e != nil {
+			break
+		}
+
+		// записанные при прошлой неудачной попытке сообщения пропускаются: хаб повторяет весь пакет;
+		// другое сообщение с тем же номером - ошибка
+		if m.MessageId <= len(r.index) {
+			e = s.checkSaved(r, m)
+			if e != nil {
+				break
+			}
+			continue
+		}
+
+		if m.MessageId != len(r.index) + 1 {
+			e = fmt.Errorf("room #%d: message #%d is out of order, expected #%d", m.RoomId, m.MessageId, len(r.index) + 1)
+			break
+		}
+
+		e = s.write(r, m)
+		if e != nil {
+			break
+		}
+
+		touched[m.RoomId] = r
+	}
+
+	if s.sync == SyncAlways {
+		for _, r := range touched {
+			fe := r.flush()
+			if e == nil {
+				e = fe
+			}
+		}
+	}
+
+	return e
+}
+
+func (s *Storage) List (roomId, firstId, count int) (hub.MessageList, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if s.rooms == nil {
+		return hub.MessageList {}, Closed
+	}
+
+	r := s.rooms[roomId]
+	if r == nil || count <= 0 {
+		return hub.MessageList {}, nil
+	}
+
+	if firstId < 1 {
+		firstId = 1
+	}
+	lastId := firstId + count - 1
+	if lastId > len(r.index) {
+		lastId = len(r.index)
+	}
+
+	result := make(hub.MessageList, 0, lastId - firstId + 1)
+	for id := firstId; id <= lastId; id++ {
+		m, e := s.read(r, roomId, id)
+		if e != nil {
+			return result, e
+		}
+
+		result = append(result, m)
+	}
+
+	return result, nil
+}
+
+func (s *Storage) Update (m *hub.MessageEntry) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.rooms == nil {
+		return false, Closed
+	}
+
+	r := s.rooms[m.RoomId]
+	if r == nil || m.MessageId < 1 || m.MessageId > len(r.index) {
+		return false, nil
+	}
+
+	e := s.write(r, m)
+	if e == nil && s.sync == SyncAlways {
+		e = r.flush()
+	}
+
+	return (e == nil), e
+}
+
+func (s *Storage) Delete (m *hub.MessageEntry) (bool, error) {
+	tomb := *m
+	tomb.Data = nil
+	tomb.Deleted = true
+	return s.Update(&tomb)
+}
+
+func (s *Storage) History (roomId, messageId int) (hub.MessageList, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if s.rooms == nil {
+		return hub.MessageList {}, Closed
+	}
+
+	r := s.rooms[roomId]
+	if r == nil || messageId < 1 || messageId > len(r.index) {
+		return hub.MessageList {}, nil
+	}
+
+	previous := r.history[messageId]
+	result := make(hub.MessageList, 0, len(previous) + 1)
+	for _, pos := range append(previous[:len(previous):len(previous)], r.index[messageId - 1]) {
+		m, e := s.readAt(r, roomId, pos)
+		if e != nil {
+			return result, e
+		}
+
+		result = append(result, m)
+	}
+
+	return result, nil
+}
+
+func (s *Storage) LastMessageId (roomId int) (int, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if s.rooms == nil {
+		return 0, Closed
+	}
+
+	r := s.rooms[roomId]
+	if r == nil {
+		return 0, nil
+	}
+
+	return len(r.index), nil
+}
+
+// удаляет каталог комнаты со всеми сегментами
+func (s *Storage) PurgeRoom (roomId int) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.rooms == nil {
+		return Closed
+	}
+
+	r := s.rooms[roomId]
+	if r == nil {
+		return nil
+	}
+
+	for _, seg := range r.segments {
+		seg.f.Close()
+	}
+	delete(s.rooms, roomId)
+
+	e := os.RemoveAll(r.dir)
+	if e == nil && s.sync == SyncAlways {
+		e = syncDir(s.dir)
+	}
+	return e
+}
+
+func (s *Storage) goSync (period time.Duration, stopSignal chan bool) {
+	ticker := time.NewTicker(period)
+
+Loop:
+	for {
+		select {
+		case <-ticker.C:
+			e := s.Flush()
+			if e != nil {
+				log.Println(e)
+			}
+
+		case <-stopSignal:
+			break Loop
+		}
+	}
+
+	ticker.Stop()
+	s.syncGroup.Done()
+}
+
+// сбрасывает на диск все несохраненные записи
+func (s *Storage) Flush () error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var result error
+	for _, r := range s.rooms {
+		e := r.flush()
+		if result == nil {
+			result = e
+		}
+	}
+
+	return result
+}
+
+func (s *Storage) closeFiles () {
+	for _, r := range s.rooms {
+		for _, seg := range r.segments {
+			seg.f.Close()
+		}
+	}
+}
+
+// повторный и одновременный вызов безопасны
+func (s *Storage) Close () error {
+	s.lock.Lock()
+	stopSignal := s.stopSignal
+	s.stopSignal = nil
+	s.lock.Unlock()
+
+	// синхронизация берет lock, поэтому ее завершения ждем без блокировки
+	if stopSignal != nil {
+		close(stopSignal)
+		s.syncGroup.Wait()
+	}
+
+	var e error
+	if s.sync != SyncNever {
+		e = s.Flush()
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.closeFiles()
+	s.rooms = nil
+	return e
+}
@@ -0,0 +1,277 @@
+package file
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ava12/go-chat/hub"
+)
+
+func newMessages (roomId, firstId, count int) hub.MessageList {
+	result := make(hub.MessageList, 0, count)
+	for i := 0; i < count; i++ {
+		result = append(result, &hub.MessageEntry {
+			RoomId:    roomId,
+			MessageId: firstId + i,
+			UserId:    1,
+			Timestamp: 1000 + i,
+			Data:      map[string]int {"n": firstId + i},
+		})
+	}
+	return result
+}
+
+func messageN (t *testing.T, m *hub.MessageEntry) int {
+	data := map[string]int {}
+	raw, ok := m.Data.(json.RawMessage)
+	if !ok {
+		t.Fatalf("r%dm%d: unexpected data type %T", m.RoomId, m.MessageId, m.Data)
+	}
+	e := json.Unmarshal(raw, &data)
+	if e != nil {
+		t.Fatal(e)
+	}
+	return data["n"]
+}
+
+func checkList (t *testing.T, s *Storage, roomId, total int) {
+	list, e := s.List(roomId, 1, total + 10)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	if len(list) != total {
+		t.Fatalf("r%d: got %d messages, expecting %d", roomId, len(list), total)
+	}
+
+	for i, m := range list {
+		if m.RoomId != roomId || m.MessageId != i + 1 {
+			t.Fatalf("r%d: got r%dm%d at position %d", roomId, m.RoomId, m.MessageId, i)
+		}
+	}
+}
+
+// история удаленного сообщения - только "надгробие", без прежних версий
+func checkDeletedHistory (t *testing.T, s *Storage, roomId, messageId int) {
+	t.Helper()
+	list, e := s.History(roomId, messageId)
+	if e != nil || len(list) != 1 || !list[0].Deleted || list[0].Data != nil {
+		t.Fatalf("unexpected history of deleted message: %+v %v", list, e)
+	}
+}
+
+func TestReopen (t *testing.T) {
+	dir := t.TempDir()
+	s, e := Open(dir, 256, SyncAlways, 0)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	for _, roomId := range []int {1, 2} {
+		e = s.Save(newMessages(roomId, 1, 30))
+		if e != nil {
+			t.Fatal(e)
+		}
+	}
+
+	changed, e := s.Update(&hub.MessageEntry {RoomId: 1, MessageId: 5, UserId: 1, Timestamp: 1004, EditTimestamp: 2000, EditorId: 2, Data: map[string]int {"n": 500}})
+	if !changed || e != nil {
+		t.Fatalf("update failed: %v %v", changed, e)
+	}
+
+	s.Update(&hub.MessageEntry {RoomId: 2, MessageId: 7, UserId: 1, Timestamp: 1006, EditTimestamp: 2500, EditorId: 1, Data: map[string]int {"n": 700}})
+	changed, e = s.Delete(&hub.MessageEntry {RoomId: 2, MessageId: 7, UserId: 1, Timestamp: 1006, EditTimestamp: 3000, EditorId: 2})
+	if !changed || e != nil {
+		t.Fatalf("delete failed: %v %v", changed, e)
+	}
+	checkDeletedHistory(t, s, 2, 7)
+
+	e = s.Save(newMessages(1, 32, 1))
+	if e == nil {
+		t.Fatal("out of order message accepted")
+	}
+
+	e = s.Close()
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	segments, _ := filepath.Glob(filepath.Join(dir, "1", "*" + segmentExt))
+	if len(segments) < 2 {
+		t.Fatalf("expecting several segments, got %d", len(segments))
+	}
+
+	s, e = Open(dir, 256, SyncNever, 0)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer s.Close()
+
+	checkList(t, s, 1, 30)
+	checkList(t, s, 2, 30)
+
+	if lastId, _ := s.LastMessageId(2); lastId != 30 {
+		t.Fatalf("last message id is %d after reopen", lastId)
+	}
+
+	list, e := s.List(1, 5, 1)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if n := messageN(t, list[0]); n != 500 || list[0].EditTimestamp != 2000 {
+		t.Fatalf("update lost: got %d", n)
+	}
+
+	list, e = s.List(2, 7, 1)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if !list[0].Deleted || list[0].Data != nil || list[0].EditTimestamp != 3000 {
+		t.Fatalf("deletion lost: %+v", list[0])
+	}
+
+	checkDeletedHistory(t, s, 2, 7)
+
+	list, e = s.History(1, 5)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if len(list) != 2 || messageN(t, list[0]) != 5 || messageN(t, list[1]) != 500 || list[1].EditorId != 2 {
+		t.Fatalf("unexpected history: %+v", list)
+	}
+}
+
+func TestTornTail (t *testing.T) {
+	dir := t.TempDir()
+	s, e := Open(dir, DefaultSegmentSize, SyncAlways, 0)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	e = s.Save(newMessages(3, 1, 10))
+	if e != nil {
+		t.Fatal(e)
+	}
+	s.Close()
+
+	name := segmentName(filepath.Join(dir, "3"), 1)
+	info, e := os.Stat(name)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	// обрываем последнюю запись на середине
+	e = os.Truncate(name, info.Size() - 5)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	s, e = Open(dir, DefaultSegmentSize, SyncAlways, 0)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	checkList(t, s, 3, 9)
+
+	e = s.Save(newMessages(3, 10, 2))
+	if e != nil {
+		t.Fatal(e)
+	}
+	s.Close()
+
+	s, e = Open(dir, DefaultSegmentSize, SyncAlways, 0)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer s.Close()
+
+	checkList(t, s, 3, 11)
+}
+
+func TestRetryBatch (t *testing.T) {
+	s, e := Open(t.TempDir(), DefaultSegmentSize, SyncAlways, 0)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer s.Close()
+
+	// первая попытка записала только часть пакета
+	e = s.Save(newMessages(1, 1, 3))
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	e = s.Save(newMessages(1, 1, 5))
+	if e != nil {
+		t.Fatal(e)
+	}
+	checkList(t, s, 1, 5)
+
+	// другое сообщение с сохраненным номером не пропускается молча
+	changed := newMessages(1, 5, 2)
+	changed[0].Data = "changed"
+	if e = s.Save(changed); e == nil {
+		t.Fatal("different message with saved id accepted")
+	}
+	checkList(t, s, 1, 5)
+}
+
+func TestCloseTwice (t *testing.T) {
+	s, e := Open(t.TempDir(), DefaultSegmentSize, SyncPeriodic, time.Millisecond)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	done := make(chan bool)
+	for i := 0; i < 2; i++ {
+		go func () {
+			s.Close()
+			done <- true
+		}()
+	}
+	<-done
+	<-done
+	if e = s.Close(); e != nil {
+		t.Fatal(e)
+	}
+}
+
+func TestCorruptRecord (t *testing.T) {
+	dir := t.TempDir()
+	s, e := Open(dir, DefaultSegmentSize, SyncAlways, 0)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	e = s.Save(newMessages(2, 1, 3))
+	if e != nil {
+		t.Fatal(e)
+	}
+	s.Close()
+
+	// портим первую запись, за которой идут целые
+	name := segmentName(filepath.Join(dir, "2"), 1)
+	f, e := os.OpenFile(name, os.O_RDWR, 0)
+	if e != nil {
+		t.Fatal(e)
+	}
+	_, e = f.WriteAt([]byte("X"), headerSize + 1)
+	f.Close()
+	if e != nil {
+		t.Fatal(e)
+	}
+	info, _ := os.Stat(name)
+
+	_, e = Open(dir, DefaultSegmentSize, SyncAlways, 0)
+	if e == nil {
+		t.Fatal("corrupt record is accepted")
+	}
+
+	after, _ := os.Stat(name)
+	if after.Size() != info.Size() {
+		t.Fatalf("segment is truncated from %d to %d bytes", info.Size(), after.Size())
+	}
+}
@@ -3,7 +3,9 @@ package hub
 import (
 	"time"
 	"errors"
+	"log"
 	"sync"
+	"sync/atomic"
 )
 
 type Conn interface {
@@ -12,22 +14,37 @@ type Conn interface {
 	NewMessage (m *MessageEntry)
 	UpdateMessage (m *MessageEntry)
 	Notice (data interface {})
-	Close ()
+	Close () // вызывается хабом из отдельной горутины, одновременно с другими методами
 }
 
 type MessageEntry struct {
 	RoomId, MessageId, UserId int
 	Timestamp int
+	EditTimestamp int // 0, если сообщение не изменялось
+	EditorId int // автор последнего изменения
+	Deleted bool // "надгробие" удаленного сообщения, Data == nil
 	Data interface {}
 }
 
 type MessageList []*MessageEntry
 
+func tombstone (m *MessageEntry, editorId, timestamp int) *MessageEntry {
+	return &MessageEntry {
+		RoomId: m.RoomId,
+		MessageId: m.MessageId,
+		UserId: m.UserId,
+		Timestamp: m.Timestamp,
+		EditTimestamp: timestamp,
+		EditorId: editorId,
+		Deleted: true,
+	}
+}
+
 const (
-	defaultSenders = 10
 	defaultFlushDelay = 30 * time.Second
 	defaultFlushItems = 20
 	defaultFlushThreshold = 50
+	defaultResumeLimit = 500
 )
 
 const taskQueueLen = 10
@@ -36,16 +53,32 @@ const taskQueueLen = 10
 type MessageStorage interface {
 	Save (m MessageList) error
 	List (roomId, firstId, count int) (MessageList, error)
-	Update (roomId, messageId int, data interface {}) (bool, error)
+	// заменяет сохраненное сообщение с теми же RoomId и MessageId,
+	// прежняя версия остается в истории правок
+	Update (m *MessageEntry) (bool, error)
+	// то же для "надгробия" удаленного сообщения; прежние версии удаляются из истории
+	Delete (m *MessageEntry) (bool, error)
+	// все версии сообщения от исходной до текущей; у удаленного сообщения - только "надгробие"
+	History (roomId, messageId int) (MessageList, error)
+	// номер последнего сохраненного сообщения в комнате, 0 - сообщений нет
+	LastMessageId (roomId int) (int, error)
 }
 
+// удаление всех сообщений комнаты; реализуется не всеми хранилищами
+type RoomPurger interface {
+	PurgeRoom (roomId int) error
+}
+
+var CannotPurge = errors.New("message storage cannot purge rooms")
+
 type memStorageRec struct {
 	lock sync.RWMutex
 	rooms map[int]MessageList
+	history map[int]map[int]MessageList
 }
 
 func NewMemStorage () MessageStorage {
-	return &memStorageRec {rooms: make(map[int]MessageList)}
+	return &memStorageRec {rooms: make(map[int]MessageList), history: make(map[int]map[int]MessageList)}
 }
 
 func (msr *memStorageRec) Save (messages MessageList) error {
@@ -79,31 +112,89 @@ func (msr *memStorageRec) List (roomId, firstId, count int) (MessageList, error)
 	return messages[firstIndex:lastIndex], nil
 }
 
-func (msr *memStorageRec) Update (roomId, messageId int, data interface {}) (bool, error) {
+func (msr *memStorageRec) Update (m *MessageEntry) (bool, error) {
 	msr.lock.Lock()
 	defer msr.lock.Unlock()
 
-	index := messageId - 1
-	messages := msr.rooms[roomId]
-	if index >= len(messages) {
+	index := m.MessageId - 1
+	messages := msr.rooms[m.RoomId]
+	if index < 0 || index >= len(messages) {
 		return false, nil
 	}
 
-	msr.rooms[roomId][index].Data = data
+	roomHistory := msr.history[m.RoomId]
+	if roomHistory == nil {
+		roomHistory = make(map[int]MessageList)
+		msr.history[m.RoomId] = roomHistory
+	}
+	if m.Deleted {
+		delete(roomHistory, m.MessageId)
+	} else {
+		roomHistory[m.MessageId] = append(roomHistory[m.MessageId], messages[index])
+	}
+	messages[index] = m
 	return true, nil
 }
 
+func (msr *memStorageRec) Delete (m *MessageEntry) (bool, error) {
+	return msr.Update(m)
+}
+
+func (msr *memStorageRec) History (roomId, messageId int) (MessageList, error) {
+	msr.lock.RLock()
+	defer msr.lock.RUnlock()
+
+	index := messageId - 1
+	messages := msr.rooms[roomId]
+	if index < 0 || index >= len(messages) {
+		return MessageList {}, nil
+	}
+
+	previous := msr.history[roomId][messageId]
+	result := make(MessageList, 0, len(previous) + 1)
+	result = append(result, previous...)
+	return append(result, messages[index]), nil
+}
+
+func (msr *memStorageRec) LastMessageId (roomId int) (int, error) {
+	msr.lock.RLock()
+	defer msr.lock.RUnlock()
+
+	return len(msr.rooms[roomId]), nil
+}
+
+func (msr *memStorageRec) PurgeRoom (roomId int) error {
+	msr.lock.Lock()
+	defer msr.lock.Unlock()
+
+	delete(msr.rooms, roomId)
+	delete(msr.history, roomId)
+	return nil
+}
+
 
 type roomRec struct {
 	UserIds []int
 	LastMessageId int
 }
 
+func (room *roomRec) hasUser (userId int) bool {
+	for _, uid := range room.UserIds {
+		if uid == userId {
+			return true
+		}
+	}
+
+	return false
+}
+
+
 const (
 	connTarget = iota
 	userTarget
 	roomTarget
 	globalTarget
+	neighbourTarget // пользователи, находящиеся в одной комнате с данным
 )
 
 type sendFunc func (c Conn)
@@ -113,11 +204,6 @@ type taskRec struct {
 	Func sendFunc
 }
 
-type parcelRec struct {
-	Conn Conn
-	Func sendFunc
-}
-
 type Hub struct {
 	storage MessageStorage
 
@@ -125,6 +211,7 @@ type Hub struct {
 	flushDelay time.Duration
 	flushItems, flushThreshold int
 	flushTimer *time.Timer
+	resumeLimit int
 
 	messageLock10 sync.RWMutex
 	messages MessageList
@@ -132,17 +219,20 @@ type Hub struct {
 	connLock20 sync.RWMutex
 	conns map[int]Conn
 	userConnIds map[int][]int
+	outboxes map[int]*outboxRec
+	queueLen int
+	sendTimeout time.Duration
 
 	roomLock30 sync.RWMutex
 	rooms map[int]*roomRec
 
 	taskQueue chan *taskRec
-	senderCnt int
-	parcelQueue chan *parcelRec
-	senderGroup sync.WaitGroup
+	watchStop chan bool
+	droppedTasks, evictedConns int64
 
+	done chan bool // закрывается остановленным хабом, задачи больше не принимаются
 	stopSignal chan bool
-	isRunning bool
+	running int32 // 1 - хаб запущен; останавливается под connLock20
 }
 
 var Stopped error = errors.New("hub is stopped")
@@ -157,37 +247,60 @@ func New (storage MessageStorage) *Hub {
 		flushDelay: defaultFlushDelay,
 		flushItems: defaultFlushItems,
 		flushThreshold: defaultFlushThreshold,
+		resumeLimit: defaultResumeLimit,
 		conns: make(map[int]Conn),
 		userConnIds: make(map[int][]int),
+		outboxes: make(map[int]*outboxRec),
+		queueLen: defaultQueueLen,
+		sendTimeout: defaultSendTimeout,
 		rooms: make(map[int]*roomRec),
 		messages: make(MessageList, 0),
-		senderCnt: defaultSenders,
 	}
 
 	return result
 }
 
-func (h *Hub) flush () {
-	h.flushLock5.Lock()
-	defer h.flushLock5.Unlock()
-	h.messageLock10.RLock()
-	defer h.messageLock10.RUnlock()
-
-	var (i int; e error)
-	cnt := len(h.messages) - h.flushItems
-	if h.flushItems > 0 && cnt > 0 {
-		for i = 0; i < cnt; i += h.flushItems {
-			e = h.storage.Save(h.messages[i:i + h.flushItems])
-			if e != nil {
+// сохраняет буфер сообщений в хранилище порциями по flushItems;
+// если all == false, неполная последняя порция остается в буфере;
+// вызывающий должен удерживать flushLock5 и messageLock10
+func (h *Hub) saveMessages (all bool) {
+	var e error
+	i := 0
+	cnt := len(h.messages)
+	for i < cnt {
+		n := h.flushItems
+		if n <= 0 || n > cnt - i {
+			if !all {
 				break
 			}
+
+			n = cnt - i
 		}
 
-		h.messages = h.messages[i:]
-		if len(h.messages) > h.flushThreshold {
+		e = h.storage.Save(h.messages[i:i + n])
+		if e != nil {
+			break
+		}
+
+		i += n
+	}
+
+	h.messages = h.messages[i:]
+	if e != nil {
+		log.Println(e)
+		if h.flushThreshold > 0 && len(h.messages) > h.flushThreshold {
 			panic(e)
 		}
 	}
+}
+
+func (h *Hub) flush () {
+	h.flushLock5.Lock()
+	defer h.flushLock5.Unlock()
+	h.messageLock10.Lock()
+	defer h.messageLock10.Unlock()
+
+	h.saveMessages(true)
 
 	if h.flushTimer != nil {
 		h.flushTimer.Stop()
@@ -195,8 +308,21 @@ func (h *Hub) flush () {
 	}
 }
 
-func (h *Hub) SetSenders (count int) {
-	h.senderCnt = count
+// длина очереди исходящих задач для новых подключений
+func (h *Hub) SetQueueLen (count int) {
+	h.connLock20.Lock()
+	defer h.connLock20.Unlock()
+
+	h.queueLen = count
+}
+
+// время выполнения одной задачи, после которого подключение закрывается; 0 - без ограничения;
+// действует на хаб, запущенный после вызова
+func (h *Hub) SetSendTimeout (timeout time.Duration) {
+	h.connLock20.Lock()
+	defer h.connLock20.Unlock()
+
+	h.sendTimeout = timeout
 }
 
 func (h *Hub) SetFlushDelay (delay time.Duration) {
@@ -209,7 +335,7 @@ func (h *Hub) SetFlushDelay (delay time.Duration) {
 			h.flushTimer.Stop()
 			h.flushTimer = nil
 		}
-	} else if h.isRunning && h.flushDelay <= 0 {
+	} else if h.isRunning() && h.flushDelay <= 0 {
 		h.flushTimer = time.AfterFunc(delay, h.flush)
 	}
 
@@ -230,6 +356,14 @@ func (h *Hub) SetFlushThreshold (count int) {
 	h.flushThreshold = count
 }
 
+// максимальное число сообщений в комнате, досылаемых при возобновлении подключения
+func (h *Hub) SetResumeLimit (count int) {
+	h.flushLock5.Lock()
+	defer h.flushLock5.Unlock()
+
+	h.resumeLimit = count
+}
+
 func (h *Hub) cleanup () {
 	if h.flushTimer != nil {
 		h.flushTimer.Stop()
@@ -240,32 +374,46 @@ func (h *Hub) cleanup () {
 	h.stopSignal <- true
 }
 
-func (h *Hub) goSend () {
-	for parcel := range h.parcelQueue {
-		parcel.Func(parcel.Conn)
-		h.senderGroup.Done()
+// ставит задачу в очередь подключения; переполнение очереди приводит к закрытию подключения;
+// вызывающий должен удерживать connLock20
+func (h *Hub) queueParcel (cid int, f sendFunc) {
+	ob := h.outboxes[cid]
+	if ob == nil || !ob.isActive() {
+		return
 	}
-}
 
-func (h *Hub) queueParcel (cid int, f sendFunc) {
-	c := h.conns[cid]
-	if c == nil {
+	if ob.put(f) {
 		return
 	}
 
-	h.senderGroup.Add(1)
-	h.parcelQueue <- &parcelRec {c, f}
+	atomic.AddInt64(&h.droppedTasks, 1)
+	if ob.evict() {
+		atomic.AddInt64(&h.evictedConns, 1)
+		log.Printf("u%dc%d: outbound queue overflow, closing\n", ob.conn.UserId(), cid)
+	}
 }
 
-func (h *Hub) goPickTask () {
+// ставит задачу в очередь рассылки; остановленный хаб задачу отбрасывает
+func (h *Hub) queueTask (task *taskRec) error {
+	select {
+	case h.taskQueue <- task:
+		return nil
+	case <- h.done:
+		return Stopped
+	}
+}
+
+func (h *Hub) goPickTask (queue chan *taskRec, done chan bool) {
 	var cid int
+	var task *taskRec
 
-	h.parcelQueue = make(chan *parcelRec)
-	for i := h.senderCnt; i > 0; i-- {
-		go h.goSend()
-	}
+	for {
+		select {
+		case task = <- queue:
+		case <- done:
+			return
+		}
 
-	for task := range h.taskQueue {
 		h.connLock20.RLock()
 
 		switch task.Target {
@@ -293,17 +441,110 @@ func (h *Hub) goPickTask () {
 					}
 				}
 				h.roomLock30.RUnlock()
+
+			case neighbourTarget:
+				h.roomLock30.RLock()
+				for _, uid := range h.neighbourIds(task.Id) {
+					for _, cid = range h.userConnIds[uid] {
+						h.queueParcel(cid, task.Func)
+					}
+				}
+				h.roomLock30.RUnlock()
 		}
 
 		h.connLock20.RUnlock()
-		h.senderGroup.Wait()
+	}
+}
+
+// пользователь и все, кто находится с ним хотя бы в одной комнате;
+// вызывающий должен удерживать roomLock30
+func (h *Hub) neighbourIds (userId int) []int {
+	seen := map[int]bool {userId: true}
+	result := []int {userId}
+	for _, room := range h.rooms {
+		if !room.hasUser(userId) {
+			continue
+		}
+
+		for _, uid := range room.UserIds {
+			if !seen[uid] {
+				seen[uid] = true
+				result = append(result, uid)
+			}
+		}
+	}
+
+	return result
+}
+
+// закрывает подключения, слишком долго выполняющие задачу
+func (h *Hub) goWatch (timeout time.Duration, stop <-chan bool) {
+	period := timeout / 4
+	if period < 10 * time.Millisecond {
+		period = 10 * time.Millisecond
+	}
+	ticker := time.NewTicker(period)
+
+Loop:
+	for {
+		select {
+		case now := <-ticker.C:
+			h.connLock20.RLock()
+			for cid, ob := range h.outboxes {
+				if ob.isStuck(now, timeout) && ob.evict() {
+					atomic.AddInt64(&h.evictedConns, 1)
+					log.Printf("u%dc%d: send timeout, closing\n", ob.conn.UserId(), cid)
+				}
+			}
+			h.connLock20.RUnlock()
+
+		case <-stop:
+			break Loop
+		}
+	}
+
+	ticker.Stop()
+}
+
+func (h *Hub) Metrics () Metrics {
+	h.connLock20.RLock()
+	defer h.connLock20.RUnlock()
+
+	result := Metrics {
+		Conns: len(h.conns),
+		DroppedTasks: atomic.LoadInt64(&h.droppedTasks),
+		EvictedConns: atomic.LoadInt64(&h.evictedConns),
+	}
+	for _, ob := range h.outboxes {
+		depth := len(ob.queue)
+		result.QueuedTasks += depth
+		if depth > result.MaxQueueDepth {
+			result.MaxQueueDepth = depth
+		}
+	}
+
+	return result
+}
+
+// число задач в очереди подключения
+func (h *Hub) QueueDepth (connId int) int {
+	h.connLock20.RLock()
+	defer h.connLock20.RUnlock()
+
+	ob := h.outboxes[connId]
+	if ob == nil {
+		return 0
 	}
 
-	close(h.parcelQueue)
+	return len(ob.queue)
+}
+
+func (h *Hub) isRunning () bool {
+	return (atomic.LoadInt32(&h.running) != 0)
 }
 
 func (h *Hub) Start () {
-	if h.isRunning {
+	if h.isRunning() {
 		return
 	}
 
@@ -311,11 +552,19 @@ func (h *Hub) Start () {
 	defer h.flushLock5.Unlock()
 
 	h.taskQueue = make(chan *taskRec, taskQueueLen)
+	h.done = make(chan bool)
 	h.stopSignal = make(chan bool, 1)
 
-	go h.goPickTask()
+	go h.goPickTask(h.taskQueue, h.done)
+
+	h.connLock20.RLock()
+	if h.sendTimeout > 0 {
+		h.watchStop = make(chan bool)
+		go h.goWatch(h.sendTimeout, h.watchStop)
+	}
+	h.connLock20.RUnlock()
 
-	h.isRunning = true
+	atomic.StoreInt32(&h.running, 1)
 
 	if h.flushDelay > 0 {
 		h.flushTimer = time.AfterFunc(h.flushDelay, h.flush)
@@ -323,56 +572,83 @@ func (h *Hub) Start () {
 }
 
 func (h *Hub) Stop () {
-	if !h.isRunning {
+	// cleanup вызывает либо Stop, либо отключение последнего подключения, решается под connLock20
+	h.connLock20.Lock()
+	if !atomic.CompareAndSwapInt32(&h.running, 1, 0) {
+		h.connLock20.Unlock()
 		return
 	}
+	noConns := (len(h.conns) == 0)
+	h.connLock20.Unlock()
 
-	h.isRunning = false
-
-	if len(h.conns) == 0 {
+	if noConns {
 		h.cleanup()
 	} else {
-		h.taskQueue <- &taskRec {globalTarget, 0, func (c Conn) {
-		c.Close()
-	}}
-
+		h.queueTask(&taskRec {globalTarget, 0, func (c Conn) {
+			c.Close()
+		}})
 	}
 
+	// очередь не закрывается: отправители, прошедшие проверку isRunning, получат Stopped
 	<- h.stopSignal
-	close(h.taskQueue)
-}
+	close(h.done)
 
-func (h *Hub) Connect (c Conn) error {
-	if !h.isRunning {
-		return Stopped
+	if h.watchStop != nil {
+		close(h.watchStop)
+		h.watchStop = nil
 	}
+}
 
+func (h *Hub) Connect (c Conn) error {
 	connId := c.Id()
 	userId := c.UserId()
 
 	h.connLock20.Lock()
 	defer h.connLock20.Unlock()
 
+	if !h.isRunning() {
+		return Stopped
+	}
+
 	if h.conns[connId] != nil {
 		return errors.New("connection already registered")
 	}
 
 	h.conns[connId] = c
+	h.outboxes[connId] = newOutbox(c, h.queueLen)
 	h.userConnIds[userId] = append(h.userConnIds[userId], connId)
 
 	return nil
 }
 
+// отключает подключение от хаба; после возврата хаб к подключению не обращается,
+// поэтому вызывать Disconnect из методов подключения, вызванных хабом, нельзя
 func (h *Hub) Disconnect (connId int) {
+	ob, last := h.disconnect(connId)
+	if ob != nil {
+		ob.wait()
+	}
+
+	// cleanup берет flushLock5 и messageLock10, поэтому вызывается после освобождения connLock20
+	if last {
+		h.cleanup()
+	}
+}
+
+// last - отключено последнее подключение остановленного хаба
+func (h *Hub) disconnect (connId int) (ob *outboxRec, last bool) {
 	h.connLock20.Lock()
 	defer h.connLock20.Unlock()
 
 	c := h.conns[connId]
 	if c == nil {
-		return
+		return nil, false
 	}
 
+	ob = h.outboxes[connId]
 	delete(h.conns, connId)
+	ob.close()
+	delete(h.outboxes, connId)
 
 	userId := c.UserId()
 	connIds := h.userConnIds[userId]
@@ -388,14 +664,11 @@ func (h *Hub) Disconnect (connId int) {
 	}
 
 	if len(h.userConnIds[userId]) > 0 {
-		return
+		return ob, false
 	}
 
 	delete(h.userConnIds, userId)
-
-	if !h.isRunning && len(h.conns) == 0 {
-		h.cleanup()
-	}
+	return ob, (!h.isRunning() && len(h.conns) == 0)
 }
 
 func (h *Hub) IsConnected (connId int) bool {
@@ -424,15 +697,50 @@ func (h *Hub) NewRoom (roomId, lastMessageId int, userIds []int) {
 	h.rooms[roomId] = room
 }
 
-func (h *Hub) DeleteRoom (roomId int) {
-	h.roomLock30.Lock()
-	defer h.roomLock30.Unlock()
+// регистрирует существующую комнату при запуске; номер последнего сообщения берется из хранилища
+func (h *Hub) RestoreRoom (roomId int, userIds []int) error {
+	lastMessageId, e := h.storage.LastMessageId(roomId)
+	if e != nil {
+		return e
+	}
 
-	if h.rooms[roomId] == nil {
-		return
+	h.NewRoom(roomId, lastMessageId, userIds)
+	return nil
+}
+
+// удаляет комнату вместе с ее участниками; если purge, сообщения комнаты удаляются
+// из буфера и хранилища, иначе остаются в хранилище
+func (h *Hub) DeleteRoom (roomId int, purge bool) error {
+	h.flushLock5.Lock()
+	defer h.flushLock5.Unlock()
+	h.messageLock10.Lock()
+	defer h.messageLock10.Unlock()
+
+	var purger RoomPurger
+	if purge {
+		var ok bool
+		purger, ok = h.storage.(RoomPurger)
+		if !ok {
+			return CannotPurge
+		}
+
+		messages := h.messages[:0]
+		for _, entry := range h.messages {
+			if entry.RoomId != roomId {
+				messages = append(messages, entry)
+			}
+		}
+		h.messages = messages
 	}
 
+	h.roomLock30.Lock()
 	delete(h.rooms, roomId)
+	h.roomLock30.Unlock()
+
+	if purger != nil {
+		return purger.PurgeRoom(roomId)
+	}
+	return nil
 }
 
 func (h *Hub) EnterRoom (userId, roomId int) error {
@@ -484,26 +792,46 @@ func (h *Hub) LeaveRoom (userId, roomId int) {
 }
 
 func (h *Hub) NewMessage (connId, roomId int, data interface {}) (messageId int, e error) {
-	if !h.isRunning {
+	if !h.isRunning() {
 		return 0, Stopped
 	}
 
 	h.flushLock5.Lock()
+	defer h.flushLock5.Unlock()
 	h.messageLock10.Lock()
+	defer h.messageLock10.Unlock()
+
+	entry, e := h.newEntry(connId, roomId, data)
+	if e != nil {
+		return 0, e
+	}
+
+	// задача ставится под messageLock10, чтобы рассылка шла в порядке номеров, но без connLock20:
+	// разборщику очереди нужен connLock20, а ожидающий его Disconnect не пустил бы разборщик
+	h.messages = append(h.messages, entry)
+	h.queueTask(&taskRec {roomTarget, roomId, func (c Conn) {
+		c.NewMessage(entry)
+	}})
+
+	if h.flushThreshold > 0 && len(h.messages) > h.flushThreshold {
+		h.saveMessages(false)
+	}
+
+	return entry.MessageId, nil
+}
+
+// новое сообщение с очередным номером в комнате; вызывающий должен удерживать messageLock10
+func (h *Hub) newEntry (connId, roomId int, data interface {}) (*MessageEntry, error) {
 	h.connLock20.RLock()
+	defer h.connLock20.RUnlock()
 	h.roomLock30.RLock()
-	defer func () {
-		h.roomLock30.RUnlock()
-		h.connLock20.RUnlock()
-		h.messageLock10.Unlock()
-		h.flushLock5.Unlock()
-	}()
+	defer h.roomLock30.RUnlock()
 
 	userId := 0
 	if connId != 0 {
 		conn := h.conns[connId]
 		if conn == nil {
-			return 0, errors.New("connection not found")
+			return nil, errors.New("connection not found")
 		}
 
 		userId = conn.UserId()
@@ -511,75 +839,173 @@ func (h *Hub) NewMessage (connId, roomId int, data interface {}) (messageId int,
 
 	room := h.rooms[roomId]
 	if room == nil {
-		return 0, errors.New("room not found")
+		return nil, errors.New("room not found")
 	}
 
 	room.LastMessageId++
-	entry := &MessageEntry {
+	return &MessageEntry {
 		RoomId: roomId,
 		MessageId: room.LastMessageId,
 		UserId: userId,
 		Timestamp: int(time.Now().Unix()),
 		Data: data,
+	}, nil
+}
+
+// ищет сообщение в буфере, затем в хранилище;
+// для сообщения из буфера возвращает также его индекс, иначе -1;
+// вызывающий должен удерживать flushLock5 и messageLock10
+func (h *Hub) message (roomId, messageId int) (*MessageEntry, int, error) {
+	for i, entry := range h.messages {
+		if entry.RoomId == roomId && entry.MessageId == messageId {
+			return entry, i, nil
+		}
 	}
 
-	h.messages = append(h.messages, entry)
-	h.taskQueue <- &taskRec {roomTarget, roomId, func (c Conn) {
-		c.NewMessage(entry)
-	}}
+	messages, e := h.storage.List(roomId, messageId, 1)
+	if e != nil {
+		return nil, -1, e
+	}
 
-	if h.flushThreshold > 0 && len(h.messages) > h.flushThreshold {
-		h.flush()
+	if len(messages) == 0 || messages[0].MessageId != messageId {
+		return nil, -1, errors.New("message not found")
 	}
 
-	return entry.MessageId, nil
+	return messages[0], -1, nil
 }
 
-func (h *Hub) UpdateMessage (roomId, messageId int, data interface {}) error {
-	if !h.isRunning {
-		return Stopped
+// то же, но сообщение из буфера предварительно сохраняется:
+// история правок ведется хранилищем, поэтому правки проходят только через него;
+// вызывающий должен удерживать flushLock5 и messageLock10 (на запись)
+func (h *Hub) storedMessage (roomId, messageId int) (*MessageEntry, error) {
+	entry, index, e := h.message(roomId, messageId)
+	if e != nil || index < 0 {
+		return entry, e
 	}
 
+	h.saveMessages(true)
+	entry, index, e = h.message(roomId, messageId)
+	if e == nil && index >= 0 {
+		e = errors.New("cannot save message")
+	}
+	return entry, e
+}
+
+func (h *Hub) Message (roomId, messageId int) (*MessageEntry, error) {
 	h.flushLock5.Lock()
 	defer h.flushLock5.Unlock()
+	h.messageLock10.RLock()
+	defer h.messageLock10.RUnlock()
 
-	changed, e := h.storage.Update(roomId, messageId, data)
+	m, _, e := h.message(roomId, messageId)
+	return m, e
+}
+
+// все версии сообщения от исходной до текущей
+func (h *Hub) MessageHistory (roomId, messageId int) (MessageList, error) {
+	h.flushLock5.Lock()
+	defer h.flushLock5.Unlock()
+	h.messageLock10.RLock()
+	defer h.messageLock10.RUnlock()
+
+	m, index, e := h.message(roomId, messageId)
 	if e != nil {
-		return e
+		return MessageList {}, e
 	}
 
-	if changed {
-		return nil
+	if index >= 0 {
+		return MessageList {m}, nil
+	}
+
+	return h.storage.History(roomId, messageId)
+}
+
+// заменяет данные сообщения и рассылает измененное сообщение всем в комнате
+func (h *Hub) UpdateMessage (editorId, roomId, messageId int, data interface {}) (*MessageEntry, error) {
+	if !h.isRunning() {
+		return nil, Stopped
 	}
 
+	h.flushLock5.Lock()
+	defer h.flushLock5.Unlock()
 	h.messageLock10.Lock()
 	defer h.messageLock10.Unlock()
 
-	for i, entry := range h.messages {
-		if entry.RoomId != roomId || entry.MessageId != messageId {
-			continue
-		}
+	entry, e := h.storedMessage(roomId, messageId)
+	if e != nil {
+		return nil, e
+	}
 
-		h.messages[i].Data = data
-		h.taskQueue <- &taskRec {roomTarget, roomId, func (c Conn) {
-			c.UpdateMessage(entry)
-		}}
-		return nil
+	if entry.Deleted {
+		return nil, errors.New("message is deleted")
+	}
+
+	updated := *entry
+	updated.EditTimestamp = int(time.Now().Unix())
+	updated.EditorId = editorId
+	updated.Data = data
+
+	changed, e := h.storage.Update(&updated)
+	if e != nil {
+		return nil, e
 	}
 
-	return errors.New("message not found")
+	if !changed {
+		return nil, errors.New("message not found")
+	}
+
+	h.queueTask(&taskRec {roomTarget, roomId, func (c Conn) {
+		c.UpdateMessage(&updated)
+	}})
+
+	return &updated, nil
+}
+
+// заменяет сообщение "надгробием" и рассылает его всем в комнате
+func (h *Hub) DeleteMessage (editorId, roomId, messageId int) (*MessageEntry, error) {
+	if !h.isRunning() {
+		return nil, Stopped
+	}
+
+	h.flushLock5.Lock()
+	defer h.flushLock5.Unlock()
+	h.messageLock10.Lock()
+	defer h.messageLock10.Unlock()
+
+	entry, e := h.storedMessage(roomId, messageId)
+	if e != nil {
+		return nil, e
+	}
+
+	if entry.Deleted {
+		return nil, errors.New("message is already deleted")
+	}
+
+	deleted := tombstone(entry, editorId, int(time.Now().Unix()))
+	changed, e := h.storage.Delete(deleted)
+	if e != nil {
+		return nil, e
+	}
+
+	if !changed {
+		return nil, errors.New("message not found")
+	}
+
+	h.queueTask(&taskRec {roomTarget, roomId, func (c Conn) {
+		c.UpdateMessage(deleted)
+	}})
+
+	return deleted, nil
 }
 
 func (h *Hub) notice (target, id int, data interface {}) error {
-	if !h.isRunning {
+	if !h.isRunning() {
 		return Stopped
 	}
 
-	h.taskQueue <- &taskRec {target, id, func (c Conn) {
+	return h.queueTask(&taskRec {target, id, func (c Conn) {
 		c.Notice(data)
-	}}
-
-	return nil
+	}})
 }
 
 func (h *Hub) ConnNotice (connId int, data interface {}) error {
@@ -598,6 +1024,11 @@ func (h *Hub) GlobalNotice (data interface {}) error {
 	return h.notice(globalTarget, 0, data)
 }
 
+// уведомление пользователю и всем, кто находится с ним в одной комнате
+func (h *Hub) NeighbourNotice (userId int, data interface {}) error {
+	return h.notice(neighbourTarget, userId, data)
+}
+
 func (h *Hub) Messages (userId, roomId, firstId, count int) (MessageList, error) {
 	if count <= 0 {
 		count = 10
@@ -649,7 +1080,7 @@ func (h *Hub) Messages (userId, roomId, firstId, count int) (MessageList, error)
 	defer h.messageLock10.RUnlock()
 
 	for _, message := range h.messages {
-		if message.RoomId != roomId {
+		if message.RoomId != roomId || message.MessageId < firstId {
 			continue
 		}
 
@@ -663,6 +1094,90 @@ func (h *Hub) Messages (userId, roomId, firstId, count int) (MessageList, error)
 	return messages, nil
 }
 
+// досылает подключению сообщения, пропущенные пользователем после разрыва связи:
+// для каждой комнаты из lastIds, в которой находится пользователь, - все сообщения с номерами больше lastIds[roomId],
+// пропусков в нумерации не будет. Досылка ставится в очередь подключения после уже поставленных задач, поэтому
+// сообщения, разосланные между подключением и вызовом Resume, приходят раньше досылки и повторяются в ней:
+// получатель должен упорядочивать сообщения по номеру и отбрасывать повторы;
+// возвращает номера комнат, в которых пропущено больше resumeLimit сообщений, - для них ничего не досылается
+func (h *Hub) Resume (connId int, lastIds map[int]int) ([]int, error) {
+	if !h.isRunning() {
+		return nil, Stopped
+	}
+
+	h.flushLock5.Lock()
+	defer h.flushLock5.Unlock()
+	h.messageLock10.RLock()
+	defer h.messageLock10.RUnlock()
+
+	stale, missed, e := h.missedMessages(connId, lastIds)
+	if e != nil {
+		return stale, e
+	}
+
+	// как в NewMessage: под messageLock10, но без connLock20
+	if len(missed) > 0 {
+		h.queueTask(&taskRec {connTarget, connId, func (c Conn) {
+			for _, m := range missed {
+				c.NewMessage(m)
+			}
+		}})
+	}
+
+	return stale, nil
+}
+
+// сообщения для Resume; вызывающий должен удерживать flushLock5 и messageLock10
+func (h *Hub) missedMessages (connId int, lastIds map[int]int) (stale []int, missed MessageList, e error) {
+	h.connLock20.RLock()
+	defer h.connLock20.RUnlock()
+	h.roomLock30.RLock()
+	defer h.roomLock30.RUnlock()
+
+	c := h.conns[connId]
+	if c == nil {
+		return nil, nil, errors.New("connection not found")
+	}
+
+	userId := c.UserId()
+	stale = make([]int, 0)
+	missed = make(MessageList, 0)
+	for roomId, lastId := range lastIds {
+		room := h.rooms[roomId]
+		if room == nil || !room.hasUser(userId) || lastId >= room.LastMessageId {
+			continue
+		}
+
+		if lastId < 0 {
+			lastId = 0
+		}
+		count := room.LastMessageId - lastId
+		if h.resumeLimit > 0 && count > h.resumeLimit {
+			stale = append(stale, roomId)
+			continue
+		}
+
+		messages, e := h.storage.List(roomId, lastId + 1, count)
+		if e != nil {
+			return stale, nil, e
+		}
+
+		nextId := lastId + 1
+		if len(messages) > 0 {
+			nextId = messages[len(messages) - 1].MessageId + 1
+		}
+		for _, m := range h.messages {
+			if m.RoomId == roomId && m.MessageId >= nextId {
+				messages = append(messages, m)
+			}
+		}
+
+		missed = append(missed, messages...)
+	}
+
+	return stale, missed, nil
+}
+
 func (h *Hub) UserRoomIds (userId int) []int {
 	h.connLock20.RLock()
 	h.roomLock30.RLock()
@@ -706,7 +1221,7 @@ func (h *Hub) IsInRoom (userId, roomId int) bool {
 
 
 func (h *Hub) OnlineUserIds () []int {
-	if !h.isRunning {
+	if !h.isRunning() {
 		return make([]int, 0)
 	}
 
@@ -737,8 +1252,24 @@ func (h *Hub) RoomUserIds (roomId int) []int {
 	return room.UserIds
 }
 
+func (h *Hub) LastMessageId (roomId int) (int, error) {
+	h.messageLock10.RLock()
+	h.roomLock30.RLock()
+	defer func () {
+		h.roomLock30.RUnlock()
+		h.messageLock10.RUnlock()
+	}()
+
+	room := h.rooms[roomId]
+	if room == nil {
+		return 0, errors.New("room not found")
+	}
+
+	return room.LastMessageId, nil
+}
+
 func (h *Hub) UserConnIds (userId int) []int {
-	if !h.isRunning {
+	if !h.isRunning() {
 		return make([]int, 0)
 	}
 
@@ -749,7 +1280,7 @@ func (h *Hub) UserConnIds (userId int) []int {
 }
 
 func (h *Hub) UserIsConnected (userId int) bool {
-	if !h.isRunning {
+	if !h.isRunning() {
 		return false
 	}
 
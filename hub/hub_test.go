@@ -5,6 +5,7 @@ import (
 	"log"
 	"fmt"
 	"math/rand"
+	"sync"
 	"time"
 )
 
@@ -99,30 +100,32 @@ const (
 type testConn struct {
 	id, userId, users int
 	connected bool
-	hub Hub
+	hub *Hub
 	userRooms [userCnt]int
 	lastMessageIds [roomCnt]int
 }
 
-func newTestConn (h Hub, id, userId int) *testConn {
+func newTestConn (h *Hub, id, userId int) *testConn {
 	return &testConn {id: id, userId: userId, hub: h}
 }
 
+// connected меняется, пока хаб не обращается к подключению: до Connect и после Disconnect
 func (c *testConn) toggle () {
 	if c.connected {
 		c.hub.Disconnect(c.id)
+		c.connected = false
 		connIds := c.hub.UserConnIds(c.userId)
 		if len(connIds) == 0 {
 			c.hub.GlobalNotice(&noticeRec {disconnectUserNotice, c.id, c.userId, 0})
 		}
 	} else {
 		connIds := c.hub.UserConnIds(c.userId)
+		c.connected = true
 		c.hub.Connect(c)
 		if len(connIds) == 0 {
 			c.hub.GlobalNotice(&noticeRec {connectUserNotice, c.id, c.userId, 0})
 		}
 	}
-	c.connected = !c.connected
 }
 
 func (c *testConn) move () int {
@@ -205,6 +208,8 @@ func (c *testConn) NewMessage (m *MessageEntry) {
 
 func (c *testConn) UpdateMessage (m *MessageEntry) {}
 
+func (c *testConn) Close () {}
+
 func (c *testConn) Notice (data interface {}) {
 	if !c.connected {
 		reportNecromancy(c.id)
@@ -262,10 +267,22 @@ func (noStorage) List (roomId, firstId, count int) (MessageList, error) {
 	return MessageList {}, nil
 }
 
-func (noStorage) Update (roomId, messageId int, data interface {}) (bool, error) {
+func (noStorage) Update (m *MessageEntry) (bool, error) {
+	return true, nil
+}
+
+func (noStorage) Delete (m *MessageEntry) (bool, error) {
 	return true, nil
 }
 
+func (noStorage) History (roomId, messageId int) (MessageList, error) {
+	return MessageList {}, nil
+}
+
+func (noStorage) LastMessageId (roomId int) (int, error) {
+	return 0, nil
+}
+
 
 const (
 	toggleEvent = iota
@@ -364,3 +381,221 @@ func TestAnomalies (t *testing.T) {
 	hub.Stop()
 	log.Printf("events generated: %v", events)
 }
+
+
+// подключение, собирающее номера полученных сообщений; при slow != 0 каждое сообщение задерживается
+type slowConn struct {
+	id, userId int
+	slow time.Duration
+	lock sync.Mutex
+	messageIds []int
+	closed chan bool
+	closeOnce sync.Once
+}
+
+func newSlowConn (id int, slow time.Duration) *slowConn {
+	return &slowConn {id: id, userId: id, slow: slow, closed: make(chan bool)}
+}
+
+func (c *slowConn) Id () int {
+	return c.id
+}
+
+func (c *slowConn) UserId () int {
+	return c.userId
+}
+
+func (c *slowConn) wait () {
+	if c.slow > 0 {
+		select {
+		case <-time.After(c.slow):
+		case <-c.closed:
+		}
+	}
+}
+
+func (c *slowConn) NewMessage (m *MessageEntry) {
+	c.wait()
+	c.lock.Lock()
+	c.messageIds = append(c.messageIds, m.MessageId)
+	c.lock.Unlock()
+}
+
+func (c *slowConn) UpdateMessage (m *MessageEntry) {}
+
+func (c *slowConn) Notice (data interface {}) {
+	c.wait()
+}
+
+func (c *slowConn) Close () {
+	c.closeOnce.Do(func () {
+		close(c.closed)
+	})
+}
+
+func (c *slowConn) received () []int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]int {}, c.messageIds...)
+}
+
+const (
+	slowRoomId = 1
+	fastConnCnt = 8
+	slowMessageCnt = 200
+)
+
+func TestSlowConsumers (t *testing.T) {
+	h := New(noStorage(true))
+	h.SetQueueLen(50)
+	h.SetSendTimeout(100 * time.Millisecond)
+	h.NewRoom(slowRoomId, 0, []int {})
+	h.Start()
+
+	conns := make([]*slowConn, 0, fastConnCnt + 2)
+	for i := 1; i <= fastConnCnt; i++ {
+		conns = append(conns, newSlowConn(i, 0))
+	}
+	overflowing := newSlowConn(fastConnCnt + 1, 20 * time.Millisecond)
+	stuck := newSlowConn(fastConnCnt + 2, time.Hour)
+	conns = append(conns, overflowing, stuck)
+
+	for _, c := range conns {
+		e := h.Connect(c)
+		if e != nil {
+			t.Fatal(e)
+		}
+		if c != stuck {
+			h.EnterRoom(c.userId, slowRoomId)
+		}
+	}
+
+	// зависшее подключение получает одно уведомление и закрывается по таймауту
+	h.ConnNotice(stuck.id, nil)
+
+	started := time.Now()
+	for i := 0; i < slowMessageCnt; i++ {
+		_, e := h.NewMessage(0, slowRoomId, i)
+		if e != nil {
+			t.Fatal(e)
+		}
+
+		// пачки по 10 сообщений, чтобы не переполнять очереди быстрых подключений
+		if i % 10 == 9 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for _, c := range conns[:fastConnCnt] {
+		for len(c.received()) < slowMessageCnt && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+
+		ids := c.received()
+		if len(ids) != slowMessageCnt {
+			t.Fatalf("c%d: got %d messages, expecting %d", c.id, len(ids), slowMessageCnt)
+		}
+		for i, id := range ids {
+			if id != i + 1 {
+				t.Fatalf("c%d: got message #%d at position %d", c.id, id, i)
+			}
+		}
+	}
+
+	if elapsed := time.Since(started); elapsed > 2 * time.Second {
+		t.Errorf("fast connections were delayed for %s", elapsed)
+	}
+
+	for _, c := range []*slowConn {overflowing, stuck} {
+		select {
+		case <-c.closed:
+		case <-time.After(time.Second):
+			t.Fatalf("c%d was not evicted", c.id)
+		}
+	}
+
+	m := h.Metrics()
+	if m.EvictedConns != 2 || m.DroppedTasks < 1 {
+		t.Fatalf("unexpected metrics: %+v", m)
+	}
+
+	for _, c := range conns {
+		h.Disconnect(c.id)
+	}
+	h.Stop()
+}
+
+// рассылки, идущие во время остановки, получают Stopped, а не закрытую очередь
+func TestStopWithSenders (t *testing.T) {
+	h := New(noStorage(true))
+	h.NewRoom(slowRoomId, 0, []int {})
+	h.Start()
+
+	c := newSlowConn(1, 0)
+	if e := h.Connect(c); e != nil {
+		t.Fatal(e)
+	}
+	h.EnterRoom(c.userId, slowRoomId)
+	go func () {
+		<-c.closed
+		h.Disconnect(c.id)
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func () {
+			defer wg.Done()
+			for {
+				if _, e := h.NewMessage(0, slowRoomId, 1); e != nil {
+					return
+				}
+				if h.RoomNotice(slowRoomId, nil) != nil {
+					return
+				}
+			}
+		}()
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	stopped := make(chan bool)
+	go func () {
+		h.Stop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop did not return")
+	}
+	wg.Wait()
+}
+
+// удаление стирает из истории прежние версии сообщения
+func TestDeletedHistory (t *testing.T) {
+	h := New(NewMemStorage())
+	h.NewRoom(1, 0, []int {})
+	h.Start()
+	defer h.Stop()
+
+	id, e := h.NewMessage(0, 1, "original")
+	if e == nil {
+		_, e = h.UpdateMessage(2, 1, id, "edited")
+	}
+	if e == nil {
+		_, e = h.DeleteMessage(3, 1, id)
+	}
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	list, e := h.MessageHistory(1, id)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if len(list) != 1 || !list[0].Deleted || list[0].Data != nil || list[0].EditorId != 3 {
+		t.Fatalf("deleted message history keeps old versions: %+v", list)
+	}
+}
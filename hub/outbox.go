@@ -0,0 +1,102 @@
+package hub
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Очередь исходящих задач подключения.
+// Задачи выполняются отдельной горутиной строго по порядку, так что медленное подключение
+// задерживает только себя. Переполнение очереди или слишком долгое выполнение задачи
+// приводят к принудительному закрытию подключения.
+// После Hub.Disconnect горутина очереди к подключению больше не обращается.
+
+const (
+	defaultQueueLen = 256
+	defaultSendTimeout = 10 * time.Second
+)
+
+type outboxRec struct {
+	conn Conn
+	queue chan sendFunc
+	done chan bool // закрывается по завершении горутины очереди
+	busySince int64 // UnixNano начала текущей задачи, 0 - простой
+	closed int32 // подключение отключено от хаба, задачи не выполняются
+	evicted int32 // подключение закрывается хабом
+}
+
+func newOutbox (c Conn, queueLen int) *outboxRec {
+	if queueLen <= 0 {
+		queueLen = defaultQueueLen
+	}
+
+	ob := &outboxRec {conn: c, queue: make(chan sendFunc, queueLen), done: make(chan bool)}
+	go ob.goDeliver()
+	return ob
+}
+
+func (ob *outboxRec) goDeliver () {
+	defer close(ob.done)
+
+	for f := range ob.queue {
+		if atomic.LoadInt32(&ob.closed) != 0 || atomic.LoadInt32(&ob.evicted) != 0 {
+			continue
+		}
+
+		atomic.StoreInt64(&ob.busySince, time.Now().UnixNano())
+		f(ob.conn)
+		atomic.StoreInt64(&ob.busySince, 0)
+	}
+}
+
+// false, если очередь переполнена
+func (ob *outboxRec) put (f sendFunc) bool {
+	select {
+	case ob.queue <- f:
+		return true
+	default:
+		return false
+	}
+}
+
+// вызывающий должен удерживать connLock20 на запись
+func (ob *outboxRec) close () {
+	atomic.StoreInt32(&ob.closed, 1)
+	close(ob.queue)
+}
+
+// ждет завершения текущей задачи; оставшиеся в очереди задачи пропускаются.
+// Вызывается без блокировок хаба, не из задачи этого же подключения
+func (ob *outboxRec) wait () {
+	<-ob.done
+}
+
+// true, если подключение занято текущей задачей дольше timeout
+func (ob *outboxRec) isStuck (now time.Time, timeout time.Duration) bool {
+	since := atomic.LoadInt64(&ob.busySince)
+	return (since != 0 && now.UnixNano() - since > int64(timeout))
+}
+
+// помечает подключение как исключенное и закрывает его;
+// само отключение от хаба выполняет владелец подключения обычным порядком
+func (ob *outboxRec) evict () bool {
+	if !atomic.CompareAndSwapInt32(&ob.evicted, 0, 1) {
+		return false
+	}
+
+	go ob.conn.Close()
+	return true
+}
+
+func (ob *outboxRec) isActive () bool {
+	return (atomic.LoadInt32(&ob.closed) == 0 && atomic.LoadInt32(&ob.evicted) == 0)
+}
+
+
+type Metrics struct {
+	Conns int
+	QueuedTasks int // всего задач в очередях подключений
+	MaxQueueDepth int
+	DroppedTasks int64 // задачи, не поместившиеся в очередь
+	EvictedConns int64 // подключения, закрытые из-за переполнения очереди или таймаута
+}
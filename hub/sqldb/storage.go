@@ -0,0 +1,218 @@
+package sqldb
+
+import (
+	"database/sql"
+	"encoding/json"
+
+	"github.com/ava12/go-chat/db"
+	"github.com/ava12/go-chat/hub"
+)
+
+const component = "messages"
+
+var migrations = []string {
+	`CREATE TABLE messages (
+		room_id INTEGER NOT NULL,
+		message_id INTEGER NOT NULL,
+		user_id INTEGER NOT NULL,
+		created INTEGER NOT NULL,
+		data TEXT NOT NULL,
+		PRIMARY KEY (room_id, message_id)
+	)`,
+
+	`ALTER TABLE messages ADD COLUMN edited INTEGER NOT NULL DEFAULT 0`,
+
+	`ALTER TABLE messages ADD COLUMN deleted INTEGER NOT NULL DEFAULT 0`,
+
+	`ALTER TABLE messages ADD COLUMN editor_id INTEGER NOT NULL DEFAULT 0;
+	CREATE TABLE message_revisions (
+		room_id INTEGER NOT NULL,
+		message_id INTEGER NOT NULL,
+		revision INTEGER NOT NULL,
+		user_id INTEGER NOT NULL,
+		created INTEGER NOT NULL,
+		edited INTEGER NOT NULL,
+		editor_id INTEGER NOT NULL,
+		deleted INTEGER NOT NULL,
+		data TEXT NOT NULL,
+		PRIMARY KEY (room_id, message_id, revision)
+	)`,
+}
+
+const messageFields = "user_id, created, edited, editor_id, deleted, data"
+
+type storageRec struct {
+	db *db.DB
+}
+
+func NewStorage (d *db.DB) (hub.MessageStorage, error) {
+	e := d.Migrate(component, migrations)
+	if e != nil {
+		return nil, e
+	}
+
+	return &storageRec {d}, nil
+}
+
+func (s *storageRec) Save (messages hub.MessageList) error {
+	tx, e := s.db.Begin()
+	if e != nil {
+		return e
+	}
+
+	query := s.db.Rebind("INSERT INTO messages (room_id, message_id, user_id, created, data) VALUES (?, ?, ?, ?, ?)")
+	for _, m := range messages {
+		var data []byte
+		data, e = json.Marshal(m.Data)
+		if e == nil {
+			_, e = tx.Exec(query, m.RoomId, m.MessageId, m.UserId, m.Timestamp, string(data))
+		}
+		if e != nil {
+			tx.Rollback()
+			return e
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *storageRec) List (roomId, firstId, count int) (hub.MessageList, error) {
+	if firstId < 1 {
+		firstId = 1
+	}
+
+	rows, e := s.db.Query("SELECT message_id, " + messageFields + " FROM messages" +
+		" WHERE room_id = ? AND message_id >= ? ORDER BY message_id LIMIT ?", roomId, firstId, count)
+	if e != nil {
+		return hub.MessageList {}, e
+	}
+
+	return scanMessages(rows, roomId, count)
+}
+
+// читает строки вида (message_id, messageFields...)
+func scanMessages (rows *sql.Rows, roomId, count int) (hub.MessageList, error) {
+	defer rows.Close()
+
+	result := make(hub.MessageList, 0, count)
+	for rows.Next() {
+		var data string
+		var deleted int
+		m := &hub.MessageEntry {RoomId: roomId}
+		e := rows.Scan(&m.MessageId, &m.UserId, &m.Timestamp, &m.EditTimestamp, &m.EditorId, &deleted, &data)
+		if e != nil {
+			return result, e
+		}
+
+		if deleted != 0 {
+			m.Deleted = true
+		} else {
+			m.Data = json.RawMessage(data)
+		}
+		result = append(result, m)
+	}
+
+	return result, rows.Err()
+}
+
+// переносит текущую версию сообщения в историю и записывает новую
+func (s *storageRec) Update (m *hub.MessageEntry) (bool, error) {
+	encoded := []byte("null")
+	deleted := 0
+	if m.Deleted {
+		deleted = 1
+	} else {
+		var e error
+		encoded, e = json.Marshal(m.Data)
+		if e != nil {
+			return false, e
+		}
+	}
+
+	tx, e := s.db.Begin()
+	if e != nil {
+		return false, e
+	}
+
+	if m.Deleted {
+		// прежние версии удаленного сообщения не хранятся
+		_, e = tx.Exec(s.db.Rebind("DELETE FROM message_revisions WHERE room_id = ? AND message_id = ?"), m.RoomId, m.MessageId)
+	} else {
+		var revision int
+		e = tx.QueryRow(s.db.Rebind("SELECT COUNT(*) FROM message_revisions WHERE room_id = ? AND message_id = ?"),
+			m.RoomId, m.MessageId).Scan(&revision)
+		if e == nil {
+			_, e = tx.Exec(s.db.Rebind("INSERT INTO message_revisions (room_id, message_id, revision, " + messageFields + ")" +
+				" SELECT room_id, message_id, ?, " + messageFields + " FROM messages WHERE room_id = ? AND message_id = ?"),
+				revision + 1, m.RoomId, m.MessageId)
+		}
+	}
+
+	var n int64
+	if e == nil {
+		var res sql.Result
+		res, e = tx.Exec(s.db.Rebind("UPDATE messages SET edited = ?, editor_id = ?, deleted = ?, data = ? WHERE room_id = ? AND message_id = ?"),
+			m.EditTimestamp, m.EditorId, deleted, string(encoded), m.RoomId, m.MessageId)
+		if e == nil {
+			n, e = res.RowsAffected()
+		}
+	}
+
+	if e != nil || n == 0 {
+		tx.Rollback()
+		return false, e
+	}
+
+	return true, tx.Commit()
+}
+
+func (s *storageRec) Delete (m *hub.MessageEntry) (bool, error) {
+	tomb := *m
+	tomb.Data = nil
+	tomb.Deleted = true
+	return s.Update(&tomb)
+}
+
+func (s *storageRec) History (roomId, messageId int) (hub.MessageList, error) {
+	rows, e := s.db.Query("SELECT message_id, " + messageFields + " FROM message_revisions" +
+		" WHERE room_id = ? AND message_id = ? ORDER BY revision", roomId, messageId)
+	if e != nil {
+		return hub.MessageList {}, e
+	}
+
+	result, e := scanMessages(rows, roomId, 1)
+	if e != nil {
+		return result, e
+	}
+
+	current, e := s.List(roomId, messageId, 1)
+	if len(current) == 0 || current[0].MessageId != messageId {
+		return hub.MessageList {}, e
+	}
+
+	return append(result, current[0]), e
+}
+
+func (s *storageRec) LastMessageId (roomId int) (int, error) {
+	var result sql.NullInt64
+	e := s.db.QueryRow("SELECT MAX(message_id) FROM messages WHERE room_id = ?", roomId).Scan(&result)
+	return int(result.Int64), e
+}
+
+func (s *storageRec) PurgeRoom (roomId int) error {
+	tx, e := s.db.Begin()
+	if e != nil {
+		return e
+	}
+
+	_, e = tx.Exec(s.db.Rebind("DELETE FROM message_revisions WHERE room_id = ?"), roomId)
+	if e == nil {
+		_, e = tx.Exec(s.db.Rebind("DELETE FROM messages WHERE room_id = ?"), roomId)
+	}
+	if e != nil {
+		tx.Rollback()
+		return e
+	}
+
+	return tx.Commit()
+}
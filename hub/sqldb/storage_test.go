@@ -0,0 +1,91 @@
+package sqldb_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/ava12/go-chat/db/dbtest"
+	"github.com/ava12/go-chat/hub"
+	hubsql "github.com/ava12/go-chat/hub/sqldb"
+)
+
+func TestMessageStorage (t *testing.T) {
+	s, e := hubsql.NewStorage(dbtest.Open(t))
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	messages := make(hub.MessageList, 0)
+	for i := 1; i <= 5; i++ {
+		messages = append(messages, &hub.MessageEntry {RoomId: 1, MessageId: i, UserId: 2, Timestamp: 100 + i, Data: i})
+	}
+	e = s.Save(messages)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	e = s.Save(messages[:1])
+	if e == nil {
+		t.Fatal("duplicate message accepted")
+	}
+
+	changed, e := s.Update(&hub.MessageEntry {RoomId: 1, MessageId: 3, UserId: 1, Timestamp: 103, EditTimestamp: 200, EditorId: 2, Data: "changed"})
+	if !changed || e != nil {
+		t.Fatalf("update failed: %v %v", changed, e)
+	}
+
+	changed, e = s.Update(&hub.MessageEntry {RoomId: 1, MessageId: 10, EditTimestamp: 200, Data: "missing"})
+	if changed || e != nil {
+		t.Fatalf("missing message updated: %v %v", changed, e)
+	}
+
+	s.Update(&hub.MessageEntry {RoomId: 1, MessageId: 4, UserId: 1, Timestamp: 104, EditTimestamp: 250, EditorId: 1, Data: "secret"})
+	changed, e = s.Delete(&hub.MessageEntry {RoomId: 1, MessageId: 4, UserId: 1, Timestamp: 104, EditTimestamp: 300, EditorId: 2})
+	if !changed || e != nil {
+		t.Fatalf("delete failed: %v %v", changed, e)
+	}
+
+	list, e := s.List(1, 2, 3)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if len(list) != 3 || list[0].MessageId != 2 || list[2].MessageId != 4 {
+		t.Fatalf("unexpected message list: %v", list)
+	}
+	if string(list[1].Data.(json.RawMessage)) != `"changed"` || list[1].Timestamp != 103 || list[1].EditTimestamp != 200 {
+		t.Fatalf("unexpected message: %+v", list[1])
+	}
+	if !list[2].Deleted || list[2].Data != nil || list[2].EditTimestamp != 300 || list[2].EditorId != 2 {
+		t.Fatalf("unexpected tombstone: %+v", list[2])
+	}
+
+	s.Update(&hub.MessageEntry {RoomId: 1, MessageId: 3, UserId: 1, Timestamp: 103, EditTimestamp: 250, EditorId: 3, Data: "again"})
+	list, e = s.History(1, 3)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if len(list) != 3 || list[0].EditTimestamp != 0 || list[1].EditorId != 2 || list[2].EditorId != 3 {
+		t.Fatalf("unexpected history: %+v", list)
+	}
+	if string(list[1].Data.(json.RawMessage)) != `"changed"` || string(list[2].Data.(json.RawMessage)) != `"again"` {
+		t.Fatalf("unexpected revisions: %+v %+v", list[1], list[2])
+	}
+
+	// история удаленного сообщения не выдает прежний текст
+	list, e = s.History(1, 4)
+	if e != nil || len(list) != 1 || !list[0].Deleted || list[0].Data != nil {
+		t.Fatalf("unexpected history of deleted message: %+v %v", list, e)
+	}
+
+	list, e = s.List(2, 1, 10)
+	if e != nil || len(list) != 0 {
+		t.Fatalf("unexpected messages in empty room: %v %v", list, e)
+	}
+
+	for roomId, expected := range map[int]int {1: 5, 2: 0} {
+		lastId, e := s.LastMessageId(roomId)
+		if e != nil || lastId != expected {
+			t.Fatalf("r%d: last message id is %d, expecting %d (%v)", roomId, lastId, expected, e)
+		}
+	}
+}
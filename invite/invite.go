@@ -0,0 +1,71 @@
+package invite
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+// Приглашения в комнаты. Приглашение адресуется конкретному пользователю (одноразовое)
+// или передается токеном любому; у токена может быть ограничено число использований и срок действия.
+// Исчерпанные приглашения удаляются, просроченные не находятся.
+
+type Entry struct {
+	Token string `json:"token"`
+	RoomId int `json:"roomId"`
+	UserId int `json:"userId,omitempty"` // 0 - для любого, у кого есть токен
+	CreatorId int `json:"creatorId"`
+	MaxUses int `json:"maxUses"` // 0 - без ограничения
+	Uses int `json:"uses"`
+	Expires int64 `json:"expires,omitempty"` // unix-время, 0 - бессрочно
+}
+
+type Registry interface {
+	// сохраняет приглашение с новым токеном
+	NewInvite (entry Entry) (Entry, error)
+	Invite (token string) (Entry, bool)
+	// проверяет приглашение и засчитывает использование
+	UseInvite (token string, userId int) (Entry, error)
+	UserInvites (userId int) []Entry // адресованные пользователю
+	DeleteInvite (token string) error
+	DeleteRoomInvites (roomId int) error
+}
+
+const tokenBytes = 16
+
+var (
+	NotFound = errors.New("invitation not found or expired")
+	WrongUser = errors.New("invitation is addressed to another user")
+)
+
+func NewToken () (string, error) {
+	buf := make([]byte, tokenBytes)
+	_, e := rand.Read(buf)
+	return hex.EncodeToString(buf), e
+}
+
+func (e Entry) Expired (now time.Time) bool {
+	return (e.Expires != 0 && e.Expires <= now.Unix())
+}
+
+// проверяет, может ли пользователь воспользоваться приглашением
+func (e Entry) Check (userId int, now time.Time) error {
+	switch {
+	case e.Expired(now) || (e.MaxUses > 0 && e.Uses >= e.MaxUses):
+		return NotFound
+	case e.UserId != 0 && e.UserId != userId:
+		return WrongUser
+	default:
+		return nil
+	}
+}
+
+// адресные приглашения одноразовые
+func Normalize (e Entry) Entry {
+	if e.UserId != 0 {
+		e.MaxUses = 1
+	}
+	e.Uses = 0
+	return e
+}
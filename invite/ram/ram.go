@@ -0,0 +1,115 @@
+package ram
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ava12/go-chat/invite"
+)
+
+type memRegistryRec struct {
+	lock sync.Mutex
+	invites map[string]*invite.Entry
+}
+
+func NewRegistry () invite.Registry {
+	return &memRegistryRec {invites: make(map[string]*invite.Entry)}
+}
+
+func (mrr *memRegistryRec) NewInvite (entry invite.Entry) (invite.Entry, error) {
+	mrr.lock.Lock()
+	defer mrr.lock.Unlock()
+
+	entry = invite.Normalize(entry)
+	for {
+		token, e := invite.NewToken()
+		if e != nil {
+			return invite.Entry {}, e
+		}
+
+		if mrr.invites[token] == nil {
+			entry.Token = token
+			break
+		}
+	}
+
+	mrr.invites[entry.Token] = &entry
+	return entry, nil
+}
+
+// вызывающий должен удерживать lock
+func (mrr *memRegistryRec) find (token string, now time.Time) *invite.Entry {
+	entry := mrr.invites[token]
+	if entry != nil && entry.Expired(now) {
+		delete(mrr.invites, token)
+		entry = nil
+	}
+	return entry
+}
+
+func (mrr *memRegistryRec) Invite (token string) (invite.Entry, bool) {
+	mrr.lock.Lock()
+	defer mrr.lock.Unlock()
+
+	entry := mrr.find(token, time.Now())
+	if entry == nil {
+		return invite.Entry {}, false
+	}
+	return *entry, true
+}
+
+func (mrr *memRegistryRec) UseInvite (token string, userId int) (invite.Entry, error) {
+	mrr.lock.Lock()
+	defer mrr.lock.Unlock()
+
+	now := time.Now()
+	entry := mrr.find(token, now)
+	if entry == nil {
+		return invite.Entry {}, invite.NotFound
+	}
+
+	e := entry.Check(userId, now)
+	if e != nil {
+		return invite.Entry {}, e
+	}
+
+	entry.Uses++
+	if entry.MaxUses > 0 && entry.Uses >= entry.MaxUses {
+		delete(mrr.invites, token)
+	}
+	return *entry, nil
+}
+
+func (mrr *memRegistryRec) UserInvites (userId int) []invite.Entry {
+	mrr.lock.Lock()
+	defer mrr.lock.Unlock()
+
+	now := time.Now()
+	result := make([]invite.Entry, 0)
+	for token, entry := range mrr.invites {
+		if entry.UserId == userId && mrr.find(token, now) != nil {
+			result = append(result, *entry)
+		}
+	}
+	return result
+}
+
+func (mrr *memRegistryRec) DeleteInvite (token string) error {
+	mrr.lock.Lock()
+	defer mrr.lock.Unlock()
+
+	delete(mrr.invites, token)
+	return nil
+}
+
+func (mrr *memRegistryRec) DeleteRoomInvites (roomId int) error {
+	mrr.lock.Lock()
+	defer mrr.lock.Unlock()
+
+	for token, entry := range mrr.invites {
+		if entry.RoomId == roomId {
+			delete(mrr.invites, token)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package sqldb
+
+import (
+	"database/sql"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/ava12/go-chat/db"
+	"github.com/ava12/go-chat/invite"
+)
+
+const component = "invites"
+
+var migrations = []string {
+	`CREATE TABLE invites (
+		token VARCHAR(64) NOT NULL PRIMARY KEY,
+		room_id INTEGER NOT NULL,
+		user_id INTEGER NOT NULL,
+		creator_id INTEGER NOT NULL,
+		max_uses INTEGER NOT NULL,
+		uses INTEGER NOT NULL,
+		expires INTEGER NOT NULL
+	)`,
+}
+
+const inviteFields = "token, room_id, user_id, creator_id, max_uses, uses, expires"
+
+type registryRec struct {
+	lock sync.Mutex
+	db *db.DB
+}
+
+func NewRegistry (d *db.DB) (invite.Registry, error) {
+	e := d.Migrate(component, migrations)
+	if e != nil {
+		return nil, e
+	}
+
+	return &registryRec {db: d}, nil
+}
+
+type scanner interface {
+	Scan (dest ... interface {}) error
+}
+
+func scanInvite (s scanner) (invite.Entry, error) {
+	entry := invite.Entry {}
+	e := s.Scan(&entry.Token, &entry.RoomId, &entry.UserId, &entry.CreatorId, &entry.MaxUses, &entry.Uses, &entry.Expires)
+	return entry, e
+}
+
+func (r *registryRec) NewInvite (entry invite.Entry) (invite.Entry, error) {
+	entry = invite.Normalize(entry)
+	for {
+		token, e := invite.NewToken()
+		if e != nil {
+			return invite.Entry {}, e
+		}
+
+		_, e = r.db.Exec("INSERT INTO invites (" + inviteFields + ") VALUES (?, ?, ?, ?, ?, ?, ?)",
+			token, entry.RoomId, entry.UserId, entry.CreatorId, entry.MaxUses, entry.Uses, entry.Expires)
+		if e == nil {
+			entry.Token = token
+			return entry, nil
+		}
+
+		if _, found := r.Invite(token); !found {
+			return invite.Entry {}, e
+		}
+	}
+}
+
+func (r *registryRec) Invite (token string) (invite.Entry, bool) {
+	entry, e := scanInvite(r.db.QueryRow("SELECT " + inviteFields + " FROM invites WHERE token = ?", token))
+	if e != nil {
+		if e != sql.ErrNoRows {
+			log.Println(e)
+		}
+		return invite.Entry {}, false
+	}
+
+	if entry.Expired(time.Now()) {
+		return invite.Entry {}, false
+	}
+	return entry, true
+}
+
+func (r *registryRec) UseInvite (token string, userId int) (invite.Entry, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	entry, found := r.Invite(token)
+	if !found {
+		return invite.Entry {}, invite.NotFound
+	}
+
+	e := entry.Check(userId, time.Now())
+	if e != nil {
+		return invite.Entry {}, e
+	}
+
+	entry.Uses++
+	if entry.MaxUses > 0 && entry.Uses >= entry.MaxUses {
+		_, e = r.db.Exec("DELETE FROM invites WHERE token = ?", token)
+	} else {
+		_, e = r.db.Exec("UPDATE invites SET uses = ? WHERE token = ?", entry.Uses, token)
+	}
+	if e != nil {
+		return invite.Entry {}, e
+	}
+	return entry, nil
+}
+
+func (r *registryRec) UserInvites (userId int) []invite.Entry {
+	result := make([]invite.Entry, 0)
+	rows, e := r.db.Query("SELECT " + inviteFields + " FROM invites WHERE user_id = ? AND (expires = 0 OR expires > ?)",
+		userId, time.Now().Unix())
+	if e != nil {
+		log.Println(e)
+		return result
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		entry, e := scanInvite(rows)
+		if e != nil {
+			log.Println(e)
+			break
+		}
+
+		result = append(result, entry)
+	}
+	return result
+}
+
+func (r *registryRec) DeleteInvite (token string) error {
+	_, e := r.db.Exec("DELETE FROM invites WHERE token = ?", token)
+	return e
+}
+
+func (r *registryRec) DeleteRoomInvites (roomId int) error {
+	_, e := r.db.Exec("DELETE FROM invites WHERE room_id = ?", roomId)
+	return e
+}
@@ -0,0 +1,48 @@
+package sqldb_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ava12/go-chat/db/dbtest"
+	"github.com/ava12/go-chat/invite"
+	invitesql "github.com/ava12/go-chat/invite/sqldb"
+)
+
+func TestInviteRegistry (t *testing.T) {
+	r, e := invitesql.NewRegistry(dbtest.Open(t))
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	token, e := r.NewInvite(invite.Entry {RoomId: 1, CreatorId: 2, MaxUses: 2})
+	if e != nil || token.Token == "" {
+		t.Fatalf("invite not created: %v %v", token, e)
+	}
+	for _, uid := range []int {3, 4} {
+		if _, e = r.UseInvite(token.Token, uid); e != nil {
+			t.Fatal(e)
+		}
+	}
+	if _, e = r.UseInvite(token.Token, 5); e != invite.NotFound {
+		t.Fatalf("exhausted invite used: %v", e)
+	}
+
+	direct, _ := r.NewInvite(invite.Entry {RoomId: 1, UserId: 7, CreatorId: 2, MaxUses: 5})
+	if _, e = r.UseInvite(direct.Token, 3); e != invite.WrongUser {
+		t.Fatalf("invite used by wrong user: %v", e)
+	}
+	if list := r.UserInvites(7); len(list) != 1 || list[0].MaxUses != 1 {
+		t.Fatalf("unexpected user invites: %v", list)
+	}
+
+	expired, _ := r.NewInvite(invite.Entry {RoomId: 1, CreatorId: 2, Expires: time.Now().Unix() - 1})
+	if _, found := r.Invite(expired.Token); found {
+		t.Fatal("expired invite found")
+	}
+
+	r.DeleteInvite(direct.Token)
+	if _, found := r.Invite(direct.Token); found {
+		t.Fatal("deleted invite found")
+	}
+}
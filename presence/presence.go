@@ -0,0 +1,190 @@
+package presence
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Статус присутствия пользователя по всем его подключениям.
+// Без подключений пользователь offline; иначе действует статус, выставленный вручную (away, dnd),
+// а при его отсутствии - online или away, если пользователь не проявлял активности дольше idleTimeout.
+// Об изменении статуса сообщается через Notifier.
+
+const (
+	Offline = "offline"
+	Online = "online"
+	Away = "away"
+	DoNotDisturb = "dnd"
+)
+
+type Notifier func (userId int, status string)
+
+type userRec struct {
+	conns int
+	manual string // "" - не выставлен
+	lastActive time.Time
+	status string // последний объявленный статус
+}
+
+type Tracker struct {
+	lock sync.Mutex
+	users map[int]*userRec
+	notify Notifier
+	idleTimeout time.Duration
+	watchStop chan bool
+}
+
+var UnknownStatus = errors.New("unknown presence status")
+
+func New (notify Notifier) *Tracker {
+	return &Tracker {users: make(map[int]*userRec), notify: notify}
+}
+
+// время бездействия, после которого пользователь считается отошедшим; 0 - не отслеживается
+func (t *Tracker) SetIdleTimeout (timeout time.Duration) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.watchStop != nil {
+		close(t.watchStop)
+		t.watchStop = nil
+	}
+
+	t.idleTimeout = timeout
+	if timeout > 0 {
+		t.watchStop = make(chan bool)
+		go t.goWatch(timeout, t.watchStop)
+	}
+}
+
+func (t *Tracker) Stop () {
+	t.SetIdleTimeout(0)
+}
+
+func (t *Tracker) goWatch (timeout time.Duration, stop <-chan bool) {
+	period := timeout / 4
+	if period < time.Second {
+		period = time.Second
+	}
+	ticker := time.NewTicker(period)
+
+Loop:
+	for {
+		select {
+		case now := <-ticker.C:
+			t.lock.Lock()
+			for uid, u := range t.users {
+				t.refresh(uid, u, now)
+			}
+			t.lock.Unlock()
+
+		case <-stop:
+			break Loop
+		}
+	}
+
+	ticker.Stop()
+}
+
+// пересчитывает статус пользователя и рассылает изменение;
+// рассылка идет под блокировкой, чтобы уведомления об одном пользователе не переставлялись;
+// вызывающий должен удерживать lock
+func (t *Tracker) refresh (uid int, u *userRec, now time.Time) {
+	status := t.status(u, now)
+	if status != u.status {
+		u.status = status
+		if t.notify != nil {
+			t.notify(uid, status)
+		}
+	}
+
+	if status == Offline && u.manual == "" {
+		delete(t.users, uid)
+	}
+}
+
+// вызывающий должен удерживать lock
+func (t *Tracker) status (u *userRec, now time.Time) string {
+	switch {
+	case u.conns <= 0:
+		return Offline
+	case u.manual != "":
+		return u.manual
+	case t.idleTimeout > 0 && now.Sub(u.lastActive) > t.idleTimeout:
+		return Away
+	default:
+		return Online
+	}
+}
+
+func (t *Tracker) touchUser (userId int, f func (u *userRec)) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	u := t.users[userId]
+	if u == nil {
+		u = &userRec {status: Offline}
+		t.users[userId] = u
+	}
+
+	f(u)
+	t.refresh(userId, u, time.Now())
+}
+
+func (t *Tracker) Connect (userId int) {
+	t.touchUser(userId, func (u *userRec) {
+		u.conns++
+		u.lastActive = time.Now()
+	})
+}
+
+func (t *Tracker) Disconnect (userId int) {
+	t.touchUser(userId, func (u *userRec) {
+		if u.conns > 0 {
+			u.conns--
+		}
+	})
+}
+
+// отмечает активность пользователя
+func (t *Tracker) Touch (userId int) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	u := t.users[userId]
+	if u != nil {
+		u.lastActive = time.Now()
+		t.refresh(userId, u, u.lastActive)
+	}
+}
+
+// выставляет статус вручную; Online снимает выставленный статус
+func (t *Tracker) SetStatus (userId int, status string) error {
+	manual := ""
+	switch status {
+	case Online:
+	case Away, DoNotDisturb:
+		manual = status
+	default:
+		return UnknownStatus
+	}
+
+	t.touchUser(userId, func (u *userRec) {
+		u.manual = manual
+		u.lastActive = time.Now()
+	})
+	return nil
+}
+
+func (t *Tracker) Status (userId int) string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	u := t.users[userId]
+	if u == nil {
+		return Offline
+	}
+
+	return t.status(u, time.Now())
+}
@@ -0,0 +1,79 @@
+package presence
+
+import (
+	"testing"
+	"time"
+)
+
+type noticeRec struct {
+	userId int
+	status string
+}
+
+func TestStatuses (t *testing.T) {
+	notices := make([]noticeRec, 0)
+	tr := New(func (userId int, status string) {
+		notices = append(notices, noticeRec {userId, status})
+	})
+
+	expect := func (expected ...noticeRec) {
+		t.Helper()
+		if len(notices) != len(expected) {
+			t.Fatalf("got notices %v, expecting %v", notices, expected)
+		}
+		for i := range expected {
+			if notices[i] != expected[i] {
+				t.Fatalf("got notices %v, expecting %v", notices, expected)
+			}
+		}
+		notices = notices[:0]
+	}
+
+	tr.Connect(1)
+	tr.Connect(1)
+	expect(noticeRec {1, Online})
+
+	tr.Disconnect(1)
+	expect()
+
+	if e := tr.SetStatus(1, "busy"); e != UnknownStatus {
+		t.Fatalf("unexpected error: %v", e)
+	}
+
+	tr.SetStatus(1, DoNotDisturb)
+	tr.Touch(1)
+	expect(noticeRec {1, DoNotDisturb})
+
+	tr.Disconnect(1)
+	expect(noticeRec {1, Offline})
+
+	// выставленный вручную статус сохраняется до следующего подключения
+	tr.Connect(1)
+	expect(noticeRec {1, DoNotDisturb})
+
+	tr.SetStatus(1, Online)
+	expect(noticeRec {1, Online})
+
+	if s := tr.Status(2); s != Offline {
+		t.Fatalf("unknown user is %s", s)
+	}
+}
+
+func TestIdle (t *testing.T) {
+	tr := New(nil)
+	tr.idleTimeout = time.Minute
+	tr.Connect(1)
+
+	tr.lock.Lock()
+	tr.users[1].lastActive = time.Now().Add(-2 * time.Minute)
+	tr.lock.Unlock()
+
+	if s := tr.Status(1); s != Away {
+		t.Fatalf("idle user is %s", s)
+	}
+
+	tr.Touch(1)
+	if s := tr.Status(1); s != Online {
+		t.Fatalf("active user is %s", s)
+	}
+}
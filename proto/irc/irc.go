@@ -0,0 +1,937 @@
+package irc
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/ava12/go-chat/access"
+	"github.com/ava12/go-chat/hub"
+	"github.com/ava12/go-chat/proto"
+	"github.com/ava12/go-chat/room"
+	"github.com/ava12/go-chat/user"
+)
+
+// Шлюз IRC (RFC 1459/2812) поверх протокола proto/simple: команды клиента переводятся в запросы протокола,
+// сообщения протокола - в строки IRC, поэтому пользователи IRC и веб-клиента сидят в одних комнатах.
+// Вход - PASS <пароль>, NICK <имя пользователя>, USER. Канал комнаты - #<номер комнаты>,
+// JOIN принимает также название комнаты с "_" вместо пробелов.
+
+const (
+	DefaultName = "go-chat"
+	RegisterTimeout = 30 * time.Second
+	WriteTimeout = 10 * time.Second
+	MaxLineSize = 8192
+
+	maxTextBytes = 400 // текст в одной строке PRIVMSG, чтобы строка с префиксом уложилась в 512 байт
+	maxNamesBytes = 400
+	maxPending = 16
+)
+
+var (
+	Quit = errors.New("client quit")
+	NotRegistered = errors.New("registration timed out")
+	NoPasswords = errors.New("user registry cannot check passwords")
+)
+
+// ответы и запросы proto/simple, которые переводит шлюз
+const (
+	textMessageType = 1
+
+	errorResp = "error"
+	messageResp = "message"
+	editMessageResp = "edit-message"
+	enterResp = "enter"
+	leaveResp = "leave"
+	roomUpdatedResp = "room-updated"
+	roomDeletedResp = "room-deleted"
+)
+
+type requestRec struct {
+	Request string `json:"request"`
+	Body interface {} `json:"body"`
+}
+
+type responseRec struct {
+	Response string `json:"response"`
+	Body json.RawMessage `json:"body"`
+}
+
+type roomIdRec struct {
+	RoomId int `json:"roomId"`
+}
+
+type messageRec struct {
+	RoomId int `json:"roomId"`
+	MessageType int `json:"messageType"`
+	Data textRec `json:"data"`
+}
+
+type textRec struct {
+	Text string `json:"text"`
+}
+
+type messageEntryRec struct {
+	RoomId int `json:"roomId"`
+	UserId int `json:"userId"`
+	EditorId int `json:"editorId"`
+	Data struct {
+		MessageType int `json:"messageType"`
+		Data textRec `json:"data"`
+	} `json:"data"`
+}
+
+type userRec struct {
+	Id int `json:"id"`
+	Name string `json:"name"`
+}
+
+type enterRec struct {
+	RoomId int `json:"roomId"`
+	User userRec `json:"user"`
+}
+
+type leaveRec struct {
+	RoomId int `json:"roomId"`
+	UserId int `json:"userId"`
+	ModeratorId int `json:"moderatorId"`
+}
+
+type updateRoomRec struct {
+	RoomId int `json:"roomId"`
+	Topic string `json:"topic"`
+}
+
+type errorRec struct {
+	Message string `json:"message"`
+}
+
+
+type Gateway struct {
+	name string
+	proto proto.Proto
+	hub *hub.Hub
+	users user.Registry
+	rooms room.Registry
+	access access.Controller
+	registerTimeout, writeTimeout time.Duration
+}
+
+// name - имя сервера в префиксах строк; p - протокол proto/simple на том же хабе
+func New (name string, p proto.Proto, h *hub.Hub, users user.Registry, rooms room.Registry, ac access.Controller) *Gateway {
+	if name == "" {
+		name = DefaultName
+	}
+	return &Gateway {name, p, h, users, rooms, ac, RegisterTimeout, WriteTimeout}
+}
+
+// время на PASS, NICK и USER; действует на подключения, созданные после вызова
+func (g *Gateway) SetRegisterTimeout (timeout time.Duration) {
+	g.registerTimeout = timeout
+}
+
+// время записи одной строки, после которого подключение закрывается
+func (g *Gateway) SetWriteTimeout (timeout time.Duration) {
+	g.writeTimeout = timeout
+}
+
+// подключение до входа
+func (g *Gateway) NewConn (nc net.Conn) *connRec {
+	scanner := bufio.NewScanner(nc)
+	scanner.Buffer(make([]byte, 0, 512), MaxLineSize)
+	return &connRec {g: g, nc: nc, scanner: scanner, nick: "*", joined: make(map[int]string), alive: 1}
+}
+
+// ник пользователя: имя без символов, недопустимых в нике
+func Nick (name string) string {
+	name = strings.Map(func (r rune) rune {
+		if r <= ' ' || strings.ContainsRune(",*?!@:", r) {
+			return '_'
+		}
+		return r
+	}, name)
+	if name == "" || strings.ContainsRune("#&+~", rune(name[0])) {
+		name = "_" + name
+	}
+	return name
+}
+
+func Channel (roomId int) string {
+	return "#" + strconv.Itoa(roomId)
+}
+
+func (g *Gateway) userName (userId int) string {
+	entry, found := g.users.User(userId)
+	u := userRec {}
+	if found {
+		data, e := json.Marshal(entry)
+		if e == nil {
+			json.Unmarshal(data, &u)
+		}
+	}
+	if u.Name == "" {
+		u.Name = "user" + strconv.Itoa(userId)
+	}
+	return u.Name
+}
+
+func (g *Gateway) prefix (userId int) string {
+	nick := Nick(g.userName(userId))
+	return nick + "!u" + strconv.Itoa(userId) + "@" + g.name
+}
+
+// комната по имени канала: #<номер> или название; личные комнаты - только по номеру и только участникам
+func (g *Gateway) findRoom (userId int, channel string) (room.Entry, bool) {
+	if !strings.HasPrefix(channel, "#") {
+		return room.Entry {}, false
+	}
+
+	channel = channel[1:]
+	id, e := strconv.Atoi(channel)
+	if e == nil {
+		entry, found := g.rooms.Room(id)
+		if found && entry.IsDirect() && !entry.HasUser(userId) {
+			found = false
+		}
+		return entry, found
+	}
+
+	for _, entry := range g.rooms.ListRooms() {
+		if !entry.IsDirect() && strings.EqualFold(Nick(entry.Name), Nick(channel)) {
+			return entry, true
+		}
+	}
+	return room.Entry {}, false
+}
+
+// тема канала: название комнаты и ее тема
+func topic (entry room.Entry) string {
+	result := "[" + entry.Name + "]"
+	if entry.Topic != "" {
+		result += " " + entry.Topic
+	}
+	return oneLine(result)
+}
+
+func oneLine (s string) string {
+	return strings.Map(func (r rune) rune {
+		if r == '\r' || r == '\n' || r == 0 {
+			return ' '
+		}
+		return r
+	}, s)
+}
+
+// разбивает текст сообщения на строки не длиннее maxTextBytes
+func textLines (text string) []string {
+	result := make([]string, 0, 1)
+	for _, line := range strings.Split(text, "\n") {
+		line = oneLine(strings.TrimRight(line, "\r"))
+		for len(line) > maxTextBytes {
+			n := maxTextBytes
+			for n > 0 && !utf8.RuneStart(line[n]) {
+				n--
+			}
+			result = append(result, line[:n])
+			line = line[n:]
+		}
+		if line != "" {
+			result = append(result, line)
+		}
+	}
+	return result
+}
+
+// разбор строки IRC: [:префикс] команда параметры [:последний параметр]
+func parseLine (line string) (command string, params []string) {
+	line = strings.TrimRight(line, "\r")
+	if strings.HasPrefix(line, "@") {
+		// теги IRCv3 не поддерживаются
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			line = strings.TrimLeft(line[i:], " ")
+		} else {
+			return "", nil
+		}
+	}
+	if strings.HasPrefix(line, ":") {
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			line = strings.TrimLeft(line[i:], " ")
+		} else {
+			return "", nil
+		}
+	}
+
+	for line != "" {
+		if line[0] == ':' {
+			params = append(params, line[1:])
+			break
+		}
+
+		i := strings.IndexByte(line, ' ')
+		if i < 0 {
+			params = append(params, line)
+			break
+		}
+		params = append(params, line[:i])
+		line = strings.TrimLeft(line[i:], " ")
+	}
+
+	if len(params) == 0 {
+		return "", nil
+	}
+	return strings.ToUpper(params[0]), params[1:]
+}
+
+
+func (g *Gateway) login (name, password string) (int, string, error) {
+	auth, ok := g.users.(user.Authenticator)
+	if !ok {
+		return 0, "", NoPasswords
+	}
+
+	id, _, e := auth.Authenticate(name, password)
+	if e != nil {
+		return 0, "", e
+	}
+	return id, Nick(g.userName(id)), nil
+}
+
+
+type pendingRec struct {
+	roomId int
+	text string
+}
+
+type connRec struct {
+	g *Gateway
+	nc net.Conn
+	scanner *bufio.Scanner
+	id, userId int
+	nick string
+	scope access.Scope
+
+	lock sync.Mutex
+	joined map[int]string // номер комнаты: тема канала
+	pending []pendingRec // отправленные сообщения, эхо которых клиенту не нужно
+
+	writeLock sync.Mutex // записи в соединение по одной
+	alive int32
+}
+
+// принимает PASS, NICK и USER не дольше RegisterTimeout и входит как пользователь NICK
+func (c *connRec) Register () error {
+	c.nc.SetReadDeadline(time.Now().Add(c.g.registerTimeout))
+	defer c.nc.SetReadDeadline(time.Time {})
+
+	var password, nick string
+	hasUser := false
+	for nick == "" || !hasUser {
+		if !c.scanner.Scan() {
+			e := c.scanner.Err()
+			if e == nil {
+				e = Quit
+			} else if ne, ok := e.(net.Error); ok && ne.Timeout() {
+				e = NotRegistered
+			}
+			return e
+		}
+
+		command, params := parseLine(c.scanner.Text())
+		switch command {
+		case "":
+		case "CAP":
+			if len(params) > 0 && strings.ToUpper(params[0]) == "LS" {
+				c.write(":" + c.g.name + " CAP * LS :")
+			}
+		case "PASS":
+			if len(params) > 0 {
+				password = params[0]
+			}
+		case "NICK":
+			if len(params) > 0 {
+				nick = params[0]
+			} else {
+				c.reply("431", "No nickname given")
+			}
+		case "USER":
+			if len(params) < 4 {
+				c.reply("461", "USER", "Not enough parameters")
+			} else {
+				hasUser = true
+			}
+		case "PING":
+			c.pong(params)
+		case "QUIT":
+			return Quit
+		default:
+			c.reply("451", "You have not registered")
+		}
+	}
+
+	uid, name, e := c.g.login(nick, password)
+	if e != nil {
+		return e
+	}
+
+	c.userId = uid
+	c.nick = name
+	return nil
+}
+
+// сообщает об ошибке входа и закрывает подключение
+func (c *connRec) Reject (e error) {
+	if e == user.WrongCredentials || e == user.BadName {
+		c.reply("464", "Password incorrect")
+	}
+	if e != Quit {
+		c.write("ERROR :Closing link: " + oneLine(e.Error()))
+	} else {
+		c.write("ERROR :Closing link")
+	}
+	c.Close()
+}
+
+// приветствует клиента, подключает его к протоколу и сообщает о комнатах, в которых пользователь уже есть;
+// scope ограничивает разрешения подключения
+func (c *connRec) Accept (id int, scope access.Scope) {
+	c.id = id
+	c.scope = scope
+	c.reply("001", "Welcome to the chat, " + c.nick)
+	c.reply("002", "Your host is " + c.g.name)
+	c.reply("003", "This server speaks the chat protocol through an IRC gateway")
+	c.write(":" + c.g.name + " 004 " + c.nick + " " + c.g.name + " go-chat o nt")
+	c.write(":" + c.g.name + " 005 " + c.nick + " CHANTYPES=# NICKLEN=" + strconv.Itoa(user.MaxNameLen) + " :are supported by this server")
+	c.reply("422", "MOTD File is missing")
+
+	c.g.proto.Connect(c)
+	for _, rid := range c.g.hub.UserRoomIds(c.userId) {
+		c.join(rid)
+	}
+}
+
+// выполняет команды до разрыва связи, после чего отключает подключение от протокола
+func (c *connRec) Serve () {
+	for c.scanner.Scan() {
+		command, params := parseLine(c.scanner.Text())
+		if command == "QUIT" {
+			c.write("ERROR :Closing link")
+			break
+		}
+
+		c.command(command, params)
+	}
+
+	if e := c.scanner.Err(); e != nil && c.IsAlive() {
+		log.Printf("u%dc%d (irc %s) %s\n", c.userId, c.id, c.nc.RemoteAddr(), e.Error())
+	}
+	c.Close()
+	c.g.proto.Disconnect(c.id)
+}
+
+func (c *connRec) command (command string, params []string) {
+	switch command {
+	case "":
+	case "PING":
+		c.pong(params)
+	case "PONG", "CAP":
+	case "PASS", "USER":
+		c.reply("462", "You may not reregister")
+	case "NICK":
+		c.notice("nick change is not supported")
+	case "JOIN":
+		c.joinCommand(params)
+	case "PART":
+		c.partCommand(params)
+	case "PRIVMSG", "NOTICE":
+		c.messageCommand(command, params)
+	case "NAMES":
+		c.namesCommand(params)
+	case "LIST":
+		c.listCommand()
+	case "TOPIC":
+		c.topicCommand(params)
+	case "WHO":
+		c.whoCommand(params)
+	case "MODE":
+		c.modeCommand(params)
+	default:
+		c.reply("421", command, "Unknown command")
+	}
+}
+
+func (c *connRec) request (name string, body interface {}) {
+	data, e := json.Marshal(requestRec {name, body})
+	if e != nil {
+		log.Println(e)
+		return
+	}
+
+	c.g.proto.TakeRequest(c, data)
+}
+
+func (c *connRec) isJoined (roomId int) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	_, found := c.joined[roomId]
+	return found
+}
+
+// параметр - каналы через запятую
+func (c *connRec) channelRooms (param string) []room.Entry {
+	result := make([]room.Entry, 0, 1)
+	for _, channel := range strings.Split(param, ",") {
+		if channel == "" {
+			continue
+		}
+
+		entry, found := c.g.findRoom(c.userId, channel)
+		if found {
+			result = append(result, entry)
+		} else {
+			c.reply("403", channel, "No such channel")
+		}
+	}
+	return result
+}
+
+func (c *connRec) joinCommand (params []string) {
+	if len(params) == 0 {
+		c.reply("461", "JOIN", "Not enough parameters")
+		return
+	}
+
+	if params[0] == "0" {
+		c.lock.Lock()
+		rids := make([]int, 0, len(c.joined))
+		for rid := range c.joined {
+			rids = append(rids, rid)
+		}
+		c.lock.Unlock()
+
+		for _, rid := range rids {
+			c.request("leave", roomIdRec {rid})
+		}
+		return
+	}
+
+	// канал появится у клиента по уведомлению о входе
+	for _, entry := range c.channelRooms(params[0]) {
+		if !c.isJoined(entry.Id) {
+			c.request("enter", roomIdRec {entry.Id})
+		}
+	}
+}
+
+func (c *connRec) partCommand (params []string) {
+	if len(params) == 0 {
+		c.reply("461", "PART", "Not enough parameters")
+		return
+	}
+
+	for _, entry := range c.channelRooms(params[0]) {
+		if c.isJoined(entry.Id) {
+			c.request("leave", roomIdRec {entry.Id})
+		} else {
+			c.reply("442", Channel(entry.Id), "You're not on that channel")
+		}
+	}
+}
+
+func (c *connRec) messageCommand (command string, params []string) {
+	if len(params) < 2 {
+		if command == "PRIVMSG" {
+			c.reply("412", "No text to send")
+		}
+		return
+	}
+
+	text := strings.TrimSpace(params[1])
+	for _, target := range strings.Split(params[0], ",") {
+		if !strings.HasPrefix(target, "#") {
+			if command == "PRIVMSG" {
+				c.reply("401", target, "Direct messages are not supported, use a shared channel")
+			}
+			continue
+		}
+
+		entry, found := c.g.findRoom(c.userId, target)
+		if !found || !c.isJoined(entry.Id) {
+			if command == "PRIVMSG" {
+				c.reply("404", target, "Cannot send to channel")
+			}
+			continue
+		}
+
+		if text == "" {
+			continue
+		}
+
+		c.lock.Lock()
+		c.pending = append(c.pending, pendingRec {entry.Id, text})
+		if len(c.pending) > maxPending {
+			c.pending = c.pending[len(c.pending) - maxPending:]
+		}
+		c.lock.Unlock()
+
+		c.request("message", messageRec {entry.Id, textMessageType, textRec {text}})
+	}
+}
+
+func (c *connRec) namesCommand (params []string) {
+	var rids []int
+	if len(params) > 0 {
+		for _, entry := range c.channelRooms(params[0]) {
+			rids = append(rids, entry.Id)
+		}
+	} else {
+		c.lock.Lock()
+		for rid := range c.joined {
+			rids = append(rids, rid)
+		}
+		c.lock.Unlock()
+	}
+
+	for _, rid := range rids {
+		c.names(rid)
+	}
+	if len(params) == 0 {
+		c.reply("366", "*", "End of NAMES list")
+	}
+}
+
+// список участников канала, только для вошедших в комнату
+func (c *connRec) names (roomId int) {
+	channel := Channel(roomId)
+	if c.isJoined(roomId) {
+		line := ""
+		for _, uid := range c.g.hub.RoomUserIds(roomId) {
+			nick := Nick(c.g.userName(uid))
+			if line != "" && len(line) + len(nick) >= maxNamesBytes {
+				c.reply("353", "=", channel, line)
+				line = ""
+			}
+			if line != "" {
+				line += " "
+			}
+			line += nick
+		}
+		if line != "" {
+			c.reply("353", "=", channel, line)
+		}
+	}
+	c.reply("366", channel, "End of NAMES list")
+}
+
+// те же комнаты, что в list-rooms протокола
+func (c *connRec) listCommand () {
+	if c.g.access.GlobalPerms(c.userId) & c.scope.Global & access.ListRoomsPerm != 0 {
+		for _, entry := range c.g.rooms.ListRooms() {
+			if entry.IsDirect() || (entry.Visibility == room.Unlisted && !c.g.hub.IsInRoom(c.userId, entry.Id)) {
+				continue
+			}
+
+			if c.g.access.RoomPerms(c.userId, entry.Id) & c.scope.Room != 0 {
+				count := len(c.g.hub.RoomUserIds(entry.Id))
+				c.reply("322", Channel(entry.Id), strconv.Itoa(count), topic(entry))
+			}
+		}
+	}
+	c.reply("323", "End of LIST")
+}
+
+func (c *connRec) topicCommand (params []string) {
+	if len(params) == 0 {
+		c.reply("461", "TOPIC", "Not enough parameters")
+		return
+	}
+
+	entry, found := c.g.findRoom(c.userId, params[0])
+	if !found {
+		c.reply("403", params[0], "No such channel")
+		return
+	}
+
+	if len(params) > 1 {
+		// новая тема придет уведомлением room-updated
+		c.request("update-room", updateRoomRec {entry.Id, params[1]})
+		return
+	}
+
+	c.reply("332", Channel(entry.Id), topic(entry))
+}
+
+func (c *connRec) whoCommand (params []string) {
+	mask := "*"
+	if len(params) > 0 {
+		mask = params[0]
+	}
+
+	if strings.HasPrefix(mask, "#") {
+		entry, found := c.g.findRoom(c.userId, mask)
+		if found && c.isJoined(entry.Id) {
+			channel := Channel(entry.Id)
+			for _, uid := range c.g.hub.RoomUserIds(entry.Id) {
+				name := c.g.userName(uid)
+				c.reply("352", channel, "u" + strconv.Itoa(uid), c.g.name, c.g.name, Nick(name), "H", "0 " + oneLine(name))
+			}
+		}
+	}
+	c.reply("315", mask, "End of WHO list")
+}
+
+func (c *connRec) modeCommand (params []string) {
+	if len(params) == 0 {
+		c.reply("461", "MODE", "Not enough parameters")
+		return
+	}
+
+	if len(params) > 1 {
+		return
+	}
+
+	if strings.HasPrefix(params[0], "#") {
+		entry, found := c.g.findRoom(c.userId, params[0])
+		if found {
+			c.write(":" + c.g.name + " 324 " + c.nick + " " + Channel(entry.Id) + " +nt")
+		} else {
+			c.reply("403", params[0], "No such channel")
+		}
+	} else if params[0] == c.nick {
+		c.write(":" + c.g.name + " 221 " + c.nick + " +")
+	}
+}
+
+func (c *connRec) pong (params []string) {
+	token := c.g.name
+	if len(params) > 0 {
+		token = params[0]
+	}
+	c.write(":" + c.g.name + " PONG " + c.g.name + " :" + oneLine(token))
+}
+
+// канал появляется у клиента: JOIN, тема и участники
+func (c *connRec) join (roomId int) {
+	entry, found := c.g.rooms.Room(roomId)
+	if !found {
+		return
+	}
+
+	c.lock.Lock()
+	_, joined := c.joined[roomId]
+	t := topic(entry)
+	c.joined[roomId] = t
+	c.lock.Unlock()
+	if joined {
+		return
+	}
+
+	channel := Channel(roomId)
+	c.write(":" + c.g.prefix(c.userId) + " JOIN " + channel)
+	c.reply("332", channel, t)
+	c.names(roomId)
+}
+
+// канал пропадает у клиента
+func (c *connRec) part (roomId, moderatorId int, reason string) bool {
+	c.lock.Lock()
+	_, joined := c.joined[roomId]
+	delete(c.joined, roomId)
+	c.lock.Unlock()
+	if !joined {
+		return false
+	}
+
+	channel := Channel(roomId)
+	if moderatorId != 0 {
+		c.write(":" + c.g.prefix(moderatorId) + " KICK " + channel + " " + c.nick + " :" + reason)
+	} else {
+		c.write(":" + c.g.prefix(c.userId) + " PART " + channel + " :" + reason)
+	}
+	return true
+}
+
+// true, если сообщение отправлено этим подключением
+func (c *connRec) isEcho (m *messageEntryRec) bool {
+	if m.UserId != c.userId {
+		return false
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for i, p := range c.pending {
+		if p.roomId == m.RoomId && p.text == m.Data.Data.Text {
+			c.pending = append(c.pending[:i], c.pending[i + 1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// переводит сообщение протокола в строки IRC; остальные сообщения клиенту IRC не нужны
+func (c *connRec) translate (resp *responseRec) {
+	switch resp.Response {
+	case messageResp, editMessageResp:
+		m := &messageEntryRec {}
+		if json.Unmarshal(resp.Body, m) != nil || m.Data.MessageType != textMessageType {
+			return
+		}
+
+		command := "PRIVMSG"
+		sender := m.UserId
+		text := m.Data.Data.Text
+		if resp.Response == editMessageResp {
+			if !c.isJoined(m.RoomId) {
+				return
+			}
+			command = "NOTICE"
+			if m.EditorId != 0 {
+				sender = m.EditorId
+			}
+			text = "(edited) " + text
+		} else if c.isEcho(m) {
+			return
+		}
+
+		// например, личная комната, созданная из веб-клиента
+		c.join(m.RoomId)
+		prefix := ":" + c.g.prefix(sender) + " " + command + " " + Channel(m.RoomId) + " :"
+		for _, line := range textLines(text) {
+			c.write(prefix + line)
+		}
+
+	case enterResp:
+		b := &enterRec {}
+		if json.Unmarshal(resp.Body, b) != nil {
+			return
+		}
+
+		if b.User.Id == c.userId {
+			c.join(b.RoomId)
+		} else if c.isJoined(b.RoomId) {
+			c.write(":" + c.g.prefix(b.User.Id) + " JOIN " + Channel(b.RoomId))
+		}
+
+	case leaveResp:
+		b := &leaveRec {}
+		if json.Unmarshal(resp.Body, b) != nil {
+			return
+		}
+
+		if b.UserId == c.userId {
+			c.part(b.RoomId, b.ModeratorId, "")
+		} else if !c.isJoined(b.RoomId) {
+			return
+		} else if b.ModeratorId != 0 {
+			c.write(":" + c.g.prefix(b.ModeratorId) + " KICK " + Channel(b.RoomId) + " " + Nick(c.g.userName(b.UserId)) + " :")
+		} else {
+			c.write(":" + c.g.prefix(b.UserId) + " PART " + Channel(b.RoomId) + " :")
+		}
+
+	case roomUpdatedResp:
+		entry := room.Entry {}
+		if json.Unmarshal(resp.Body, &entry) != nil {
+			return
+		}
+
+		t := topic(entry)
+		c.lock.Lock()
+		old, joined := c.joined[entry.Id]
+		if joined {
+			c.joined[entry.Id] = t
+		}
+		c.lock.Unlock()
+		if joined && old != t {
+			c.write(":" + c.g.name + " TOPIC " + Channel(entry.Id) + " :" + t)
+		}
+
+	case roomDeletedResp:
+		b := &roomIdRec {}
+		if json.Unmarshal(resp.Body, b) == nil {
+			c.part(b.RoomId, 0, "room deleted")
+		}
+
+	case errorResp:
+		b := &errorRec {}
+		if json.Unmarshal(resp.Body, b) == nil {
+			c.notice(b.Message)
+		}
+	}
+}
+
+func (c *connRec) notice (text string) {
+	c.write(":" + c.g.name + " NOTICE " + c.nick + " :" + oneLine(text))
+}
+
+// ответ сервера с числовым кодом; последний параметр передается после ":"
+func (c *connRec) reply (code string, params ... string) {
+	line := ":" + c.g.name + " " + code + " " + c.nick
+	for i, param := range params {
+		if i == len(params) - 1 {
+			line += " :" + oneLine(param)
+		} else {
+			line += " " + param
+		}
+	}
+	c.write(line)
+}
+
+func (c *connRec) write (line string) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	if !c.IsAlive() {
+		return
+	}
+
+	c.nc.SetWriteDeadline(time.Now().Add(c.g.writeTimeout))
+	_, e := c.nc.Write([]byte(line + "\r\n"))
+	if e != nil {
+		log.Printf("u%dc%d (irc %s) %s\n", c.userId, c.id, c.nc.RemoteAddr(), e.Error())
+		c.Close()
+	}
+}
+
+func (c *connRec) Id () int {
+	return c.id
+}
+
+func (c *connRec) UserId () int {
+	return c.userId
+}
+
+func (c *connRec) Scope () access.Scope {
+	return c.scope
+}
+
+// принимает сообщение протокола
+func (c *connRec) Send (m []byte) {
+	resp := &responseRec {}
+	e := json.Unmarshal(m, resp)
+	if e != nil {
+		log.Printf("u%dc%d (irc %s) %s\n", c.userId, c.id, c.nc.RemoteAddr(), e.Error())
+		return
+	}
+
+	c.translate(resp)
+}
+
+// не ждет завершения текущей записи: закрытое соединение прерывает ее
+func (c *connRec) Close () {
+	if atomic.CompareAndSwapInt32(&c.alive, 1, 0) {
+		c.nc.Close()
+	}
+}
+
+func (c *connRec) IsAlive () bool {
+	return (atomic.LoadInt32(&c.alive) != 0)
+}
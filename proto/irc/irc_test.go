@@ -0,0 +1,385 @@
+package irc
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ava12/go-chat/access"
+	"github.com/ava12/go-chat/access/role"
+	"github.com/ava12/go-chat/hub"
+	"github.com/ava12/go-chat/proto/simple"
+	"github.com/ava12/go-chat/room"
+	"github.com/ava12/go-chat/user"
+	roleram "github.com/ava12/go-chat/access/role/ram"
+	roomram "github.com/ava12/go-chat/room/ram"
+)
+
+func TestParseLine (t *testing.T) {
+	samples := []struct {
+		line, command string
+		params []string
+	} {
+		{"privmsg #1 :hello  world\r", "PRIVMSG", []string {"#1", "hello  world"}},
+		{":nick!u@host JOIN #1,#dev", "JOIN", []string {"#1,#dev"}},
+		{"@time=x PING :token", "PING", []string {"token"}},
+		{"USER x 0 * :Real Name", "USER", []string {"x", "0", "*", "Real Name"}},
+		{"PRIVMSG #1 :", "PRIVMSG", []string {"#1", ""}},
+		{":prefix", "", nil},
+		{"", "", nil},
+	}
+
+	for _, s := range samples {
+		command, params := parseLine(s.line)
+		if command != s.command || !reflect.DeepEqual(params, s.params) {
+			t.Errorf("%q: got %q %q, expecting %q %q", s.line, command, params, s.command, s.params)
+		}
+	}
+}
+
+func TestTextLines (t *testing.T) {
+	long := strings.Repeat("я", maxTextBytes)
+	lines := textLines("one\r\n\ntwo\n" + long)
+	if len(lines) != 4 || lines[0] != "one" || lines[1] != "two" || lines[2] + lines[3] != long {
+		t.Fatalf("bad lines: %q", lines)
+	}
+	for _, line := range lines {
+		if len(line) > maxTextBytes || !strings.HasPrefix(long, line) && line != "one" && line != "two" {
+			t.Fatalf("line is too long or split inside a rune: %q", line)
+		}
+	}
+
+	if lines = textLines("bare\rreturn\r"); len(lines) != 1 || lines[0] != "bare return" {
+		t.Fatalf("bad lines with bare CR: %q", lines)
+	}
+
+	if Nick("bob smith:1") != "bob_smith_1" || Nick("#room") != "_#room" {
+		t.Fatalf("bad nicks: %q, %q", Nick("bob smith:1"), Nick("#room"))
+	}
+}
+
+const (
+	alice = iota + 1
+	bob
+	carol
+	dave
+)
+
+const (
+	general = iota + 1
+	secret
+)
+
+const (
+	testPassword = "password"
+	expectTimeout = time.Second
+)
+
+// реестр без bcrypt, чтобы вход в тестах не тормозил: пароль у всех testPassword
+type testUsersRec []string
+
+func (u testUsersRec) User (id int) (interface {}, bool) {
+	if id < 1 || id > len(u) {
+		return nil, false
+	}
+	return userRec {id, u[id - 1]}, true
+}
+
+func (u testUsersRec) Login (w http.ResponseWriter, r *http.Request) (int, interface {}, error) {
+	return 0, nil, user.WrongCredentials
+}
+
+func (u testUsersRec) Authenticate (name, password string) (int, interface {}, error) {
+	for i, n := range u {
+		if n == name && password == testPassword {
+			return i + 1, userRec {i + 1, n}, nil
+		}
+	}
+	return 0, nil, user.WrongCredentials
+}
+
+// шлюз поверх протокола и хаба в памяти; carol в #general без права писать, dave - без права входить,
+// в #secret без приглашения не войти
+func newTestGateway (t *testing.T) (*Gateway, *hub.Hub) {
+	users := testUsersRec {"alice", "bob", "carol", "dave"}
+	rooms := roomram.NewRegistry()
+	rooms.CreateRoom("general", alice)
+	rooms.CreateRoom("secret", alice)
+	rooms.SetVisibility(secret, room.InviteOnly)
+
+	ac, e := role.NewController(role.DefaultConf(), roleram.NewStorage(), rooms)
+	if e != nil {
+		t.Fatal(e)
+	}
+	ac.NewRoom(alice, general)
+	ac.NewRoom(alice, secret)
+	for uid, r := range map[int]string {carol: role.Muted, dave: role.Banned} {
+		if e = ac.SetRoomRole(alice, uid, general, r); e != nil {
+			t.Fatal(e)
+		}
+	}
+
+	h := hub.New(hub.NewMemStorage())
+	h.Start()
+	p := simple.New(h, users, rooms, ac)
+	if e = p.RestoreRooms(); e != nil {
+		t.Fatal(e)
+	}
+	t.Cleanup(func () {
+		p.Stop()
+		h.Stop()
+	})
+
+	g := New("test", p, h, users, rooms, ac)
+	g.SetRegisterTimeout(expectTimeout / 2)
+	g.SetWriteTimeout(expectTimeout / 2)
+	return g, h
+}
+
+type clientRec struct {
+	nc net.Conn
+	lines chan string
+}
+
+// подключение с серверной стороны обслуживается так же, как в server.serveIrc;
+// строки от сервера читаются сразу, иначе синхронный net.Pipe остановит запись
+func connect (t *testing.T, g *Gateway, id int, scope access.Scope) *clientRec {
+	server, client := net.Pipe()
+	c := &clientRec {client, make(chan string, 100)}
+	t.Cleanup(func () {
+		client.Close()
+	})
+
+	go func () {
+		conn := g.NewConn(server)
+		e := conn.Register()
+		if e != nil {
+			conn.Reject(e)
+			return
+		}
+
+		conn.Accept(id, scope)
+		conn.Serve()
+	}()
+
+	go func () {
+		defer close(c.lines)
+		scanner := bufio.NewScanner(client)
+		for scanner.Scan() {
+			c.lines <- scanner.Text()
+		}
+	}()
+
+	return c
+}
+
+func (c *clientRec) send (t *testing.T, lines ... string) {
+	t.Helper()
+	for _, line := range lines {
+		if _, e := io.WriteString(c.nc, line + "\r\n"); e != nil {
+			t.Fatal(e)
+		}
+	}
+}
+
+// пропускает строки до первой, содержащей все подстроки
+func (c *clientRec) expect (t *testing.T, parts ... string) string {
+	t.Helper()
+	timeout := time.After(expectTimeout)
+	for {
+		select {
+		case line, ok := <-c.lines:
+			if !ok {
+				t.Fatalf("connection closed, expecting %q", parts)
+			}
+
+			found := true
+			for _, part := range parts {
+				found = found && strings.Contains(line, part)
+			}
+			if found {
+				return line
+			}
+
+		case <-timeout:
+			t.Fatalf("timed out, expecting %q", parts)
+		}
+	}
+}
+
+func login (t *testing.T, g *Gateway, id int, name string) *clientRec {
+	t.Helper()
+	return loginScoped(t, g, id, name, access.FullScope)
+}
+
+func loginScoped (t *testing.T, g *Gateway, id int, name string, scope access.Scope) *clientRec {
+	t.Helper()
+	c := connect(t, g, id, scope)
+	c.send(t, "CAP LS 302", "PASS " + testPassword, "NICK " + name, "USER " + name + " 0 * :" + name)
+	c.expect(t, " 001 " + name + " ")
+	c.expect(t, " 422 ")
+	return c
+}
+
+func TestRegister (t *testing.T) {
+	g, _ := newTestGateway(t)
+
+	c := connect(t, g, 1, access.FullScope)
+	c.send(t, "JOIN #1")
+	c.expect(t, " 451 ")
+	c.send(t, "PASS wrongpassword", "NICK alice", "USER alice 0 * :Alice")
+	c.expect(t, " 464 ")
+	c.expect(t, "ERROR :Closing link")
+	for line := range c.lines {
+		t.Fatalf("unexpected line after rejection: %q", line)
+	}
+
+	c = login(t, g, 2, "alice")
+	c.send(t, "PING :token", "PASS again")
+	c.expect(t, "PONG test :token")
+	c.expect(t, " 462 alice ")
+	c.send(t, "QUIT")
+	c.expect(t, "ERROR :Closing link")
+
+	g.SetRegisterTimeout(50 * time.Millisecond)
+	c = connect(t, g, 3, access.FullScope)
+	c.send(t, "NICK alice")
+	c.expect(t, "ERROR :Closing link: registration timed out")
+}
+
+func TestJoinPart (t *testing.T) {
+	g, h := newTestGateway(t)
+	a := login(t, g, 1, "alice")
+	b := login(t, g, 2, "bob")
+
+	a.send(t, "JOIN #1")
+	a.expect(t, ":alice!u1@test JOIN #1")
+	a.expect(t, " 332 alice #1 :[general]")
+	a.expect(t, " 353 alice = #1 :alice")
+	a.expect(t, " 366 alice #1 ")
+	if !h.IsInRoom(alice, general) {
+		t.Fatal("JOIN did not enter the room")
+	}
+
+	// канал по названию комнаты
+	b.send(t, "JOIN #General")
+	b.expect(t, ":bob!u2@test JOIN #1")
+	a.expect(t, ":bob!u2@test JOIN #1")
+	if !h.IsInRoom(bob, general) {
+		t.Fatal("JOIN by room name did not enter the room")
+	}
+
+	b.send(t, "PART #1")
+	b.expect(t, ":bob!u2@test PART #1")
+	a.expect(t, ":bob!u2@test PART #1")
+	if h.IsInRoom(bob, general) {
+		t.Fatal("PART did not leave the room")
+	}
+
+	b.send(t, "PART #1", "JOIN #7")
+	b.expect(t, " 442 bob #1 ")
+	b.expect(t, " 403 bob #7 ")
+}
+
+func TestMessages (t *testing.T) {
+	g, _ := newTestGateway(t)
+	a := login(t, g, 1, "alice")
+	b := login(t, g, 2, "bob")
+	for _, c := range []*clientRec {a, b} {
+		c.send(t, "JOIN #1")
+		c.expect(t, " 366 ")
+	}
+	a.expect(t, ":bob!u2@test JOIN #1")
+
+	a.send(t, "PRIVMSG #1 :hello, bob")
+	b.expect(t, ":alice!u1@test PRIVMSG #1 :hello, bob")
+
+	// свое сообщение не возвращается отправителю
+	b.send(t, "PRIVMSG #1 :hi")
+	if line := a.expect(t, "PRIVMSG"); line != ":bob!u2@test PRIVMSG #1 :hi" {
+		t.Fatalf("unexpected message %q", line)
+	}
+
+	a.send(t, "PRIVMSG #2 :psst", "PRIVMSG bob :psst")
+	a.expect(t, " 404 alice #2 ")
+	a.expect(t, " 401 alice bob ")
+}
+
+func TestNamesList (t *testing.T) {
+	g, _ := newTestGateway(t)
+	a := login(t, g, 1, "alice")
+	b := login(t, g, 2, "bob")
+	for _, c := range []*clientRec {a, b} {
+		c.send(t, "JOIN #1")
+		c.expect(t, " 366 ")
+	}
+
+	a.send(t, "NAMES #1")
+	line := a.expect(t, " 353 alice = #1 :")
+	if !strings.Contains(line, "alice") || !strings.Contains(line, "bob") {
+		t.Fatalf("unexpected names %q", line)
+	}
+	a.expect(t, " 366 alice #1 ")
+
+	b.send(t, "LIST")
+	if line = b.expect(t, " 32"); line != ":test 322 bob #1 2 :[general]" {
+		t.Fatalf("unexpected list entry %q", line)
+	}
+	b.expect(t, " 323 bob ")
+}
+
+func TestDenied (t *testing.T) {
+	g, h := newTestGateway(t)
+	a := login(t, g, 1, "alice")
+	b := login(t, g, 2, "bob")
+	c := login(t, g, 3, "carol")
+	d := login(t, g, 4, "dave")
+
+	d.send(t, "JOIN #1")
+	d.expect(t, "NOTICE dave :you cannot enter room #1")
+	b.send(t, "JOIN #2")
+	b.expect(t, "NOTICE bob :you cannot enter room #2")
+	if h.IsInRoom(dave, general) || h.IsInRoom(bob, secret) {
+		t.Fatal("denied JOIN entered the room")
+	}
+
+	b.send(t, "LIST")
+	if line := b.expect(t, " 32"); line != ":test 322 bob #1 0 :[general]" {
+		t.Fatalf("unexpected list entry %q", line)
+	}
+	b.expect(t, " 323 bob ")
+
+	for _, cl := range []*clientRec {a, b, c} {
+		cl.send(t, "JOIN #1")
+		cl.expect(t, " 366 ")
+	}
+	c.send(t, "PRIVMSG #1 :spam")
+	c.expect(t, "NOTICE carol :you cannot post messages in room #1")
+
+	// сообщение carol не создано: следующее сообщение в канале - от alice
+	a.send(t, "PRIVMSG #1 :after")
+	if line := b.expect(t, "PRIVMSG"); line != ":alice!u1@test PRIVMSG #1 :after" {
+		t.Fatalf("unexpected message %q", line)
+	}
+}
+
+// область подключения сужает разрешения так же, как у API-токенов
+func TestScope (t *testing.T) {
+	g, _ := newTestGateway(t)
+	b := loginScoped(t, g, 2, "bob", access.Scope {Room: access.ReadPerm})
+
+	b.send(t, "LIST")
+	if line := b.expect(t, " 32"); line != ":test 323 bob :End of LIST" {
+		t.Fatalf("rooms listed without list-rooms: %q", line)
+	}
+
+	b.send(t, "JOIN #1")
+	b.expect(t, " 366 ")
+	b.send(t, "PRIVMSG #1 :hi")
+	b.expect(t, "NOTICE bob :you cannot post messages in room #1")
+}
@@ -6,10 +6,16 @@ import (
 	"github.com/ava12/go-chat/user"
 	"github.com/ava12/go-chat/room"
 	"github.com/ava12/go-chat/access"
+	"github.com/ava12/go-chat/presence"
+	"github.com/ava12/go-chat/cursor"
+	"github.com/ava12/go-chat/invite"
 	"encoding/json"
 	"strings"
 	"log"
 	"fmt"
+	"sync"
+	"time"
+	"unicode/utf8"
 )
 
 
@@ -30,6 +36,34 @@ const (
 	listMessagesReq = "list-messages"
 	userInfoReq = "user-info"
 	roomInfoReq = "room-info"
+	editMessageReq = "edit-message"
+	deleteMessageReq = "delete-message"
+	messageHistoryReq = "message-history"
+	resumeReq = "resume"
+	setPresenceReq = "set-presence"
+	listPresenceReq = "list-presence"
+	typingStartReq = "typing-start"
+	typingStopReq = "typing-stop"
+	markReadReq = "mark-read"
+	readReceiptsReq = "read-receipts"
+	startDmReq = "start-dm"
+	listDmsReq = "list-dms"
+	grantRoleReq = "grant-role"
+	revokeRoleReq = "revoke-role"
+	listRolesReq = "list-roles"
+	kickReq = "kick"
+	banReq = "ban"
+	unbanReq = "unban"
+	muteReq = "mute"
+	unmuteReq = "unmute"
+	setVisibilityReq = "set-visibility"
+	createInviteReq = "create-invite"
+	acceptInviteReq = "accept-invite"
+	listInvitesReq = "list-invites"
+	revokeInviteReq = "revoke-invite"
+	updateRoomReq = "update-room"
+	archiveRoomReq = "archive-room"
+	deleteRoomReq = "delete-room"
 )
 
 type response struct {
@@ -50,6 +84,37 @@ const (
 	listMessagesResp = "list-messages"
 	userInfoResp = "user-info"
 	roomInfoResp = "room-info"
+	editMessageResp = "edit-message"
+	messageDeletedResp = "message-deleted"
+	messageHistoryResp = "message-history"
+	resumeResp = "resume"
+	presenceResp = "presence"
+	listPresenceResp = "list-presence"
+	typingResp = "typing"
+	readResp = "read"
+	readReceiptResp = "read-receipt"
+	readReceiptsResp = "read-receipts"
+	directRoomResp = "direct-room"
+	listDmsResp = "list-dms"
+	roleResp = "role"
+	listRolesResp = "list-roles"
+	roomUpdatedResp = "room-updated"
+	inviteResp = "invite"
+	listInvitesResp = "list-invites"
+	inviteRevokedResp = "invite-revoked"
+	roomDeletedResp = "room-deleted"
+)
+
+// судьба сообщений удаленной комнаты
+const (
+	KeepHistory = "keep"
+	PurgeHistory = "purge"
+)
+
+const (
+	maxRoomNameLen = 100
+	maxTopicLen = 250
+	maxDescriptionLen = 4000
 )
 
 type errorResponse struct {
@@ -88,8 +153,184 @@ type listRoomsResponse struct {
 
 type inRoomsResponse listRoomsResponse
 
+type startDmRequest struct {
+	UserIds []int `json:"userIds"` // собеседники, сам пользователь добавляется автоматически
+}
+
+// личная комната; рассылается участникам при ее создании
+type directRoomResponse RoomPermEntry
+
+type listDmsResponse listRoomsResponse
+
+type resumeRequest struct {
+	Rooms map[int]int `json:"rooms"` // {roomId: lastMessageId}
+}
+
+type resumeResponse struct {
+	Rooms []RoomPermEntry `json:"rooms"`
+	Stale []int `json:"stale"` // комнаты, для которых сообщения не досылались
+}
+
+type setPresenceRequest struct {
+	Status string `json:"status"` // "online" снимает выставленный вручную статус
+}
+
+type PresenceEntry struct {
+	UserId int `json:"userId"`
+	Status string `json:"status"`
+}
+
+type presenceResponse PresenceEntry
+
+type listPresenceRequest struct {
+	UserIds []int `json:"userIds"`
+}
+
+type listPresenceResponse struct {
+	Users []PresenceEntry `json:"users"`
+}
+
+type typingRequest struct {
+	RoomId int `json:"roomId"`
+}
+
+type typingResponse struct {
+	RoomId int `json:"roomId"`
+	UserId int `json:"userId"`
+	Typing bool `json:"typing"`
+}
+
+type markReadRequest struct {
+	RoomId int `json:"roomId"`
+	MessageId int `json:"messageId"`
+}
+
+// только подключениям самого пользователя
+type readResponse struct {
+	RoomId int `json:"roomId"`
+	MessageId int `json:"messageId"`
+	Unread int `json:"unread"`
+}
+
+type ReadEntry struct {
+	UserId int `json:"userId"`
+	MessageId int `json:"messageId"`
+}
+
+// остальным участникам комнаты
+type readReceiptResponse struct {
+	RoomId int `json:"roomId"`
+	ReadEntry
+}
+
+type readReceiptsRequest struct {
+	RoomId int `json:"roomId"`
+}
+
+type readReceiptsResponse struct {
+	RoomId int `json:"roomId"`
+	Users []ReadEntry `json:"users"`
+}
+
+type roleRequest struct {
+	RoomId int `json:"roomId"` // 0 - глобальная роль
+	UserId int `json:"userId"`
+	Role string `json:"role"` // не нужна для revoke-role
+}
+
+// действующая роль и разрешения пользователя после изменения
+type roleResponse struct {
+	RoomId int `json:"roomId"`
+	UserId int `json:"userId"`
+	Role string `json:"role"`
+	Perm int `json:"perm"`
+}
+
+// kick, ban, unban, mute, unmute
+type moderateRequest struct {
+	RoomId int `json:"roomId"`
+	UserId int `json:"userId"`
+}
+
+type listRolesRequest struct {
+	RoomId int `json:"roomId"`
+}
+
+type RoleEntry struct {
+	UserId int `json:"userId"`
+	Role string `json:"role"`
+}
+
+type listRolesResponse struct {
+	RoomId int `json:"roomId"`
+	Roles []RoleEntry `json:"roles"` // только назначенные роли
+}
+
 type newRoomRequest struct {
 	Name string `json:"name"`
+	Visibility string `json:"visibility"` // по умолчанию public
+}
+
+type setVisibilityRequest struct {
+	RoomId int `json:"roomId"`
+	Visibility string `json:"visibility"`
+}
+
+// рассылается участникам комнаты при изменении ее свойств, для общедоступной - всем
+type roomUpdatedResponse room.Entry
+
+// отсутствующие поля не изменяются
+type updateRoomRequest struct {
+	RoomId int `json:"roomId"`
+	Name *string `json:"name"`
+	Topic *string `json:"topic"`
+	Description *string `json:"description"`
+}
+
+type archiveRoomRequest struct {
+	RoomId int `json:"roomId"`
+	Archived bool `json:"archived"`
+}
+
+type deleteRoomRequest struct {
+	RoomId int `json:"roomId"`
+}
+
+// участники удаленной комнаты выводятся из нее без уведомлений leave
+type roomDeletedResponse struct {
+	RoomId int `json:"roomId"`
+	UserId int `json:"userId"` // кто удалил
+}
+
+type createInviteRequest struct {
+	RoomId int `json:"roomId"`
+	UserId int `json:"userId"` // 0 - приглашение по токену для любого
+	MaxUses int `json:"maxUses"` // 0 - без ограничения
+	Ttl int `json:"ttl"` // секунды, 0 - бессрочно
+}
+
+type InviteEntry struct {
+	invite.Entry
+	RoomName string `json:"roomName"`
+}
+
+// создавшему приглашение и адресату
+type inviteResponse InviteEntry
+
+type acceptInviteRequest struct {
+	Token string `json:"token"`
+}
+
+type listInvitesResponse struct {
+	Invites []InviteEntry `json:"invites"`
+}
+
+type revokeInviteRequest struct {
+	Token string `json:"token"`
+}
+
+type inviteRevokedResponse struct {
+	Token string `json:"token"`
 }
 
 type newRoomResponse RoomPermEntry
@@ -110,6 +351,7 @@ type leaveRequest struct {
 type leaveResponse struct {
 	RoomId int `json:"roomId"`
 	UserId int `json:"userId"`
+	ModeratorId int `json:"moderatorId,omitempty"` // пользователь выведен из комнаты модератором
 }
 
 type listUsersRequest struct {
@@ -145,17 +387,62 @@ type roomInfoRequest struct {
 
 type roomInfoResponse RoomPermEntry
 
+type editMessageRequest struct {
+	RoomId int `json:"roomId"`
+	MessageId int `json:"messageId"`
+	MessageType int `json:"messageType"`
+	Data json.RawMessage `json:"data"`
+}
+
+type editMessageResponse MessageEntry
+
+type deleteMessageRequest struct {
+	RoomId int `json:"roomId"`
+	MessageId int `json:"messageId"`
+}
+
+type messageDeletedResponse MessageEntry
+
+type messageHistoryRequest struct {
+	RoomId int `json:"roomId"`
+	MessageId int `json:"messageId"`
+}
+
+type messageHistoryResponse struct {
+	RoomId int `json:"roomId"`
+	MessageId int `json:"messageId"`
+	Revisions MessageList `json:"revisions"`
+}
+
 
 type MessageEntry struct {
 	RoomId int `json:"roomId"`
 	MessageId int `json:"messageId"`
 	UserId int `json:"userId"`
 	Timestamp int `json:"timestamp"`
+	Edited bool `json:"edited"`
+	EditTimestamp int `json:"editTimestamp,omitempty"`
+	EditorId int `json:"editorId,omitempty"`
+	Deleted bool `json:"deleted,omitempty"`
 	Data interface {} `json:"data"`
 }
 
 type MessageList []*MessageEntry
 
+func newMessageEntry (m *hub.MessageEntry) *MessageEntry {
+	return &MessageEntry {
+		RoomId: m.RoomId,
+		MessageId: m.MessageId,
+		UserId: m.UserId,
+		Timestamp: m.Timestamp,
+		Edited: (m.EditTimestamp != 0),
+		EditTimestamp: m.EditTimestamp,
+		EditorId: m.EditorId,
+		Deleted: m.Deleted,
+		Data: m.Data,
+	}
+}
+
 
 type hubConnRec struct {
 	c conn.Conn
@@ -186,10 +473,15 @@ func (c *hubConnRec) send (response interface {}) {
 }
 
 func (c *hubConnRec) NewMessage (m *hub.MessageEntry) {
-	c.send(response {messageResp, MessageEntry(*m)})
+	c.send(response {messageResp, messageResponse(*newMessageEntry(m))})
 }
 
 func (c *hubConnRec) UpdateMessage (m *hub.MessageEntry) {
+	if m.Deleted {
+		c.send(response {messageDeletedResp, messageDeletedResponse(*newMessageEntry(m))})
+	} else {
+		c.send(response {editMessageResp, editMessageResponse(*newMessageEntry(m))})
+	}
 }
 
 func (c *hubConnRec) Notice (data interface {}) {
@@ -202,11 +494,13 @@ func (c *hubConnRec) Close () {
 
 
 type RoomPermEntry struct {
-	Id int `json:"id"`
-	Name string `json:"name"`
+	room.Entry
 	Perm int `json:"perm"`
+	Unread int `json:"unread"`
 }
 
+const maxDirectUsers = 8
+
 
 type requestHandler func (conn.Conn, []byte)
 
@@ -216,7 +510,18 @@ type Proto struct {
 	users user.Registry
 	rooms room.Registry
 	access access.Controller
+	members room.Members // nil - членство в комнатах прекращается с отключением пользователя
+	presence *presence.Tracker
+	typing *typingTracker
+	cursors cursor.Registry // nil - позиции прочтения не хранятся
+	invites invite.Registry // nil - приглашения не поддерживаются
+	readReceipts bool
+	purgeHistory bool // удалять сообщения вместе с комнатой
 	handlers map[string]requestHandler
+
+	graceLock sync.Mutex
+	gracePeriod time.Duration
+	graceTimers map[int]*time.Timer // userId: таймер выхода из комнат
 }
 
 func New (hub *hub.Hub, users user.Registry, rooms room.Registry, access access.Controller) *Proto {
@@ -236,7 +541,9 @@ func New (hub *hub.Hub, users user.Registry, rooms room.Registry, access access.
 		panic("no access controller")
 	}
 
-	p := &Proto {hub: hub, users: users, rooms: rooms, access: access}
+	p := &Proto {hub: hub, users: users, rooms: rooms, access: access, graceTimers: make(map[int]*time.Timer)}
+	p.presence = presence.New(p.notifyPresence)
+	p.typing = newTypingTracker(p.notifyTyping)
 
 	hs := make(map[string]requestHandler)
 
@@ -247,6 +554,34 @@ func New (hub *hub.Hub, users user.Registry, rooms room.Registry, access access.
 	hs[listUsersReq] = p.listUsers
 	hs[listMessagesReq] = p.listMessages
 	hs[messageReq] = p.newMessage
+	hs[editMessageReq] = p.editMessage
+	hs[deleteMessageReq] = p.deleteMessage
+	hs[messageHistoryReq] = p.messageHistory
+	hs[resumeReq] = p.resume
+	hs[setPresenceReq] = p.setPresence
+	hs[listPresenceReq] = p.listPresence
+	hs[typingStartReq] = p.typingStart
+	hs[typingStopReq] = p.typingStop
+	hs[markReadReq] = p.markRead
+	hs[readReceiptsReq] = p.listReadReceipts
+	hs[startDmReq] = p.startDm
+	hs[listDmsReq] = p.listDms
+	hs[grantRoleReq] = p.grantRole
+	hs[revokeRoleReq] = p.revokeRole
+	hs[listRolesReq] = p.listRoles
+	hs[kickReq] = p.kick
+	hs[banReq] = p.ban
+	hs[unbanReq] = p.unban
+	hs[muteReq] = p.mute
+	hs[unmuteReq] = p.unmute
+	hs[setVisibilityReq] = p.setVisibility
+	hs[createInviteReq] = p.createInvite
+	hs[acceptInviteReq] = p.acceptInvite
+	hs[listInvitesReq] = p.listInvites
+	hs[revokeInviteReq] = p.revokeInvite
+	hs[updateRoomReq] = p.updateRoom
+	hs[archiveRoomReq] = p.archiveRoom
+	hs[deleteRoomReq] = p.deleteRoom
 	hs[newRoomReq] = p.createRoom
 	hs[roomInfoReq] = p.roomInfo
 	hs[userInfoReq] = p.userInfo
@@ -256,8 +591,168 @@ func New (hub *hub.Hub, users user.Registry, rooms room.Registry, access access.
 	return p
 }
 
+// время, в течение которого отключившийся пользователь остается в комнатах
+// и может возобновить подключение без потери сообщений; 0 - выход сразу
+func (p *Proto) SetGracePeriod (period time.Duration) {
+	p.graceLock.Lock()
+	defer p.graceLock.Unlock()
+
+	p.gracePeriod = period
+}
+
+// включает постоянное членство: пользователь остается в комнате до явного выхода
+// и после перезапуска сервера; вызывается до RestoreRooms
+func (p *Proto) SetMembers (members room.Members) {
+	p.members = members
+}
+
+// регистрирует в хабе комнаты, созданные до запуска сервера
+func (p *Proto) RestoreRooms () error {
+	for _, entry := range p.rooms.ListRooms() {
+		userIds := []int {}
+		if p.members != nil {
+			var e error
+			userIds, e = p.members.RoomUserIds(entry.Id)
+			if e != nil {
+				return e
+			}
+		}
+
+		e := p.hub.RestoreRoom(entry.Id, userIds)
+		if e != nil {
+			return fmt.Errorf("room #%d: %s", entry.Id, e.Error())
+		}
+	}
+
+	return nil
+}
+
+// вход в комнату с сохранением членства
+func (p *Proto) joinRoom (uid, rid int) error {
+	e := p.hub.EnterRoom(uid, rid)
+	if e == nil && p.members != nil {
+		e = p.members.Join(rid, uid)
+	}
+	return e
+}
+
+// выход из комнаты с сохранением членства
+func (p *Proto) quitRoom (uid, rid int) {
+	p.hub.LeaveRoom(uid, rid)
+	if p.members != nil {
+		e := p.members.Leave(rid, uid)
+		if e != nil {
+			log.Println(e)
+		}
+	}
+}
+
+func (p *Proto) SetCursors (cursors cursor.Registry) {
+	p.cursors = cursors
+}
+
+func (p *Proto) SetInvites (invites invite.Registry) {
+	p.invites = invites
+}
+
+// KeepHistory - сообщения удаленной комнаты остаются в хранилище, PurgeHistory - удаляются
+// (хранилище сообщений должно поддерживать hub.RoomPurger)
+func (p *Proto) SetHistoryPolicy (policy string) error {
+	switch policy {
+	case "", KeepHistory:
+		p.purgeHistory = false
+	case PurgeHistory:
+		p.purgeHistory = true
+	default:
+		return fmt.Errorf("unknown history policy: %q", policy)
+	}
+	return nil
+}
+
+// рассылать ли участникам комнаты уведомления о прочтении сообщений; требует SetCursors
+func (p *Proto) SetReadReceipts (enabled bool) {
+	p.readReceipts = enabled
+}
+
+// число непрочитанных сообщений в комнате; 0, если позиции не хранятся
+func (p *Proto) unread (uid, rid int) int {
+	if p.cursors == nil {
+		return 0
+	}
+
+	last, e := p.hub.LastMessageId(rid)
+	if e != nil {
+		return 0
+	}
+
+	cursor, e := p.cursors.Cursor(uid, rid)
+	if e != nil {
+		log.Println(e)
+		return 0
+	}
+
+	if last > cursor {
+		return last - cursor
+	}
+	return 0
+}
+
+// разрешения пользователя подключения, суженные областью подключения
+func (p *Proto) globalPerms (c conn.Conn) access.PermFlags {
+	return p.access.GlobalPerms(c.UserId()) & conn.ScopeOf(c).Global
+}
+
+func (p *Proto) roomPerms (c conn.Conn, roomId int) access.PermFlags {
+	return p.access.RoomPerms(c.UserId(), roomId) & conn.ScopeOf(c).Room
+}
+
+func (p *Proto) hasGlobalPerm (c conn.Conn, perm access.PermFlags) bool {
+	return (perm & p.globalPerms(c) != 0)
+}
+
+func (p *Proto) hasRoomPerm (c conn.Conn, roomId int, perm access.PermFlags) bool {
+	return (perm & p.roomPerms(c, roomId) != 0)
+}
+
+// true, если пользователь забанен в комнате; без управления ролями банов нет
+func (p *Proto) isBanned (userId, roomId int) bool {
+	rm, ok := p.access.(access.RoleManager)
+	return (ok && rm.RoomRole(userId, roomId) == access.BannedRole)
+}
+
+func (p *Proto) roomPermEntry (uid int, room room.Entry, perm int) RoomPermEntry {
+	return RoomPermEntry {room, perm, p.unread(uid, room.Id)}
+}
+
+// время бездействия, после которого пользователь считается отошедшим; 0 - не отслеживается
+func (p *Proto) SetIdleTimeout (timeout time.Duration) {
+	p.presence.SetIdleTimeout(timeout)
+}
+
+func (p *Proto) notifyPresence (userId int, status string) {
+	p.hub.NeighbourNotice(userId, &response {presenceResp, presenceResponse {userId, status}})
+}
+
+func (p *Proto) notifyTyping (userId, roomId int, typing bool) {
+	p.hub.RoomNotice(roomId, &response {typingResp, typingResponse {roomId, userId, typing}})
+}
+
+// таймер выхода останавливается и подключение регистрируется под graceLock,
+// иначе сработавший в промежутке таймер выведет пользователя из комнат
 func (p *Proto) Connect (c conn.Conn) {
-	p.hub.Connect(&hubConnRec {c})
+	p.graceLock.Lock()
+	timer := p.graceTimers[c.UserId()]
+	if timer != nil {
+		timer.Stop()
+		delete(p.graceTimers, c.UserId())
+	}
+	e := p.hub.Connect(&hubConnRec {c})
+	p.graceLock.Unlock()
+
+	if e == nil {
+		p.presence.Connect(c.UserId())
+		p.typing.connect(c.UserId())
+	}
 }
 
 func (p *Proto) Disconnect (connId int) {
@@ -266,22 +761,80 @@ func (p *Proto) Disconnect (connId int) {
 		return
 	}
 
-	uid := hc.Id()
+	uid := hc.UserId()
 	p.hub.Disconnect(connId)
+	p.presence.Disconnect(uid)
+	p.typing.disconnect(uid)
 	if p.hub.UserIsConnected(uid) {
 		return
 	}
 
+	if p.members != nil {
+		return
+	}
+
+	p.graceLock.Lock()
+	defer p.graceLock.Unlock()
+
+	if p.graceTimers == nil {
+		return
+	}
+
+	if p.gracePeriod <= 0 {
+		p.leaveAllRooms(uid)
+		return
+	}
+
+	if p.graceTimers[uid] != nil {
+		p.graceTimers[uid].Stop()
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(p.gracePeriod, func () {
+		p.graceLock.Lock()
+		defer p.graceLock.Unlock()
+
+		// остановленный таймер мог сработать до остановки и дождаться блокировки, когда его уже заменил новый
+		if p.graceTimers == nil || p.graceTimers[uid] != timer {
+			return
+		}
+
+		delete(p.graceTimers, uid)
+		if !p.hub.UserIsConnected(uid) {
+			p.leaveAllRooms(uid)
+		}
+	})
+	p.graceTimers[uid] = timer
+}
+
+// выводит пользователя из комнаты по решению модератора или после потери доступа
+func (p *Proto) expel (uid, rid, moderatorId int) {
+	p.typing.stop(uid, rid)
+	p.quitRoom(uid, rid)
+	resp := &response {leaveResp, leaveResponse {rid, uid, moderatorId}}
+	p.hub.UserNotice(uid, resp)
+	p.hub.RoomNotice(rid, resp)
+}
+
+func (p *Proto) leaveAllRooms (uid int) {
 	rids := p.hub.UserRoomIds(uid)
 	for _, rid := range rids {
 		p.hub.LeaveRoom(uid, rid)
-		resp := &response {leaveResp, leaveResponse {rid, uid}}
+		resp := &response {leaveResp, leaveResponse {rid, uid, 0}}
 		p.hub.RoomNotice(rid, resp)
 	}
 }
 
 func (p *Proto) Stop () {
+	p.presence.Stop()
+	p.typing.clear()
+
+	p.graceLock.Lock()
+	defer p.graceLock.Unlock()
 
+	for _, timer := range p.graceTimers {
+		timer.Stop()
+	}
+	p.graceTimers = nil
 }
 
 func (p *Proto) TakeRequest (c conn.Conn, r []byte) {
@@ -299,6 +852,7 @@ func (p *Proto) TakeRequest (c conn.Conn, r []byte) {
 
 	handler := p.handlers[req.Request]
 	if handler != nil {
+		p.presence.Touch(c.UserId())
 		handler(c, req.Body)
 	} else {
 		log.Printf("u%dc%d: unknown request type: %s", c.UserId(), cid, req.Request)
@@ -329,98 +883,457 @@ func (p *Proto) decodeBody (c conn.Conn, body []byte, v interface {}) bool {
 func (p *Proto) whoami (c conn.Conn, body []byte) {
 	uid := c.UserId()
 	user, _ := p.users.User(uid)
-	perm := p.access.GlobalPerms(uid)
+	perm := p.globalPerms(c)
 	resp := &response {whoamiResp, whoamiResponse {user, perm}}
 	p.hub.ConnNotice(c.Id(), resp)
 }
 
 func (p *Proto) listRooms (c conn.Conn, body []byte) {
 	uid := c.UserId()
-	if !p.access.HasGlobalPerm(uid, access.ListRoomsPerm) {
+	if !p.hasGlobalPerm(c, access.ListRoomsPerm) {
 		p.respondError(c, "you cannot list rooms")
 		return
 	}
 
 	rooms := p.rooms.ListRooms()
 	roomPerms := make([]RoomPermEntry, 0, len(rooms))
-	for _, room := range rooms {
-		perm := p.access.RoomPerms(uid, room.Id)
+	for _, entry := range rooms {
+		if entry.IsDirect() || (entry.Visibility == room.Unlisted && !p.hub.IsInRoom(uid, entry.Id)) {
+			continue
+		}
+
+		perm := p.roomPerms(c, entry.Id)
 		if perm != 0 {
-			roomPerms = append(roomPerms, RoomPermEntry {room.Id, room.Name, perm})
+			roomPerms = append(roomPerms, p.roomPermEntry(uid, entry, perm))
 		}
 	}
 	resp := &response {listRoomsResp, listRoomsResponse {roomPerms}}
 	p.hub.ConnNotice(c.Id(), resp)
 }
 
-func (p *Proto) inRooms (c conn.Conn, body []byte) {
+func (p *Proto) listDms (c conn.Conn, body []byte) {
 	uid := c.UserId()
-	rids := p.hub.UserRoomIds(uid)
-	result := make([]RoomPermEntry, 0, len(rids))
-	for _, rid := range rids {
-		room, found := p.rooms.Room(rid)
-		if found {
-			perm := p.access.RoomPerms(uid, room.Id)
-			result = append(result, RoomPermEntry {room.Id, room.Name, perm})
-		}
+	rooms := p.rooms.DirectRooms(uid)
+	result := make([]RoomPermEntry, 0, len(rooms))
+	for _, room := range rooms {
+		result = append(result, p.roomPermEntry(uid, room, p.roomPerms(c, room.Id)))
 	}
 
-	resp := &response {inRoomsResp, inRoomsResponse {result}}
+	resp := &response {listDmsResp, listDmsResponse {result}}
 	p.hub.ConnNotice(c.Id(), resp)
 }
 
-func (p *Proto) createRoom (c conn.Conn, body []byte) {
-	b := &newRoomRequest {}
+// находит или создает личную комнату и входит в нее;
+// в новую комнату входят все участники, о ней сообщается уведомлением direct-room
+func (p *Proto) startDm (c conn.Conn, body []byte) {
+	b := &startDmRequest {}
 	if !p.decodeBody(c, body, b) {
 		return
 	}
 
 	uid := c.UserId()
-	if !p.access.HasGlobalPerm(uid, access.CreateRoomPerm) {
-		p.respondError(c, "you cannot create a room")
-		return
-	}
-
-	name := strings.TrimSpace(b.Name)
-	if name == "" {
-		p.respondError(c, "empty room name")
+	userIds := room.NormalizeUserIds(append(b.UserIds, uid))
+	if len(userIds) < 2 {
+		p.respondError(c, "no participants")
 		return
 	}
-
-	rid, e := p.rooms.CreateRoom(name)
-	if e != nil {
-		p.respondError(c, e.Error())
+	if len(userIds) > maxDirectUsers {
+		p.respondError(c, "too many participants, maximum is %d", maxDirectUsers)
 		return
 	}
 
-	p.access.NewRoom(uid, rid)
-	perm := p.access.RoomPerms(uid, rid)
-	p.hub.NewRoom(rid, 0, []int {})
-	resp := &response {newRoomResp, newRoomResponse {rid, name, perm}}
-	p.hub.GlobalNotice(resp)
-}
-
-func (p *Proto) enterRoom (c conn.Conn, body []byte) {
-	b := &enterRequest {}
-	if !p.decodeBody(c, body, b) {
-		return
+	for _, id := range userIds {
+		if _, found := p.users.User(id); !found {
+			p.respondError(c, "user #%d not found", id)
+			return
+		}
 	}
 
-	if !p.access.HasRoomPerm(c.UserId(), b.RoomId, access.ReadPerm) {
-		p.respondError(c, "you cannot enter room #%d", b.RoomId)
-		return
+	// новую личную комнату можно начать только с теми, кто видит пользователя в общей комнате
+	if !p.hasDirectRoom(uid, userIds) {
+		for _, id := range userIds {
+			if id != uid && !p.areNeighbours(uid, id) {
+				p.respondError(c, "user #%d does not share a room with you", id)
+				return
+			}
+		}
 	}
 
-	uid := c.UserId()
-	e := p.hub.EnterRoom(uid, b.RoomId)
+	entry, created, e := p.rooms.DirectRoom(userIds)
 	if e != nil {
 		p.respondError(c, e.Error())
 		return
 	}
 
-	user, _ := p.users.User(uid)
-	p.hub.EnterRoom(uid, b.RoomId)
-	resp := &response {enterResp, enterResponse {b.RoomId, user}}
+	notified := []int {uid}
+	if created {
+		p.hub.NewRoom(entry.Id, 0, []int {})
+		notified = entry.UserIds
+	}
+	for _, id := range notified {
+		perm := p.access.RoomPerms(id, entry.Id)
+		p.hub.UserNotice(id, &response {directRoomResp, directRoomResponse(p.roomPermEntry(id, entry, perm))})
+	}
+
+	// участники входят в новую комнату сразу, чтобы получать сообщения
+	for _, id := range notified {
+		if p.hub.IsInRoom(id, entry.Id) {
+			continue
+		}
+
+		e = p.joinRoom(id, entry.Id)
+		if e != nil {
+			p.respondError(c, e.Error())
+			return
+		}
+
+		user, _ := p.users.User(id)
+		p.hub.RoomNotice(entry.Id, &response {enterResp, enterResponse {entry.Id, user}})
+	}
+}
+
+func (p *Proto) hasDirectRoom (userId int, userIds []int) bool {
+	key := room.DirectKey(userIds)
+	for _, entry := range p.rooms.DirectRooms(userId) {
+		if room.DirectKey(entry.UserIds) == key {
+			return true
+		}
+	}
+	return false
+}
+
+// true, если пользователи находятся в общей комнате, не личной
+func (p *Proto) areNeighbours (userId, otherId int) bool {
+	for _, rid := range p.hub.UserRoomIds(userId) {
+		entry, found := p.rooms.Room(rid)
+		if found && !entry.IsDirect() && p.hub.IsInRoom(otherId, rid) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Proto) userRooms (c conn.Conn) []RoomPermEntry {
+	uid := c.UserId()
+	rids := p.hub.UserRoomIds(uid)
+	result := make([]RoomPermEntry, 0, len(rids))
+	for _, rid := range rids {
+		room, found := p.rooms.Room(rid)
+		if found {
+			perm := p.roomPerms(c, room.Id)
+			result = append(result, p.roomPermEntry(uid, room, perm))
+		}
+	}
+
+	return result
+}
+
+func (p *Proto) inRooms (c conn.Conn, body []byte) {
+	resp := &response {inRoomsResp, inRoomsResponse {p.userRooms(c)}}
+	p.hub.ConnNotice(c.Id(), resp)
+}
+
+func (p *Proto) setPresence (c conn.Conn, body []byte) {
+	b := &setPresenceRequest {}
+	if !p.decodeBody(c, body, b) {
+		return
+	}
+
+	e := p.presence.SetStatus(c.UserId(), b.Status)
+	if e != nil {
+		p.respondError(c, "%s: %q", e.Error(), b.Status)
+	}
+}
+
+func (p *Proto) listPresence (c conn.Conn, body []byte) {
+	b := &listPresenceRequest {}
+	if !p.decodeBody(c, body, b) {
+		return
+	}
+
+	result := make([]PresenceEntry, 0, len(b.UserIds))
+	for _, uid := range b.UserIds {
+		result = append(result, PresenceEntry {uid, p.presence.Status(uid)})
+	}
+
+	resp := &response {listPresenceResp, listPresenceResponse {result}}
+	p.hub.ConnNotice(c.Id(), resp)
+}
+
+// возобновление после разрыва связи: клиент сообщает номера последних полученных сообщений;
+// если пользователь уже вышел из комнаты (истек период ожидания), он входит в нее снова.
+// Пропущенные сообщения приходят ответами message, но новые сообщения могут прийти раньше них,
+// а досланные - повторить уже полученные: клиент упорядочивает сообщения по номеру и отбрасывает повторы
+func (p *Proto) resume (c conn.Conn, body []byte) {
+	b := &resumeRequest {}
+	if !p.decodeBody(c, body, b) {
+		return
+	}
+
+	uid := c.UserId()
+	for rid := range b.Rooms {
+		if p.hub.IsInRoom(uid, rid) || !p.hasRoomPerm(c, rid, access.ReadPerm) {
+			continue
+		}
+
+		if p.joinRoom(uid, rid) == nil {
+			user, _ := p.users.User(uid)
+			p.hub.RoomNotice(rid, &response {enterResp, enterResponse {rid, user}})
+		}
+	}
+
+	stale, e := p.hub.Resume(c.Id(), b.Rooms)
+	if e != nil {
+		p.respondError(c, e.Error())
+		return
+	}
+
+	resp := &response {resumeResp, resumeResponse {p.userRooms(c), stale}}
+	p.hub.ConnNotice(c.Id(), resp)
+}
+
+func (p *Proto) createRoom (c conn.Conn, body []byte) {
+	b := &newRoomRequest {}
+	if !p.decodeBody(c, body, b) {
+		return
+	}
+
+	uid := c.UserId()
+	if !p.hasGlobalPerm(c, access.CreateRoomPerm) {
+		p.respondError(c, "you cannot create a room")
+		return
+	}
+
+	name := strings.TrimSpace(b.Name)
+	if name == "" {
+		p.respondError(c, "empty room name")
+		return
+	}
+
+	visibility := b.Visibility
+	if visibility == "" {
+		visibility = room.Public
+	}
+	if !room.IsVisibility(visibility) {
+		p.respondError(c, "unknown room visibility: %q", visibility)
+		return
+	}
+
+	rid, e := p.rooms.CreateRoom(name, uid)
+	if e == nil && visibility != room.Public {
+		e = p.rooms.SetVisibility(rid, visibility)
+	}
+	if e != nil {
+		p.respondError(c, e.Error())
+		return
+	}
+
+	p.access.NewRoom(uid, rid)
+	perm := p.roomPerms(c, rid)
+	p.hub.NewRoom(rid, 0, []int {})
+	entry, _ := p.rooms.Room(rid)
+	resp := &response {newRoomResp, newRoomResponse(p.roomPermEntry(uid, entry, perm))}
+	if visibility == room.Public {
+		p.hub.GlobalNotice(resp)
+	} else {
+		p.hub.UserNotice(uid, resp)
+	}
+}
+
+func (p *Proto) setVisibility (c conn.Conn, body []byte) {
+	b := &setVisibilityRequest {}
+	if !p.decodeBody(c, body, b) {
+		return
+	}
+
+	if !p.hasRoomPerm(c, b.RoomId, access.RenamePerm) {
+		p.respondError(c, "you cannot change room #%d", b.RoomId)
+		return
+	}
+
+	e := p.rooms.SetVisibility(b.RoomId, b.Visibility)
+	if e != nil {
+		p.respondError(c, e.Error())
+		return
+	}
+
+	p.notifyRoomUpdated(b.RoomId)
+}
+
+func (p *Proto) notifyRoomUpdated (rid int) {
+	entry, found := p.rooms.Room(rid)
+	if !found {
+		return
+	}
+
+	resp := &response {roomUpdatedResp, roomUpdatedResponse(entry)}
+	if entry.Visibility == room.Public {
+		p.hub.GlobalNotice(resp)
+	} else {
+		p.hub.RoomNotice(rid, resp)
+	}
+}
+
+func (p *Proto) updateRoom (c conn.Conn, body []byte) {
+	b := &updateRoomRequest {}
+	if !p.decodeBody(c, body, b) {
+		return
+	}
+
+	denied := (b.Name != nil && !p.hasRoomPerm(c, b.RoomId, access.RenamePerm)) ||
+		((b.Topic != nil || b.Description != nil) && !p.hasRoomPerm(c, b.RoomId, access.TopicPerm))
+	if denied {
+		p.respondError(c, "you cannot change room #%d", b.RoomId)
+		return
+	}
+
+	// все поля проверяются до первого изменения, чтобы ошибка не оставила комнату измененной наполовину
+	var name, topic string
+	if b.Name != nil {
+		name = strings.TrimSpace(*b.Name)
+		if name == "" {
+			p.respondError(c, "empty room name")
+			return
+		}
+		if utf8.RuneCountInString(name) > maxRoomNameLen {
+			p.respondError(c, "room name is too long")
+			return
+		}
+	}
+	if b.Topic != nil {
+		topic = strings.TrimSpace(*b.Topic)
+		if utf8.RuneCountInString(topic) > maxTopicLen {
+			p.respondError(c, "room topic is too long")
+			return
+		}
+	}
+	if b.Description != nil && utf8.RuneCountInString(*b.Description) > maxDescriptionLen {
+		p.respondError(c, "room description is too long")
+		return
+	}
+
+	var e error
+	if b.Name != nil {
+		e = p.rooms.Rename(b.RoomId, name)
+	}
+	if e == nil && b.Topic != nil {
+		e = p.rooms.SetTopic(b.RoomId, topic)
+	}
+	if e == nil && b.Description != nil {
+		e = p.rooms.SetDescription(b.RoomId, *b.Description)
+	}
+	if e != nil {
+		p.respondError(c, e.Error())
+		return
+	}
+
+	p.notifyRoomUpdated(b.RoomId)
+}
+
+func (p *Proto) archiveRoom (c conn.Conn, body []byte) {
+	b := &archiveRoomRequest {}
+	if !p.decodeBody(c, body, b) {
+		return
+	}
+
+	if !p.hasRoomPerm(c, b.RoomId, access.DeletePerm) {
+		p.respondError(c, "you cannot archive room #%d", b.RoomId)
+		return
+	}
+
+	e := p.rooms.SetArchived(b.RoomId, b.Archived)
+	if e != nil {
+		p.respondError(c, e.Error())
+		return
+	}
+
+	if b.Archived {
+		for _, id := range p.hub.RoomUserIds(b.RoomId) {
+			p.typing.stop(id, b.RoomId)
+		}
+	}
+	p.notifyRoomUpdated(b.RoomId)
+}
+
+// удаляет комнату из реестра и хаба, выводит из нее участников
+// и забывает связанные с ней роли, позиции прочтения и приглашения
+func (p *Proto) deleteRoom (c conn.Conn, body []byte) {
+	b := &deleteRoomRequest {}
+	if !p.decodeBody(c, body, b) {
+		return
+	}
+
+	uid := c.UserId()
+	rid := b.RoomId
+	entry, found := p.rooms.Room(rid)
+	if !found || entry.IsDirect() || !p.hasRoomPerm(c, rid, access.DeletePerm) {
+		p.respondError(c, "you cannot delete room #%d", rid)
+		return
+	}
+
+	e := p.rooms.DeleteRoom(rid)
+	if e != nil {
+		p.respondError(c, e.Error())
+		return
+	}
+
+	// участники запоминаются до удаления комнаты из хаба, уведомление рассылается после всех удалений
+	userIds := p.hub.RoomUserIds(rid)
+	for _, id := range userIds {
+		p.typing.stop(id, rid)
+		p.quitRoom(id, rid)
+	}
+
+	e = p.hub.DeleteRoom(rid, p.purgeHistory)
+	if e != nil {
+		// комната уже удалена из реестра, поэтому об удалении все равно уведомляются все
+		p.respondError(c, "room #%d is deleted, but its history is not: %s", rid, e.Error())
+	}
+
+	p.access.DeleteRoom(rid)
+	if p.cursors != nil {
+		e = p.cursors.DeleteRoom(rid)
+		if e != nil {
+			log.Println(e)
+		}
+	}
+	if p.invites != nil {
+		e = p.invites.DeleteRoomInvites(rid)
+		if e != nil {
+			log.Println(e)
+		}
+	}
+
+	resp := &response {roomDeletedResp, roomDeletedResponse {rid, uid}}
+	if entry.Visibility == room.Public {
+		p.hub.GlobalNotice(resp)
+	} else {
+		for _, id := range userIds {
+			p.hub.UserNotice(id, resp)
+		}
+	}
+}
+
+func (p *Proto) enterRoom (c conn.Conn, body []byte) {
+	b := &enterRequest {}
+	if !p.decodeBody(c, body, b) {
+		return
+	}
+
+	if !p.hasRoomPerm(c, b.RoomId, access.ReadPerm) {
+		p.respondError(c, "you cannot enter room #%d", b.RoomId)
+		return
+	}
+
+	uid := c.UserId()
+	e := p.joinRoom(uid, b.RoomId)
+	if e != nil {
+		p.respondError(c, e.Error())
+		return
+	}
+
+	user, _ := p.users.User(uid)
+	resp := &response {enterResp, enterResponse {b.RoomId, user}}
 	p.hub.RoomNotice(b.RoomId, resp)
 }
 
@@ -431,8 +1344,9 @@ func (p *Proto) leaveRoom (c conn.Conn, body []byte) {
 	}
 
 	uid := c.UserId()
-	p.hub.LeaveRoom(uid, b.RoomId)
-	resp := &response {leaveResp, leaveResponse {b.RoomId, uid}}
+	p.typing.stop(uid, b.RoomId)
+	p.quitRoom(uid, b.RoomId)
+	resp := &response {leaveResp, leaveResponse {b.RoomId, uid, 0}}
 	p.hub.ConnNotice(c.Id(), resp)
 	p.hub.RoomNotice(b.RoomId, resp)
 }
@@ -444,7 +1358,7 @@ func (p *Proto) listUsers (c conn.Conn, body []byte) {
 	}
 
 	uid := c.UserId()
-	if !p.hub.IsInRoom(uid, b.RoomId) {
+	if !p.hub.IsInRoom(uid, b.RoomId) || !p.hasRoomPerm(c, b.RoomId, access.ReadPerm) {
 		p.respondError(c, "you are not in room #%d", b.RoomId)
 		return
 	}
@@ -469,6 +1383,11 @@ func (p *Proto) listMessages (c conn.Conn, body []byte) {
 	}
 
 	uid := c.UserId()
+	if !p.hasRoomPerm(c, b.RoomId, access.ReadPerm) {
+		p.respondError(c, "you cannot read messages in room #%d", b.RoomId)
+		return
+	}
+
 	messages, e := p.hub.Messages(uid, b.RoomId, b.FirstMessageId, b.MessageCnt)
 	if e != nil {
 		p.respondError(c, e.Error())
@@ -477,7 +1396,7 @@ func (p *Proto) listMessages (c conn.Conn, body []byte) {
 
 	result := make(MessageList, 0, len(messages))
 	for _, m := range messages {
-		result = append(result, (*MessageEntry)(m))
+		result = append(result, newMessageEntry(m))
 	}
 
 	resp := &response {listMessagesResp, listMessagesResponse {b.RoomId, b.FirstMessageId, result}}
@@ -507,7 +1426,7 @@ func (p *Proto) roomInfo (c conn.Conn, body []byte) {
 	}
 
 	uid := c.UserId()
-	perm := p.access.RoomPerms(uid, b.RoomId)
+	perm := p.roomPerms(c, b.RoomId)
 	if perm == 0 {
 		p.respondError(c, "room #%d not found", b.RoomId)
 		return
@@ -519,7 +1438,7 @@ func (p *Proto) roomInfo (c conn.Conn, body []byte) {
 		return
 	}
 
-	resp := &response {roomInfoResp, roomInfoResponse {room.Id, room.Name, perm}}
+	resp := &response {roomInfoResp, roomInfoResponse(p.roomPermEntry(uid, room, perm))}
 	p.hub.ConnNotice(c.Id(), resp)
 }
 
@@ -529,7 +1448,7 @@ func (p *Proto) newMessage (c conn.Conn, body []byte) {
 		return
 	}
 
-	if !p.access.HasRoomPerm(c.UserId(), b.RoomId, access.WritePerm) {
+	if !p.hasRoomPerm(c, b.RoomId, access.WritePerm) {
 		p.respondError(c, "you cannot post messages in room #%d", b.RoomId)
 		return
 	}
@@ -543,21 +1462,603 @@ func (p *Proto) newMessage (c conn.Conn, body []byte) {
 	}
 }
 
-func (p *Proto) newTextMessage (c conn.Conn, roomId int, data []byte) {
+func (p *Proto) decodeTextMessage (c conn.Conn, data []byte) *hubMessageData {
 	d := &textMessageData {}
 	if !p.decodeBody(c, data, d) {
-		return
+		return nil
 	}
 
 	d.Text = strings.TrimSpace(d.Text)
 	if d.Text == "" {
 		p.respondError(c, "empty message text")
+		return nil
+	}
+
+	return &hubMessageData {textMessageType, d}
+}
+
+func (p *Proto) newTextMessage (c conn.Conn, roomId int, data []byte) {
+	hubData := p.decodeTextMessage(c, data)
+	if hubData == nil {
+		return
+	}
+
+	mid, e := p.hub.NewMessage(c.Id(), roomId, hubData)
+	if e != nil {
+		p.respondError(c, e.Error())
+		return
+	}
+
+	p.typing.stop(c.UserId(), roomId)
+	if p.cursors != nil {
+		// свои сообщения считаются прочитанными, уведомления не нужны
+		_, e = p.cursors.SetCursor(c.UserId(), roomId, mid)
+		if e != nil {
+			log.Println(e)
+		}
+	}
+}
+
+func (p *Proto) markRead (c conn.Conn, body []byte) {
+	b := &markReadRequest {}
+	if !p.decodeBody(c, body, b) {
+		return
+	}
+
+	if p.cursors == nil {
+		p.respondError(c, "read cursors are not supported")
+		return
+	}
+
+	uid := c.UserId()
+	if !p.hub.IsInRoom(uid, b.RoomId) || !p.hasRoomPerm(c, b.RoomId, access.ReadPerm) {
+		p.respondError(c, "you are not in room #%d", b.RoomId)
 		return
 	}
 
-	hubData := &hubMessageData {textMessageType, d}
-	_, e := p.hub.NewMessage(c.Id(), roomId, hubData)
+	last, e := p.hub.LastMessageId(b.RoomId)
 	if e != nil {
 		p.respondError(c, e.Error())
+		return
+	}
+
+	mid := b.MessageId
+	if mid > last {
+		mid = last
+	}
+	moved, e := p.cursors.SetCursor(uid, b.RoomId, mid)
+	if e != nil {
+		p.respondError(c, e.Error())
+		return
+	}
+	if !moved {
+		return
+	}
+
+	p.hub.UserNotice(uid, &response {readResp, readResponse {b.RoomId, mid, last - mid}})
+	if p.readReceipts {
+		p.hub.RoomNotice(b.RoomId, &response {readReceiptResp, readReceiptResponse {b.RoomId, ReadEntry {uid, mid}}})
+	}
+}
+
+// позиции прочтения участников комнаты
+func (p *Proto) listReadReceipts (c conn.Conn, body []byte) {
+	b := &readReceiptsRequest {}
+	if !p.decodeBody(c, body, b) {
+		return
+	}
+
+	if p.cursors == nil || !p.readReceipts {
+		p.respondError(c, "read receipts are disabled")
+		return
+	}
+
+	if !p.hub.IsInRoom(c.UserId(), b.RoomId) {
+		p.respondError(c, "you are not in room #%d", b.RoomId)
+		return
+	}
+
+	cursors, e := p.cursors.RoomCursors(b.RoomId)
+	if e != nil {
+		p.respondError(c, e.Error())
+		return
+	}
+
+	userIds := p.hub.RoomUserIds(b.RoomId)
+	result := make([]ReadEntry, 0, len(userIds))
+	for _, id := range userIds {
+		if cursors[id] > 0 {
+			result = append(result, ReadEntry {id, cursors[id]})
+		}
+	}
+
+	resp := &response {readReceiptsResp, readReceiptsResponse {b.RoomId, result}}
+	p.hub.ConnNotice(c.Id(), resp)
+}
+
+func (p *Proto) typingStart (c conn.Conn, body []byte) {
+	b := &typingRequest {}
+	if !p.decodeBody(c, body, b) {
+		return
+	}
+
+	uid := c.UserId()
+	if !p.hub.IsInRoom(uid, b.RoomId) || !p.hasRoomPerm(c, b.RoomId, access.WritePerm) {
+		return
+	}
+
+	p.typing.start(uid, b.RoomId)
+}
+
+func (p *Proto) typingStop (c conn.Conn, body []byte) {
+	b := &typingRequest {}
+	if !p.decodeBody(c, body, b) {
+		return
+	}
+
+	p.typing.stop(c.UserId(), b.RoomId)
+}
+
+func (p *Proto) editMessage (c conn.Conn, body []byte) {
+	b := &editMessageRequest {}
+	if !p.decodeBody(c, body, b) {
+		return
+	}
+
+	uid := c.UserId()
+	if !p.hub.IsInRoom(uid, b.RoomId) {
+		p.respondError(c, "you are not in room #%d", b.RoomId)
+		return
+	}
+
+	if !p.hasRoomPerm(c, b.RoomId, access.WritePerm) {
+		p.respondError(c, "you cannot edit messages in room #%d", b.RoomId)
+		return
+	}
+
+	m, e := p.hub.Message(b.RoomId, b.MessageId)
+	if e != nil {
+		p.respondError(c, e.Error())
+		return
+	}
+
+	if m.UserId != uid && !p.hasRoomPerm(c, b.RoomId, access.ModeratePerm) {
+		p.respondError(c, "you cannot edit message #%d", b.MessageId)
+		return
+	}
+
+	var hubData *hubMessageData
+	switch b.MessageType {
+		case textMessageType:
+			hubData = p.decodeTextMessage(c, b.Data)
+
+		default:
+			p.respondError(c, fmt.Sprintf("unknown message type: %d", b.MessageType))
+	}
+	if hubData == nil {
+		return
+	}
+
+	_, e = p.hub.UpdateMessage(uid, b.RoomId, b.MessageId, hubData)
+	if e != nil {
+		p.respondError(c, e.Error())
+	}
+}
+
+func (p *Proto) deleteMessage (c conn.Conn, body []byte) {
+	b := &deleteMessageRequest {}
+	if !p.decodeBody(c, body, b) {
+		return
+	}
+
+	uid := c.UserId()
+	if !p.hub.IsInRoom(uid, b.RoomId) {
+		p.respondError(c, "you are not in room #%d", b.RoomId)
+		return
+	}
+
+	m, e := p.hub.Message(b.RoomId, b.MessageId)
+	if e != nil {
+		p.respondError(c, e.Error())
+		return
+	}
+
+	perm := access.ModeratePerm
+	if m.UserId == uid {
+		perm = access.WritePerm
+	}
+	if !p.hasRoomPerm(c, b.RoomId, perm) {
+		p.respondError(c, "you cannot delete message #%d", b.MessageId)
+		return
+	}
+
+	_, e = p.hub.DeleteMessage(uid, b.RoomId, b.MessageId)
+	if e != nil {
+		p.respondError(c, e.Error())
+	}
+}
+
+func (p *Proto) messageHistory (c conn.Conn, body []byte) {
+	b := &messageHistoryRequest {}
+	if !p.decodeBody(c, body, b) {
+		return
+	}
+
+	if !p.hasRoomPerm(c, b.RoomId, access.HistoryPerm) {
+		p.respondError(c, "you cannot view message history in room #%d", b.RoomId)
+		return
+	}
+
+	revisions, e := p.hub.MessageHistory(b.RoomId, b.MessageId)
+	if e != nil {
+		p.respondError(c, e.Error())
+		return
+	}
+
+	// прежние версии чужих сообщений видят только модераторы
+	if len(revisions) > 0 && revisions[0].UserId != c.UserId() && !p.hasRoomPerm(c, b.RoomId, access.ModeratePerm) {
+		p.respondError(c, "you cannot view history of message #%d", b.MessageId)
+		return
+	}
+
+	result := make(MessageList, 0, len(revisions))
+	for _, m := range revisions {
+		result = append(result, newMessageEntry(m))
+	}
+
+	resp := &response {messageHistoryResp, messageHistoryResponse {b.RoomId, b.MessageId, result}}
+	p.hub.ConnNotice(c.Id(), resp)
+}
+
+func (p *Proto) roleManager (c conn.Conn) access.RoleManager {
+	rm, ok := p.access.(access.RoleManager)
+	if !ok {
+		p.respondError(c, "roles are not supported")
+	}
+	return rm
+}
+
+func (p *Proto) grantRole (c conn.Conn, body []byte) {
+	b := &roleRequest {}
+	if !p.decodeBody(c, body, b) {
+		return
+	}
+
+	if b.Role == "" {
+		p.respondError(c, "no role")
+		return
+	}
+
+	p.setRole(c, b.RoomId, b.UserId, b.Role, access.RolesPerm)
+}
+
+func (p *Proto) revokeRole (c conn.Conn, body []byte) {
+	b := &roleRequest {}
+	if !p.decodeBody(c, body, b) {
+		return
+	}
+
+	p.setRole(c, b.RoomId, b.UserId, "", access.RolesPerm)
+}
+
+// об изменении сообщается комнате, самому пользователю и выполнившему изменение;
+// perm - разрешение в комнате, нужное для изменения; для глобальных ролей нужно AdminPerm
+func (p *Proto) setRole (c conn.Conn, rid, uid int, role string, perm access.PermFlags) {
+	rm := p.roleManager(c)
+	if rm == nil {
+		return
+	}
+
+	actorId := c.UserId()
+	if (rid == 0 && !p.hasGlobalPerm(c, access.AdminPerm)) ||
+		(rid != 0 && !p.hasRoomPerm(c, rid, perm)) {
+		p.respondError(c, "you cannot change roles of user #%d", uid)
+		return
+	}
+
+	if _, found := p.users.User(uid); !found {
+		p.respondError(c, "user #%d not found", uid)
+		return
+	}
+
+	if rid == 0 {
+		e := rm.SetGlobalRole(actorId, uid, role)
+		if e != nil {
+			p.respondError(c, "cannot change role of user #%d: %s", uid, e.Error())
+			return
+		}
+
+		resp := &response {roleResp, roleResponse {0, uid, rm.GlobalRole(uid), p.access.GlobalPerms(uid)}}
+		p.hub.UserNotice(uid, resp)
+		if uid != actorId {
+			p.hub.ConnNotice(c.Id(), resp)
+		}
+		return
+	}
+
+	if _, found := p.rooms.Room(rid); !found {
+		p.respondError(c, "room #%d not found", rid)
+		return
+	}
+
+	e := rm.SetRoomRole(actorId, uid, rid, role)
+	if e != nil {
+		p.respondError(c, "cannot change role of user #%d in room #%d: %s", uid, rid, e.Error())
+		return
+	}
+
+	resp := &response {roleResp, roleResponse {rid, uid, rm.RoomRole(uid, rid), p.access.RoomPerms(uid, rid)}}
+	p.hub.RoomNotice(rid, resp)
+	if !p.hub.IsInRoom(uid, rid) {
+		p.hub.UserNotice(uid, resp)
+	}
+	if !p.hub.IsInRoom(actorId, rid) {
+		p.hub.ConnNotice(c.Id(), resp)
+	}
+
+	if p.hub.IsInRoom(uid, rid) && !p.access.HasRoomPerm(uid, rid, access.ReadPerm) {
+		p.expel(uid, rid, actorId)
+	}
+}
+
+func (p *Proto) listRoles (c conn.Conn, body []byte) {
+	b := &listRolesRequest {}
+	if !p.decodeBody(c, body, b) {
+		return
+	}
+
+	rm := p.roleManager(c)
+	if rm == nil {
+		return
+	}
+
+	if !p.hasRoomPerm(c, b.RoomId, access.ReadPerm) {
+		p.respondError(c, "room #%d not found", b.RoomId)
+		return
+	}
+
+	roles := rm.RoomRoles(b.RoomId)
+	result := make([]RoleEntry, 0, len(roles))
+	for uid, role := range roles {
+		result = append(result, RoleEntry {uid, role})
+	}
+
+	resp := &response {listRolesResp, listRolesResponse {b.RoomId, result}}
+	p.hub.ConnNotice(c.Id(), resp)
+}
+
+func (p *Proto) kick (c conn.Conn, body []byte) {
+	b := &moderateRequest {}
+	if !p.decodeBody(c, body, b) {
+		return
+	}
+
+	actorId := c.UserId()
+	if !p.hasRoomPerm(c, b.RoomId, access.KickPerm) {
+		p.respondError(c, "you cannot kick users from room #%d", b.RoomId)
+		return
+	}
+
+	rm, _ := p.access.(access.RoleManager)
+	if b.UserId == actorId || (rm != nil && !rm.Outranks(actorId, b.UserId, b.RoomId)) {
+		p.respondError(c, "you cannot kick user #%d", b.UserId)
+		return
+	}
+
+	if !p.hub.IsInRoom(b.UserId, b.RoomId) {
+		p.respondError(c, "user #%d is not in room #%d", b.UserId, b.RoomId)
+		return
+	}
+
+	p.expel(b.UserId, b.RoomId, actorId)
+}
+
+func (p *Proto) ban (c conn.Conn, body []byte) {
+	b := &moderateRequest {}
+	if p.decodeBody(c, body, b) {
+		p.setRole(c, b.RoomId, b.UserId, access.BannedRole, access.BanPerm)
+	}
+}
+
+func (p *Proto) mute (c conn.Conn, body []byte) {
+	b := &moderateRequest {}
+	if p.decodeBody(c, body, b) {
+		p.setRole(c, b.RoomId, b.UserId, access.MutedRole, access.MutePerm)
+	}
+}
+
+func (p *Proto) unban (c conn.Conn, body []byte) {
+	p.liftRole(c, body, access.BannedRole, access.BanPerm)
+}
+
+func (p *Proto) unmute (c conn.Conn, body []byte) {
+	p.liftRole(c, body, access.MutedRole, access.MutePerm)
+}
+
+// снимает роль, назначенную модератором, не затрагивая остальные
+func (p *Proto) liftRole (c conn.Conn, body []byte, role string, perm access.PermFlags) {
+	b := &moderateRequest {}
+	if !p.decodeBody(c, body, b) {
+		return
+	}
+
+	rm := p.roleManager(c)
+	if rm == nil {
+		return
+	}
+
+	if b.RoomId == 0 || rm.RoomRole(b.UserId, b.RoomId) != role {
+		p.respondError(c, "user #%d is not %s in room #%d", b.UserId, role, b.RoomId)
+		return
+	}
+
+	p.setRole(c, b.RoomId, b.UserId, "", perm)
+}
+
+func (p *Proto) inviteEntry (entry invite.Entry) InviteEntry {
+	r, _ := p.rooms.Room(entry.RoomId)
+	return InviteEntry {entry, r.Name}
+}
+
+func (p *Proto) createInvite (c conn.Conn, body []byte) {
+	b := &createInviteRequest {}
+	if !p.decodeBody(c, body, b) {
+		return
+	}
+
+	if p.invites == nil {
+		p.respondError(c, "invitations are not supported")
+		return
+	}
+
+	uid := c.UserId()
+	entry, found := p.rooms.Room(b.RoomId)
+	if !found || entry.IsDirect() || !p.hasRoomPerm(c, b.RoomId, access.InvitePerm) {
+		p.respondError(c, "you cannot invite users to room #%d", b.RoomId)
+		return
+	}
+
+	if b.UserId != 0 {
+		if _, found = p.users.User(b.UserId); !found {
+			p.respondError(c, "user #%d not found", b.UserId)
+			return
+		}
+	}
+
+	inv := invite.Entry {RoomId: b.RoomId, UserId: b.UserId, CreatorId: uid, MaxUses: b.MaxUses}
+	if b.Ttl > 0 {
+		inv.Expires = time.Now().Unix() + int64(b.Ttl)
+	}
+	inv, e := p.invites.NewInvite(inv)
+	if e != nil {
+		p.respondError(c, e.Error())
+		return
+	}
+
+	resp := &response {inviteResp, inviteResponse(p.inviteEntry(inv))}
+	p.hub.ConnNotice(c.Id(), resp)
+	if inv.UserId != 0 && inv.UserId != uid {
+		p.hub.UserNotice(inv.UserId, resp)
+	}
+}
+
+// допускает в комнату по приглашению и входит в нее;
+// приглашение не расходуется, если доступ к комнате уже есть
+func (p *Proto) acceptInvite (c conn.Conn, body []byte) {
+	b := &acceptInviteRequest {}
+	if !p.decodeBody(c, body, b) {
+		return
+	}
+
+	if p.invites == nil {
+		p.respondError(c, "invitations are not supported")
+		return
+	}
+
+	uid := c.UserId()
+	inv, found := p.invites.Invite(b.Token)
+	if !found {
+		p.respondError(c, invite.NotFound.Error())
+		return
+	}
+
+	// приглашение не расходуется, если войти по нему все равно нельзя
+	rid := inv.RoomId
+	entry, found := p.rooms.Room(rid)
+	if !found {
+		p.respondError(c, "room #%d not found", rid)
+		return
+	}
+	if conn.ScopeOf(c).Room & access.ReadPerm == 0 || p.isBanned(uid, rid) {
+		p.respondError(c, "you cannot enter room #%d", rid)
+		return
+	}
+
+	if !p.access.HasRoomPerm(uid, rid, access.ReadPerm) {
+		_, e := p.invites.UseInvite(b.Token, uid)
+		if e != nil {
+			p.respondError(c, e.Error())
+			return
+		}
+
+		e = p.access.Admit(uid, rid)
+		if e != nil {
+			p.respondError(c, e.Error())
+			return
+		}
+		if !p.hasRoomPerm(c, rid, access.ReadPerm) {
+			p.respondError(c, "you cannot enter room #%d", rid)
+			return
+		}
+	}
+
+	resp := &response {roomInfoResp, roomInfoResponse(p.roomPermEntry(uid, entry, p.access.RoomPerms(uid, rid)))}
+	p.hub.UserNotice(uid, resp)
+	if p.hub.IsInRoom(uid, rid) {
+		return
+	}
+
+	e := p.joinRoom(uid, rid)
+	if e != nil {
+		p.respondError(c, e.Error())
+		return
+	}
+
+	user, _ := p.users.User(uid)
+	p.hub.RoomNotice(rid, &response {enterResp, enterResponse {rid, user}})
+}
+
+func (p *Proto) listInvites (c conn.Conn, body []byte) {
+	if p.invites == nil {
+		p.respondError(c, "invitations are not supported")
+		return
+	}
+
+	invites := p.invites.UserInvites(c.UserId())
+	result := make([]InviteEntry, 0, len(invites))
+	for _, inv := range invites {
+		result = append(result, p.inviteEntry(inv))
+	}
+
+	resp := &response {listInvitesResp, listInvitesResponse {result}}
+	p.hub.ConnNotice(c.Id(), resp)
+}
+
+// отозвать приглашение может создатель, адресат (отказ) и любой, кто может приглашать в комнату
+func (p *Proto) revokeInvite (c conn.Conn, body []byte) {
+	b := &revokeInviteRequest {}
+	if !p.decodeBody(c, body, b) {
+		return
+	}
+
+	if p.invites == nil {
+		p.respondError(c, "invitations are not supported")
+		return
+	}
+
+	uid := c.UserId()
+	inv, found := p.invites.Invite(b.Token)
+	if !found {
+		p.respondError(c, invite.NotFound.Error())
+		return
+	}
+
+	if inv.CreatorId != uid && inv.UserId != uid && !p.hasRoomPerm(c, inv.RoomId, access.InvitePerm) {
+		p.respondError(c, "you cannot revoke this invitation")
+		return
+	}
+
+	e := p.invites.DeleteInvite(b.Token)
+	if e != nil {
+		p.respondError(c, e.Error())
+		return
+	}
+
+	resp := &response {inviteRevokedResp, inviteRevokedResponse {b.Token}}
+	p.hub.ConnNotice(c.Id(), resp)
+	for _, id := range []int {inv.CreatorId, inv.UserId} {
+		if id != 0 && id != uid {
+			p.hub.UserNotice(id, resp)
+		}
 	}
 }
@@ -0,0 +1,748 @@
+package simple
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ava12/go-chat/access"
+	"github.com/ava12/go-chat/access/role"
+	"github.com/ava12/go-chat/hub"
+	"github.com/ava12/go-chat/room"
+	"github.com/ava12/go-chat/user"
+	roleram "github.com/ava12/go-chat/access/role/ram"
+	inviteram "github.com/ava12/go-chat/invite/ram"
+	roomram "github.com/ava12/go-chat/room/ram"
+	userram "github.com/ava12/go-chat/user/ram"
+)
+
+const (
+	owner = iota + 1
+	moderator
+	member
+	other
+)
+
+const testRoomId = 1
+
+// реестр без паролей: bcrypt под -race слишком медленный
+type testUsersRec []string
+
+func (u testUsersRec) User (id int) (interface {}, bool) {
+	if id < 1 || id > len(u) {
+		return nil, false
+	}
+	return userram.UserEntry {Id: id, Name: u[id - 1]}, true
+}
+
+func (u testUsersRec) Login (w http.ResponseWriter, r *http.Request) (int, interface {}, error) {
+	return 0, nil, user.WrongCredentials
+}
+
+type testEnvRec struct {
+	h *hub.Hub
+	p *Proto
+	ac *role.Controller
+	rooms room.Registry
+}
+
+// протокол на хабе и реестрах в памяти; комната testRoomId создана owner, moderator в ней модератор
+func newTestEnv (t *testing.T) *testEnvRec {
+	users := testUsersRec {"owner", "moderator", "member", "other"}
+	rooms := roomram.NewRegistry()
+	rooms.CreateRoom("room", owner)
+	ac, e := role.NewController(role.DefaultConf(), roleram.NewStorage(), rooms)
+	if e != nil {
+		t.Fatal(e)
+	}
+	ac.NewRoom(owner, testRoomId)
+	if e = ac.SetRoomRole(owner, moderator, testRoomId, role.Moderator); e != nil {
+		t.Fatal(e)
+	}
+
+	h := hub.New(hub.NewMemStorage())
+	h.Start()
+	p := New(h, users, rooms, ac)
+	p.SetInvites(inviteram.NewRegistry())
+	if e = p.RestoreRooms(); e != nil {
+		t.Fatal(e)
+	}
+	t.Cleanup(func () {
+		p.Stop()
+		h.Stop()
+	})
+
+	return &testEnvRec {h, p, ac, rooms}
+}
+
+type testResponseRec struct {
+	Response string `json:"response"`
+	Body json.RawMessage `json:"body"`
+}
+
+type testConnRec struct {
+	id, userId int
+	env *testEnvRec
+	responses chan testResponseRec
+	alive int32
+}
+
+// подключение пользователя userId с номером userId
+func (env *testEnvRec) connect (t *testing.T, userId int) *testConnRec {
+	return env.connectAs(t, userId, userId)
+}
+
+func (env *testEnvRec) connectAs (t *testing.T, connId, userId int) *testConnRec {
+	c := &testConnRec {connId, userId, env, make(chan testResponseRec, 100), 1}
+	env.p.Connect(c)
+	t.Cleanup(func () {
+		env.p.Disconnect(c.id)
+	})
+	return c
+}
+
+func (c *testConnRec) Id () int {
+	return c.id
+}
+
+func (c *testConnRec) UserId () int {
+	return c.userId
+}
+
+func (c *testConnRec) Send (m []byte) {
+	r := testResponseRec {}
+	if json.Unmarshal(m, &r) == nil {
+		c.responses <- r
+	}
+}
+
+func (c *testConnRec) Close () {
+	atomic.StoreInt32(&c.alive, 0)
+}
+
+func (c *testConnRec) IsAlive () bool {
+	return (atomic.LoadInt32(&c.alive) != 0)
+}
+
+func (c *testConnRec) request (t *testing.T, name string, body interface {}) {
+	t.Helper()
+	data, e := json.Marshal(map[string]interface {} {"request": name, "body": body})
+	if e != nil {
+		t.Fatal(e)
+	}
+	c.env.p.TakeRequest(c, data)
+}
+
+// ответы, пришедшие до ответа на whoami: хаб рассылает подключению задачи по порядку,
+// поэтому все последствия уже выполненных запросов приходят раньше
+func (c *testConnRec) sync (t *testing.T) []testResponseRec {
+	t.Helper()
+	c.request(t, whoamiReq, nil)
+	result := make([]testResponseRec, 0)
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case r := <-c.responses:
+			if r.Response == whoamiResp {
+				return result
+			}
+			result = append(result, r)
+
+		case <-timeout:
+			t.Fatalf("u%dc%d: no whoami response", c.userId, c.id)
+		}
+	}
+}
+
+// тело первого ответа с данным именем среди уже пришедших
+func (c *testConnRec) expect (t *testing.T, name string, body interface {}) {
+	t.Helper()
+	for _, r := range c.sync(t) {
+		if r.Response == name {
+			if body != nil {
+				if e := json.Unmarshal(r.Body, body); e != nil {
+					t.Fatal(e)
+				}
+			}
+			return
+		}
+	}
+	t.Fatalf("u%dc%d: no %q response", c.userId, c.id, name)
+}
+
+func (c *testConnRec) expectError (t *testing.T, message string) {
+	t.Helper()
+	b := errorResponse {}
+	c.expect(t, errorResp, &b)
+	if !strings.Contains(b.Message, message) {
+		t.Fatalf("u%dc%d: expecting error %q, got %q", c.userId, c.id, message, b.Message)
+	}
+}
+
+// проверяет, что ответов с данным именем не было
+func (c *testConnRec) expectNo (t *testing.T, name string) {
+	t.Helper()
+	for _, r := range c.sync(t) {
+		if r.Response == name {
+			t.Fatalf("u%dc%d: unexpected %q response: %s", c.userId, c.id, name, r.Body)
+		}
+	}
+}
+
+func (c *testConnRec) enter (t *testing.T, roomId int) {
+	t.Helper()
+	c.request(t, enterReq, enterRequest {roomId})
+	c.expect(t, enterResp, nil)
+}
+
+func (c *testConnRec) say (t *testing.T, roomId int, text string) int {
+	t.Helper()
+	c.request(t, messageReq, map[string]interface {} {
+		"roomId": roomId, "messageType": textMessageType, "data": textMessageData {text},
+	})
+	m := MessageEntry {}
+	c.expect(t, messageResp, &m)
+	return m.MessageId
+}
+
+func TestMessageHistory (t *testing.T) {
+	env := newTestEnv(t)
+	conns := make(map[int]*testConnRec)
+	for _, uid := range []int {owner, moderator, member} {
+		conns[uid] = env.connect(t, uid)
+		conns[uid].enter(t, testRoomId)
+	}
+	for _, c := range conns {
+		c.sync(t)
+	}
+
+	mid := conns[member].say(t, testRoomId, "first")
+	conns[member].request(t, editMessageReq, map[string]interface {} {
+		"roomId": testRoomId, "messageId": mid, "messageType": textMessageType, "data": textMessageData {"second"},
+	})
+	conns[owner].expect(t, editMessageResp, nil)
+
+	for _, uid := range []int {member, moderator} {
+		conns[uid].request(t, messageHistoryReq, messageHistoryRequest {testRoomId, mid})
+		b := messageHistoryResponse {}
+		conns[uid].expect(t, messageHistoryResp, &b)
+		if len(b.Revisions) != 2 {
+			t.Fatalf("u%d: unexpected history %+v", uid, b.Revisions)
+		}
+	}
+
+	// историю чужого сообщения без moderate не посмотреть
+	ownMid := conns[owner].say(t, testRoomId, "owner's")
+	conns[member].request(t, messageHistoryReq, messageHistoryRequest {testRoomId, ownMid})
+	conns[member].expectError(t, "you cannot view history")
+
+	// у заглушенного право на историю остается
+	if e := env.ac.SetRoomRole(owner, member, testRoomId, access.MutedRole); e != nil {
+		t.Fatal(e)
+	}
+	conns[member].request(t, messageHistoryReq, messageHistoryRequest {testRoomId, mid})
+	conns[member].expect(t, messageHistoryResp, nil)
+
+	// от удаленного сообщения остается только "надгробие"
+	conns[moderator].request(t, deleteMessageReq, deleteMessageRequest {testRoomId, mid})
+	conns[owner].expect(t, messageDeletedResp, nil)
+	conns[owner].request(t, messageHistoryReq, messageHistoryRequest {testRoomId, mid})
+	b := messageHistoryResponse {}
+	conns[owner].expect(t, messageHistoryResp, &b)
+	if len(b.Revisions) != 1 || !b.Revisions[0].Deleted || b.Revisions[0].Data != nil {
+		t.Fatalf("unexpected history of deleted message: %+v", b.Revisions)
+	}
+}
+
+func TestResume (t *testing.T) {
+	env := newTestEnv(t)
+	env.p.SetGracePeriod(time.Hour)
+	o := env.connect(t, owner)
+	o.enter(t, testRoomId)
+	m := env.connect(t, member)
+	m.enter(t, testRoomId)
+	lastId := m.say(t, testRoomId, "before")
+	o.sync(t)
+
+	env.p.Disconnect(m.id)
+	missed := map[int]bool {
+		o.say(t, testRoomId, "first"): true,
+		o.say(t, testRoomId, "second"): true,
+	}
+	o.expectNo(t, leaveResp)
+
+	m = env.connectAs(t, 100, member)
+	m.request(t, resumeReq, resumeRequest {map[int]int {testRoomId: lastId}})
+	b := resumeResponse {}
+	for _, r := range m.sync(t) {
+		switch r.Response {
+		case messageResp:
+			entry := MessageEntry {}
+			json.Unmarshal(r.Body, &entry)
+			delete(missed, entry.MessageId)
+		case resumeResp:
+			json.Unmarshal(r.Body, &b)
+		}
+	}
+	if len(missed) != 0 {
+		t.Fatalf("messages not resent: %v", missed)
+	}
+	if len(b.Rooms) != 1 || b.Rooms[0].Id != testRoomId || len(b.Stale) != 0 {
+		t.Fatalf("unexpected resume response: %+v", b)
+	}
+}
+
+func TestGraceExpiry (t *testing.T) {
+	env := newTestEnv(t)
+	env.p.SetGracePeriod(50 * time.Millisecond)
+	o := env.connect(t, owner)
+	o.enter(t, testRoomId)
+	m := env.connect(t, member)
+	m.enter(t, testRoomId)
+	o.sync(t)
+
+	// переподключение в течение GracePeriod оставляет пользователя в комнате
+	env.p.Disconnect(m.id)
+	m = env.connectAs(t, 100, member)
+	time.Sleep(100 * time.Millisecond)
+	if !env.h.IsInRoom(member, testRoomId) {
+		t.Fatal("reconnected user left the room")
+	}
+	o.expectNo(t, leaveResp)
+
+	env.p.Disconnect(m.id)
+	deadline := time.Now().Add(time.Second)
+	for env.h.IsInRoom(member, testRoomId) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	b := leaveResponse {}
+	o.expect(t, leaveResp, &b)
+	if b.RoomId != testRoomId || b.UserId != member || b.ModeratorId != 0 {
+		t.Fatalf("unexpected leave response: %+v", b)
+	}
+}
+
+func TestAcceptInviteBanned (t *testing.T) {
+	env := newTestEnv(t)
+	env.rooms.SetVisibility(testRoomId, room.InviteOnly)
+	if e := env.ac.SetRoomRole(owner, member, testRoomId, access.BannedRole); e != nil {
+		t.Fatal(e)
+	}
+
+	o := env.connect(t, owner)
+	o.request(t, createInviteReq, createInviteRequest {RoomId: testRoomId, MaxUses: 1})
+	inv := InviteEntry {}
+	o.expect(t, inviteResp, &inv)
+
+	// забаненному приглашение не помогает и не расходуется
+	m := env.connect(t, member)
+	m.request(t, acceptInviteReq, acceptInviteRequest {inv.Token})
+	m.expectError(t, "you cannot enter room")
+	if env.h.IsInRoom(member, testRoomId) {
+		t.Fatal("banned user entered the room")
+	}
+
+	x := env.connect(t, other)
+	x.request(t, acceptInviteReq, acceptInviteRequest {inv.Token})
+	x.expect(t, enterResp, nil)
+	if !env.h.IsInRoom(other, testRoomId) {
+		t.Fatal("invited user did not enter the room")
+	}
+}
+
+func TestStartDm (t *testing.T) {
+	env := newTestEnv(t)
+	m := env.connect(t, member)
+	x := env.connect(t, other)
+
+	// без общей комнаты личную не начать
+	m.request(t, startDmReq, startDmRequest {[]int {other}})
+	m.expectError(t, "does not share a room")
+	x.expectNo(t, directRoomResp)
+
+	m.enter(t, testRoomId)
+	x.enter(t, testRoomId)
+	m.request(t, startDmReq, startDmRequest {[]int {other}})
+	b := directRoomResponse {}
+	x.expect(t, directRoomResp, &b)
+	if len(b.UserIds) != 2 || b.Perm & access.WritePerm == 0 {
+		t.Fatalf("unexpected direct room: %+v", b)
+	}
+
+	// начатую комнату можно открыть и без общей
+	x.request(t, leaveReq, leaveRequest {testRoomId})
+	x.sync(t)
+	m.request(t, startDmReq, startDmRequest {[]int {other}})
+	m.expect(t, directRoomResp, nil)
+}
+
+func TestUpdateRoom (t *testing.T) {
+	env := newTestEnv(t)
+	o := env.connect(t, owner)
+	m := env.connect(t, member)
+	m.enter(t, testRoomId)
+
+	// недопустимая тема отменяет и переименование
+	name := "renamed"
+	topic := strings.Repeat("x", maxTopicLen + 1)
+	o.request(t, updateRoomReq, updateRoomRequest {RoomId: testRoomId, Name: &name, Topic: &topic})
+	o.expectError(t, "topic is too long")
+	m.expectNo(t, roomUpdatedResp)
+	if entry, _ := env.rooms.Room(testRoomId); entry.Name != "room" {
+		t.Fatalf("room renamed by failed update: %q", entry.Name)
+	}
+
+	m.request(t, updateRoomReq, updateRoomRequest {RoomId: testRoomId, Name: &name})
+	m.expectError(t, "you cannot change room")
+
+	topic = "topic"
+	o.request(t, updateRoomReq, updateRoomRequest {RoomId: testRoomId, Name: &name, Topic: &topic})
+	b := roomUpdatedResponse {}
+	m.expect(t, roomUpdatedResp, &b)
+	if b.Name != name || b.Topic != topic {
+		t.Fatalf("unexpected room update: %+v", b)
+	}
+
+	// модератор меняет тему, но не название
+	md := env.connect(t, moderator)
+	name = "moderated"
+	md.request(t, updateRoomReq, updateRoomRequest {RoomId: testRoomId, Name: &name})
+	md.expectError(t, "you cannot change room")
+	topic = "moderated"
+	md.request(t, updateRoomReq, updateRoomRequest {RoomId: testRoomId, Topic: &topic})
+	b = roomUpdatedResponse {}
+	m.expect(t, roomUpdatedResp, &b)
+	if b.Name != "renamed" || b.Topic != topic {
+		t.Fatalf("unexpected room update: %+v", b)
+	}
+}
+
+func TestDeleteRoom (t *testing.T) {
+	env := newTestEnv(t)
+	o := env.connect(t, owner)
+	md := env.connect(t, moderator)
+	m := env.connect(t, member)
+	m.enter(t, testRoomId)
+
+	md.request(t, deleteRoomReq, deleteRoomRequest {testRoomId})
+	md.expectError(t, "you cannot delete room")
+	m.expectNo(t, roomDeletedResp)
+
+	o.request(t, deleteRoomReq, deleteRoomRequest {testRoomId})
+	b := roomDeletedResponse {}
+	m.expect(t, roomDeletedResp, &b)
+	if b.RoomId != testRoomId || b.UserId != owner {
+		t.Fatalf("unexpected room deletion: %+v", b)
+	}
+	if _, found := env.rooms.Room(testRoomId); found || env.h.IsInRoom(member, testRoomId) {
+		t.Fatal("room not deleted")
+	}
+	if env.ac.RoomRole(moderator, testRoomId) != role.Member {
+		t.Fatal("roles of deleted room kept")
+	}
+}
+
+func (c *testConnRec) edit (t *testing.T, roomId, messageId int, text string) {
+	t.Helper()
+	c.request(t, editMessageReq, map[string]interface {} {
+		"roomId": roomId, "messageId": messageId, "messageType": textMessageType, "data": textMessageData {text},
+	})
+}
+
+// текст из данных сообщения {"messageType": ..., "data": {"text": ...}}
+func messageText (data interface {}) string {
+	m, _ := data.(map[string]interface {})
+	d, _ := m["data"].(map[string]interface {})
+	text, _ := d["text"].(string)
+	return text
+}
+
+func TestEditMessage (t *testing.T) {
+	env := newTestEnv(t)
+	conns := make(map[int]*testConnRec)
+	for _, uid := range []int {owner, moderator, member} {
+		conns[uid] = env.connect(t, uid)
+		conns[uid].enter(t, testRoomId)
+	}
+	x := env.connect(t, other)
+	mid := conns[member].say(t, testRoomId, "first")
+	conns[moderator].sync(t)
+	modMid := conns[moderator].say(t, testRoomId, "moderator's")
+	for _, c := range conns {
+		c.sync(t)
+	}
+
+	x.edit(t, testRoomId, mid, "other's")
+	x.expectError(t, "you are not in room")
+
+	// чужое сообщение без moderate не исправить
+	conns[member].edit(t, testRoomId, modMid, "member's")
+	conns[member].expectError(t, "you cannot edit message")
+	conns[owner].expectNo(t, editMessageResp)
+
+	conns[member].edit(t, testRoomId, mid, "second")
+	for _, uid := range []int {owner, moderator} {
+		b := editMessageResponse {}
+		conns[uid].expect(t, editMessageResp, &b)
+		if b.MessageId != mid || !b.Edited || b.EditorId != member || messageText(b.Data) != "second" {
+			t.Fatalf("u%d: unexpected edit: %+v", uid, b)
+		}
+	}
+
+	conns[member].sync(t)
+	conns[moderator].edit(t, testRoomId, mid, "third")
+	b := editMessageResponse {}
+	conns[member].expect(t, editMessageResp, &b)
+	if b.UserId != member || b.EditorId != moderator {
+		t.Fatalf("unexpected moderator edit: %+v", b)
+	}
+	conns[owner].sync(t)
+
+	// без права писать не исправить и свое
+	if e := env.ac.SetRoomRole(owner, member, testRoomId, access.MutedRole); e != nil {
+		t.Fatal(e)
+	}
+	conns[member].edit(t, testRoomId, mid, "muted")
+	conns[member].expectError(t, "you cannot edit messages")
+	conns[owner].expectNo(t, editMessageResp)
+}
+
+func TestDeleteMessage (t *testing.T) {
+	env := newTestEnv(t)
+	conns := make(map[int]*testConnRec)
+	for _, uid := range []int {owner, moderator, member} {
+		conns[uid] = env.connect(t, uid)
+		conns[uid].enter(t, testRoomId)
+	}
+	x := env.connect(t, other)
+	mid := conns[member].say(t, testRoomId, "first")
+	conns[moderator].sync(t)
+	modMid := conns[moderator].say(t, testRoomId, "moderator's")
+	for _, c := range conns {
+		c.sync(t)
+	}
+
+	x.request(t, deleteMessageReq, deleteMessageRequest {testRoomId, mid})
+	x.expectError(t, "you are not in room")
+
+	conns[member].request(t, deleteMessageReq, deleteMessageRequest {testRoomId, modMid})
+	conns[member].expectError(t, "you cannot delete message")
+	conns[owner].expectNo(t, messageDeletedResp)
+
+	conns[member].request(t, deleteMessageReq, deleteMessageRequest {testRoomId, mid})
+	for _, uid := range []int {owner, moderator} {
+		b := messageDeletedResponse {}
+		conns[uid].expect(t, messageDeletedResp, &b)
+		if b.MessageId != mid || !b.Deleted || b.Data != nil || b.EditorId != member {
+			t.Fatalf("u%d: unexpected deletion: %+v", uid, b)
+		}
+	}
+
+	// модератор удаляет и чужие
+	mid = conns[member].say(t, testRoomId, "second")
+	conns[moderator].request(t, deleteMessageReq, deleteMessageRequest {testRoomId, mid})
+	b := messageDeletedResponse {}
+	conns[member].expect(t, messageDeletedResp, &b)
+	if b.MessageId != mid || b.UserId != member || b.EditorId != moderator {
+		t.Fatalf("unexpected moderator deletion: %+v", b)
+	}
+}
+
+func TestKick (t *testing.T) {
+	env := newTestEnv(t)
+	conns := make(map[int]*testConnRec)
+	for _, uid := range []int {owner, moderator, member} {
+		conns[uid] = env.connect(t, uid)
+		conns[uid].enter(t, testRoomId)
+	}
+	for _, c := range conns {
+		c.sync(t)
+	}
+	md := conns[moderator]
+
+	conns[member].request(t, kickReq, moderateRequest {testRoomId, moderator})
+	conns[member].expectError(t, "you cannot kick users")
+
+	// ни себя, ни старшего не выгнать
+	for _, uid := range []int {moderator, owner} {
+		md.request(t, kickReq, moderateRequest {testRoomId, uid})
+		md.expectError(t, "you cannot kick user")
+	}
+	md.request(t, kickReq, moderateRequest {testRoomId, other})
+	md.expectError(t, "is not in room")
+	conns[owner].expectNo(t, leaveResp)
+
+	md.request(t, kickReq, moderateRequest {testRoomId, member})
+	for _, uid := range []int {owner, member} {
+		b := leaveResponse {}
+		conns[uid].expect(t, leaveResp, &b)
+		if b.RoomId != testRoomId || b.UserId != member || b.ModeratorId != moderator {
+			t.Fatalf("u%d: unexpected leave response: %+v", uid, b)
+		}
+	}
+	if env.h.IsInRoom(member, testRoomId) {
+		t.Fatal("kicked user is still in the room")
+	}
+
+	// выгнанный может вернуться
+	conns[member].enter(t, testRoomId)
+}
+
+func TestBanMute (t *testing.T) {
+	env := newTestEnv(t)
+	conns := make(map[int]*testConnRec)
+	for _, uid := range []int {owner, moderator, member} {
+		conns[uid] = env.connect(t, uid)
+		conns[uid].enter(t, testRoomId)
+	}
+	for _, c := range conns {
+		c.sync(t)
+	}
+	o, md, m := conns[owner], conns[moderator], conns[member]
+
+	m.request(t, muteReq, moderateRequest {testRoomId, moderator})
+	m.expectError(t, "you cannot change roles")
+	md.request(t, banReq, moderateRequest {testRoomId, owner})
+	md.expectError(t, "cannot change role")
+	o.expectNo(t, roleResp)
+
+	md.request(t, muteReq, moderateRequest {testRoomId, member})
+	b := roleResponse {}
+	o.expect(t, roleResp, &b)
+	if b.UserId != member || b.Role != access.MutedRole || b.Perm & access.WritePerm != 0 {
+		t.Fatalf("unexpected mute: %+v", b)
+	}
+	m.request(t, messageReq, map[string]interface {} {
+		"roomId": testRoomId, "messageType": textMessageType, "data": textMessageData {"muted"},
+	})
+	m.expectError(t, "you cannot post messages")
+
+	md.request(t, unmuteReq, moderateRequest {testRoomId, member})
+	b = roleResponse {}
+	o.expect(t, roleResp, &b)
+	if b.UserId != member || b.Perm & access.WritePerm == 0 {
+		t.Fatalf("unexpected unmute: %+v", b)
+	}
+	m.say(t, testRoomId, "unmuted")
+
+	// снимается только своя роль
+	md.request(t, unbanReq, moderateRequest {testRoomId, member})
+	md.expectError(t, "is not banned")
+
+	md.request(t, banReq, moderateRequest {testRoomId, member})
+	l := leaveResponse {}
+	m.expect(t, leaveResp, &l)
+	if l.UserId != member || l.ModeratorId != moderator {
+		t.Fatalf("unexpected leave response: %+v", l)
+	}
+	if env.h.IsInRoom(member, testRoomId) {
+		t.Fatal("banned user is still in the room")
+	}
+	m.request(t, enterReq, enterRequest {testRoomId})
+	m.expectError(t, "you cannot enter room")
+
+	md.request(t, unbanReq, moderateRequest {testRoomId, member})
+	m.expect(t, roleResp, nil)
+	m.enter(t, testRoomId)
+}
+
+func TestInvites (t *testing.T) {
+	env := newTestEnv(t)
+	env.rooms.SetVisibility(testRoomId, room.InviteOnly)
+	o := env.connect(t, owner)
+	md := env.connect(t, moderator)
+	m := env.connect(t, member)
+	x := env.connect(t, other)
+
+	m.request(t, createInviteReq, createInviteRequest {RoomId: testRoomId})
+	m.expectError(t, "you cannot invite users")
+	x.request(t, enterReq, enterRequest {testRoomId})
+	x.expectError(t, "you cannot enter room")
+
+	md.request(t, createInviteReq, createInviteRequest {RoomId: testRoomId, UserId: other})
+	inv := InviteEntry {}
+	x.expect(t, inviteResp, &inv)
+	if inv.RoomId != testRoomId || inv.UserId != other || inv.CreatorId != moderator || inv.RoomName != "room" {
+		t.Fatalf("unexpected invite: %+v", inv)
+	}
+	md.expect(t, inviteResp, nil)
+
+	x.request(t, listInvitesReq, nil)
+	l := listInvitesResponse {}
+	x.expect(t, listInvitesResp, &l)
+	if len(l.Invites) != 1 || l.Invites[0].Token != inv.Token {
+		t.Fatalf("unexpected invite list: %+v", l.Invites)
+	}
+
+	// отозвать чужое приглашение без права приглашать нельзя
+	m.request(t, revokeInviteReq, revokeInviteRequest {inv.Token})
+	m.expectError(t, "you cannot revoke this invitation")
+
+	x.request(t, acceptInviteReq, acceptInviteRequest {inv.Token})
+	x.expect(t, enterResp, nil)
+	if !env.h.IsInRoom(other, testRoomId) {
+		t.Fatal("invited user did not enter the room")
+	}
+
+	// адресат может отказаться, создатель узнает об этом
+	md.request(t, createInviteReq, createInviteRequest {RoomId: testRoomId, UserId: member})
+	m.expect(t, inviteResp, &inv)
+	md.sync(t)
+	m.request(t, revokeInviteReq, revokeInviteRequest {inv.Token})
+	r := inviteRevokedResponse {}
+	md.expect(t, inviteRevokedResp, &r)
+	if r.Token != inv.Token {
+		t.Fatalf("unexpected revoked invite: %+v", r)
+	}
+	m.expect(t, inviteRevokedResp, nil)
+
+	// отозвать может и любой, кто может приглашать
+	md.request(t, createInviteReq, createInviteRequest {RoomId: testRoomId})
+	md.expect(t, inviteResp, &inv)
+	o.request(t, revokeInviteReq, revokeInviteRequest {inv.Token})
+	o.expect(t, inviteRevokedResp, nil)
+	md.expect(t, inviteRevokedResp, nil)
+	m.request(t, acceptInviteReq, acceptInviteRequest {inv.Token})
+	m.expectError(t, "not found")
+}
+
+func TestArchiveRoom (t *testing.T) {
+	env := newTestEnv(t)
+	o := env.connect(t, owner)
+	md := env.connect(t, moderator)
+	m := env.connect(t, member)
+	m.enter(t, testRoomId)
+	mid := m.say(t, testRoomId, "before")
+
+	md.request(t, archiveRoomReq, archiveRoomRequest {testRoomId, true})
+	md.expectError(t, "you cannot archive room")
+	m.expectNo(t, roomUpdatedResp)
+
+	o.request(t, archiveRoomReq, archiveRoomRequest {testRoomId, true})
+	b := roomUpdatedResponse {}
+	m.expect(t, roomUpdatedResp, &b)
+	if b.Id != testRoomId || !b.Archived {
+		t.Fatalf("unexpected room update: %+v", b)
+	}
+
+	// архив только для чтения
+	m.request(t, messageReq, map[string]interface {} {
+		"roomId": testRoomId, "messageType": textMessageType, "data": textMessageData {"archived"},
+	})
+	m.expectError(t, "you cannot post messages")
+	m.edit(t, testRoomId, mid, "archived")
+	m.expectError(t, "you cannot edit messages")
+	m.request(t, listMessagesReq, listMessagesRequest {RoomId: testRoomId, FirstMessageId: 1, MessageCnt: 10})
+	m.expect(t, listMessagesResp, nil)
+
+	o.request(t, archiveRoomReq, archiveRoomRequest {testRoomId, false})
+	b = roomUpdatedResponse {}
+	m.expect(t, roomUpdatedResp, &b)
+	if b.Archived {
+		t.Fatalf("unexpected room update: %+v", b)
+	}
+	m.say(t, testRoomId, "after")
+}
@@ -10,12 +10,31 @@ function ChatProto (callbacks, conn) {
 		inRooms: null, // function (rooms)
 		newRoom: null, // function (room)
 		enter: null, // function (roomId, user)
-		leave: null, // function (roomId, userId)
+		leave: null, // function (roomId, userId, moderatorId)
 		listUsers: null, // function (roomId, users)
 		listMessages: null, // function (roomId, firstMessageId, messages)
 		userInfo: null, // function (user)
 		roomInfo: null, // function (room)
 		textMessage: null, // function (roomId, messageId, userId, timestamp, text)
+		editTextMessage: null, // function (roomId, messageId, editTimestamp, text)
+		messageDeleted: null, // function (roomId, messageId)
+		messageHistory: null, // function (roomId, messageId, revisions)
+		resume: null, // function (rooms, staleRoomIds)
+		presence: null, // function (userId, status)
+		listPresence: null, // function (users)
+		typing: null, // function (roomId, userId, isTyping)
+		read: null, // function (roomId, messageId, unread)
+		readReceipt: null, // function (roomId, userId, messageId)
+		readReceipts: null, // function (roomId, users)
+		directRoom: null, // function (room)
+		listDms: null, // function (rooms)
+		role: null, // function (roomId, userId, role, perm), roomId == 0 - глобальная роль
+		listRoles: null, // function (roomId, roles)
+		roomUpdated: null, // function (room)
+		invite: null, // function (invite)
+		listInvites: null, // function (invites)
+		inviteRevoked: null, // function (token)
+		roomDeleted: null, // function (roomId, userId)
 		response: null, // function (responseType, responseBody)
 		connError: null // function (message)
 	}
@@ -32,14 +51,38 @@ function ChatProto (callbacks, conn) {
 ChatProto.prototype.perm = {
 	global: {
 		listRooms: 1,
-		createRoom: 2
+		createRoom: 2,
+		admin: 4
 	},
 	room: {
 		read: 1,
-		write: 2
+		write: 2,
+		moderate: 4,
+		history: 8,
+		kick: 16,
+		ban: 32,
+		mute: 64,
+		invite: 128,
+		rename: 256,
+		topic: 512,
+		roles: 1024,
+		delete: 2048
 	}
 }
 
+ChatProto.prototype.presence = {
+	offline: 'offline',
+	online: 'online',
+	away: 'away',
+	dnd: 'dnd'
+}
+
+ChatProto.prototype.visibility = {
+	public: 'public',
+	unlisted: 'unlisted',
+	invite: 'invite'
+}
+
 ChatProto.prototype.messageTypes = {
 	text: 1
 }
@@ -49,12 +92,30 @@ ChatProto.prototype.responseMap = { // {response: [callback, (arg... | '*')]}
 	'list-rooms': ['listRooms', 'rooms'],
 	'in-rooms': ['inRooms', 'rooms'],
 	enter: ['enter', 'roomId', 'user', 'perm'],
-	leave: ['leave', 'roomId', 'userId'],
+	leave: ['leave', 'roomId', 'userId', 'moderatorId'],
 	'new-room': ['newRoom', '*'],
 	'list-users': ['listUsers', 'roomId', 'users'],
 	'list-messages': ['listMessages', 'roomId', 'firstMessageId', 'messages'],
 	'user-info': ['userInfo', '*'],
 	'room-info': ['roomInfo', '*'],
+	'message-deleted': ['messageDeleted', 'roomId', 'messageId'],
+	'message-history': ['messageHistory', 'roomId', 'messageId', 'revisions'],
+	resume: ['resume', 'rooms', 'stale'],
+	presence: ['presence', 'userId', 'status'],
+	'list-presence': ['listPresence', 'users'],
+	typing: ['typing', 'roomId', 'userId', 'typing'],
+	read: ['read', 'roomId', 'messageId', 'unread'],
+	'read-receipt': ['readReceipt', 'roomId', 'userId', 'messageId'],
+	'read-receipts': ['readReceipts', 'roomId', 'users'],
+	'direct-room': ['directRoom', '*'],
+	'list-dms': ['listDms', 'rooms'],
+	role: ['role', 'roomId', 'userId', 'role', 'perm'],
+	'list-roles': ['listRoles', 'roomId', 'roles'],
+	'room-updated': ['roomUpdated', '*'],
+	invite: ['invite', '*'],
+	'list-invites': ['listInvites', 'invites'],
+	'invite-revoked': ['inviteRevoked', 'token'],
+	'room-deleted': ['roomDeleted', 'roomId', 'userId'],
 	error: ['error', 'message']
 }
 
@@ -109,6 +170,18 @@ ChatProto.prototype.takeResponse = function (response) {
 			}
 		break
 
+		case 'edit-message':
+			var b = response.body
+			args = [b.roomId, b.messageId, b.editTimestamp]
+
+			switch (b.data.messageType) {
+				case this.messageTypes.text:
+					name = 'editTextMessage'
+					args.push(b.data.data.text)
+				break
+			}
+		break
+
 		default:
 			var def = this.responseMap[response.response]
 			if (def) {
@@ -168,8 +241,89 @@ ChatProto.prototype.sendInRooms = function () {
 	this.send('in-rooms')
 }
 
-ChatProto.prototype.sendNewRoom = function (name) {
-	this.send('new-room', {name: name})
+ChatProto.prototype.sendNewRoom = function (name, visibility) {
+	this.send('new-room', {name: name, visibility: visibility || ''})
+}
+
+ChatProto.prototype.sendUpdateRoom = function (roomId, fields) { // fields: {name, topic, description}, все необязательны
+	var body = {roomId: roomId}
+	for (var name in fields) {
+		body[name] = fields[name]
+	}
+	this.send('update-room', body)
+}
+
+ChatProto.prototype.sendArchiveRoom = function (roomId, archived) {
+	this.send('archive-room', {roomId: roomId, archived: !!archived})
+}
+
+ChatProto.prototype.sendDeleteRoom = function (roomId) {
+	this.send('delete-room', {roomId: roomId})
+}
+
+ChatProto.prototype.sendSetVisibility = function (roomId, visibility) {
+	this.send('set-visibility', {roomId: roomId, visibility: visibility})
+}
+
+ChatProto.prototype.sendCreateInvite = function (roomId, userId, maxUses, ttl) { // userId == 0 - токен для любого
+	this.send('create-invite', {roomId: roomId, userId: userId || 0, maxUses: maxUses || 0, ttl: ttl || 0})
+}
+
+ChatProto.prototype.sendAcceptInvite = function (token) {
+	this.send('accept-invite', {token: token})
+}
+
+ChatProto.prototype.sendListInvites = function () {
+	this.send('list-invites')
+}
+
+ChatProto.prototype.sendRevokeInvite = function (token) {
+	this.send('revoke-invite', {token: token})
+}
+
+ChatProto.prototype.sendStartDm = function (userIds) {
+	this.send('start-dm', {userIds: userIds})
+}
+
+ChatProto.prototype.sendListDms = function () {
+	this.send('list-dms')
+}
+
+ChatProto.prototype.sendGrantRole = function (roomId, userId, role) {
+	this.send('grant-role', {roomId: roomId, userId: userId, role: role})
+}
+
+ChatProto.prototype.sendRevokeRole = function (roomId, userId) {
+	this.send('revoke-role', {roomId: roomId, userId: userId})
+}
+
+ChatProto.prototype.sendListRoles = function (roomId) {
+	this.send('list-roles', {roomId: roomId})
+}
+
+ChatProto.prototype.sendKick = function (roomId, userId) {
+	this.send('kick', {roomId: roomId, userId: userId})
+}
+
+ChatProto.prototype.sendBan = function (roomId, userId) {
+	this.send('ban', {roomId: roomId, userId: userId})
+}
+
+ChatProto.prototype.sendUnban = function (roomId, userId) {
+	this.send('unban', {roomId: roomId, userId: userId})
+}
+
+ChatProto.prototype.sendMute = function (roomId, userId) {
+	this.send('mute', {roomId: roomId, userId: userId})
+}
+
+ChatProto.prototype.sendUnmute = function (roomId, userId) {
+	this.send('unmute', {roomId: roomId, userId: userId})
+}
+
+// досланные сообщения могут прийти после новых и повторять уже полученные, их нужно упорядочивать по messageId
+ChatProto.prototype.sendResume = function (lastIds) { // lastIds: {roomId: lastMessageId}
+	this.send('resume', {rooms: lastIds})
 }
 
 ChatProto.prototype.sendEnter = function (roomId) {
@@ -199,3 +353,39 @@ ChatProto.prototype.sendRoomInfo = function (roomId) {
 ChatProto.prototype.sendTextMessage = function (roomId, text) {
 	this.send('message', {roomId: roomId, messageType: this.messageTypes.text, data: {text: text}})
 }
+
+ChatProto.prototype.sendEditTextMessage = function (roomId, messageId, text) {
+	this.send('edit-message', {roomId: roomId, messageId: messageId, messageType: this.messageTypes.text, data: {text: text}})
+}
+
+ChatProto.prototype.sendDeleteMessage = function (roomId, messageId) {
+	this.send('delete-message', {roomId: roomId, messageId: messageId})
+}
+
+ChatProto.prototype.sendMessageHistory = function (roomId, messageId) {
+	this.send('message-history', {roomId: roomId, messageId: messageId})
+}
+
+ChatProto.prototype.sendSetPresence = function (status) {
+	this.send('set-presence', {status: status})
+}
+
+ChatProto.prototype.sendListPresence = function (userIds) {
+	this.send('list-presence', {userIds: userIds})
+}
+
+ChatProto.prototype.sendTypingStart = function (roomId) {
+	this.send('typing-start', {roomId: roomId})
+}
+
+ChatProto.prototype.sendTypingStop = function (roomId) {
+	this.send('typing-stop', {roomId: roomId})
+}
+
+ChatProto.prototype.sendMarkRead = function (roomId, messageId) {
+	this.send('mark-read', {roomId: roomId, messageId: messageId})
+}
+
+ChatProto.prototype.sendReadReceipts = function (roomId) {
+	this.send('read-receipts', {roomId: roomId})
+}
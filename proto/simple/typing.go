@@ -0,0 +1,156 @@
+package simple
+
+import (
+	"sync"
+	"time"
+)
+
+// Индикаторы набора текста. Состояние хранится только в памяти и рассылается уведомлениями в комнату,
+// хранилище сообщений и нумерация сообщений не затрагиваются.
+// Повторные typing-start лишь продлевают индикатор; включение индикатора - не чаще раза в typingInterval;
+// если клиент пропал, индикатор снимается через typingTimeout.
+
+const (
+	typingTimeout = 6 * time.Second
+	typingInterval = time.Second
+)
+
+type typingKey struct {
+	userId, roomId int
+}
+
+type typingRec struct {
+	timer *time.Timer // nil - индикатор выключен
+	gen int // номер взвода таймера; сработавший устаревший таймер ничего не меняет
+	started time.Time
+}
+
+type typingTracker struct {
+	lock sync.Mutex
+	entries map[typingKey]*typingRec
+	conns map[int]int // число подключений пользователя
+	gen int
+	timeout, interval time.Duration
+	notify func (userId, roomId int, typing bool)
+}
+
+func newTypingTracker (notify func (userId, roomId int, typing bool)) *typingTracker {
+	return &typingTracker {
+		entries: make(map[typingKey]*typingRec),
+		conns: make(map[int]int),
+		timeout: typingTimeout,
+		interval: typingInterval,
+		notify: notify,
+	}
+}
+
+// вызывающий должен удерживать lock
+func (tt *typingTracker) arm (entry *typingRec, userId, roomId int) {
+	if entry.timer != nil {
+		entry.timer.Stop()
+	}
+
+	tt.gen++
+	gen := tt.gen
+	entry.gen = gen
+	entry.timer = time.AfterFunc(tt.timeout, func () {
+		tt.expire(userId, roomId, gen)
+	})
+}
+
+func (tt *typingTracker) start (userId, roomId int) {
+	tt.lock.Lock()
+	defer tt.lock.Unlock()
+
+	key := typingKey {userId, roomId}
+	entry := tt.entries[key]
+	if entry == nil {
+		entry = &typingRec {}
+		tt.entries[key] = entry
+	}
+
+	if entry.timer != nil {
+		tt.arm(entry, userId, roomId)
+		return
+	}
+
+	now := time.Now()
+	if now.Sub(entry.started) < tt.interval {
+		return
+	}
+
+	entry.started = now
+	tt.arm(entry, userId, roomId)
+	tt.notify(userId, roomId, true)
+}
+
+func (tt *typingTracker) expire (userId, roomId, gen int) {
+	tt.lock.Lock()
+	defer tt.lock.Unlock()
+
+	entry := tt.entries[typingKey {userId, roomId}]
+	if entry != nil && entry.gen == gen {
+		tt.turnOff(entry, userId, roomId)
+	}
+}
+
+func (tt *typingTracker) stop (userId, roomId int) {
+	tt.lock.Lock()
+	defer tt.lock.Unlock()
+
+	entry := tt.entries[typingKey {userId, roomId}]
+	if entry != nil {
+		tt.turnOff(entry, userId, roomId)
+	}
+}
+
+// вызывающий должен удерживать lock
+func (tt *typingTracker) turnOff (entry *typingRec, userId, roomId int) {
+	if entry.timer == nil {
+		return
+	}
+
+	entry.timer.Stop()
+	entry.timer = nil
+	tt.notify(userId, roomId, false)
+}
+
+func (tt *typingTracker) connect (userId int) {
+	tt.lock.Lock()
+	defer tt.lock.Unlock()
+
+	tt.conns[userId]++
+}
+
+// с отключением последнего подключения пользователя снимает все его индикаторы
+func (tt *typingTracker) disconnect (userId int) {
+	tt.lock.Lock()
+	defer tt.lock.Unlock()
+
+	if tt.conns[userId] > 1 {
+		tt.conns[userId]--
+		return
+	}
+
+	delete(tt.conns, userId)
+	for key, entry := range tt.entries {
+		if key.userId != userId {
+			continue
+		}
+
+		tt.turnOff(entry, key.userId, key.roomId)
+		delete(tt.entries, key)
+	}
+}
+
+func (tt *typingTracker) clear () {
+	tt.lock.Lock()
+	defer tt.lock.Unlock()
+
+	for key, entry := range tt.entries {
+		if entry.timer != nil {
+			entry.timer.Stop()
+		}
+		delete(tt.entries, key)
+	}
+}
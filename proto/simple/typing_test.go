@@ -0,0 +1,111 @@
+package simple
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+type typingLogRec struct {
+	lock sync.Mutex
+	events []string
+}
+
+func (l *typingLogRec) notify (userId, roomId int, typing bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.events = append(l.events, fmt.Sprintf("u%dr%d:%v", userId, roomId, typing))
+}
+
+func (l *typingLogRec) check (t *testing.T, expected ...string) {
+	t.Helper()
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if fmt.Sprint(l.events) != fmt.Sprint(expected) {
+		t.Fatalf("expecting %v, got %v", expected, l.events)
+	}
+}
+
+func newTestTracker (timeout, interval time.Duration) (*typingTracker, *typingLogRec) {
+	l := &typingLogRec {}
+	tt := newTypingTracker(l.notify)
+	tt.timeout = timeout
+	tt.interval = interval
+	return tt, l
+}
+
+func TestTypingStartStop (t *testing.T) {
+	tt, l := newTestTracker(time.Hour, time.Hour)
+	defer tt.clear()
+
+	tt.start(1, 2)
+	tt.start(1, 2)
+	l.check(t, "u1r2:true")
+
+	tt.stop(1, 2)
+	tt.stop(1, 2)
+	l.check(t, "u1r2:true", "u1r2:false")
+
+	// повторное включение не чаще раза в interval
+	tt.start(1, 2)
+	l.check(t, "u1r2:true", "u1r2:false")
+}
+
+func TestTypingTimeout (t *testing.T) {
+	tt, l := newTestTracker(100 * time.Millisecond, 0)
+	defer tt.clear()
+
+	tt.start(1, 2)
+	for i := 0; i < 3; i++ {
+		time.Sleep(50 * time.Millisecond)
+		tt.start(1, 2)
+	}
+	l.check(t, "u1r2:true")
+
+	time.Sleep(300 * time.Millisecond)
+	l.check(t, "u1r2:true", "u1r2:false")
+}
+
+func TestTypingStaleTimer (t *testing.T) {
+	tt, l := newTestTracker(time.Hour, 0)
+	defer tt.clear()
+
+	tt.start(1, 2)
+	tt.lock.Lock()
+	gen := tt.entries[typingKey {1, 2}].gen
+	tt.lock.Unlock()
+
+	// таймер сработал, но его обработчик ждал блокировку, пока индикатор продлевался
+	tt.start(1, 2)
+	tt.expire(1, 2, gen)
+	l.check(t, "u1r2:true")
+
+	tt.lock.Lock()
+	gen = tt.entries[typingKey {1, 2}].gen
+	tt.lock.Unlock()
+	tt.expire(1, 2, gen)
+	l.check(t, "u1r2:true", "u1r2:false")
+}
+
+func TestTypingDisconnect (t *testing.T) {
+	tt, l := newTestTracker(time.Hour, 0)
+	defer tt.clear()
+
+	tt.connect(1)
+	tt.connect(1)
+	tt.connect(3)
+	tt.start(1, 2)
+	tt.start(3, 2)
+
+	tt.disconnect(1)
+	l.check(t, "u1r2:true", "u3r2:true")
+
+	tt.disconnect(1)
+	l.check(t, "u1r2:true", "u3r2:true", "u1r2:false")
+
+	tt.connect(1)
+	tt.start(1, 2)
+	l.check(t, "u1r2:true", "u3r2:true", "u1r2:false", "u1r2:true")
+}
@@ -2,18 +2,21 @@ package ram
 
 import (
 	"github.com/ava12/go-chat/room"
+	"errors"
 	"fmt"
 	"sync"
+	"time"
 )
 
 type memRegistryRec struct {
 	lock sync.RWMutex
 	rooms map[int]*room.Entry
+	direct map[string]int // ключ личной комнаты: id
 	lastId int
 }
 
 func NewRegistry () room.Registry {
-	return &memRegistryRec {rooms: make(map[int]*room.Entry)}
+	return &memRegistryRec {rooms: make(map[int]*room.Entry), direct: make(map[string]int)}
 }
 
 func (mrr *memRegistryRec) ListRooms () []room.Entry {
@@ -27,18 +30,33 @@ func (mrr *memRegistryRec) ListRooms () []room.Entry {
 	return result
 }
 
-func (mrr *memRegistryRec) CreateRoom (name string) (id int, e error) {
-	mrr.lock.RLock()
-	defer mrr.lock.RUnlock()
-
+// вызывающий должен удерживать lock
+func (mrr *memRegistryRec) checkName (id int, name string) error {
 	for _, entry := range mrr.rooms {
-		if entry.Name == name {
-			return 0, fmt.Errorf("room \"%s\" already exists", name)
+		if !entry.IsDirect() && entry.Name == name && entry.Id != id {
+			return fmt.Errorf("room \"%s\" already exists", name)
 		}
 	}
+	return nil
+}
+
+func (mrr *memRegistryRec) CreateRoom (name string, creatorId int) (id int, e error) {
+	mrr.lock.Lock()
+	defer mrr.lock.Unlock()
+
+	e = mrr.checkName(0, name)
+	if e != nil {
+		return 0, e
+	}
 
 	mrr.lastId++
-	mrr.rooms[mrr.lastId] = &room.Entry {mrr.lastId, name}
+	mrr.rooms[mrr.lastId] = &room.Entry {
+		Id: mrr.lastId,
+		Name: name,
+		Visibility: room.Public,
+		CreatorId: creatorId,
+		Created: time.Now().Unix(),
+	}
 	return mrr.lastId, nil
 }
 
@@ -53,3 +71,104 @@ func (mrr *memRegistryRec) Room (id int) (room.Entry, bool) {
 		return room.Entry {}, false
 	}
 }
+
+// изменяет общую комнату под блокировкой
+func (mrr *memRegistryRec) update (id int, f func (entry *room.Entry) error) error {
+	mrr.lock.Lock()
+	defer mrr.lock.Unlock()
+
+	entry := mrr.rooms[id]
+	switch {
+	case entry == nil:
+		return room.NotFound
+	case entry.IsDirect():
+		return errors.New("cannot change a direct room")
+	}
+
+	return f(entry)
+}
+
+func (mrr *memRegistryRec) SetVisibility (id int, visibility string) error {
+	if !room.IsVisibility(visibility) {
+		return fmt.Errorf("unknown room visibility: %q", visibility)
+	}
+
+	return mrr.update(id, func (entry *room.Entry) error {
+		entry.Visibility = visibility
+		return nil
+	})
+}
+
+func (mrr *memRegistryRec) Rename (id int, name string) error {
+	return mrr.update(id, func (entry *room.Entry) error {
+		e := mrr.checkName(id, name)
+		if e == nil {
+			entry.Name = name
+		}
+		return e
+	})
+}
+
+func (mrr *memRegistryRec) SetTopic (id int, topic string) error {
+	return mrr.update(id, func (entry *room.Entry) error {
+		entry.Topic = topic
+		return nil
+	})
+}
+
+func (mrr *memRegistryRec) SetDescription (id int, description string) error {
+	return mrr.update(id, func (entry *room.Entry) error {
+		entry.Description = description
+		return nil
+	})
+}
+
+func (mrr *memRegistryRec) SetArchived (id int, archived bool) error {
+	return mrr.update(id, func (entry *room.Entry) error {
+		entry.Archived = archived
+		return nil
+	})
+}
+
+func (mrr *memRegistryRec) DeleteRoom (id int) error {
+	return mrr.update(id, func (entry *room.Entry) error {
+		delete(mrr.rooms, id)
+		return nil
+	})
+}
+
+func (mrr *memRegistryRec) DirectRoom (userIds []int) (room.Entry, bool, error) {
+	mrr.lock.Lock()
+	defer mrr.lock.Unlock()
+
+	key := room.DirectKey(userIds)
+	id, found := mrr.direct[key]
+	if found {
+		return *mrr.rooms[id], false, nil
+	}
+
+	mrr.lastId++
+	entry := &room.Entry {
+		Id: mrr.lastId,
+		UserIds: room.NormalizeUserIds(userIds),
+		Visibility: room.InviteOnly,
+		Created: time.Now().Unix(),
+	}
+	mrr.rooms[entry.Id] = entry
+	mrr.direct[key] = entry.Id
+	return *entry, true, nil
+}
+
+func (mrr *memRegistryRec) DirectRooms (userId int) []room.Entry {
+	mrr.lock.RLock()
+	defer mrr.lock.RUnlock()
+
+	result := make([]room.Entry, 0)
+	for _, id := range mrr.direct {
+		entry := mrr.rooms[id]
+		if entry.HasUser(userId) {
+			result = append(result, *entry)
+		}
+	}
+	return result
+}
@@ -1,12 +1,112 @@
 package room
 
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// видимость общей комнаты
+const (
+	Public = "public"
+	Unlisted = "unlisted" // не попадает в список комнат, войти можно по номеру
+	InviteOnly = "invite" // видна и доступна только приглашенным
+)
+
 type Entry struct {
 	Id int `json:"id"`
 	Name string `json:"name"`
+	UserIds []int `json:"userIds,omitempty"` // участники личной комнаты, nil - общая комната
+	Visibility string `json:"visibility"`
+	Topic string `json:"topic"`
+	Description string `json:"description"`
+	CreatorId int `json:"creatorId"` // 0 - неизвестен или личная комната
+	Created int64 `json:"created"` // unix-время, 0 - неизвестно
+	Archived bool `json:"archived"` // только чтение
+}
+
+var NotFound = errors.New("room not found")
+
+func IsVisibility (v string) bool {
+	return (v == Public || v == Unlisted || v == InviteOnly)
+}
+
+func (e Entry) IsDirect () bool {
+	return (e.UserIds != nil)
+}
+
+func (e Entry) HasUser (userId int) bool {
+	for _, uid := range e.UserIds {
+		if uid == userId {
+			return true
+		}
+	}
+	return false
 }
 
 type Registry interface {
-	ListRooms () []Entry
-	CreateRoom (name string) (id int, e error)
+	ListRooms () []Entry // все комнаты, включая личные
+	CreateRoom (name string, creatorId int) (id int, e error) // видимость Public
 	Room (id int) (Entry, bool)
+	SetVisibility (id int, visibility string) error
+	// изменения свойств не применяются к личным комнатам
+	Rename (id int, name string) error
+	SetTopic (id int, topic string) error
+	SetDescription (id int, description string) error
+	SetArchived (id int, archived bool) error
+	// номер удаленной комнаты повторно не выдается
+	DeleteRoom (id int) error
+	// находит или создает личную комнату для набора участников
+	DirectRoom (userIds []int) (entry Entry, created bool, e error)
+	DirectRooms (userId int) []Entry
+}
+
+// постоянное членство пользователей в комнатах, не зависящее от подключения
+type Members interface {
+	RoomUserIds (roomId int) ([]int, error)
+	Join (roomId, userId int) error
+	Leave (roomId, userId int) error
+}
+
+// упорядоченный список участников без повторов
+func NormalizeUserIds (userIds []int) []int {
+	result := make([]int, 0, len(userIds))
+	for _, uid := range userIds {
+		result = append(result, uid)
+	}
+	sort.Ints(result)
+
+	n := 0
+	for i, uid := range result {
+		if i == 0 || uid != result[n - 1] {
+			result[n] = uid
+			n++
+		}
+	}
+	return result[:n]
+}
+
+// ключ личной комнаты: упорядоченные номера участников через запятую
+func DirectKey (userIds []int) string {
+	userIds = NormalizeUserIds(userIds)
+	parts := make([]string, len(userIds))
+	for i, uid := range userIds {
+		parts[i] = strconv.Itoa(uid)
+	}
+	return strings.Join(parts, ",")
+}
+
+func ParseDirectKey (key string) ([]int, error) {
+	parts := strings.Split(key, ",")
+	result := make([]int, 0, len(parts))
+	for _, part := range parts {
+		uid, e := strconv.Atoi(part)
+		if e != nil {
+			return nil, e
+		}
+
+		result = append(result, uid)
+	}
+	return result, nil
 }
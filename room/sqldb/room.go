@@ -0,0 +1,295 @@
+package sqldb
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ava12/go-chat/db"
+	"github.com/ava12/go-chat/room"
+)
+
+const component = "rooms"
+
+var migrations = []string {
+	`CREATE TABLE rooms (
+		id INTEGER NOT NULL PRIMARY KEY,
+		name VARCHAR(255) NOT NULL UNIQUE
+	)`,
+
+	`CREATE TABLE room_members (
+		room_id INTEGER NOT NULL,
+		user_id INTEGER NOT NULL,
+		PRIMARY KEY (room_id, user_id)
+	)`,
+
+	// уникальность названий общих комнат проверяется при создании
+	`CREATE TABLE rooms_new (
+		id INTEGER NOT NULL PRIMARY KEY,
+		name VARCHAR(255) NOT NULL,
+		direct_key VARCHAR(255) UNIQUE
+	);
+	INSERT INTO rooms_new (id, name) SELECT id, name FROM rooms;
+	DROP TABLE rooms;
+	ALTER TABLE rooms_new RENAME TO rooms`,
+
+	`ALTER TABLE rooms ADD COLUMN visibility VARCHAR(16) NOT NULL DEFAULT 'public';
+	UPDATE rooms SET visibility = 'invite' WHERE direct_key IS NOT NULL`,
+
+	// удаленные комнаты остаются в таблице, чтобы их номера не выдавались повторно
+	`ALTER TABLE rooms ADD COLUMN topic TEXT NOT NULL DEFAULT '';
+	ALTER TABLE rooms ADD COLUMN description TEXT NOT NULL DEFAULT '';
+	ALTER TABLE rooms ADD COLUMN creator_id INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE rooms ADD COLUMN created BIGINT NOT NULL DEFAULT 0;
+	ALTER TABLE rooms ADD COLUMN archived INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE rooms ADD COLUMN deleted INTEGER NOT NULL DEFAULT 0`,
+}
+
+const roomFields = "id, name, direct_key, visibility, topic, description, creator_id, created, archived"
+
+type registryRec struct {
+	lock sync.Mutex
+	db *db.DB
+}
+
+type Registry interface {
+	room.Registry
+	room.Members
+}
+
+func NewRegistry (d *db.DB) (Registry, error) {
+	e := d.Migrate(component, migrations)
+	if e != nil {
+		return nil, e
+	}
+
+	return &registryRec {db: d}, nil
+}
+
+type scanner interface {
+	Scan (dest ... interface {}) error
+}
+
+// ключ личной комнаты хранится с запятыми по краям, чтобы искать участника через LIKE
+func scanRoom (s scanner) (room.Entry, error) {
+	entry := room.Entry {}
+	var key sql.NullString
+	var archived int
+	e := s.Scan(&entry.Id, &entry.Name, &key, &entry.Visibility, &entry.Topic, &entry.Description,
+		&entry.CreatorId, &entry.Created, &archived)
+	entry.Archived = (archived != 0)
+	if e == nil && key.Valid {
+		entry.UserIds, e = room.ParseDirectKey(strings.Trim(key.String, ","))
+	}
+	return entry, e
+}
+
+func (r *registryRec) listRooms (query string, args ... interface {}) []room.Entry {
+	result := make([]room.Entry, 0)
+	rows, e := r.db.Query(query, args...)
+	if e != nil {
+		log.Println(e)
+		return result
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		entry, e := scanRoom(rows)
+		if e != nil {
+			log.Println(e)
+			break
+		}
+
+		result = append(result, entry)
+	}
+
+	return result
+}
+
+func (r *registryRec) ListRooms () []room.Entry {
+	return r.listRooms("SELECT " + roomFields + " FROM rooms WHERE deleted = 0 ORDER BY id")
+}
+
+// вызывающий должен удерживать lock
+func (r *registryRec) checkName (id int, name string) error {
+	var found int
+	e := r.db.QueryRow("SELECT id FROM rooms WHERE name = ? AND id <> ? AND direct_key IS NULL AND deleted = 0", name, id).Scan(&found)
+	switch e {
+	case nil:
+		return fmt.Errorf("room \"%s\" already exists", name)
+	case sql.ErrNoRows:
+		return nil
+	default:
+		return e
+	}
+}
+
+func (r *registryRec) CreateRoom (name string, creatorId int) (id int, e error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	e = r.checkName(0, name)
+	if e != nil {
+		return 0, e
+	}
+
+	id, e = r.db.NextId("rooms")
+	if e != nil {
+		return 0, e
+	}
+
+	_, e = r.db.Exec("INSERT INTO rooms (id, name, visibility, creator_id, created) VALUES (?, ?, ?, ?, ?)",
+		id, name, room.Public, creatorId, time.Now().Unix())
+	if e != nil {
+		return 0, e
+	}
+
+	return id, nil
+}
+
+func (r *registryRec) Room (id int) (room.Entry, bool) {
+	entry, e := scanRoom(r.db.QueryRow("SELECT " + roomFields + " FROM rooms WHERE id = ? AND deleted = 0", id))
+	if e != nil {
+		if e != sql.ErrNoRows {
+			log.Println(e)
+		}
+		return room.Entry {}, false
+	}
+
+	return entry, true
+}
+
+func (r *registryRec) DirectRoom (userIds []int) (room.Entry, bool, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	key := "," + room.DirectKey(userIds) + ","
+	entry, e := scanRoom(r.db.QueryRow("SELECT " + roomFields + " FROM rooms WHERE direct_key = ?", key))
+	if e != sql.ErrNoRows {
+		return entry, false, e
+	}
+
+	id, e := r.db.NextId("rooms")
+	if e != nil {
+		return room.Entry {}, false, e
+	}
+
+	created := time.Now().Unix()
+	_, e = r.db.Exec("INSERT INTO rooms (id, name, direct_key, visibility, created) VALUES (?, '', ?, ?, ?)",
+		id, key, room.InviteOnly, created)
+	if e != nil {
+		return room.Entry {}, false, e
+	}
+
+	entry = room.Entry {Id: id, UserIds: room.NormalizeUserIds(userIds), Visibility: room.InviteOnly, Created: created}
+	return entry, true, nil
+}
+
+// изменяет поле общей комнаты
+func (r *registryRec) update (id int, field string, value interface {}) error {
+	res, e := r.db.Exec("UPDATE rooms SET " + field + " = ? WHERE id = ? AND direct_key IS NULL AND deleted = 0", value, id)
+	if e != nil {
+		return e
+	}
+
+	n, _ := res.RowsAffected()
+	if n == 0 {
+		return room.NotFound
+	}
+	return nil
+}
+
+func (r *registryRec) SetVisibility (id int, visibility string) error {
+	if !room.IsVisibility(visibility) {
+		return fmt.Errorf("unknown room visibility: %q", visibility)
+	}
+
+	return r.update(id, "visibility", visibility)
+}
+
+func (r *registryRec) Rename (id int, name string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	e := r.checkName(id, name)
+	if e != nil {
+		return e
+	}
+
+	return r.update(id, "name", name)
+}
+
+func (r *registryRec) SetTopic (id int, topic string) error {
+	return r.update(id, "topic", topic)
+}
+
+func (r *registryRec) SetDescription (id int, description string) error {
+	return r.update(id, "description", description)
+}
+
+func (r *registryRec) SetArchived (id int, archived bool) error {
+	flag := 0
+	if archived {
+		flag = 1
+	}
+	return r.update(id, "archived", flag)
+}
+
+func (r *registryRec) DeleteRoom (id int) error {
+	e := r.update(id, "deleted", 1)
+	if e != nil {
+		return e
+	}
+
+	_, e = r.db.Exec("DELETE FROM room_members WHERE room_id = ?", id)
+	return e
+}
+
+func (r *registryRec) DirectRooms (userId int) []room.Entry {
+	pattern := "%," + strconv.Itoa(userId) + ",%"
+	return r.listRooms("SELECT " + roomFields + " FROM rooms WHERE direct_key LIKE ? AND deleted = 0 ORDER BY id", pattern)
+}
+
+func (r *registryRec) RoomUserIds (roomId int) ([]int, error) {
+	result := make([]int, 0)
+	rows, e := r.db.Query("SELECT user_id FROM room_members WHERE room_id = ? ORDER BY user_id", roomId)
+	if e != nil {
+		return result, e
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var uid int
+		e = rows.Scan(&uid)
+		if e != nil {
+			return result, e
+		}
+
+		result = append(result, uid)
+	}
+
+	return result, rows.Err()
+}
+
+func (r *registryRec) Join (roomId, userId int) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	var found int
+	e := r.db.QueryRow("SELECT COUNT(*) FROM room_members WHERE room_id = ? AND user_id = ?", roomId, userId).Scan(&found)
+	if e != nil || found > 0 {
+		return e
+	}
+
+	_, e = r.db.Exec("INSERT INTO room_members (room_id, user_id) VALUES (?, ?)", roomId, userId)
+	return e
+}
+
+func (r *registryRec) Leave (roomId, userId int) error {
+	_, e := r.db.Exec("DELETE FROM room_members WHERE room_id = ? AND user_id = ?", roomId, userId)
+	return e
+}
@@ -0,0 +1,127 @@
+package sqldb_test
+
+import (
+	"testing"
+
+	"github.com/ava12/go-chat/db/dbtest"
+	"github.com/ava12/go-chat/room"
+	roomsql "github.com/ava12/go-chat/room/sqldb"
+)
+
+func TestRoomRegistry (t *testing.T) {
+	r, e := roomsql.NewRegistry(dbtest.Open(t))
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	id1, e := r.CreateRoom("first", 7)
+	if e != nil {
+		t.Fatal(e)
+	}
+	id2, e := r.CreateRoom("second", 7)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if id1 == id2 {
+		t.Fatal("duplicate room id")
+	}
+
+	_, e = r.CreateRoom("first", 8)
+	if e == nil {
+		t.Fatal("duplicate room name accepted")
+	}
+
+	entry, found := r.Room(id2)
+	if !found || entry.Name != "second" || entry.CreatorId != 7 || entry.Created == 0 {
+		t.Fatalf("room #%d not found: %v", id2, entry)
+	}
+
+	_, found = r.Room(id2 + 10)
+	if found {
+		t.Fatal("missing room found")
+	}
+
+	if rooms := r.ListRooms(); len(rooms) != 2 {
+		t.Fatalf("expecting 2 rooms, got %v", rooms)
+	}
+
+	for _, uid := range []int {3, 1, 3} {
+		e = r.Join(id1, uid)
+		if e != nil {
+			t.Fatal(e)
+		}
+	}
+	e = r.Leave(id1, 5)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	uids, e := r.RoomUserIds(id1)
+	if e != nil || len(uids) != 2 || uids[0] != 1 || uids[1] != 3 {
+		t.Fatalf("unexpected members: %v %v", uids, e)
+	}
+
+	r.Leave(id1, 1)
+	if uids, _ = r.RoomUserIds(id1); len(uids) != 1 {
+		t.Fatalf("unexpected members after leave: %v", uids)
+	}
+
+	dm, created, e := r.DirectRoom([]int {12, 2, 12})
+	if e != nil || !created || len(dm.UserIds) != 2 || dm.UserIds[0] != 2 || dm.UserIds[1] != 12 {
+		t.Fatalf("unexpected direct room: %v %v %v", dm, created, e)
+	}
+	same, created, e := r.DirectRoom([]int {2, 12})
+	if e != nil || created || same.Id != dm.Id {
+		t.Fatalf("direct room not found: %v %v %v", same, created, e)
+	}
+	r.DirectRoom([]int {1, 2, 3})
+
+	if dms := r.DirectRooms(2); len(dms) != 2 {
+		t.Fatalf("expecting 2 direct rooms, got %v", dms)
+	}
+	if dms := r.DirectRooms(1); len(dms) != 1 || !dms[0].HasUser(3) {
+		t.Fatalf("unexpected direct rooms: %v", dms)
+	}
+	if entry, _ = r.Room(dm.Id); !entry.IsDirect() {
+		t.Fatalf("room #%d is not direct: %v", dm.Id, entry)
+	}
+	if _, e = r.CreateRoom("", 0); e != nil {
+		t.Fatalf("direct room name clashes with public room: %v", e)
+	}
+
+	if entry.Visibility != room.InviteOnly || r.SetVisibility(dm.Id, room.Public) == nil {
+		t.Fatalf("unexpected direct room visibility: %v", entry)
+	}
+	if r.SetVisibility(id1, "secret") == nil {
+		t.Fatal("unknown visibility accepted")
+	}
+	e = r.SetVisibility(id1, room.Unlisted)
+	if entry, _ = r.Room(id1); e != nil || entry.Visibility != room.Unlisted {
+		t.Fatalf("unexpected room visibility: %v %v", entry, e)
+	}
+	if entry, _ = r.Room(id2); entry.Visibility != room.Public {
+		t.Fatalf("unexpected default visibility: %v", entry)
+	}
+
+	if r.Rename(id2, "first") == nil || r.Rename(dm.Id, "dm") == nil {
+		t.Fatal("bad rename accepted")
+	}
+	r.Rename(id2, "renamed")
+	r.SetTopic(id2, "topic")
+	r.SetDescription(id2, "description")
+	r.SetArchived(id2, true)
+	entry, _ = r.Room(id2)
+	if entry.Name != "renamed" || entry.Topic != "topic" || entry.Description != "description" || !entry.Archived {
+		t.Fatalf("room not updated: %v", entry)
+	}
+
+	if e = r.DeleteRoom(id2); e != nil {
+		t.Fatal(e)
+	}
+	if _, found = r.Room(id2); found || r.DeleteRoom(id2) != room.NotFound {
+		t.Fatal("deleted room found")
+	}
+	if id, _ := r.CreateRoom("renamed", 7); id <= id2 {
+		t.Fatalf("room id #%d reused", id)
+	}
+}
@@ -2,54 +2,149 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/ava12/go-chat/access"
+	"github.com/ava12/go-chat/apitoken"
 	"github.com/ava12/go-chat/config"
 	"github.com/ava12/go-chat/conn"
+	"github.com/ava12/go-chat/conn/poll"
+	"github.com/ava12/go-chat/conn/sse"
+	"github.com/ava12/go-chat/conn/tcp"
 	"github.com/ava12/go-chat/conn/ws"
 	"github.com/ava12/go-chat/fserv"
 	"github.com/ava12/go-chat/hub"
 	"github.com/ava12/go-chat/proto"
+	"github.com/ava12/go-chat/proto/irc"
 	"github.com/ava12/go-chat/session"
 	"github.com/ava12/go-chat/user"
 )
 
+var Forbidden = errors.New("permission denied")
+
+const (
+	stateStopped = iota
+	stateStarting
+	stateRunning
+	stateStopping // в том числе после завершения Run
+)
+
 const (
 	configSection = "Server"
 
 	RefreshQueues = 2
 	RefreshPeriod = time.Minute
 
-	WsPath     = "/ws"
-	WhoamiPath = "/whoami"
-	LoginPath  = "/login"
-	LogoutPath = "/logout"
+	WsPath      = "/ws"
+	SsePath     = "/sse" // GET - поток событий, POST - запросы
+	PollPath     = "/poll" // GET - опрос, POST - запрос
+	PollOpenPath = "/poll/open"
+	WhoamiPath  = "/whoami"
+	LoginPath   = "/login"
+	LogoutPath  = "/logout"
+	MetricsPath = "/metrics" // только для локальных запросов
+
+	// только для реестров, поддерживающих user.Accounts
+	RegisterPath      = "/register"
+	PasswordPath      = "/password"
+	ResetTokenPath    = "/reset-token" // только для администраторов
+	ResetPasswordPath = "/reset-password"
+
+	// управление API-токенами, только при входе по cookie
+	TokensPath      = "/tokens"
+	RevokeTokenPath = "/tokens/revoke"
+
+	// сессии пользователя, только при входе по cookie
+	SessionsPath      = "/sessions"
+	RevokeSessionPath = "/sessions/revoke"
+
+	bearerPrefix = "Bearer "
 
 	DefaultAddr        = ":8080"
 	DefaultSessionName = "sid"
-	DefaultSessionTtl  = 365 * 86400
 )
 
 type conf struct {
-	Addr string
-	Dirs map[string]string
+	Addr       string
+	Dirs       map[string]string
+	TcpAddr    string // строки JSON по TCP, пусто - не принимаются
+	TlsAddr    string // то же по TLS
+	TlsCert    string
+	TlsKey     string
+	IrcAddr    string // шлюз IRC, пусто - не принимается
+	IrcTlsAddr string // то же по TLS, сертификат TlsCert
+	IrcName    string // имя сервера IRC
 }
 
 type whoamiRec struct {
 	Success bool        `json:"success"`
 	User    interface{} `json:"user,omitempty"`
+	Error   string      `json:"error,omitempty"`
+}
+
+type resetTokenRec struct {
+	Success bool   `json:"success"`
+	Token   string `json:"token"`
+}
+
+type pollRec struct {
+	Success bool   `json:"success"`
+	Id      int    `json:"id"`
+	Key     string `json:"key"`
+}
+
+type tokensRec struct {
+	Success bool             `json:"success"`
+	Tokens  []apitoken.Entry `json:"tokens"`
+}
+
+type newTokenRec struct {
+	Success bool           `json:"success"`
+	Secret  string         `json:"secret"`
+	Token   apitoken.Entry `json:"token"`
+}
+
+type sessionRec struct {
+	session.Info
+	Current bool `json:"current,omitempty"`
+}
+
+type sessionsRec struct {
+	Success  bool         `json:"success"`
+	Sessions []sessionRec `json:"sessions"`
 }
 
+// подключение вошло либо по сессии, либо по API-токену
 type refreshItem struct {
 	conn    conn.Conn
 	session session.Session
+	token   string
+}
+
+type listenerRec struct {
+	ln    net.Listener
+	serve func(nc net.Conn)
+}
+
+// удостоверение запроса
+type authRec struct {
+	userId  int
+	user    interface{}
+	session session.Session // nil при входе по API-токену
+	token   string
+	scope   access.Scope
 }
 
 func logRequest (r *http.Request, e error) {
@@ -65,13 +160,23 @@ type Server struct {
 	lastConnId int64
 
 	Addr        string
+	TcpAddr     string
+	TlsAddr     string
+	IrcAddr     string
+	IrcTlsAddr  string
+	IrcName     string
+	TlsConfig   *tls.Config // нужен, если задан TlsAddr или IrcTlsAddr
 	SessionName string
-	SessionTtl  int
+	SweepPeriod time.Duration // период очистки реестра сессий
+	WsOptions   ws.Options
 
 	Hub      *hub.Hub
 	Sessions session.Registry
 	Users    user.Registry
+	Tokens   apitoken.Registry // nil - API-токены не принимаются
+	Access   access.Controller // nil - токены сброса пароля не выдаются
 	Proto    proto.Proto
+	Irc      *irc.Gateway // нужен, если задан IrcAddr или IrcTlsAddr
 	Http     *http.Server
 
 	mux        *http.ServeMux
@@ -81,21 +186,31 @@ type Server struct {
 	refreshQueues int
 	refreshPeriod time.Duration
 	refreshChans  []chan refreshItem
+	refreshDone   chan bool // закрывается при остановке, очереди проверки больше не принимают подключений
+	stopSweep     chan bool
+
+	fs   *fserv.Factory
+	sse  *sse.Registry
+	poll *poll.Registry
 
-	fs *fserv.Factory
+	listeners []listenerRec
 
-	starting, running, stopping bool
+	stateLock sync.Mutex
+	state     int // меняется под stateLock
 }
 
 func New (c *config.Config) (*Server, error) {
 	result := &Server{
 		Addr:          DefaultAddr,
 		SessionName:   DefaultSessionName,
-		SessionTtl:    DefaultSessionTtl,
+		SweepPeriod:   session.DefaultSweepPeriod,
+		WsOptions:     ws.DefaultOptions,
 		refreshQueues: RefreshQueues,
 		refreshPeriod: RefreshPeriod,
 		mux:           http.NewServeMux(),
 		fs:            fserv.NewFactory(),
+		sse:           sse.NewRegistry(),
+		poll:          poll.NewRegistry(),
 	}
 
 	sect := conf {}
@@ -103,6 +218,25 @@ func New (c *config.Config) (*Server, error) {
 	if sect.Addr != "" {
 		result.Addr = sect.Addr
 	}
+	result.TcpAddr = sect.TcpAddr
+	result.TlsAddr = sect.TlsAddr
+	result.IrcAddr = sect.IrcAddr
+	result.IrcTlsAddr = sect.IrcTlsAddr
+	result.IrcName = sect.IrcName
+	if sect.TlsAddr != "" || sect.IrcTlsAddr != "" {
+		cert, e := tls.LoadX509KeyPair(sect.TlsCert, sect.TlsKey)
+		if e != nil {
+			return nil, e
+		}
+
+		result.TlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+
+	wc, e := ws.ReadConf(c)
+	if e != nil {
+		return nil, e
+	}
+	result.WsOptions = wc.Options()
 
 	for url, path := range sect.Dirs {
 		path, e := filepath.Abs(path)
@@ -129,8 +263,16 @@ func (s *Server) serve (w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (s *Server) sessionCookie (sess session.Session) *http.Cookie {
-	return &http.Cookie{Name: s.SessionName, Value: sess.Id(), MaxAge: s.SessionTtl}
+// cookie недоступна скриптам, не уходит со сторонними POST-запросами и по TLS передается только по TLS
+func (s *Server) sessionCookie (r *http.Request, sess session.Session) *http.Cookie {
+	return &http.Cookie{
+		Name:     s.SessionName,
+		Value:    sess.Id(),
+		MaxAge:   int(sess.Ttl()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		Secure:   (r.TLS != nil),
+	}
 }
 
 func deleteCookie (w http.ResponseWriter, name string) {
@@ -159,11 +301,63 @@ func (s *Server) whoami (w http.ResponseWriter, r *http.Request) (sess session.S
 		return
 	}
 
-	http.SetCookie(w, s.sessionCookie(sess))
+	http.SetCookie(w, s.sessionCookie(r, sess))
 	user = u
 	return
 }
 
+// пользователь по API-токену из заголовка Authorization, иначе по сессии из cookie;
+// nil без ошибки - анонимный запрос
+func (s *Server) auth (w http.ResponseWriter, r *http.Request) (*authRec, error) {
+	header := r.Header.Get("Authorization")
+	if header == "" {
+		sess, u := s.whoami(w, r)
+		if u == nil {
+			return nil, nil
+		}
+		return &authRec{sess.UserId(), u, sess, "", access.FullScope}, nil
+	}
+
+	if !strings.HasPrefix(header, bearerPrefix) {
+		return nil, user.WrongCredentials
+	}
+
+	return s.tokenAuth(strings.TrimSpace(header[len(bearerPrefix):]))
+}
+
+func (s *Server) tokenAuth (token string) (*authRec, error) {
+	if s.Tokens == nil {
+		return nil, user.WrongCredentials
+	}
+
+	entry, found := s.Tokens.Token(token)
+	if !found {
+		return nil, user.WrongCredentials
+	}
+
+	u, found := s.Users.User(entry.UserId)
+	if !found {
+		return nil, user.WrongCredentials
+	}
+
+	return &authRec{entry.UserId, u, nil, token, entry.Scope}, nil
+}
+
+// вход по номеру сессии без cookie; cookie при этом не обновляется
+func (s *Server) sessionAuth (id string) (*authRec, error) {
+	sess := s.Sessions.Session(id)
+	if sess == nil {
+		return nil, user.WrongCredentials
+	}
+
+	u, found := s.Users.User(sess.UserId())
+	if !found {
+		return nil, user.WrongCredentials
+	}
+
+	return &authRec{sess.UserId(), u, sess, "", access.FullScope}, nil
+}
+
 func serveJson (w http.ResponseWriter, r *http.Request, data interface{}) {
 	response, e := json.Marshal(data)
 	logRequest(r, e)
@@ -172,27 +366,404 @@ func serveJson (w http.ResponseWriter, r *http.Request, data interface{}) {
 	logRequest(r, e)
 }
 
+// ответ с ошибкой; код ответа зависит от ошибки
+func serveError (w http.ResponseWriter, r *http.Request, e error) {
+	status := http.StatusInternalServerError
+	switch e {
+	case user.WrongCredentials, user.BadToken:
+		status = http.StatusUnauthorized
+	case user.NameTaken:
+		status = http.StatusConflict
+	case user.BadName, user.BadPassword, apitoken.BadName:
+		status = http.StatusBadRequest
+	case apitoken.NotFound, session.NotFound:
+		status = http.StatusNotFound
+	case session.Unsupported:
+		status = http.StatusNotImplemented
+	case Forbidden:
+		status = http.StatusForbidden
+	default:
+		logRequest(r, e)
+		e = errors.New("internal server error")
+	}
+
+	serveErrorStatus(w, r, status, e)
+}
+
+func serveErrorStatus (w http.ResponseWriter, r *http.Request, status int, e error) {
+	response, _ := json.Marshal(whoamiRec{Error: e.Error()})
+	w.Header().Set("Content-Type", "text/json")
+	w.WriteHeader(status)
+	_, e = w.Write(response)
+	logRequest(r, e)
+}
+
+// true, если метод запроса POST и запрос пришел не со страницы другого сайта;
+// иначе отвечает 405 или 403
+func requirePost (w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+
+	if !sameOrigin(r) {
+		serveError(w, r, Forbidden)
+		return false
+	}
+
+	return true
+}
+
+// защита от CSRF: браузер указывает в Origin (или хотя бы в Referer) сайт, со страницы которого
+// отправлен запрос; запросы без обоих заголовков (не из браузера) принимаются
+func sameOrigin (r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		origin = r.Header.Get("Referer")
+	}
+	if origin == "" {
+		return true
+	}
+
+	u, e := url.Parse(origin)
+	return (e == nil && u.Host != "" && strings.EqualFold(u.Host, r.Host))
+}
+
+func (s *Server) isAdmin (a *authRec) bool {
+	return (s.Access != nil && a.scope.Global & access.AdminPerm != 0 && s.Access.HasGlobalPerm(a.userId, access.AdminPerm))
+}
+
+func isLocal (r *http.Request) bool {
+	host, _, e := net.SplitHostPort(r.RemoteAddr)
+	ip := net.ParseIP(host)
+	return (e == nil && ip != nil && ip.IsLoopback())
+}
+
+// реестр пользователей с паролями; иначе отвечает 404
+func (s *Server) accounts (w http.ResponseWriter, r *http.Request) user.Accounts {
+	accounts, ok := s.Users.(user.Accounts)
+	if !ok {
+		http.NotFound(w, r)
+	}
+	return accounts
+}
+
 func (s *Server) serveWhoami (w http.ResponseWriter, r *http.Request) {
-	_, user := s.whoami(w, r)
-	serveJson(w, r, whoamiRec{true, user})
+	a, e := s.auth(w, r)
+	if e != nil {
+		serveError(w, r, e)
+		return
+	}
+
+	var u interface{}
+	if a != nil {
+		u = a.user
+	}
+	serveJson(w, r, whoamiRec{true, u, ""})
+}
+
+func (s *Server) serveMetrics (w http.ResponseWriter, r *http.Request) {
+	if !isLocal(r) {
+		http.NotFound(w, r)
+		return
+	}
+
+	serveJson(w, r, s.Hub.Metrics())
+}
+
+// открывает сессию и выставляет cookie; при ошибке отвечает 500
+func (s *Server) newSession (w http.ResponseWriter, r *http.Request, uid int) bool {
+	sess := s.Sessions.NewSession(uid, session.DeviceOf(r))
+	if sess == nil {
+		serveError(w, r, errors.New("cannot create session"))
+		return false
+	}
+
+	http.SetCookie(w, s.sessionCookie(r, sess))
+	return true
 }
 
 func (s *Server) serveLogin (w http.ResponseWriter, r *http.Request) {
-	sess, user := s.whoami(w, r)
+	if !requirePost(w, r) {
+		return
+	}
+
+	_, user := s.whoami(w, r)
 	if user != nil {
-		serveJson(w, r, whoamiRec{false, user})
+		serveJson(w, r, whoamiRec{false, user, ""})
 		return
 	}
 
 	uid, user, e := s.Users.Login(w, r)
 	if (e != nil) {
-		logRequest(r, e)
+		serveError(w, r, e)
+		return
+	}
+
+	if !s.newSession(w, r, uid) {
+		return
+	}
+
+	serveJson(w, r, whoamiRec{true, user, ""})
+}
+
+// регистрация с одновременным входом
+func (s *Server) serveRegister (w http.ResponseWriter, r *http.Request) {
+	accounts := s.accounts(w, r)
+	if accounts == nil || !requirePost(w, r) {
+		return
+	}
+
+	_, u := s.whoami(w, r)
+	if u != nil {
+		serveJson(w, r, whoamiRec{false, u, ""})
+		return
+	}
+
+	uid, u, e := accounts.Register(r.PostFormValue("name"), r.PostFormValue("password"))
+	if e != nil {
+		serveError(w, r, e)
+		return
+	}
+
+	if !s.newSession(w, r, uid) {
+		return
+	}
+
+	serveJson(w, r, whoamiRec{true, u, ""})
+}
+
+// смена пароля вошедшим пользователем: поля old и new
+func (s *Server) servePassword (w http.ResponseWriter, r *http.Request) {
+	accounts := s.accounts(w, r)
+	if accounts == nil || !requirePost(w, r) {
+		return
+	}
+
+	sess, u := s.whoami(w, r)
+	if u == nil {
+		serveError(w, r, user.WrongCredentials)
+		return
+	}
+
+	e := accounts.ChangePassword(sess.UserId(), r.PostFormValue("old"), r.PostFormValue("new"))
+	if e != nil {
+		serveError(w, r, e)
+		return
+	}
+
+	if !s.revokeCredentials(w, r, sess.UserId(), sess) {
+		return
+	}
+
+	serveJson(w, r, whoamiRec{true, u, ""})
+}
+
+// после смены пароля завершает сессии пользователя, кроме keep (nil - все), и отзывает его API-токены;
+// подключения по завершенным сессиям и токенам закрываются при очередной проверке.
+// Если реестр завершает только все сессии разом, вместо keep открывается новая сессия;
+// false, если ответ с ошибкой уже отправлен
+func (s *Server) revokeCredentials (w http.ResponseWriter, r *http.Request, uid int, keep session.Session) bool {
+	if revoker, ok := s.Sessions.(session.UserRevoker); ok {
+		e := revoker.DeleteUserSessions(uid)
+		if e != nil {
+			log.Println(e)
+		}
+		if keep != nil && !s.newSession(w, r, uid) {
+			return false
+		}
+	} else {
+		keepKey := ""
+		if keep != nil {
+			keepKey = keep.Info().Key
+		}
+		for _, info := range s.Sessions.UserSessions(uid) {
+			if info.Key == keepKey {
+				continue
+			}
+
+			e := s.Sessions.DeleteUserSession(uid, info.Key)
+			if e != nil && e != session.NotFound {
+				log.Println(e)
+			}
+		}
+	}
+
+	if s.Tokens == nil {
+		return true
+	}
+
+	for _, entry := range s.Tokens.UserTokens(uid) {
+		e := s.Tokens.RevokeToken(uid, entry.Id)
+		if e != nil && e != apitoken.NotFound {
+			log.Println(e)
+		}
+	}
+	return true
+}
+
+// выдает токен сброса пароля пользователя name; токен передается пользователю администратором.
+// Нужно глобальное право admin, при входе по API-токену - и в области действия токена
+func (s *Server) serveResetToken (w http.ResponseWriter, r *http.Request) {
+	accounts := s.accounts(w, r)
+	if accounts == nil || !requirePost(w, r) {
+		return
+	}
+
+	a, e := s.auth(w, r)
+	if e == nil && a == nil {
+		e = user.WrongCredentials
+	}
+	if e == nil && !s.isAdmin(a) {
+		e = Forbidden
+	}
+	if e != nil {
+		serveError(w, r, e)
+		return
+	}
+
+	token, e := accounts.ResetToken(r.PostFormValue("name"))
+	if e != nil {
+		serveError(w, r, e)
+		return
+	}
+
+	serveJson(w, r, resetTokenRec{true, token})
+}
+
+// новый пароль по токену сброса: поля token и password
+func (s *Server) serveResetPassword (w http.ResponseWriter, r *http.Request) {
+	accounts := s.accounts(w, r)
+	if accounts == nil || !requirePost(w, r) {
+		return
+	}
+
+	uid, e := accounts.ResetPassword(r.PostFormValue("token"), r.PostFormValue("password"))
+	if e != nil {
+		serveError(w, r, e)
+		return
+	}
+
+	if !s.revokeCredentials(w, r, uid, nil) {
+		return
+	}
+
+	serveJson(w, r, whoamiRec{true, nil, ""})
+}
+
+// реестр API-токенов; отвечает 404, если токены не используются,
+// и 401, если запрос выполнен не по сессии: токеном нельзя выпустить другой токен
+func (s *Server) tokenOwner (w http.ResponseWriter, r *http.Request) (int, bool) {
+	if s.Tokens == nil {
+		http.NotFound(w, r)
+		return 0, false
+	}
+
+	sess, u := s.whoami(w, r)
+	if u == nil {
+		serveError(w, r, user.WrongCredentials)
+		return 0, false
+	}
+
+	return sess.UserId(), true
+}
+
+// GET - список токенов пользователя, POST - новый токен: поля name и scope
+// (имена разрешений через запятую или пробел, "*" - все разрешения пользователя)
+func (s *Server) serveTokens (w http.ResponseWriter, r *http.Request) {
+	uid, ok := s.tokenOwner(w, r)
+	if !ok {
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		serveJson(w, r, tokensRec{true, s.Tokens.UserTokens(uid)})
+		return
+	}
+	if !requirePost(w, r) {
 		return
 	}
 
-	sess = s.Sessions.NewSession(uid)
-	http.SetCookie(w, s.sessionCookie(sess))
-	serveJson(w, r, whoamiRec{true, user})
+	names := strings.FieldsFunc(r.PostFormValue("scope"), func (c rune) bool {
+		return (c == ',' || c == ' ')
+	})
+	scope, e := access.ParseScope(names)
+	if e != nil {
+		serveErrorStatus(w, r, http.StatusBadRequest, e)
+		return
+	}
+
+	secret, entry, e := s.Tokens.NewToken(uid, r.PostFormValue("name"), scope)
+	if e != nil {
+		serveError(w, r, e)
+		return
+	}
+
+	serveJson(w, r, newTokenRec{true, secret, entry})
+}
+
+// отзыв токена: поле id; подключения по токену закрываются при ближайшем обновлении
+func (s *Server) serveRevokeToken (w http.ResponseWriter, r *http.Request) {
+	uid, ok := s.tokenOwner(w, r)
+	if !ok || !requirePost(w, r) {
+		return
+	}
+
+	id, _ := strconv.Atoi(r.PostFormValue("id"))
+	e := s.Tokens.RevokeToken(uid, id)
+	if e != nil {
+		serveError(w, r, e)
+		return
+	}
+
+	serveJson(w, r, tokensRec{true, s.Tokens.UserTokens(uid)})
+}
+
+// активные сессии пользователя, текущая отмечена
+func (s *Server) serveSessions (w http.ResponseWriter, r *http.Request) {
+	sess, u := s.whoami(w, r)
+	if u == nil {
+		serveError(w, r, user.WrongCredentials)
+		return
+	}
+
+	serveJson(w, r, s.userSessions(sess))
+}
+
+// завершение сессии пользователя по ключу: поле key; подключения по ней закрываются при ближайшем обновлении
+func (s *Server) serveRevokeSession (w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r) {
+		return
+	}
+
+	sess, u := s.whoami(w, r)
+	if u == nil {
+		serveError(w, r, user.WrongCredentials)
+		return
+	}
+
+	key := r.PostFormValue("key")
+	e := s.Sessions.DeleteUserSession(sess.UserId(), key)
+	if e != nil {
+		serveError(w, r, e)
+		return
+	}
+
+	if key == session.Key(sess.Id()) {
+		deleteCookie(w, s.SessionName)
+	}
+	serveJson(w, r, s.userSessions(sess))
+}
+
+func (s *Server) userSessions (current session.Session) sessionsRec {
+	key := session.Key(current.Id())
+	list := s.Sessions.UserSessions(current.UserId())
+	result := sessionsRec{true, make([]sessionRec, 0, len(list))}
+	for _, info := range list {
+		result.Sessions = append(result.Sessions, sessionRec{info, info.Key == key})
+	}
+	return result
 }
 
 func (s *Server) serveLogout (w http.ResponseWriter, r *http.Request) {
@@ -202,24 +773,27 @@ func (s *Server) serveLogout (w http.ResponseWriter, r *http.Request) {
 		deleteCookie(w, s.SessionName)
 	}
 
-	serveJson(w, r, whoamiRec{true, nil})
+	serveJson(w, r, whoamiRec{true, nil, ""})
 }
 
 func (s *Server) serveWs (w http.ResponseWriter, r *http.Request) {
-	if !s.running || s.stopping {
+	if !s.isRunning() {
 		http.NotFoundHandler().ServeHTTP(w, r)
 		return
 	}
 
-	sess, user := s.whoami(w, r)
-	if user == nil {
-		logRequest(r, errors.New("anon"))
+	a, e := s.auth(w, r)
+	if a == nil {
+		if e == nil {
+			e = errors.New("anon")
+		}
+		logRequest(r, e)
 		w.WriteHeader(http.StatusForbidden)
 		return
 	}
 
 	id := s.newId()
-	conn, e := ws.New(w, r, s.Proto, int(id), sess.UserId())
+	conn, e := ws.New(w, r, int(id), a.userId, a.scope, s.WsOptions)
 	if e != nil {
 		s.reuseId(id)
 		logRequest(r, e)
@@ -227,7 +801,272 @@ func (s *Server) serveWs (w http.ResponseWriter, r *http.Request) {
 	}
 
 	s.Proto.Connect(conn)
-	s.refreshChans[int(id)%s.refreshQueues] <- refreshItem{conn, sess}
+	s.track(refreshItem{conn, a.session, a.token})
+	conn.Serve(s.Proto)
+}
+
+// подключение Server-Sent Events для клиентов, у которых не работает WebSocket
+func (s *Server) serveSse (w http.ResponseWriter, r *http.Request) {
+	if !s.isRunning() {
+		http.NotFoundHandler().ServeHTTP(w, r)
+		return
+	}
+
+	a, e := s.auth(w, r)
+	if a == nil {
+		if e == nil {
+			e = errors.New("anon")
+		}
+		logRequest(r, e)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		e = s.sse.TakeRequest(w, r, s.Proto, a.userId)
+		if e != nil {
+			logRequest(r, e)
+			http.Error(w, e.Error(), http.StatusNotFound)
+		} else {
+			w.WriteHeader(http.StatusNoContent)
+		}
+		return
+	}
+
+	id := s.newId()
+	conn, e := s.sse.New(w, r, int(id), a.userId, a.scope)
+	if e != nil {
+		s.reuseId(id)
+		logRequest(r, e)
+		return
+	}
+
+	s.Proto.Connect(conn)
+	s.track(refreshItem{conn, a.session, a.token})
+	s.sse.Serve(conn, r, s.Proto)
+}
+
+// подключение длинными запросами; открывается POST-запросом, номер и ключ подключения возвращаются в ответе
+func (s *Server) serveOpenPoll (w http.ResponseWriter, r *http.Request) {
+	if !s.isRunning() {
+		http.NotFoundHandler().ServeHTTP(w, r)
+		return
+	}
+
+	if !requirePost(w, r) {
+		return
+	}
+
+	a, e := s.auth(w, r)
+	if a == nil {
+		if e == nil {
+			e = user.WrongCredentials
+		}
+		serveError(w, r, e)
+		return
+	}
+
+	id := s.newId()
+	conn, e := s.poll.New(r, s.Proto, int(id), a.userId, a.scope)
+	if e != nil {
+		s.reuseId(id)
+		serveError(w, r, e)
+		return
+	}
+
+	// клиент может начать опрос сразу после ответа, поэтому подключение регистрируется до него
+	s.Proto.Connect(conn)
+	s.track(refreshItem{conn, a.session, a.token})
+	serveJson(w, r, pollRec{true, conn.Id(), conn.Key()})
+}
+
+func (s *Server) servePoll (w http.ResponseWriter, r *http.Request) {
+	a, e := s.auth(w, r)
+	if a == nil {
+		if e == nil {
+			e = errors.New("anon")
+		}
+		logRequest(r, e)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		e = s.poll.TakeRequest(r, a.userId)
+		if e == nil {
+			w.WriteHeader(http.StatusNoContent)
+		}
+	} else {
+		e = s.poll.Poll(w, r, a.userId)
+	}
+	logRequest(r, e)
+	if e == poll.NotFound {
+		http.Error(w, e.Error(), http.StatusNotFound)
+	}
+}
+
+// открывает заданные слушатели TCP и TLS
+func (s *Server) listen () error {
+	e := s.listenTcp(s.TcpAddr, false, s.serveTcp)
+	if e == nil {
+		e = s.listenTcp(s.TlsAddr, true, s.serveTcp)
+	}
+	if e == nil {
+		e = s.listenTcp(s.IrcAddr, false, s.serveIrc)
+	}
+	if e == nil {
+		e = s.listenTcp(s.IrcTlsAddr, true, s.serveIrc)
+	}
+	if e != nil {
+		s.closeListeners()
+	}
+	return e
+}
+
+// пустой адрес - слушатель не нужен
+func (s *Server) listenTcp (addr string, secure bool, serve func(nc net.Conn)) error {
+	if addr == "" {
+		return nil
+	}
+
+	var ln net.Listener
+	var e error
+	if secure {
+		if s.TlsConfig == nil {
+			return errors.New("no TLS configuration")
+		}
+
+		ln, e = tls.Listen("tcp", addr, s.TlsConfig)
+	} else {
+		ln, e = net.Listen("tcp", addr)
+	}
+	if e == nil {
+		s.listeners = append(s.listeners, listenerRec{ln, serve})
+	}
+	return e
+}
+
+func (s *Server) closeListeners () {
+	for _, l := range s.listeners {
+		l.ln.Close()
+	}
+	s.listeners = nil
+}
+
+func (s *Server) goAcceptTcp (l listenerRec) {
+	for {
+		nc, e := l.ln.Accept()
+		if e != nil {
+			if !errors.Is(e, net.ErrClosed) {
+				log.Println(e)
+			}
+			break
+		}
+
+		go l.serve(nc)
+	}
+
+	s.waitGroup.Done()
+}
+
+// первая строка - номер сессии или секрет API-токена
+func (s *Server) serveTcp (nc net.Conn) {
+	conn := tcp.New(nc)
+	cred, e := conn.ReadCredentials()
+	var a *authRec
+	if e == nil {
+		if cred.Token != "" {
+			a, e = s.tokenAuth(cred.Token)
+		} else {
+			a, e = s.sessionAuth(cred.Session)
+		}
+	}
+	if e == nil && !s.isRunning() {
+		e = errors.New("server is stopping")
+	}
+	if e != nil {
+		log.Printf("%s (tcp %s)\n", e.Error(), nc.RemoteAddr())
+		conn.Reject(e)
+		return
+	}
+
+	id := s.newId()
+	conn.Accept(int(id), a.userId, a.scope, a.user)
+	s.Proto.Connect(conn)
+	s.track(refreshItem{conn, a.session, a.token})
+	conn.Serve(s.Proto)
+}
+
+// вход по PASS и NICK; на время подключения открывается сессия, поэтому подключение видно в списке сессий
+// и закрывается, когда сессию завершают (в том числе при смене пароля)
+func (s *Server) serveIrc (nc net.Conn) {
+	conn := s.Irc.NewConn(nc)
+	e := conn.Register()
+	if e == nil && !s.isRunning() {
+		e = errors.New("server is stopping")
+	}
+	var sess session.Session
+	if e == nil {
+		sess = s.Sessions.NewSession(conn.UserId(), ircDevice(nc))
+		if sess == nil {
+			e = errors.New("cannot create session")
+		}
+	}
+	if e != nil {
+		if e != irc.Quit {
+			log.Printf("%s (irc %s)\n", e.Error(), nc.RemoteAddr())
+		}
+		conn.Reject(e)
+		return
+	}
+
+	conn.Accept(int(s.newId()), access.FullScope)
+	s.track(refreshItem{conn, sess, ""})
+	conn.Serve()
+	s.Sessions.Delete(sess.Id())
+}
+
+func ircDevice (nc net.Conn) session.Device {
+	ip, _, e := net.SplitHostPort(nc.RemoteAddr().String())
+	if e != nil {
+		ip = nc.RemoteAddr().String()
+	}
+	return session.Device{UserAgent: "IRC", Ip: ip}
+}
+
+func (s *Server) isRunning () bool {
+	s.stateLock.Lock()
+	defer s.stateLock.Unlock()
+
+	return (s.state == stateRunning)
+}
+
+func (s *Server) setState (state int) {
+	s.stateLock.Lock()
+	s.state = state
+	s.stateLock.Unlock()
+}
+
+// ставит подключение в очередь проверки сессии; если сервер уже останавливается, закрывает подключение
+func (s *Server) track (item refreshItem) {
+	s.stateLock.Lock()
+	running := (s.state == stateRunning)
+	var queue chan refreshItem
+	if running {
+		queue = s.refreshChans[item.conn.Id()%s.refreshQueues]
+	}
+	done := s.refreshDone
+	s.stateLock.Unlock()
+
+	// очередь может быть заполнена, поэтому ждем ее без блокировки
+	if running {
+		select {
+		case queue <- item:
+			return
+		case <-done:
+		}
+	}
+	item.conn.Close()
 }
 
 func (s *Server) newId () int64 {
@@ -240,11 +1079,24 @@ func (s *Server) reuseId (id int64) {
 
 func (s *Server) init () {
 	s.mux.HandleFunc(WsPath, s.serveWs)
+	s.mux.HandleFunc(SsePath, s.serveSse)
+	s.mux.HandleFunc(PollPath, s.servePoll)
+	s.mux.HandleFunc(PollOpenPath, s.serveOpenPoll)
 	s.mux.HandleFunc(WhoamiPath, s.serveWhoami)
 	s.mux.HandleFunc(LoginPath, s.serveLogin)
 	s.mux.HandleFunc(LogoutPath, s.serveLogout)
+	s.mux.HandleFunc(MetricsPath, s.serveMetrics)
+	s.mux.HandleFunc(RegisterPath, s.serveRegister)
+	s.mux.HandleFunc(PasswordPath, s.servePassword)
+	s.mux.HandleFunc(ResetTokenPath, s.serveResetToken)
+	s.mux.HandleFunc(ResetPasswordPath, s.serveResetPassword)
+	s.mux.HandleFunc(TokensPath, s.serveTokens)
+	s.mux.HandleFunc(RevokeTokenPath, s.serveRevokeToken)
+	s.mux.HandleFunc(SessionsPath, s.serveSessions)
+	s.mux.HandleFunc(RevokeSessionPath, s.serveRevokeSession)
 
-	if s.Users == nil || s.Sessions == nil || s.Hub == nil || s.Proto == nil {
+	if s.Users == nil || s.Sessions == nil || s.Hub == nil || s.Proto == nil ||
+		(s.Irc == nil && (s.IrcAddr != "" || s.IrcTlsAddr != "")) {
 		panic("server is not properly initialized")
 	}
 
@@ -265,54 +1117,102 @@ func (s *Server) start () {
 	s.Hub.Start()
 	s.waitGroup.Add(s.refreshQueues)
 	s.refreshChans = make([]chan refreshItem, 0, s.refreshQueues)
+	s.refreshDone = make(chan bool)
 	for i := 0; i < s.refreshQueues; i++ {
 		ch := make(chan refreshItem, 4)
 		s.refreshChans = append(s.refreshChans, ch)
-		go s.goRefreshSessions(ch)
+		go s.goRefreshSessions(ch, s.refreshDone)
 	}
+
+	s.stopSweep = make(chan bool)
+	s.waitGroup.Add(1)
+	go s.goSweepSessions()
 }
 
+// вызывается в состоянии stateStopping: новые подключения в очереди проверки уже не попадают
 func (s *Server) done () {
-	for _, ch := range s.refreshChans {
-		close(ch)
-	}
+	s.closeListeners()
+	s.stateLock.Lock()
 	s.refreshChans = make([]chan refreshItem, 0)
+	s.stateLock.Unlock()
+	close(s.refreshDone)
+	close(s.stopSweep)
 
 	s.Hub.Stop()
+	s.Proto.Stop()
 	s.waitGroup.Wait()
 }
 
 func (s *Server) Run () error {
-	if s.starting || s.running || s.stopping {
+	s.stateLock.Lock()
+	if s.state != stateStopped {
+		s.stateLock.Unlock()
 		return errors.New("chat server already running")
 	}
+	s.state = stateStarting
+	s.stateLock.Unlock()
 
-	s.starting = true
 	s.init()
+	e := s.listen()
+	if e != nil {
+		s.setState(stateStopped)
+		return e
+	}
 	s.start()
+	for _, l := range s.listeners {
+		s.waitGroup.Add(1)
+		go s.goAcceptTcp(l)
+	}
 
 	log.Println("listening")
-	s.running = true
-	e := s.Http.ListenAndServe()
+	s.setState(stateRunning)
+	e = s.Http.ListenAndServe()
 	log.Println("cleanup")
 
-	s.stopping = true
+	s.setState(stateStopping)
 	s.done()
 	return e
 }
 
 func (s *Server) Stop () {
 	log.Println("stop request")
-	if s.running {
-		ctx, _ := context.WithTimeout(context.Background(), time.Second*5)
+	s.stateLock.Lock()
+	running := (s.state == stateRunning)
+	if running {
+		s.state = stateStopping
+	}
+	s.stateLock.Unlock()
+
+	if running {
+		// потоки SSE и опросы не завершатся сами, а Shutdown ждет завершения запросов
+		s.sse.CloseAll()
+		s.poll.CloseAll()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
 		e := s.Http.Shutdown(ctx)
+		cancel()
 		if e != nil {
 			log.Println(e)
 		}
 	}
 }
 
-func (s *Server) goRefreshSessions (queue <-chan refreshItem) {
+// продлевает сессию подключения; подключение по завершенной сессии или отозванному токену закрывается
+func (s *Server) refresh (item *refreshItem) bool {
+	if item.session != nil {
+		if s.Sessions.Touch(item.session.Id()) {
+			// сессии без хранилища (signed) помнят время обращения только в самом объекте
+			item.session.Touch()
+			return true
+		}
+	} else if _, found := s.Tokens.Token(item.token); found {
+		return true
+	}
+
+	item.conn.Close()
+	return false
+}
+
+func (s *Server) goRefreshSessions (queue <-chan refreshItem, done <-chan bool) {
 	items := make([]*refreshItem, 0)
 	timer := time.NewTicker(s.refreshPeriod)
 
@@ -324,8 +1224,7 @@ Loop:
 			i := 0
 			for i < l {
 				ip := items[i]
-				if ip.conn.IsAlive() {
-					ip.session.Touch()
+				if ip.conn.IsAlive() && s.refresh(ip) {
 					i++
 				} else {
 					l--
@@ -337,15 +1236,33 @@ Loop:
 				items = items[:l]
 			}
 
-		case item, alive := <-queue:
-			if !alive {
-				break Loop
-			}
-
+		case item := <-queue:
 			items = append(items, &item)
+
+		case <-done:
+			break Loop
+		}
+	}
+
+	timer.Stop()
+	s.waitGroup.Done()
+}
+
+// удаляет истекшие сессии; последняя очистка - при остановке сервера, чтобы реестр сохранил обращения к сессиям
+func (s *Server) goSweepSessions () {
+	timer := time.NewTicker(s.SweepPeriod)
+
+Loop:
+	for {
+		select {
+		case <-timer.C:
+			s.Sessions.Sweep()
+		case <-s.stopSweep:
+			break Loop
 		}
 	}
 
 	timer.Stop()
+	s.Sessions.Sweep()
 	s.waitGroup.Done()
 }
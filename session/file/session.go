@@ -0,0 +1,92 @@
+package file
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	sess "github.com/ava12/go-chat/session"
+	"github.com/ava12/go-chat/session/ram"
+)
+
+// Реестр в памяти, сохраняемый в JSON-файл. Файл перезаписывается целиком при создании и удалении сессий;
+// обращения к сессиям сохраняются при очистке реестра (раз в SweepPeriod и при остановке сервера).
+// После аварийного завершения теряются обращения не дольше чем за SweepPeriod: такие сессии
+// восстанавливаются с более ранним временем обращения и по IdleTimeout истекают раньше, но не позже.
+
+type Registry struct {
+	*ram.Registry
+	saveLock sync.Mutex
+	path     string
+}
+
+func NewRegistry (path string, t sess.Timeouts) (*Registry, error) {
+	path, e := filepath.Abs(path)
+	if e != nil {
+		return nil, e
+	}
+
+	result := &Registry {Registry: ram.NewRegistry(t), path: path}
+	data, e := os.ReadFile(path)
+	if os.IsNotExist(e) {
+		return result, nil
+	}
+	if e != nil {
+		return nil, e
+	}
+
+	records := make([]sess.Record, 0)
+	e = json.Unmarshal(data, &records)
+	if e != nil {
+		return nil, e
+	}
+
+	result.Restore(records)
+	return result, nil
+}
+
+// файл содержит номера сессий, поэтому доступен только владельцу
+func (r *Registry) save () {
+	r.saveLock.Lock()
+	defer r.saveLock.Unlock()
+
+	data, e := json.Marshal(r.Records())
+	if e == nil {
+		tmp := r.path + ".tmp"
+		e = os.WriteFile(tmp, data, 0600)
+		if e == nil {
+			e = os.Rename(tmp, r.path)
+		}
+	}
+	if e != nil {
+		log.Println(e)
+	}
+}
+
+func (r *Registry) NewSession (userId int, device sess.Device) sess.Session {
+	result := r.Registry.NewSession(userId, device)
+	if result != nil {
+		r.save()
+	}
+	return result
+}
+
+func (r *Registry) Sweep () {
+	r.Registry.Sweep()
+	r.save()
+}
+
+func (r *Registry) Delete (id string) {
+	r.Registry.Delete(id)
+	r.save()
+}
+
+func (r *Registry) DeleteUserSession (userId int, key string) error {
+	e := r.Registry.DeleteUserSession(userId, key)
+	if e == nil {
+		r.save()
+	}
+	return e
+}
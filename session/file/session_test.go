@@ -0,0 +1,78 @@
+package file_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ava12/go-chat/session"
+	"github.com/ava12/go-chat/session/file"
+)
+
+func TestPersistence (t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.json")
+	timeouts := session.Timeouts {Ttl: time.Hour, Idle: time.Hour}
+	r, e := file.NewRegistry(path, timeouts)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	s := r.NewSession(7, session.Device {UserAgent: "test agent", Ip: "127.0.0.1"})
+	deleted := r.NewSession(7, session.Device {})
+	revoked := r.NewSession(8, session.Device {})
+	if s == nil || deleted == nil || revoked == nil {
+		t.Fatal("session not created")
+	}
+	r.Delete(deleted.Id())
+	if e = r.DeleteUserSession(8, session.Key(revoked.Id())); e != nil {
+		t.Fatal(e)
+	}
+
+	info, e := os.Stat(path)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Fatalf("session file is accessible by others: %v", info.Mode())
+	}
+
+	r, e = file.NewRegistry(path, timeouts)
+	if e != nil {
+		t.Fatal(e)
+	}
+	restored := r.Session(s.Id())
+	if restored == nil || restored.UserId() != 7 {
+		t.Fatalf("session not restored: %v", restored)
+	}
+	if r.Session(deleted.Id()) != nil || r.Session(revoked.Id()) != nil {
+		t.Fatal("deleted session restored")
+	}
+	list := r.UserSessions(7)
+	if len(list) != 1 || list[0].UserAgent != "test agent" || list[0].Ip != "127.0.0.1" {
+		t.Fatalf("unexpected user sessions: %v", list)
+	}
+}
+
+func TestTouchSaved (t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.json")
+	timeouts := session.Timeouts {Ttl: time.Hour, Idle: 10 * time.Second}
+	r, e := file.NewRegistry(path, timeouts)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	now := time.Now().Unix()
+	r.Restore([]session.Record {{Id: "touched", UserId: 1, Created: now - 100, Touched: now - 9}})
+	r.Touch("touched")
+	r.Sweep()
+
+	r, e = file.NewRegistry(path, timeouts)
+	if e != nil {
+		t.Fatal(e)
+	}
+	list := r.UserSessions(1)
+	if len(list) != 1 || list[0].Touched < now {
+		t.Fatalf("touch not saved: %v", list)
+	}
+}
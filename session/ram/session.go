@@ -1,61 +1,58 @@
 package ram
 
 import (
-	"math/rand"
-	"strconv"
+	"log"
 	"sync"
 	"sync/atomic"
 	"time"
 	sess "github.com/ava12/go-chat/session"
 )
 
-func init () {
-	rand.Seed(time.Now().UnixNano())
-}
-
-const DefaultTtl = time.Hour
-
 type Session struct {
-	ttl       int64 // seconds
-	timestamp int64 // seconds
-	id        string
-	userId    int
-}
-
-func newSession (userId int, ttl time.Duration) *Session {
-	return &Session{int64(ttl / time.Second), time.Now().Unix(), strconv.FormatInt(rand.Int63(), 10), userId}
+	rec      sess.Record // Touched - на момент загрузки, текущее значение в touched
+	touched  int64
+	timeouts sess.Timeouts
 }
 
 func (s *Session) Id () string {
-	return s.id
+	return s.rec.Id
 }
 
 func (s *Session) UserId () int {
-	return s.userId
+	return s.rec.UserId
 }
 
 func (s *Session) Ttl () int64 {
-	return atomic.LoadInt64(&s.ttl)
+	return s.timeouts.Left(s.record(), time.Now().Unix())
 }
 
 func (s *Session) Touch () {
-	atomic.StoreInt64(&s.timestamp, time.Now().Unix())
+	atomic.StoreInt64(&s.touched, time.Now().Unix())
 }
 
 func (s *Session) Expired () bool {
-	ts := atomic.LoadInt64(&s.timestamp)
-	return (ts+s.ttl < time.Now().Unix())
+	return s.timeouts.Expired(s.record(), time.Now().Unix())
+}
+
+func (s *Session) Info () sess.Info {
+	return s.record().Info()
+}
+
+func (s *Session) record () sess.Record {
+	rec := s.rec
+	rec.Touched = atomic.LoadInt64(&s.touched)
+	return rec
 }
 
 
 type Registry struct {
 	lock     sync.RWMutex
 	sessions map[string]*Session
-	ttl      time.Duration
+	timeouts sess.Timeouts
 }
 
-func NewRegistry() *Registry {
-	return &Registry{sessions: make(map[string]*Session), ttl: DefaultTtl}
+func NewRegistry (t sess.Timeouts) *Registry {
+	return &Registry{sessions: make(map[string]*Session), timeouts: t}
 }
 
 func (r *Registry) Session (id string) sess.Session {
@@ -72,32 +69,28 @@ func (r *Registry) Session (id string) sess.Session {
 }
 
 func (r *Registry) Touch (id string) bool {
-	r.lock.RLock()
-	defer r.lock.RUnlock()
-
-	s := r.sessions[id]
-	if s != nil {
-		s.Touch()
-		return true
-	} else {
-		return false
-	}
+	return (r.Session(id) != nil)
 }
 
-func (r *Registry) NewSession (userId int) sess.Session {
+func (r *Registry) NewSession (userId int, device sess.Device) sess.Session {
 	r.lock.Lock()
 	defer r.lock.Unlock()
 
-	var result *Session
+	now := time.Now().Unix()
 	for {
-		result = newSession(userId, DefaultTtl)
-		if r.sessions[result.id] == nil {
-			break
+		id, e := sess.NewId()
+		if e != nil {
+			log.Println(e)
+			return nil
 		}
-	}
 
-	r.sessions[result.id] = result
-	return result
+		if r.sessions[id] == nil {
+			rec := sess.Record {Id: id, UserId: userId, Created: now, Device: device}
+			result := &Session {rec, now, r.timeouts}
+			r.sessions[id] = result
+			return result
+		}
+	}
 }
 
 func (r *Registry) Sweep () {
@@ -119,3 +112,56 @@ func (r *Registry) Delete (id string) {
 
 	delete(r.sessions, id)
 }
+
+func (r *Registry) UserSessions (userId int) []sess.Info {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	result := make([]sess.Info, 0)
+	for _, s := range r.sessions {
+		if s.rec.UserId == userId && !s.Expired() {
+			result = append(result, s.Info())
+		}
+	}
+	return result
+}
+
+func (r *Registry) DeleteUserSession (userId int, key string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for id, s := range r.sessions {
+		if s.rec.UserId == userId && sess.Key(id) == key {
+			delete(r.sessions, id)
+			return nil
+		}
+	}
+	return sess.NotFound
+}
+
+// неистекшие сессии для сохранения
+func (r *Registry) Records () []sess.Record {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	result := make([]sess.Record, 0, len(r.sessions))
+	for _, s := range r.sessions {
+		if !s.Expired() {
+			result = append(result, s.record())
+		}
+	}
+	return result
+}
+
+// добавляет сохраненные сессии, истекшие пропускаются
+func (r *Registry) Restore (records []sess.Record) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	now := time.Now().Unix()
+	for _, rec := range records {
+		if !r.timeouts.Expired(rec, now) {
+			r.sessions[rec.Id] = &Session {rec, rec.Touched, r.timeouts}
+		}
+	}
+}
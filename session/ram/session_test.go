@@ -0,0 +1,88 @@
+package ram_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ava12/go-chat/session"
+	"github.com/ava12/go-chat/session/ram"
+)
+
+func TestRegistry (t *testing.T) {
+	r := ram.NewRegistry(session.Timeouts {Ttl: time.Hour})
+	s := r.NewSession(7, session.Device {UserAgent: "test agent", Ip: "127.0.0.1"})
+	other := r.NewSession(7, session.Device {UserAgent: "other agent"})
+	r.NewSession(8, session.Device {})
+	if s == nil || other == nil {
+		t.Fatal("session not created")
+	}
+	if s.Ttl() <= 0 || s.Ttl() > 3600 {
+		t.Fatalf("unexpected session ttl: %d", s.Ttl())
+	}
+
+	found := r.Session(s.Id())
+	if found == nil || found.UserId() != 7 || found.Expired() {
+		t.Fatalf("session not found: %v", found)
+	}
+
+	list := r.UserSessions(7)
+	if len(list) != 2 {
+		t.Fatalf("unexpected user sessions: %v", list)
+	}
+	keys := map[string]string {}
+	for _, info := range list {
+		keys[info.UserAgent] = info.Key
+	}
+	if keys["test agent"] != session.Key(s.Id()) || keys["other agent"] != session.Key(other.Id()) {
+		t.Fatalf("unexpected user sessions: %v", list)
+	}
+
+	if e := r.DeleteUserSession(8, keys["other agent"]); e != session.NotFound {
+		t.Fatalf("session deleted by another user: %v", e)
+	}
+	if e := r.DeleteUserSession(7, keys["other agent"]); e != nil || r.Session(other.Id()) != nil {
+		t.Fatalf("user session not deleted: %v", e)
+	}
+	if list = r.UserSessions(7); len(list) != 1 || list[0].Key != keys["test agent"] {
+		t.Fatalf("unexpected user sessions: %v", list)
+	}
+
+	r.Delete(s.Id())
+	if r.Session(s.Id()) != nil || r.Touch(s.Id()) {
+		t.Fatal("deleted session found")
+	}
+}
+
+func TestIdleTimeout (t *testing.T) {
+	r := ram.NewRegistry(session.Timeouts {Ttl: time.Hour, Idle: 10 * time.Second})
+	now := time.Now().Unix()
+	r.Restore([]session.Record {
+		{Id: "idle", UserId: 1, Created: now - 100, Touched: now - 11},
+		{Id: "live", UserId: 1, Created: now - 100, Touched: now - 5},
+		{Id: "old", UserId: 1, Created: now - 4000, Touched: now},
+		// истекает в течение секунды
+		{Id: "expiring", UserId: 1, Created: now - 100, Touched: now - 10},
+	})
+
+	if r.Touch("idle") || r.Touch("old") {
+		t.Fatal("expired session restored")
+	}
+	if !r.Touch("live") {
+		t.Fatal("live session not restored")
+	}
+	if list := r.UserSessions(1); len(list) != 2 || list[0].Touched < now {
+		t.Fatalf("unexpected user sessions: %v", list)
+	}
+
+	deadline := time.Now().Add(3 * time.Second)
+	for len(r.Records()) > 1 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	r.Sweep()
+	if list := r.UserSessions(1); len(list) != 1 || list[0].Key != session.Key("live") {
+		t.Fatalf("unexpected sessions after sweep: %v", list)
+	}
+	if r.Session("expiring") != nil {
+		t.Fatal("idle session not swept")
+	}
+}
@@ -1,17 +1,159 @@
 package session
 
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/ava12/go-chat/config"
+)
+
+// Сессия действует не дольше Ttl с момента создания и истекает раньше,
+// если к ней не обращались дольше IdleTimeout.
+
 type Session interface {
 	Id () string
 	UserId () int
-	Ttl () int64
+	Ttl () int64 // секунды до окончания срока действия
 	Touch ()
 	Expired () bool
+	Info () Info
 }
 
 type Registry interface {
 	Session (id string) Session
-	Touch (id string) bool
-	NewSession (userId int) Session
-	Sweep ()
+	Touch (id string) bool // false, если сессии нет или она истекла
+	NewSession (userId int, device Device) Session
+	Sweep () // удаляет истекшие сессии
 	Delete (id string)
+	UserSessions (userId int) []Info
+	// удаляет сессию пользователя по Info.Key
+	DeleteUserSession (userId int, key string) error
+}
+
+// завершение всех сессий пользователя сразу; реализуется не всеми реестрами
+type UserRevoker interface {
+	DeleteUserSessions (userId int) error
+}
+
+// откуда открыта сессия
+type Device struct {
+	UserAgent string `json:"userAgent"`
+	Ip string `json:"ip"`
+}
+
+// сведения о сессии для владельца; по открытому ключу нельзя восстановить номер сессии
+type Info struct {
+	Key string `json:"key"`
+	Created int64 `json:"created"`
+	Touched int64 `json:"touched"`
+	Device
+}
+
+// состояние сессии в хранилище
+type Record struct {
+	Id string `json:"id"`
+	UserId int `json:"userId"`
+	Created int64 `json:"created"`
+	Touched int64 `json:"touched"`
+	Device
+}
+
+type Timeouts struct {
+	Ttl time.Duration
+	Idle time.Duration // 0 - не ограничено
+}
+
+const (
+	configSection = "Sessions"
+
+	DefaultTtl = 30 * 24 * time.Hour
+	DefaultSweepPeriod = 10 * time.Minute
+	DefaultFile = "sessions.json"
+	DefaultEpochFile = "session-epochs.json"
+	MaxUserAgentLen = 255
+
+	idBytes = 16
+	keyBytes = 8
+)
+
+var (
+	NotFound = errors.New("session not found")
+	Unsupported = errors.New("operation is not supported by session registry")
+)
+
+// секция Sessions файла настроек, времена в секундах
+type Conf struct {
+	Ttl int
+	IdleTimeout int // 0 - не ограничено
+	SweepPeriod int // для реестра "file" это и период сохранения обращений к сессиям
+	File string // для реестра "file"
+	Keys []string // для реестра "signed", подписывает первый
+	Encrypt bool // для реестра "signed"
+	EpochFile string // для реестра "signed": поколения сессий пользователей
+}
+
+func ReadConf (c *config.Config) (Conf, error) {
+	result := Conf {
+		Ttl: int(DefaultTtl / time.Second),
+		SweepPeriod: int(DefaultSweepPeriod / time.Second),
+		File: DefaultFile,
+		EpochFile: DefaultEpochFile,
+	}
+	e := c.Section(configSection, &result)
+	if e == nil && (result.Ttl <= 0 || result.IdleTimeout < 0 || result.SweepPeriod <= 0) {
+		e = fmt.Errorf("bad session timeouts: ttl %d, idle %d, sweep %d", result.Ttl, result.IdleTimeout, result.SweepPeriod)
+	}
+	return result, e
+}
+
+func (c Conf) Timeouts () Timeouts {
+	return Timeouts {time.Duration(c.Ttl) * time.Second, time.Duration(c.IdleTimeout) * time.Second}
+}
+
+func (t Timeouts) Expired (r Record, now int64) bool {
+	return (r.Created + int64(t.Ttl / time.Second) < now ||
+		(t.Idle > 0 && r.Touched + int64(t.Idle / time.Second) < now))
+}
+
+// секунды до окончания срока действия
+func (t Timeouts) Left (r Record, now int64) int64 {
+	left := r.Created + int64(t.Ttl / time.Second) - now
+	if left < 0 {
+		left = 0
+	}
+	return left
+}
+
+func (r Record) Info () Info {
+	return Info {Key(r.Id), r.Created, r.Touched, r.Device}
+}
+
+func NewId () (string, error) {
+	buf := make([]byte, idBytes)
+	_, e := rand.Read(buf)
+	return hex.EncodeToString(buf), e
+}
+
+func Key (id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:keyBytes])
+}
+
+func DeviceOf (r *http.Request) Device {
+	ua := r.UserAgent()
+	if len(ua) > MaxUserAgentLen {
+		ua = ua[:MaxUserAgentLen]
+	}
+
+	ip, _, e := net.SplitHostPort(r.RemoteAddr)
+	if e != nil {
+		ip = r.RemoteAddr
+	}
+	return Device {ua, ip}
 }
@@ -0,0 +1,372 @@
+package signed
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	sess "github.com/ava12/go-chat/session"
+)
+
+// Сессии без хранилища: пользователь, время входа, последнего обращения и окончания срока
+// хранятся в самом номере сессии (значении cookie), подписанном HMAC-SHA256 и при необходимости зашифрованном AES-GCM.
+// Подписывается первым ключом из списка, проверяется любым: при смене новый ключ добавляется в начало,
+// старый удаляется, когда истекут выданные с ним сессии. Включение и выключение шифрования завершает все сессии.
+// Список сессий пользователя пуст. Delete (выход) заносит сессию в список отозванных до окончания ее срока;
+// список хранится только в памяти процесса: после перезапуска и в других процессах за балансировщиком
+// сессия снова действует до окончания срока.
+// Все сессии пользователя завершает DeleteUserSessions: у пользователя увеличивается номер поколения,
+// сессии прежних поколений не принимаются. Поколения хранятся в памяти и, если задан файл, в JSON-файле.
+
+const (
+	MinKeyLen = 32
+
+	signLabel = "go-chat session signature"
+	encryptLabel = "go-chat session encryption"
+)
+
+var (
+	NoKeys = errors.New("no session keys")
+	ShortKey = errors.New("session key must be at least 32 bytes long")
+)
+
+type keyRec struct {
+	sign []byte
+	aead cipher.AEAD // nil без шифрования
+}
+
+type payloadRec struct {
+	UserId int `json:"u"`
+	Issued int64 `json:"i"`
+	Expires int64 `json:"e"`
+	Touched int64 `json:"t"`
+	Nonce string `json:"n"` // различает сессии, выданные одновременно
+	Epoch int `json:"g,omitempty"` // поколение сессий пользователя
+}
+
+type Session struct {
+	lock sync.Mutex
+	payload payloadRec
+	id string
+	registry *Registry
+}
+
+func (s *Session) Id () string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.id
+}
+
+func (s *Session) UserId () int {
+	return s.payload.UserId
+}
+
+func (s *Session) Ttl () int64 {
+	left := s.payload.Expires - time.Now().Unix()
+	if left < 0 {
+		left = 0
+	}
+	return left
+}
+
+// обновляет время обращения, номер сессии при этом меняется
+func (s *Session) Touch () {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	p := s.payload
+	p.Touched = time.Now().Unix()
+	id, e := s.registry.encode(p)
+	if e != nil {
+		log.Println(e)
+		return
+	}
+
+	s.payload.Touched = p.Touched
+	s.id = id
+}
+
+func (s *Session) Expired () bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.registry.expired(s.payload, time.Now().Unix())
+}
+
+func (s *Session) Info () sess.Info {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return sess.Info {Key: s.payload.Nonce, Created: s.payload.Issued, Touched: s.payload.Touched}
+}
+
+
+type Registry struct {
+	keys []keyRec
+	timeouts sess.Timeouts
+
+	epochLock sync.RWMutex
+	epochs map[int]int // {userId: поколение}, нет записи - 0
+	epochFile string // пусто - поколения не сохраняются
+
+	revokeLock sync.RWMutex
+	revoked map[string]int64 // {Nonce: Expires} сессий, завершенных Delete
+}
+
+func NewRegistry (keys []string, encrypt bool, t sess.Timeouts) (*Registry, error) {
+	if len(keys) == 0 {
+		return nil, NoKeys
+	}
+
+	result := &Registry {keys: make([]keyRec, 0, len(keys)), timeouts: t, epochs: make(map[int]int), revoked: make(map[string]int64)}
+	for _, key := range keys {
+		if len(key) < MinKeyLen {
+			return nil, ShortKey
+		}
+
+		k := keyRec {sign: derive(key, signLabel)}
+		if encrypt {
+			block, e := aes.NewCipher(derive(key, encryptLabel))
+			if e == nil {
+				k.aead, e = cipher.NewGCM(block)
+			}
+			if e != nil {
+				return nil, e
+			}
+		}
+		result.keys = append(result.keys, k)
+	}
+
+	return result, nil
+}
+
+// загружает поколения сессий из файла, если он есть, и сохраняет их туда при изменении
+func (r *Registry) SetEpochFile (path string) error {
+	path, e := filepath.Abs(path)
+	if e != nil {
+		return e
+	}
+
+	data, e := os.ReadFile(path)
+	if e != nil && !os.IsNotExist(e) {
+		return e
+	}
+
+	epochs := make(map[string]int)
+	if e == nil {
+		e = json.Unmarshal(data, &epochs)
+		if e != nil {
+			return e
+		}
+	}
+
+	r.epochLock.Lock()
+	defer r.epochLock.Unlock()
+
+	for key, epoch := range epochs {
+		userId, e := strconv.Atoi(key)
+		if e != nil {
+			return e
+		}
+		r.epochs[userId] = epoch
+	}
+	r.epochFile = path
+	return nil
+}
+
+func (r *Registry) epoch (userId int) int {
+	r.epochLock.RLock()
+	defer r.epochLock.RUnlock()
+
+	return r.epochs[userId]
+}
+
+// вызывающий должен удерживать epochLock на запись
+func (r *Registry) saveEpochs () error {
+	if r.epochFile == "" {
+		return nil
+	}
+
+	data, e := json.Marshal(r.epochs)
+	if e != nil {
+		return e
+	}
+
+	tmp := r.epochFile + ".tmp"
+	e = os.WriteFile(tmp, data, 0600)
+	if e == nil {
+		e = os.Rename(tmp, r.epochFile)
+	}
+	return e
+}
+
+func derive (key, label string) []byte {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(label))
+	return mac.Sum(nil)
+}
+
+func sign (key []byte, body string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(body))
+	return mac.Sum(nil)
+}
+
+// номер сессии: base64(данные) "." base64(подпись данных)
+func (r *Registry) encode (p payloadRec) (string, error) {
+	data, e := json.Marshal(p)
+	if e != nil {
+		return "", e
+	}
+
+	k := r.keys[0]
+	if k.aead != nil {
+		nonce := make([]byte, k.aead.NonceSize())
+		_, e = rand.Read(nonce)
+		if e != nil {
+			return "", e
+		}
+		data = k.aead.Seal(nonce, nonce, data, nil)
+	}
+
+	body := base64.RawURLEncoding.EncodeToString(data)
+	return body + "." + base64.RawURLEncoding.EncodeToString(sign(k.sign, body)), nil
+}
+
+func (r *Registry) decode (id string) (payloadRec, bool) {
+	result := payloadRec {}
+	body, signature, found := strings.Cut(id, ".")
+	if !found {
+		return result, false
+	}
+
+	mac, e := base64.RawURLEncoding.DecodeString(signature)
+	if e != nil {
+		return result, false
+	}
+
+	for _, k := range r.keys {
+		if !hmac.Equal(mac, sign(k.sign, body)) {
+			continue
+		}
+
+		data, e := base64.RawURLEncoding.DecodeString(body)
+		if e == nil && k.aead != nil {
+			size := k.aead.NonceSize()
+			if len(data) < size {
+				return result, false
+			}
+			data, e = k.aead.Open(nil, data[:size], data[size:], nil)
+		}
+		if e == nil {
+			e = json.Unmarshal(data, &result)
+		}
+		return result, (e == nil)
+	}
+
+	return result, false
+}
+
+// истекшая или завершенная сессия
+func (r *Registry) expired (p payloadRec, now int64) bool {
+	return (p.Expires < now || (r.timeouts.Idle > 0 && p.Touched + int64(r.timeouts.Idle / time.Second) < now) ||
+		p.Epoch < r.epoch(p.UserId) || r.isRevoked(p.Nonce))
+}
+
+func (r *Registry) isRevoked (nonce string) bool {
+	r.revokeLock.RLock()
+	defer r.revokeLock.RUnlock()
+
+	_, found := r.revoked[nonce]
+	return found
+}
+
+func (r *Registry) Session (id string) sess.Session {
+	p, valid := r.decode(id)
+	if !valid || r.expired(p, time.Now().Unix()) {
+		return nil
+	}
+
+	result := &Session {payload: p, id: id, registry: r}
+	result.Touch()
+	return result
+}
+
+// проверяет сессию; время обращения обновляется только в самой сессии
+func (r *Registry) Touch (id string) bool {
+	p, valid := r.decode(id)
+	return (valid && !r.expired(p, time.Now().Unix()))
+}
+
+func (r *Registry) NewSession (userId int, device sess.Device) sess.Session {
+	nonce, e := sess.NewId()
+	if e != nil {
+		log.Println(e)
+		return nil
+	}
+
+	now := time.Now().Unix()
+	p := payloadRec {userId, now, now + int64(r.timeouts.Ttl / time.Second), now, sess.Key(nonce), r.epoch(userId)}
+	id, e := r.encode(p)
+	if e != nil {
+		log.Println(e)
+		return nil
+	}
+
+	return &Session {payload: p, id: id, registry: r}
+}
+
+// забывает отозванные сессии, срок которых и так истек
+func (r *Registry) Sweep () {
+	r.revokeLock.Lock()
+	defer r.revokeLock.Unlock()
+
+	now := time.Now().Unix()
+	for nonce, expires := range r.revoked {
+		if expires < now {
+			delete(r.revoked, nonce)
+		}
+	}
+}
+
+// номер сессии меняется при каждом обращении, поэтому отзывается Nonce: он один у всех номеров сессии
+func (r *Registry) Delete (id string) {
+	p, valid := r.decode(id)
+	if !valid || r.expired(p, time.Now().Unix()) {
+		return
+	}
+
+	r.revokeLock.Lock()
+	defer r.revokeLock.Unlock()
+
+	r.revoked[p.Nonce] = p.Expires
+}
+
+func (r *Registry) UserSessions (userId int) []sess.Info {
+	return make([]sess.Info, 0)
+}
+
+func (r *Registry) DeleteUserSession (userId int, key string) error {
+	return sess.Unsupported
+}
+
+func (r *Registry) DeleteUserSessions (userId int) error {
+	r.epochLock.Lock()
+	defer r.epochLock.Unlock()
+
+	r.epochs[userId]++
+	return r.saveEpochs()
+}
@@ -0,0 +1,131 @@
+package signed
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	sess "github.com/ava12/go-chat/session"
+)
+
+const (
+	oldKey = "old key old key old key old key old key"
+	newKey = "new key new key new key new key new key"
+)
+
+var timeouts = sess.Timeouts {Ttl: time.Hour}
+
+func TestSignedSessions (t *testing.T) {
+	for _, encrypt := range []bool {false, true} {
+		r, e := NewRegistry([]string {oldKey}, encrypt, timeouts)
+		if e != nil {
+			t.Fatal(e)
+		}
+
+		s := r.NewSession(7, sess.Device {})
+		found := r.Session(s.Id())
+		if found == nil || found.UserId() != 7 || found.Ttl() <= 0 {
+			t.Fatalf("session not found (encrypt: %v): %v", encrypt, found)
+		}
+		if encrypt && strings.Contains(s.Id(), "eyJ1Ijo3") {
+			t.Fatal("session payload is not encrypted")
+		}
+
+		body, signature, _ := strings.Cut(s.Id(), ".")
+		tampered := body + "." + strings.Repeat("A", len(signature))
+		if r.Session(tampered) != nil || r.Touch(tampered) {
+			t.Fatalf("tampered session accepted (encrypt: %v)", encrypt)
+		}
+
+		rotated, _ := NewRegistry([]string {newKey, oldKey}, encrypt, timeouts)
+		if !rotated.Touch(s.Id()) {
+			t.Fatalf("old key rejected after rotation (encrypt: %v)", encrypt)
+		}
+		fresh := rotated.NewSession(8, sess.Device {})
+		if r.Touch(fresh.Id()) {
+			t.Fatalf("session signed with unknown key accepted (encrypt: %v)", encrypt)
+		}
+
+		dropped, _ := NewRegistry([]string {newKey}, encrypt, timeouts)
+		if dropped.Touch(s.Id()) || !dropped.Touch(fresh.Id()) {
+			t.Fatalf("unexpected sessions after key removal (encrypt: %v)", encrypt)
+		}
+	}
+}
+
+func TestSignedExpiry (t *testing.T) {
+	r, _ := NewRegistry([]string {oldKey}, false, sess.Timeouts {Ttl: time.Hour, Idle: time.Minute})
+	now := time.Now().Unix()
+	expired, _ := r.encode(payloadRec {7, now - 7200, now - 3600, now, "a", 0})
+	idle, _ := r.encode(payloadRec {7, now - 600, now + 3000, now - 120, "b", 0})
+	if r.Touch(expired) || r.Touch(idle) {
+		t.Fatal("expired session accepted")
+	}
+
+	if _, e := NewRegistry([]string {"short"}, false, timeouts); e != ShortKey {
+		t.Fatalf("short key accepted: %v", e)
+	}
+}
+
+func TestSignedRevoke (t *testing.T) {
+	path := filepath.Join(t.TempDir(), "epochs.json")
+	r, _ := NewRegistry([]string {oldKey}, false, timeouts)
+	if e := r.SetEpochFile(path); e != nil {
+		t.Fatal(e)
+	}
+
+	old := r.NewSession(7, sess.Device {})
+	other := r.NewSession(8, sess.Device {})
+	if e := r.DeleteUserSessions(7); e != nil {
+		t.Fatal(e)
+	}
+
+	fresh := r.NewSession(7, sess.Device {})
+	if r.Touch(old.Id()) || r.Session(old.Id()) != nil || !old.Expired() {
+		t.Fatal("revoked session accepted")
+	}
+	if !r.Touch(other.Id()) || !r.Touch(fresh.Id()) {
+		t.Fatal("session revoked by mistake")
+	}
+
+	// поколения переживают перезапуск
+	restarted, _ := NewRegistry([]string {oldKey}, false, timeouts)
+	if e := restarted.SetEpochFile(path); e != nil {
+		t.Fatal(e)
+	}
+	if restarted.Touch(old.Id()) || !restarted.Touch(fresh.Id()) {
+		t.Fatal("session epochs are not restored")
+	}
+}
+
+func TestSignedDelete (t *testing.T) {
+	// с шифрованием номер меняется при каждом обращении, даже в ту же секунду
+	r, _ := NewRegistry([]string {oldKey}, true, timeouts)
+	s := r.NewSession(7, sess.Device {})
+	other := r.NewSession(7, sess.Device {})
+	issued := s.Id()
+
+	// после обращения номер другой, но отзывается вся сессия
+	touched := r.Session(issued)
+	if touched.Id() == issued {
+		t.Fatal("session id not changed by touch")
+	}
+	r.Delete(touched.Id())
+	if r.Touch(issued) || r.Session(touched.Id()) != nil || !s.Expired() {
+		t.Fatal("deleted session accepted")
+	}
+	if !r.Touch(other.Id()) {
+		t.Fatal("session deleted by mistake")
+	}
+
+	r.Sweep()
+	if len(r.revoked) != 1 {
+		t.Fatalf("live revoked session forgotten: %v", r.revoked)
+	}
+	r.revoked["expired"] = time.Now().Unix() - 1
+	r.Sweep()
+	if len(r.revoked) != 1 {
+		t.Fatalf("expired revoked session kept: %v", r.revoked)
+	}
+}
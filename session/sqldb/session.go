@@ -0,0 +1,227 @@
+package sqldb
+
+import (
+	"database/sql"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/ava12/go-chat/db"
+	sess "github.com/ava12/go-chat/session"
+)
+
+const component = "sessions"
+
+var migrations = []string {
+	`CREATE TABLE sessions (
+		id VARCHAR(64) NOT NULL PRIMARY KEY,
+		user_id INTEGER NOT NULL,
+		ttl INTEGER NOT NULL,
+		touched INTEGER NOT NULL
+	)`,
+
+	// ttl больше не используется: сроки задаются настройками реестра
+	`ALTER TABLE sessions ADD COLUMN created BIGINT NOT NULL DEFAULT 0;
+	UPDATE sessions SET created = touched;
+	ALTER TABLE sessions ADD COLUMN user_agent VARCHAR(255) NOT NULL DEFAULT '';
+	ALTER TABLE sessions ADD COLUMN ip VARCHAR(64) NOT NULL DEFAULT ''`,
+}
+
+const sessionFields = "id, user_id, created, touched, user_agent, ip"
+
+type Session struct {
+	rec      sess.Record // Touched - на момент загрузки, текущее значение в touched
+	touched  int64
+	timeouts sess.Timeouts
+	registry *Registry
+}
+
+func (s *Session) Id () string {
+	return s.rec.Id
+}
+
+func (s *Session) UserId () int {
+	return s.rec.UserId
+}
+
+func (s *Session) Ttl () int64 {
+	return s.timeouts.Left(s.record(), time.Now().Unix())
+}
+
+func (s *Session) Touch () {
+	now := time.Now().Unix()
+	atomic.StoreInt64(&s.touched, now)
+	s.registry.touch(s.rec.Id, now)
+}
+
+func (s *Session) Expired () bool {
+	return s.timeouts.Expired(s.record(), time.Now().Unix())
+}
+
+func (s *Session) Info () sess.Info {
+	return s.record().Info()
+}
+
+func (s *Session) record () sess.Record {
+	rec := s.rec
+	rec.Touched = atomic.LoadInt64(&s.touched)
+	return rec
+}
+
+
+type Registry struct {
+	db       *db.DB
+	timeouts sess.Timeouts
+}
+
+func NewRegistry (d *db.DB, t sess.Timeouts) (*Registry, error) {
+	e := d.Migrate(component, migrations)
+	if e != nil {
+		return nil, e
+	}
+
+	return &Registry {d, t}, nil
+}
+
+// наименьшие допустимые времена создания и обращения для неистекших сессий
+func (r *Registry) limits (now int64) (created, touched int64) {
+	created = now - int64(r.timeouts.Ttl / time.Second)
+	if r.timeouts.Idle > 0 {
+		touched = now - int64(r.timeouts.Idle / time.Second)
+	}
+	return
+}
+
+type scanner interface {
+	Scan (dest ... interface {}) error
+}
+
+func scanRecord (s scanner) (sess.Record, error) {
+	rec := sess.Record {}
+	e := s.Scan(&rec.Id, &rec.UserId, &rec.Created, &rec.Touched, &rec.UserAgent, &rec.Ip)
+	return rec, e
+}
+
+func (r *Registry) touch (id string, timestamp int64) bool {
+	created, touched := r.limits(timestamp)
+	res, e := r.db.Exec("UPDATE sessions SET touched = ? WHERE id = ? AND created >= ? AND touched >= ?",
+		timestamp, id, created, touched)
+	if e != nil {
+		log.Println(e)
+		return false
+	}
+
+	n, _ := res.RowsAffected()
+	return (n > 0)
+}
+
+func (r *Registry) Session (id string) sess.Session {
+	rec, e := scanRecord(r.db.QueryRow("SELECT " + sessionFields + " FROM sessions WHERE id = ?", id))
+	if e != nil {
+		if e != sql.ErrNoRows {
+			log.Println(e)
+		}
+		return nil
+	}
+
+	result := &Session {rec, rec.Touched, r.timeouts, r}
+	if result.Expired() {
+		return nil
+	}
+
+	result.Touch()
+	return result
+}
+
+func (r *Registry) Touch (id string) bool {
+	return r.touch(id, time.Now().Unix())
+}
+
+func (r *Registry) NewSession (userId int, device sess.Device) sess.Session {
+	ttl := int64(r.timeouts.Ttl / time.Second)
+	for {
+		id, e := sess.NewId()
+		if e != nil {
+			log.Println(e)
+			return nil
+		}
+
+		now := time.Now().Unix()
+		_, e = r.db.Exec("INSERT INTO sessions (" + sessionFields + ", ttl) VALUES (?, ?, ?, ?, ?, ?, ?)",
+			id, userId, now, now, device.UserAgent, device.Ip, ttl)
+		if e == nil {
+			rec := sess.Record {Id: id, UserId: userId, Created: now, Device: device}
+			return &Session {rec, now, r.timeouts, r}
+		}
+
+		var found int
+		if r.db.QueryRow("SELECT COUNT(*) FROM sessions WHERE id = ?", id).Scan(&found) != nil || found == 0 {
+			log.Println(e)
+			return nil
+		}
+	}
+}
+
+func (r *Registry) Sweep () {
+	created, touched := r.limits(time.Now().Unix())
+	_, e := r.db.Exec("DELETE FROM sessions WHERE created < ? OR touched < ?", created, touched)
+	if e != nil {
+		log.Println(e)
+	}
+}
+
+func (r *Registry) Delete (id string) {
+	_, e := r.db.Exec("DELETE FROM sessions WHERE id = ?", id)
+	if e != nil {
+		log.Println(e)
+	}
+}
+
+func (r *Registry) userRecords (userId int) ([]sess.Record, error) {
+	result := make([]sess.Record, 0)
+	created, touched := r.limits(time.Now().Unix())
+	rows, e := r.db.Query("SELECT " + sessionFields + " FROM sessions WHERE user_id = ? AND created >= ? AND touched >= ? ORDER BY created",
+		userId, created, touched)
+	if e != nil {
+		return result, e
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		rec, e := scanRecord(rows)
+		if e != nil {
+			return result, e
+		}
+
+		result = append(result, rec)
+	}
+	return result, rows.Err()
+}
+
+func (r *Registry) UserSessions (userId int) []sess.Info {
+	records, e := r.userRecords(userId)
+	if e != nil {
+		log.Println(e)
+	}
+
+	result := make([]sess.Info, 0, len(records))
+	for _, rec := range records {
+		result = append(result, rec.Info())
+	}
+	return result
+}
+
+func (r *Registry) DeleteUserSession (userId int, key string) error {
+	records, e := r.userRecords(userId)
+	if e != nil {
+		return e
+	}
+
+	for _, rec := range records {
+		if sess.Key(rec.Id) == key {
+			_, e = r.db.Exec("DELETE FROM sessions WHERE id = ?", rec.Id)
+			return e
+		}
+	}
+	return sess.NotFound
+}
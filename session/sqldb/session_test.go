@@ -0,0 +1,52 @@
+package sqldb_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ava12/go-chat/db/dbtest"
+	"github.com/ava12/go-chat/session"
+	sessionsql "github.com/ava12/go-chat/session/sqldb"
+)
+
+func TestSessionRegistry (t *testing.T) {
+	r, e := sessionsql.NewRegistry(dbtest.Open(t), session.Timeouts {Ttl: time.Hour})
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	s := r.NewSession(7, session.Device {UserAgent: "test agent", Ip: "127.0.0.1"})
+	if s == nil {
+		t.Fatal("session not created")
+	}
+	other := r.NewSession(7, session.Device {})
+	if s.Ttl() <= 0 || s.Ttl() > 3600 {
+		t.Fatalf("unexpected session ttl: %d", s.Ttl())
+	}
+
+	found := r.Session(s.Id())
+	if found == nil || found.UserId() != 7 || found.Expired() {
+		t.Fatalf("session not found: %v", found)
+	}
+
+	r.Sweep()
+	if !r.Touch(s.Id()) {
+		t.Fatal("live session swept")
+	}
+
+	list := r.UserSessions(7)
+	if len(list) != 2 || list[0].UserAgent != "test agent" || list[0].Key != session.Key(s.Id()) {
+		t.Fatalf("unexpected user sessions: %v", list)
+	}
+	if e = r.DeleteUserSession(8, list[1].Key); e != session.NotFound {
+		t.Fatalf("session deleted by another user: %v", e)
+	}
+	if e = r.DeleteUserSession(7, list[1].Key); e != nil || r.Session(other.Id()) != nil {
+		t.Fatalf("user session not deleted: %v", e)
+	}
+
+	r.Delete(s.Id())
+	if r.Session(s.Id()) != nil || r.Touch(s.Id()) {
+		t.Fatal("deleted session found")
+	}
+}
@@ -0,0 +1,6 @@
+//go:build sqlite
+
+package main
+
+// драйвер SQLite для хранилищ "sql" (имя драйвера "sqlite"): go build -tags sqlite
+import _ "github.com/glebarez/go-sqlite"
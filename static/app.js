@@ -7,14 +7,20 @@ function makeUser (data, chat) {
 }
 
 function makeRoom (data, isIn) {
-	return new Room(data.id, data.name, data.perm, !!isIn)
+	var room = new Room(data.id, data.name, data.perm, !!isIn, data.userIds)
+	room.unread = +data.unread || 0
+	room.visibility = data.visibility || 'public'
+	room.topic = data.topic || ''
+	room.description = data.description || ''
+	room.archived = !!data.archived
+	return room
 }
 
 function initApp (app) {
 	var proto = app.proto
 	var chat = app.chat
 
-	var textMessageHandler = function (roomId, messageId, userId, timestamp, text) {
+	var textMessageHandler = function (roomId, messageId, userId, timestamp, text, editTimestamp) {
 		var room = chat.getRoom(roomId)
 		if (!room) {
 			return
@@ -22,17 +28,31 @@ function initApp (app) {
 
 		var user = chat.getUser(userId), message
 		if (user) {
-			message = new Message(messageId, roomId, user, timestamp, text)
+			message = new Message(messageId, roomId, user, timestamp, text, editTimestamp)
 			room.addMessage(message, room.id != chat.currentRoomId)
 			return
 		}
 
 		proto.sendUserInfo(userId)
 		user = makeUser({id: userId, name: '???'}, chat)
-		message = new Message(messageId, roomId, user, timestamp, text)
+		message = new Message(messageId, roomId, user, timestamp, text, editTimestamp)
 		chat.pending(userId, roomId, message)
 	}
 
+	var addDirectRoom = function (data) {
+		var room = chat.getRoom(data.id)
+		if (!room) {
+			room = makeRoom(data)
+			chat.addRoom(room)
+		}
+
+		var userIds = chat.unknownUserIds(room)
+		for (var i = 0; i < userIds.length; i++) {
+			proto.sendUserInfo(userIds[i])
+		}
+		return room
+	}
+
 	var callbacks = {
 		afterRecv: function (response) {
 			var typ = (response.response == 'error' ? 'error' : 'response')
@@ -46,7 +66,7 @@ function initApp (app) {
 		connError: function (message) {
 			app.errorText = message
 			app.state = app.states.disconnected
-			chat.reset()
+			app.scheduleReconnect()
 		},
 
 		whoami: function (user, globalPerm) {
@@ -59,10 +79,46 @@ function initApp (app) {
 				chat.addRoom(makeRoom(rooms[i]))
 			}
 		},
+		resume: function (rooms, stale) {
+			var isIn = {}
+			for (var i = 0; i < rooms.length; i++) {
+				var room = chat.getRoom(rooms[i].id)
+				if (!room) {
+					room = makeRoom(rooms[i])
+					chat.addRoom(room)
+				}
+				room.setPerm(rooms[i].perm)
+				room.unread = rooms[i].unread
+				room.userEnter(chat.getUser(chat.userId))
+				isIn[room.id] = true
+				if (!room.shownMessageId()) {
+					proto.sendListMessages(room.id, -50, 50)
+				}
+			}
+
+			for (var id in chat.rooms) {
+				if (chat.rooms[id].isIn && !isIn[id]) {
+					chat.leaveRoom(id)
+				}
+			}
+
+			for (var i = 0; i < stale.length; i++) {
+				var room = chat.getRoom(stale[i])
+				if (room) {
+					room.leave()
+					room.userEnter(chat.getUser(chat.userId))
+					proto.sendListMessages(room.id, -50, 50)
+				}
+			}
+
+			app.reconnectDelay = 0
+			app.scroll()
+		},
 		inRooms: function (rooms) {
 			for (var i = 0; i < rooms.length; i++) {
 				var room = chat.getRoom(rooms[i].id)
 				room.setPerm(rooms[i].perm)
+				room.unread = rooms[i].unread
 				room.userEnter(chat.getUser(chat.userId))
 				app.proto.sendListMessages(room.id, -50, 50)
 			}
@@ -70,29 +126,167 @@ function initApp (app) {
 		newRoom: function (room) {
 			chat.addRoom(makeRoom(room))
 		},
+		listDms: function (rooms) {
+			for (var i = 0; i < rooms.length; i++) {
+				addDirectRoom(rooms[i])
+			}
+		},
+		directRoom: function (data) {
+			var room = addDirectRoom(data)
+			if (app.dmPending) {
+				app.dmPending = false
+				app.dmRoomId = room.id
+				app.selectRoom(room.id)
+			}
+		},
 		enter: function (roomId, user) {
 			user = makeUser(user, chat)
 			chat.addUser(user)
+
+			// в личную комнату, открытую собеседником, пользователь входит без переключения
+			var room = chat.getRoom(roomId)
+			if (room && room.isDirect() && user.id == chat.userId && roomId != chat.currentRoomId && roomId != app.dmRoomId) {
+				room.userEnter(user)
+				return
+			}
+
 			chat.enterRoom(roomId, user)
 		},
-		leave: function (roomId, userId) {
+		leave: function (roomId, userId, moderatorId) {
 			if (userId == chat.userId && roomId == chat.currentRoomId) {
 				location.hash = ''
 			}
+			var room = chat.getRoom(roomId)
 			chat.leaveRoom(roomId, userId)
+			if (userId == chat.userId && moderatorId && room) {
+				alert('Вас вывели из комнаты ' + room.name)
+			}
 		},
 		listUsers: function (roomId, users) {
+			var userIds = []
 			for (var i = 0; i < users.length; i++) {
 				var user = makeUser(users[i], chat)
 				chat.addUser(user)
 				chat.enterRoom(roomId, user)
+				userIds.push(user.id)
+			}
+			if (userIds.length) {
+				proto.sendListPresence(userIds)
+			}
+		},
+		presence: function (userId, status) {
+			chat.setUserStatus(userId, status)
+			if (userId == chat.userId) {
+				app.presence = status
+			}
+		},
+		typing: function (roomId, userId, isTyping) {
+			var room = chat.getRoom(roomId)
+			var user = chat.getUser(userId)
+			if (room && user && userId != chat.userId) {
+				room.setTyping(user, isTyping)
+			}
+		},
+		read: function (roomId, messageId, unread) {
+			var room = chat.getRoom(roomId)
+			if (room) {
+				room.unread = unread
+			}
+		},
+		readReceipt: function (roomId, userId, messageId) {
+			var room = chat.getRoom(roomId)
+			if (room && userId != chat.userId) {
+				room.setReadId(userId, messageId)
+			}
+		},
+		readReceipts: function (roomId, users) {
+			var room = chat.getRoom(roomId)
+			for (var i = 0; room && i < users.length; i++) {
+				if (users[i].userId != chat.userId) {
+					room.setReadId(users[i].userId, users[i].messageId)
+				}
+			}
+		},
+		role: function (roomId, userId, role, perm) {
+			if (!roomId) {
+				if (userId == chat.userId) {
+					chat.setUserId(userId, perm)
+				}
+				return
+			}
+
+			var room = chat.getRoom(roomId)
+			if (!room) {
+				return
+			}
+
+			room.setRole(userId, role)
+			if (userId == chat.userId) {
+				room.setPerm(perm)
+			}
+		},
+		roomUpdated: function (data) {
+			var room = chat.getRoom(data.id)
+			var wasArchived = (room && room.archived)
+			chat.updateRoom(data)
+			// в архивной комнате меняются разрешения
+			if (room && room.isIn && wasArchived != data.archived) {
+				proto.sendRoomInfo(room.id)
+			}
+		},
+		roomDeleted: function (roomId, userId) {
+			var room = chat.getRoom(roomId)
+			if (!room) {
+				return
+			}
+
+			if (roomId == chat.currentRoomId) {
+				location.hash = ''
+			}
+			chat.deleteRoom(roomId)
+			if (room.isIn && userId != chat.userId) {
+				alert('Комната ' + room.name + ' удалена')
+			}
+		},
+		invite: function (invite) {
+			if (invite.creatorId == chat.userId) {
+				prompt('Приглашение в комнату ' + invite.roomName, invite.token)
+			}
+			if (invite.userId == chat.userId) {
+				app.invites.add(invite)
+			}
+		},
+		listInvites: function (invites) {
+			app.invites.clear()
+			for (var i = 0; i < invites.length; i++) {
+				app.invites.add(invites[i])
+			}
+		},
+		inviteRevoked: function (token) {
+			app.invites.remove(token)
+		},
+		listRoles: function (roomId, roles) {
+			var room = chat.getRoom(roomId)
+			if (room) {
+				room.setRoles(roles)
+			}
+		},
+		listPresence: function (users) {
+			for (var i = 0; i < users.length; i++) {
+				chat.setUserStatus(users[i].userId, users[i].status)
 			}
 		},
 		userInfo: function (user) {
 			chat.addUser(makeUser(user, chat))
 		},
-		roomInfo: function (room) {
-			chat.addRoom(makeRoom(room))
+		roomInfo: function (data) {
+			var room = chat.getRoom(data.id)
+			if (room) {
+				room.setPerm(data.perm)
+				chat.updateRoom(data)
+			} else {
+				chat.addRoom(makeRoom(data))
+			}
 		},
 		textMessage: function (roomId, messageId, userId, timestamp, text) {
 			var room = chat.getRoom(roomId)
@@ -101,14 +295,18 @@ function initApp (app) {
 			}
 
 			var smi = room.shownMessageId()
-			if (!smi && messageId > 1) {
+			if ((!smi && messageId > 1) || messageId <= smi) { // повтор после resume уже показан
 				return
 			}
 
 			textMessageHandler(roomId, messageId, userId, timestamp, text)
+			if (roomId != chat.currentRoomId && userId != chat.userId) {
+				room.unread++
+			}
 			if (smi + 1 != messageId) {
 				proto.sendListMessages(roomId, smi + 1, messageId - smi - 1)
 			} else {
+				app.markRead()
 				app.scroll()
 			}
 		},
@@ -125,14 +323,40 @@ function initApp (app) {
 			var flagNew = (roomId != chat.currentRoomId)
 			for (var i = 0; i < messages.length; i++) {
 				var m = messages[i]
+				if (m.deleted) {
+					textMessageHandler(m.roomId, m.messageId, m.userId, m.timestamp, '', 0)
+					room.deleteMessage(m.messageId)
+					continue
+				}
+
 				if (m.data.messageType != proto.messageTypes.text) {
 					continue
 				}
 
-				textMessageHandler(m.roomId, m.messageId, m.userId, m.timestamp, m.data.data.text)
+				textMessageHandler(m.roomId, m.messageId, m.userId, m.timestamp, m.data.data.text, m.editTimestamp)
 			}
 
+			app.markRead()
 			app.scroll()
+		},
+		editTextMessage: function (roomId, messageId, editTimestamp, text) {
+			var room = chat.getRoom(roomId)
+			if (room) {
+				room.updateMessage(messageId, text, editTimestamp)
+			}
+		},
+		messageDeleted: function (roomId, messageId) {
+			var room = chat.getRoom(roomId)
+			if (room) {
+				room.deleteMessage(messageId)
+			}
+		},
+		messageHistory: function (roomId, messageId, revisions) {
+			var room = chat.getRoom(roomId)
+			var message = (room ? room.findMessage(messageId) : null)
+			if (message) {
+				message.setHistory(revisions)
+			}
 		}
 	}
 
@@ -144,6 +368,7 @@ function createApp () {
 		el: '#content',
 		data: {
 			userName: '',
+			password: '',
 			lastRoomId: 0,
 			chat: new Chat(),
 			proto: new ChatProto(),
@@ -154,6 +379,25 @@ function createApp () {
 			showRooms: true,
 			showUsers: true,
 			loggerDump: null,
+			presence: 'online',
+			roleNames: {
+				owner: 'владелец',
+				moderator: 'модератор',
+				muted: 'без права голоса',
+				banned: 'заблокирован'
+			},
+			presenceNames: {
+				online: 'в сети',
+				away: 'отошел',
+				dnd: 'не беспокоить'
+			},
+			invites: new SortedList('token', 'roomName'), // адресованные пользователю приглашения
+			dmPending: false,
+			dmRoomId: 0,
+			typingRoomId: 0,
+			typingSent: 0,
+			reconnectDelay: 0,
+			reconnectTimer: null,
 			state: 'init',
 			states: {
 				init: 'init',
@@ -171,16 +415,24 @@ function createApp () {
 		methods: {
 			run: function () {
 				var t = this
+				var errHandler = null
+				if (t.state == t.states.disconnected) {
+					errHandler = function () {
+						t.scheduleReconnect()
+					}
+				}
+
 				;(new Xhr()).post('/whoami', null, function (xhr) {
 					var response = xhr.getJsonResponse()
 					if (!response.user) {
+						t.chat.reset()
 						t.state = t.states.login
 					} else {
 						t.userName = response.user.name
 						t.state = t.states.chat
 						t.connect()
 					}
-				})
+				}, errHandler)
 			},
 
 			expandLog: function () {
@@ -208,23 +460,71 @@ function createApp () {
 				this.loggerDump = null
 			},
 
-			login: function () {
+			// сообщение об ошибке из ответа сервера
+			xhrError: function (xhr, defaultText) {
+				var text = defaultText
+				try {
+					text = xhr.getJsonResponse().error || text
+				} catch (e) {}
+				alert(text)
+			},
+
+			// вход или регистрация (register == true)
+			login: function (register) {
 				var t = this
+				var path = (register === true ? '/register' : '/login')
 				t.state = t.states.connect
-				;(new Xhr()).post('/login', {name: t.userName}, function (xhr) {
+				;(new Xhr()).post(path, {name: t.userName, password: t.password}, function (xhr) {
 					var response = xhr.getJsonResponse()
+					t.password = ''
 					if (!response.success) {
 						alert('Не удалось подключиться')
 						t.state = t.states.login
 					} else {
+						t.chat.reset()
 						t.userName = response.user.name
 						t.state = t.states.chat
 						t.connect()
 					}
+				}, function (xhr) {
+					t.state = t.states.login
+					t.xhrError(xhr, 'Не удалось войти')
+				})
+			},
+
+			// новый пароль по токену, выданному администратором
+			resetPassword: function () {
+				var token = (prompt('Токен сброса пароля') || '').trim()
+				if (!token) return
+
+				var password = prompt('Новый пароль')
+				if (!password) return
+
+				var t = this
+				;(new Xhr()).post('/reset-password', {token: token, password: password}, function () {
+					alert('Пароль изменен')
+				}, function (xhr) {
+					t.xhrError(xhr, 'Не удалось сбросить пароль')
+				})
+			},
+
+			changePassword: function () {
+				var oldPassword = prompt('Текущий пароль')
+				if (oldPassword === null) return
+
+				var newPassword = prompt('Новый пароль')
+				if (!newPassword) return
+
+				var t = this
+				;(new Xhr()).post('/password', {old: oldPassword, new: newPassword}, function () {
+					alert('Пароль изменен')
+				}, function (xhr) {
+					t.xhrError(xhr, 'Не удалось изменить пароль')
 				})
 			},
 
 			logout: function () {
+				this.cancelReconnect()
 				;(new Xhr()).post('/logout', null, false)
 				this.proto.disconnect()
 				this.chat.reset()
@@ -233,12 +533,93 @@ function createApp () {
 				this.state = this.states.login
 			},
 
+			// после разрыва связи запрашиваются только пропущенные сообщения
 			connect: function () {
+				this.cancelReconnect()
 				this.errorText = ''
-				this.proto.connect(new WsConn())
+				var lastIds = this.chat.lastMessageIds()
+				this.proto.connect(this.newConn())
 				this.proto.sendWhoami()
 				this.proto.sendListRooms()
-				this.proto.sendInRooms()
+				this.proto.sendListDms()
+				this.proto.sendListInvites()
+				if (lastIds) {
+					this.proto.sendResume(lastIds)
+				} else {
+					this.chat.reset()
+					this.proto.sendInRooms()
+				}
+			},
+
+			// транспорт выбирается параметром адреса ?transport=sse или ?transport=poll;
+			// без параметра - WebSocket, если браузер его поддерживает, иначе SSE или длинные запросы
+			newConn: function () {
+				var transport = /[?&]transport=(\w+)/.exec(location.search)
+				transport = (transport ? transport[1] : (window.WebSocket ? 'ws' : (window.EventSource ? 'sse' : 'poll')))
+				switch (transport) {
+					case 'sse':
+						return new SseConn()
+					case 'poll':
+						return new PollConn()
+					default:
+						return new WsConn()
+				}
+			},
+
+			scheduleReconnect: function () {
+				this.cancelReconnect()
+				this.reconnectDelay = (this.reconnectDelay ? Math.min(this.reconnectDelay * 2, 30000) : 1000)
+				var t = this
+				this.reconnectTimer = setTimeout(function () {
+					t.reconnectTimer = null
+					t.run()
+				}, this.reconnectDelay)
+			},
+
+			cancelReconnect: function () {
+				if (this.reconnectTimer) {
+					clearTimeout(this.reconnectTimer)
+					this.reconnectTimer = null
+				}
+			},
+
+			// typing-start повторяется не чаще раза в 2 секунды, пока пользователь печатает
+			typingInput: function () {
+				var roomId = this.chat.currentRoomId
+				if (!roomId || !this.messageText.trim()) {
+					this.typingDone()
+					return
+				}
+
+				var now = Date.now()
+				if (roomId != this.typingRoomId || now - this.typingSent > 2000) {
+					this.typingDone()
+					this.proto.sendTypingStart(roomId)
+					this.typingRoomId = roomId
+					this.typingSent = now
+				}
+			},
+
+			typingDone: function () {
+				if (this.typingRoomId) {
+					this.proto.sendTypingStop(this.typingRoomId)
+					this.typingRoomId = 0
+				}
+			},
+
+			// отмечает прочитанными все показанные сообщения текущей комнаты
+			markRead: function () {
+				var room = this.chat.currentRoom
+				if (!room || room.shownMessageId() <= room.markedId) {
+					return
+				}
+
+				room.markedId = room.shownMessageId()
+				this.proto.sendMarkRead(room.id, room.markedId)
+			},
+
+			setPresence: function () {
+				this.proto.sendSetPresence(this.presence)
 			},
 
 			scroll: function () {
@@ -264,26 +645,106 @@ function createApp () {
 				name = name.trim()
 				if (!name) return
 
-				this.proto.sendNewRoom(name)
+				var visibility = (confirm('Вход только по приглашениям?') ? 'invite' : 'public')
+				this.proto.sendNewRoom(name, visibility)
 				this.rest()
 			},
 
+			editRoom: function (field) {
+				var room = this.chat.currentRoom
+				if (!room) return
+
+				var titles = {name: 'Название комнаты', topic: 'Тема комнаты', description: 'Описание комнаты'}
+				var value = prompt(titles[field], room[field])
+				if (value === null) return
+
+				var fields = {}
+				fields[field] = value
+				this.proto.sendUpdateRoom(room.id, fields)
+			},
+
+			archiveRoom: function () {
+				var room = this.chat.currentRoom
+				if (!room) return
+
+				if (room.archived || confirm('Перевести комнату ' + room.name + ' в архив?')) {
+					this.proto.sendArchiveRoom(room.id, !room.archived)
+				}
+			},
+
+			deleteRoom: function () {
+				var room = this.chat.currentRoom
+				if (room && confirm('Удалить комнату ' + room.name + '?')) {
+					this.proto.sendDeleteRoom(room.id)
+				}
+			},
+
+			createInvite: function () {
+				var room = this.chat.currentRoom
+				if (!room) return
+
+				var maxUses = prompt('Число использований приглашения (0 - без ограничения)', '1')
+				if (maxUses === null) return
+
+				this.proto.sendCreateInvite(room.id, 0, +maxUses || 0, 0)
+			},
+
+			// без токена запрашивает токен у пользователя
+			acceptInvite: function (token) {
+				if (!token) {
+					token = (prompt('Токен приглашения') || '').trim()
+				}
+				if (!token) return
+
+				this.invites.remove(token)
+				this.proto.sendAcceptInvite(token)
+			},
+
+			declineInvite: function (token) {
+				this.invites.remove(token)
+				this.proto.sendRevokeInvite(token)
+			},
+
 			leaveRoom: function () {
 				this.proto.sendLeave(this.chat.currentRoomId)
 				input.blur()
 			},
 
+			startDm: function (user) {
+				if (user.id == this.chat.userId) {
+					return
+				}
+
+				this.dmPending = true
+				this.proto.sendStartDm([user.id])
+			},
+
+			// kick, ban, unban, mute, unmute
+			moderate: function (action, user) {
+				var roomId = this.chat.currentRoomId
+				switch (action) {
+					case 'kick': this.proto.sendKick(roomId, user.id); break
+					case 'ban': this.proto.sendBan(roomId, user.id); break
+					case 'unban': this.proto.sendUnban(roomId, user.id); break
+					case 'mute': this.proto.sendMute(roomId, user.id); break
+					case 'unmute': this.proto.sendUnmute(roomId, user.id); break
+				}
+			},
+
 			selectRoom: function (roomId) {
 				var room = this.chat.getRoom(roomId)
 				if (room.isIn) {
 					this.chat.enterRoom(roomId)
 					this.proto.sendListUsers(roomId)
+					this.markRead()
 				} else {
 					this.proto.sendEnter(roomId)
 					this.proto.sendRoomInfo(roomId)
 					this.proto.sendListUsers(roomId)
 					this.proto.sendListMessages(roomId, -50, 50)
 				}
+				this.proto.sendReadReceipts(roomId)
+				this.proto.sendListRoles(roomId)
 				this.rest()
 			},
 
@@ -303,6 +764,7 @@ function createApp () {
 				if (text == '') return
 
 				this.proto.sendTextMessage(c.currentRoomId, text)
+				this.typingRoomId = 0
 				this.rest()
 			}
 		}
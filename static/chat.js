@@ -55,30 +55,80 @@ RoomPerm.prototype.canWrite = function () {
 	return !!(this.flags & 2)
 }
 
+RoomPerm.prototype.canModerate = function () {
+	return !!(this.flags & 4)
+}
+
+RoomPerm.prototype.canViewHistory = function () {
+	return !!(this.flags & 8)
+}
+
+RoomPerm.prototype.canKick = function () {
+	return !!(this.flags & 16)
+}
+
+RoomPerm.prototype.canBan = function () {
+	return !!(this.flags & 32)
+}
+
+RoomPerm.prototype.canMute = function () {
+	return !!(this.flags & 64)
+}
+
+RoomPerm.prototype.canInvite = function () {
+	return !!(this.flags & 128)
+}
+
+RoomPerm.prototype.canRename = function () {
+	return !!(this.flags & 256)
+}
+
+RoomPerm.prototype.canChangeTopic = function () {
+	return !!(this.flags & 512)
+}
+
+RoomPerm.prototype.canManageRoles = function () {
+	return !!(this.flags & 1024)
+}
+
+RoomPerm.prototype.canDelete = function () {
+	return !!(this.flags & 2048)
+}
+
 
 function GlobalPerm (flags) {
 	this.flags = flags
 }
 
-RoomPerm.prototype.canListRooms = function () {
+GlobalPerm.prototype.canListRooms = function () {
 	return !!(this.flags & 1)
 }
 
-RoomPerm.prototype.canCreateRoom = function () {
+GlobalPerm.prototype.canCreateRoom = function () {
 	return !!(this.flags & 2)
 }
 
+GlobalPerm.prototype.isAdmin = function () {
+	return !!(this.flags & 4)
+}
+
 
 function User (id, name, color) {
 	this.id = +id
 	this.name = name
 	this.color = color
+	this.status = 'online'
 }
 
 
-function Room (id, name, perm, isIn) {
+function Room (id, name, perm, isIn, userIds) {
 	this.id = +id
 	this.name = name
+	this.userIds = userIds || null // участники личной комнаты
+	this.visibility = 'public' // public, unlisted, invite
+	this.topic = ''
+	this.description = ''
+	this.archived = false // только чтение
 	this.isIn = !!isIn
 	this.setPerm(perm)
 	this.users = new SortedList()
@@ -87,6 +137,16 @@ function Room (id, name, perm, isIn) {
 	this.messages = []
 	this.lastId = 0
 	this.newMessages = new SortedList('id', 'id')
+	this.typingUsers = new SortedList()
+
+	this.unread = 0
+	this.markedId = 0 // последний номер, отправленный в mark-read
+	this.readIds = {} // {userId: messageId}, позиции прочтения других участников
+	this.roles = {} // {userId: role}, только назначенные роли
+}
+
+Room.prototype.isDirect = function () {
+	return !!this.userIds
 }
 
 Room.prototype.setPerm = function (perm) {
@@ -99,6 +159,7 @@ Room.prototype.addUser = function (user) {
 
 Room.prototype.removeUser = function (userId) {
 	this.users.remove(userId)
+	this.typingUsers.remove(userId)
 }
 
 Room.prototype.userEnter = function (user) {
@@ -106,8 +167,81 @@ Room.prototype.userEnter = function (user) {
 	this.isIn = true
 }
 
+Room.prototype.setTyping = function (user, isTyping) {
+	if (isTyping) {
+		this.typingUsers.add(user)
+	} else {
+		this.typingUsers.remove(user.id)
+	}
+}
+
+Room.prototype.typingText = function () {
+	var names = []
+	for (var i = 0; i < this.typingUsers.items.length; i++) {
+		names.push(this.typingUsers.items[i].name)
+	}
+
+	switch (names.length) {
+		case 0:
+			return ''
+		case 1:
+			return names[0] + ' печатает…'
+		default:
+			return names.join(', ') + ' печатают…'
+	}
+}
+
+Room.prototype.setRoles = function (roles) {
+	var result = {}
+	for (var i = 0; i < roles.length; i++) {
+		result[roles[i].userId] = roles[i].role
+	}
+	this.roles = result
+}
+
+Room.prototype.setRole = function (userId, role) {
+	var result = {}
+	for (var id in this.roles) {
+		result[id] = this.roles[id]
+	}
+	if (role == 'member') {
+		delete result[userId]
+	} else {
+		result[userId] = role
+	}
+	this.roles = result
+}
+
+Room.prototype.setReadId = function (userId, messageId) {
+	if (this.readIds[userId] && this.readIds[userId] >= messageId) {
+		return
+	}
+
+	// новый объект, чтобы добавленный ключ отслеживался Vue
+	var ids = {}
+	for (var id in this.readIds) {
+		ids[id] = this.readIds[id]
+	}
+	ids[userId] = messageId
+	this.readIds = ids
+}
+
+// число участников, прочитавших сообщение
+Room.prototype.readCount = function (messageId) {
+	var result = 0
+	for (var id in this.readIds) {
+		if (this.readIds[id] >= messageId) {
+			result++
+		}
+	}
+	return result
+}
+
 Room.prototype.leave = function () {
 	this.isIn = false
+	this.markedId = 0
+	this.readIds = {}
+	this.typingUsers.clear()
 	this.newMessage = false
 	this.newMessages.clear()
 	this.users.clear()
@@ -142,8 +276,8 @@ Room.prototype.addMessage = function (message, flagNew) {
 
 	nextId++
 	var headLen = 0
-	for (var i = 0; i < this.newMessages.length; i++) {
-		message = this.newMessages[i]
+	for (var i = 0; i < this.newMessages.items.length; i++) {
+		message = this.newMessages.items[i]
 		if (message.id != nextId) {
 			break
 		}
@@ -156,18 +290,75 @@ Room.prototype.addMessage = function (message, flagNew) {
 	this.newMessages.cutHead(headLen)
 }
 
+Room.prototype.findMessage = function (messageId) {
+	for (var i = this.messages.length - 1; i >= 0; i--) {
+		var message = this.messages[i]
+		if (message.id == messageId) {
+			return message
+		}
+
+		if (message.id < messageId) {
+			break
+		}
+	}
+
+	return null
+}
+
+Room.prototype.updateMessage = function (messageId, text, editTimestamp) {
+	var message = this.findMessage(messageId)
+	if (message) {
+		message.setText(text, editTimestamp)
+	}
+}
+
+Room.prototype.deleteMessage = function (messageId) {
+	var message = this.findMessage(messageId)
+	if (message) {
+		message.setDeleted()
+	}
+}
+
 Room.prototype.shownMessageId = function () {
 	return (this.messages.length ? this.messages[this.messages.length - 1].id : 0)
 }
 
 
-function Message (id, roomId, user, timestamp, text) {
+function Message (id, roomId, user, timestamp, text, editTimestamp) {
 	this.id = +id
 	this.roomId = +roomId
 	this.user = user
 	this.time = new Date(timestamp * 1000)
 	this.timeText = formatTime(this.time, '%e.%m %H:%M:%S')
+	this.history = null
+	this.setText(text, editTimestamp)
+}
+
+Message.prototype.setText = function (text, editTimestamp) {
 	this.text = text
+	this.deleted = false
+	this.edited = !!editTimestamp
+	this.editTimeText = (editTimestamp ? formatTime(new Date(editTimestamp * 1000), '%e.%m %H:%M:%S') : '')
+}
+
+Message.prototype.setHistory = function (revisions) {
+	this.history = []
+	for (var i = 0; i < revisions.length; i++) {
+		var r = revisions[i]
+		this.history.push({
+			editorId: r.editorId || r.userId,
+			timeText: formatTime(new Date((r.editTimestamp || r.timestamp) * 1000), '%e.%m %H:%M:%S'),
+			deleted: !!r.deleted,
+			text: (r.deleted ? '' : r.data.data.text)
+		})
+	}
+}
+
+Message.prototype.setDeleted = function () {
+	this.text = ''
+	this.deleted = true
+	this.edited = false
+	this.editTimeText = ''
 }
 
 
@@ -178,6 +369,7 @@ function Chat () {
 	this.pendingUsers = {} // {userId: {roomId: [message]}}
 	this.rooms = {}
 	this.roomList = new SortedList()
+	this.dmList = new SortedList()
 
 	this.currentRoom = null
 	this.currentRoomId = 0
@@ -192,10 +384,25 @@ Chat.prototype.reset = function () {
 	this.pendingUsers = {}
 	this.rooms = {}
 	this.roomList = new SortedList()
+	this.dmList = new SortedList()
 	this.currentRoom = null
 	this.currentRoomId = 0
 }
 
+// номера последних полученных сообщений в комнатах, где находится пользователь
+Chat.prototype.lastMessageIds = function () {
+	var result = {}, has = false
+	for (var id in this.rooms) {
+		var room = this.rooms[id]
+		if (room.isIn) {
+			result[id] = room.shownMessageId()
+			has = true
+		}
+	}
+
+	return (has ? result : null)
+}
+
 Chat.prototype.resetUser = function () {
 	this.userId = 0
 	this.userPerm = 0
@@ -209,6 +416,7 @@ Chat.prototype.setUserId = function (id, globalPerm) {
 
 Chat.prototype.addUser = function (user) {
 	this.users[user.id] = user
+	this.updateDirectNames(user.id)
 	var pending = this.pendingUsers[user.id]
 	if (!pending) {
 		return
@@ -233,7 +441,93 @@ Chat.prototype.addRoom = function (room) {
 	}
 
 	this.rooms[room.id] = room
-	this.roomList.add(room)
+	if (room.isDirect()) {
+		room.name = this.directName(room)
+		this.dmList.add(room)
+	} else {
+		this.roomList.add(room)
+	}
+}
+
+// data - свойства комнаты из уведомления room-updated
+Chat.prototype.updateRoom = function (data) {
+	var room = this.rooms[data.id]
+	if (!room) {
+		return
+	}
+
+	room.topic = data.topic
+	room.description = data.description
+	room.archived = data.archived
+	room.visibility = data.visibility
+	if (!room.isDirect() && room.name != data.name) {
+		room.name = data.name
+		this.roomList.remove(room.id)
+		this.roomList.add(room)
+	}
+}
+
+Chat.prototype.deleteRoom = function (roomId) {
+	var room = this.rooms[roomId]
+	if (!room) {
+		return
+	}
+
+	if (roomId == this.currentRoomId) {
+		this.currentRoomId = 0
+		this.currentRoom = null
+	}
+	room.leave()
+	this.roomList.remove(room.id)
+	this.dmList.remove(room.id)
+	delete this.rooms[roomId]
+}
+
+// название личной комнаты - имена собеседников
+Chat.prototype.directName = function (room) {
+	var names = []
+	for (var i = 0; i < room.userIds.length; i++) {
+		var uid = room.userIds[i]
+		if (uid != this.userId) {
+			names.push(this.users[uid] ? this.users[uid].name : '#' + uid)
+		}
+	}
+	return names.join(', ')
+}
+
+Chat.prototype.updateDirectNames = function (userId) {
+	var changed = false
+	for (var i = 0; i < this.dmList.items.length; i++) {
+		var room = this.dmList.items[i]
+		if (room.userIds.indexOf(userId) >= 0) {
+			room.name = this.directName(room)
+			changed = true
+		}
+	}
+
+	if (changed) {
+		this.dmList.items.sort(function (a, b) {
+			return (a.name < b.name ? -1 : (a.name > b.name ? 1 : 0))
+		})
+	}
+}
+
+// номера участников личных комнат, о которых ничего не известно
+Chat.prototype.unknownUserIds = function (room) {
+	var result = []
+	for (var i = 0; room.isDirect() && i < room.userIds.length; i++) {
+		if (!this.users[room.userIds[i]]) {
+			result.push(room.userIds[i])
+		}
+	}
+	return result
+}
+
+Chat.prototype.setUserStatus = function (userId, status) {
+	var user = this.users[userId]
+	if (user) {
+		user.status = status
+	}
 }
 
 Chat.prototype.getUser = function (userId) {
@@ -3,7 +3,9 @@ package ram
 import (
 	"net/http"
 	"sync"
-	"strings"
+	"time"
+
+	"github.com/ava12/go-chat/user"
 )
 
 type UserEntry struct {
@@ -11,15 +13,27 @@ type UserEntry struct {
 	Name string `json:"name"`
 }
 
+type resetRec struct {
+	userId int
+	expires time.Time
+}
+
 type Registry struct {
 	lock sync.RWMutex
 	names map[int]string
 	ids map[string]int
+	hashes map[int]string
+	resets map[string]resetRec // {хеш токена: сброс}
 	lastId int
 }
 
 func NewRegistry () *Registry {
-	return &Registry {names: make(map[int]string), ids: make(map[string]int)}
+	return &Registry {
+		names: make(map[int]string),
+		ids: make(map[string]int),
+		hashes: make(map[int]string),
+		resets: make(map[string]resetRec),
+	}
 }
 
 func (r *Registry) User (id int) (interface{}, bool) {
@@ -34,34 +48,132 @@ func (r *Registry) User (id int) (interface{}, bool) {
 	}
 }
 
-func (r *Registry) AddUser (name string) int {
+func (r *Registry) UserIdByName (name string) int {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	return r.ids[name]
+}
+
+func (r *Registry) Register (name, password string) (int, interface {}, error) {
+	name, e := user.NormalizeName(name)
+	if e != nil {
+		return 0, nil, e
+	}
+
+	hash, e := user.HashPassword(password)
+	if e != nil {
+		return 0, nil, e
+	}
+
 	r.lock.Lock()
 	defer r.lock.Unlock()
 
-	id := r.ids[name]
-	if id > 0 {
-		return id
+	if r.ids[name] > 0 {
+		return 0, nil, user.NameTaken
 	}
 
 	r.lastId++
-	id = r.lastId
+	id := r.lastId
 	r.names[id] = name
 	r.ids[name] = id
-	return id
+	r.hashes[id] = hash
+	return id, UserEntry {id, name}, nil
 }
 
-func (r *Registry) UserIdByName (name string) int {
+func (r *Registry) Login (w http.ResponseWriter, re *http.Request) (int, interface {}, error) {
+	name, password, e := user.Credentials(re)
+	if e != nil {
+		return 0, nil, e
+	}
+
+	return r.Authenticate(name, password)
+}
+
+func (r *Registry) Authenticate (name, password string) (int, interface {}, error) {
+	name, e := user.NormalizeName(name)
+	if e != nil {
+		return 0, nil, e
+	}
+
 	r.lock.RLock()
-	defer r.lock.RUnlock()
+	id := r.ids[name]
+	hash := r.hashes[id]
+	r.lock.RUnlock()
 
-	return r.ids[name]
+	if !user.CheckPassword(hash, password) {
+		return 0, nil, user.WrongCredentials
+	}
+
+	return id, UserEntry {id, name}, nil
 }
 
-func (r *Registry) Login (w http.ResponseWriter, re *http.Request) (int, interface {}, error) {
-	name := strings.TrimSpace(re.PostFormValue("name"))
-	uid := r.UserIdByName(name)
-	if uid == 0 {
-		uid = r.AddUser(name)
+func (r *Registry) ChangePassword (id int, oldPassword, newPassword string) error {
+	r.lock.RLock()
+	hash := r.hashes[id]
+	r.lock.RUnlock()
+
+	if !user.CheckPassword(hash, oldPassword) {
+		return user.WrongCredentials
+	}
+
+	return r.setPassword(id, newPassword)
+}
+
+func (r *Registry) setPassword (id int, password string) error {
+	hash, e := user.HashPassword(password)
+	if e != nil {
+		return e
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.hashes[id] = hash
+	return nil
+}
+
+func (r *Registry) ResetToken (name string) (string, error) {
+	id := r.UserIdByName(name)
+	if id == 0 {
+		return "", user.BadName
+	}
+
+	token, e := user.NewResetToken()
+	if e != nil {
+		return "", e
 	}
-	return uid, &UserEntry {uid, name}, nil
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	now := time.Now()
+	for t, reset := range r.resets {
+		if reset.expires.Before(now) {
+			delete(r.resets, t)
+		}
+	}
+	r.resets[user.HashResetToken(token)] = resetRec {id, now.Add(user.ResetTokenTtl)}
+	return token, nil
+}
+
+// токен расходуется только при допустимом новом пароле
+func (r *Registry) ResetPassword (token, newPassword string) (int, error) {
+	hash, e := user.HashPassword(newPassword)
+	if e != nil {
+		return 0, e
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	key := user.HashResetToken(token)
+	reset, found := r.resets[key]
+	if !found || reset.expires.Before(time.Now()) {
+		return 0, user.BadToken
+	}
+
+	delete(r.resets, key)
+	r.hashes[reset.userId] = hash
+	return reset.userId, nil
 }
@@ -0,0 +1,134 @@
+package ram
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ava12/go-chat/user"
+	"github.com/ava12/go-chat/user/usertest"
+)
+
+func TestRegistry (t *testing.T) {
+	r := NewRegistry()
+
+	login := func (name, password string) (int, error) {
+		id, _, e := r.Login(nil, usertest.LoginRequest(name, password))
+		return id, e
+	}
+
+	id, entry, e := r.Register(" alice ", "password1")
+	if e != nil {
+		t.Fatal(e)
+	}
+	if entry != (UserEntry {id, "alice"}) {
+		t.Fatalf("unexpected user entry: %#v", entry)
+	}
+	if _, _, e = r.Register("alice", "password2"); e != user.NameTaken {
+		t.Fatalf("duplicate name: %v", e)
+	}
+
+	if !user.CheckPassword(r.hashes[id], "password1") {
+		t.Fatalf("password hash is not stored: %q", r.hashes[id])
+	}
+
+	if uid, e := login("alice", "password1"); uid != id || e != nil {
+		t.Fatalf("login failed: %d %v", uid, e)
+	}
+	for _, creds := range [][2]string {{"alice", "password2"}, {"bob", "password1"}} {
+		if _, e = login(creds[0], creds[1]); e != user.WrongCredentials {
+			t.Fatalf("%s logged in with %q: %v", creds[0], creds[1], e)
+		}
+	}
+	if uid, entry, e := r.Authenticate("alice ", "password1"); uid != id || entry != (UserEntry {id, "alice"}) || e != nil {
+		t.Fatalf("authentication failed: %d %v %v", uid, entry, e)
+	}
+
+	entry, found := r.User(id)
+	if !found || entry != (UserEntry {id, "alice"}) {
+		t.Fatalf("user #%d not found: %v", id, entry)
+	}
+	if _, found = r.User(id + 1); found {
+		t.Fatal("missing user found")
+	}
+}
+
+func TestChangePassword (t *testing.T) {
+	r := NewRegistry()
+	id, _, e := r.Register("alice", "password1")
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	if e = r.ChangePassword(id, "wrong", "password2"); e != user.WrongCredentials {
+		t.Fatalf("password changed with wrong old password: %v", e)
+	}
+	if e = r.ChangePassword(id, "password1", "short"); e != user.BadPassword {
+		t.Fatalf("short new password: %v", e)
+	}
+	if e = r.ChangePassword(id + 1, "password1", "password2"); e != user.WrongCredentials {
+		t.Fatalf("password of missing user changed: %v", e)
+	}
+	if e = r.ChangePassword(id, "password1", "password2"); e != nil {
+		t.Fatal(e)
+	}
+
+	if _, _, e = r.Authenticate("alice", "password1"); e != user.WrongCredentials {
+		t.Fatalf("old password accepted: %v", e)
+	}
+	if _, _, e = r.Authenticate("alice", "password2"); e != nil {
+		t.Fatal(e)
+	}
+}
+
+func TestResetPassword (t *testing.T) {
+	r := NewRegistry()
+	id, _, e := r.Register("alice", "password1")
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	if _, e = r.ResetToken("bob"); e != user.BadName {
+		t.Fatalf("reset token for missing user: %v", e)
+	}
+
+	token, e := r.ResetToken("alice")
+	if e != nil {
+		t.Fatal(e)
+	}
+	if _, found := r.resets[token]; found || len(r.resets) != 1 {
+		t.Fatal("reset token stored in plain text")
+	}
+
+	if _, e = r.ResetPassword("wrong", "password2"); e != user.BadToken {
+		t.Fatalf("wrong reset token accepted: %v", e)
+	}
+	if _, e = r.ResetPassword(token, "short"); e != user.BadPassword {
+		t.Fatalf("short password on reset: %v", e)
+	}
+	if uid, e := r.ResetPassword(token, "password2"); uid != id || e != nil {
+		t.Fatalf("reset failed: %d %v", uid, e)
+	}
+	if _, e = r.ResetPassword(token, "password3"); e != user.BadToken {
+		t.Fatalf("reset token reused: %v", e)
+	}
+	if _, _, e = r.Authenticate("alice", "password2"); e != nil {
+		t.Fatal(e)
+	}
+
+	// просроченный токен не принимается и удаляется при выдаче следующего
+	expired, e := r.ResetToken("alice")
+	if e != nil {
+		t.Fatal(e)
+	}
+	key := user.HashResetToken(expired)
+	r.resets[key] = resetRec {id, time.Now().Add(-time.Second)}
+	if _, e = r.ResetPassword(expired, "password3"); e != user.BadToken {
+		t.Fatalf("expired reset token accepted: %v", e)
+	}
+	if _, e = r.ResetToken("alice"); e != nil {
+		t.Fatal(e)
+	}
+	if _, found := r.resets[key]; found {
+		t.Fatal("expired reset token kept")
+	}
+}
@@ -0,0 +1,217 @@
+package sqldb
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ava12/go-chat/db"
+	"github.com/ava12/go-chat/user"
+)
+
+const component = "users"
+
+var migrations = []string {
+	`CREATE TABLE users (
+		id INTEGER NOT NULL PRIMARY KEY,
+		name VARCHAR(255) NOT NULL UNIQUE
+	)`,
+
+	// у пользователей, заведенных до появления паролей, хеш пустой: войти можно только после сброса пароля
+	`ALTER TABLE users ADD COLUMN password_hash VARCHAR(255) NOT NULL DEFAULT '';
+	CREATE TABLE password_resets (
+		token VARCHAR(64) NOT NULL PRIMARY KEY,
+		user_id INTEGER NOT NULL,
+		expires BIGINT NOT NULL
+	)`,
+
+	// токены хранились открытым текстом; выданные токены перестают действовать
+	`DROP TABLE password_resets;
+	CREATE TABLE password_resets (
+		token_hash VARCHAR(64) NOT NULL PRIMARY KEY,
+		user_id INTEGER NOT NULL,
+		expires BIGINT NOT NULL
+	)`,
+}
+
+type UserEntry struct {
+	Id int `json:"id"`
+	Name string `json:"name"`
+}
+
+type Registry struct {
+	lock sync.Mutex
+	db *db.DB
+}
+
+func NewRegistry (d *db.DB) (*Registry, error) {
+	e := d.Migrate(component, migrations)
+	if e != nil {
+		return nil, e
+	}
+
+	return &Registry {db: d}, nil
+}
+
+func (r *Registry) User (id int) (interface{}, bool) {
+	entry := UserEntry {}
+	e := r.db.QueryRow("SELECT id, name FROM users WHERE id = ?", id).Scan(&entry.Id, &entry.Name)
+	if e != nil {
+		if e != sql.ErrNoRows {
+			log.Println(e)
+		}
+		return UserEntry {}, false
+	}
+
+	return entry, true
+}
+
+func (r *Registry) UserIdByName (name string) (int, error) {
+	var id int
+	e := r.db.QueryRow("SELECT id FROM users WHERE name = ?", name).Scan(&id)
+	if e == sql.ErrNoRows {
+		return 0, nil
+	}
+
+	return id, e
+}
+
+func (r *Registry) Register (name, password string) (int, interface {}, error) {
+	name, e := user.NormalizeName(name)
+	if e != nil {
+		return 0, nil, e
+	}
+
+	hash, e := user.HashPassword(password)
+	if e != nil {
+		return 0, nil, e
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	id, e := r.UserIdByName(name)
+	if e != nil {
+		return 0, nil, e
+	}
+	if id > 0 {
+		return 0, nil, user.NameTaken
+	}
+
+	id, e = r.db.NextId("users")
+	if e != nil {
+		return 0, nil, e
+	}
+
+	_, e = r.db.Exec("INSERT INTO users (id, name, password_hash) VALUES (?, ?, ?)", id, name, hash)
+	if e != nil {
+		return 0, nil, e
+	}
+
+	return id, UserEntry {id, name}, nil
+}
+
+func (r *Registry) Login (w http.ResponseWriter, re *http.Request) (int, interface {}, error) {
+	name, password, e := user.Credentials(re)
+	if e != nil {
+		return 0, nil, e
+	}
+
+	return r.Authenticate(name, password)
+}
+
+func (r *Registry) Authenticate (name, password string) (int, interface {}, error) {
+	name, e := user.NormalizeName(name)
+	if e != nil {
+		return 0, nil, e
+	}
+
+	var id int
+	var hash string
+	e = r.db.QueryRow("SELECT id, password_hash FROM users WHERE name = ?", name).Scan(&id, &hash)
+	if e != nil && e != sql.ErrNoRows {
+		return 0, nil, e
+	}
+
+	if !user.CheckPassword(hash, password) {
+		return 0, nil, user.WrongCredentials
+	}
+
+	return id, UserEntry {id, name}, nil
+}
+
+func (r *Registry) ChangePassword (id int, oldPassword, newPassword string) error {
+	var hash string
+	e := r.db.QueryRow("SELECT password_hash FROM users WHERE id = ?", id).Scan(&hash)
+	if e != nil && e != sql.ErrNoRows {
+		return e
+	}
+
+	if !user.CheckPassword(hash, oldPassword) {
+		return user.WrongCredentials
+	}
+
+	hash, e = user.HashPassword(newPassword)
+	if e != nil {
+		return e
+	}
+
+	_, e = r.db.Exec("UPDATE users SET password_hash = ? WHERE id = ?", hash, id)
+	return e
+}
+
+func (r *Registry) ResetToken (name string) (string, error) {
+	id, e := r.UserIdByName(name)
+	if e != nil {
+		return "", e
+	}
+	if id == 0 {
+		return "", user.BadName
+	}
+
+	token, e := user.NewResetToken()
+	if e != nil {
+		return "", e
+	}
+
+	now := time.Now()
+	_, e = r.db.Exec("DELETE FROM password_resets WHERE expires <= ?", now.Unix())
+	if e == nil {
+		_, e = r.db.Exec("INSERT INTO password_resets (token_hash, user_id, expires) VALUES (?, ?, ?)",
+			user.HashResetToken(token), id, now.Add(user.ResetTokenTtl).Unix())
+	}
+	if e != nil {
+		return "", e
+	}
+
+	return token, nil
+}
+
+// токен расходуется только при допустимом новом пароле
+func (r *Registry) ResetPassword (token, newPassword string) (int, error) {
+	hash, e := user.HashPassword(newPassword)
+	if e != nil {
+		return 0, e
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	key := user.HashResetToken(token)
+	var id int
+	e = r.db.QueryRow("SELECT user_id FROM password_resets WHERE token_hash = ? AND expires > ?", key, time.Now().Unix()).Scan(&id)
+	if e == sql.ErrNoRows {
+		return 0, user.BadToken
+	}
+	if e != nil {
+		return 0, e
+	}
+
+	_, e = r.db.Exec("DELETE FROM password_resets WHERE token_hash = ?", key)
+	if e == nil {
+		_, e = r.db.Exec("UPDATE users SET password_hash = ? WHERE id = ?", hash, id)
+	}
+	return id, e
+}
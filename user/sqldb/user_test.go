@@ -0,0 +1,71 @@
+package sqldb_test
+
+import (
+	"testing"
+
+	"github.com/ava12/go-chat/db/dbtest"
+	"github.com/ava12/go-chat/user"
+	"github.com/ava12/go-chat/user/usertest"
+	usersql "github.com/ava12/go-chat/user/sqldb"
+)
+
+func TestUserRegistry (t *testing.T) {
+	d := dbtest.Open(t)
+	r, e := usersql.NewRegistry(d)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	login := func (name, password string) (int, error) {
+		id, _, e := r.Login(nil, usertest.LoginRequest(name, password))
+		return id, e
+	}
+
+	id, _, e := r.Register(" alice ", "password1")
+	if e != nil {
+		t.Fatal(e)
+	}
+	if _, _, e = r.Register("alice", "password2"); e != user.NameTaken {
+		t.Fatalf("duplicate name: %v", e)
+	}
+
+	if uid, e := login("alice", "password1"); uid != id || e != nil {
+		t.Fatalf("login failed: %d %v", uid, e)
+	}
+	for _, creds := range [][2]string {{"alice", "password2"}, {"bob", "password1"}} {
+		if _, e = login(creds[0], creds[1]); e != user.WrongCredentials {
+			t.Fatalf("%s logged in with %q: %v", creds[0], creds[1], e)
+		}
+	}
+
+	if r.ChangePassword(id, "wrong", "password3") != user.WrongCredentials || r.ChangePassword(id, "password1", "password3") != nil {
+		t.Fatal("unexpected password change result")
+	}
+
+	token, e := r.ResetToken("alice")
+	if e != nil {
+		t.Fatal(e)
+	}
+	var cnt int
+	e = d.QueryRow("SELECT COUNT(*) FROM password_resets WHERE token_hash = ?", token).Scan(&cnt)
+	if e != nil || cnt != 0 {
+		t.Fatalf("reset token stored in plain text: %d %v", cnt, e)
+	}
+	if _, e = r.ResetPassword(token, "short"); e != user.BadPassword {
+		t.Fatalf("short password on reset: %v", e)
+	}
+	if uid, e := r.ResetPassword(token, "password4"); uid != id || e != nil {
+		t.Fatalf("reset failed: %d %v", uid, e)
+	}
+	if _, e = r.ResetPassword(token, "password5"); e != user.BadToken {
+		t.Fatalf("reset token reused: %v", e)
+	}
+	if _, e = login("alice", "password4"); e != nil {
+		t.Fatal(e)
+	}
+
+	entry, found := r.User(id)
+	if !found || entry.(usersql.UserEntry).Name != "alice" {
+		t.Fatalf("user #%d not found: %v", id, entry)
+	}
+}
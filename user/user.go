@@ -1,10 +1,107 @@
 package user
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/bcrypt"
 )
 
 type Registry interface {
 	User (id int) (interface{}, bool)
 	Login (w http.ResponseWriter, r *http.Request) (id int, user interface {}, e error)
 }
+
+// проверка имени и пароля без HTTP-запроса, например, для входа по IRC; реализуется не всеми реестрами
+type Authenticator interface {
+	Authenticate (name, password string) (id int, user interface {}, e error)
+}
+
+// учетные записи с паролями; реализуется не всеми реестрами
+type Accounts interface {
+	Register (name, password string) (id int, user interface {}, e error)
+	ChangePassword (id int, oldPassword, newPassword string) error
+	// одноразовый токен сброса пароля, действует ResetTokenTtl; хранится только хеш токена
+	ResetToken (name string) (string, error)
+	// возвращает номер пользователя, чей пароль сброшен
+	ResetPassword (token, newPassword string) (int, error)
+}
+
+const (
+	MinPasswordLen = 8
+	MaxPasswordLen = 72 // ограничение bcrypt
+	MaxNameLen = 20
+	ResetTokenTtl = time.Hour
+
+	resetTokenBytes = 16
+)
+
+var (
+	WrongCredentials = errors.New("wrong user name or password")
+	NameTaken = errors.New("user name is already taken")
+	BadName = errors.New("bad user name")
+	BadPassword = errors.New("password must be 8 to 72 bytes long")
+	BadToken = errors.New("reset token is invalid or expired")
+)
+
+// обрезает пробелы по краям; пустое и слишком длинное имя - BadName
+func NormalizeName (name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || utf8.RuneCountInString(name) > MaxNameLen {
+		return "", BadName
+	}
+	return name, nil
+}
+
+func HashPassword (password string) (string, error) {
+	if len(password) < MinPasswordLen || len(password) > MaxPasswordLen {
+		return "", BadPassword
+	}
+
+	hash, e := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), e
+}
+
+var (
+	dummyOnce sync.Once
+	dummyHash []byte
+)
+
+// пустой хеш (нет пользователя или пароля) не подходит ни к какому паролю,
+// но проверяется так же долго, чтобы по времени ответа нельзя было узнать о существовании пользователя
+func CheckPassword (hash, password string) bool {
+	if hash != "" {
+		return (bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil)
+	}
+
+	dummyOnce.Do(func () {
+		dummyHash, _ = bcrypt.GenerateFromPassword([]byte("no such password"), bcrypt.DefaultCost)
+	})
+	bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+	return false
+}
+
+func NewResetToken () (string, error) {
+	buf := make([]byte, resetTokenBytes)
+	_, e := rand.Read(buf)
+	return hex.EncodeToString(buf), e
+}
+
+// под этим ключом токен сброса хранится в реестре
+func HashResetToken (token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// имя и пароль из формы запроса
+func Credentials (r *http.Request) (name, password string, e error) {
+	name, e = NormalizeName(r.PostFormValue("name"))
+	return name, r.PostFormValue("password"), e
+}
@@ -0,0 +1,46 @@
+package user_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ava12/go-chat/user"
+	"github.com/ava12/go-chat/user/usertest"
+)
+
+func TestNormalizeName (t *testing.T) {
+	if name, e := user.NormalizeName(" alice "); name != "alice" || e != nil {
+		t.Fatalf("unexpected name: %q %v", name, e)
+	}
+	for _, name := range []string {"", "  ", strings.Repeat("я", user.MaxNameLen + 1)} {
+		if _, e := user.NormalizeName(name); e != user.BadName {
+			t.Fatalf("bad name %q accepted: %v", name, e)
+		}
+	}
+}
+
+func TestPassword (t *testing.T) {
+	for _, password := range []string {"short", strings.Repeat("x", user.MaxPasswordLen + 1)} {
+		if _, e := user.HashPassword(password); e != user.BadPassword {
+			t.Fatalf("bad password of %d bytes accepted: %v", len(password), e)
+		}
+	}
+
+	hash, e := user.HashPassword("password1")
+	if e != nil || hash == "password1" || !strings.HasPrefix(hash, "$2") {
+		t.Fatalf("password is not hashed with bcrypt: %q %v", hash, e)
+	}
+	if !user.CheckPassword(hash, "password1") || user.CheckPassword(hash, "password2") || user.CheckPassword("", "") {
+		t.Fatal("unexpected password check result")
+	}
+}
+
+func TestCredentials (t *testing.T) {
+	name, password, e := user.Credentials(usertest.LoginRequest(" alice ", " secret "))
+	if name != "alice" || password != " secret " || e != nil {
+		t.Fatalf("unexpected credentials: %q %q %v", name, password, e)
+	}
+	if _, _, e = user.Credentials(usertest.LoginRequest("", "secret")); e != user.BadName {
+		t.Fatalf("empty name accepted: %v", e)
+	}
+}
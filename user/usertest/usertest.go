@@ -0,0 +1,16 @@
+// запросы к реестрам пользователей для тестов
+package usertest
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// POST-запрос входа с формой, которую читает user.Credentials
+func LoginRequest (name, password string) *http.Request {
+	form := url.Values {"name": {name}, "password": {password}}
+	r, _ := http.NewRequest(http.MethodPost, "/login", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return r
+}